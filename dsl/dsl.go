@@ -10,6 +10,37 @@ import (
 
 // Execute a statement on the data in the provided datadir
 func Execute(input string, conf *config.Config) (store.Result, error) {
+	storageDriver, err := driver.GetConfiguredDriver(conf)
+	if err != nil {
+		return store.EmptyResult(), err
+	}
+
+	return ExecuteWithDriver(input, conf, storageDriver)
+}
+
+// Target returns the name of the index a statement reads or modifies, and whether the statement modifies it.
+// Only the keyword and index name of the statement are read, so the rest of the statement does not need to be
+// valid. False is returned when the statement does not start with a known keyword and an index name
+func Target(input string) (indexName string, writes bool, ok bool) {
+	lex := newLexer(input)
+	keyword, err := lex.next()
+	if err != nil {
+		return "", false, false
+	}
+	writes, ok = keywordWrites[keyword.value]
+	if !ok {
+		return "", false, false
+	}
+	index, err := lex.next()
+	if err != nil {
+		return "", false, false
+	}
+	return index.value, writes, true
+}
+
+// ExecuteWithDriver executes a statement using the provided storage driver, so that several statements
+// can share a driver
+func ExecuteWithDriver(input string, conf *config.Config, storageDriver driver.StorageDriver) (store.Result, error) {
 	parser := newParser(input)
 
 	query, err := parser.Parse()
@@ -27,11 +58,6 @@ func Execute(input string, conf *config.Config) (store.Result, error) {
 		return store.EmptyResult(), errors.New("Invalid map index page size from environment")
 	}
 
-	storageDriver, err := driver.GetConfiguredDriver(conf)
-	if err != nil {
-		return store.EmptyResult(), err
-	}
-
 	// handle query based on type
 	switch query.oType {
 	case typeQuery:
@@ -39,14 +65,20 @@ func Execute(input string, conf *config.Config) (store.Result, error) {
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return autoIndex.Query(query.autoSel)
+		result, err := autoIndex.Query(query.autoSel)
+		return query.projection.Apply(result), err
 
 	case typeQueryKey:
 		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return mapIndex.Query(query.mapSel)
+		if query.at != nil {
+			result, err := mapIndex.QueryAt(query.mapSel.Select(), *query.at)
+			return query.projection.Apply(result), err
+		}
+		result, err := mapIndex.Query(query.mapSel)
+		return query.projection.Apply(result), err
 
 	case typeInsert:
 		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, autoPageSize)
@@ -60,7 +92,7 @@ func Execute(input string, conf *config.Config) (store.Result, error) {
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return mapIndex.Insert(query.mapSel, query.payload)
+		return mapIndex.InsertWithTTL(query.mapSel, query.payload, query.ttl)
 
 	case typeUpdate:
 		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, autoPageSize)
@@ -81,7 +113,7 @@ func Execute(input string, conf *config.Config) (store.Result, error) {
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return mapIndex.Upsert(query.mapSel, query.payload)
+		return mapIndex.UpsertWithTTL(query.mapSel, query.payload, query.ttl)
 
 	case typeDelete:
 		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, autoPageSize)
@@ -102,41 +134,200 @@ func Execute(input string, conf *config.Config) (store.Result, error) {
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return autoIndex.List(query.limit, query.offset, query.listDesc)
+		if query.paged {
+			result, err := autoIndex.ListAfter(query.after, query.limit, query.offset, query.listDesc, query.filter)
+			return query.projection.Apply(result), err
+		}
+		result, err := autoIndex.ListWhere(query.limit, query.offset, query.listDesc, query.filter)
+		return query.projection.Apply(result), err
 
 	case typeListKey:
 		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return mapIndex.List(query.limit, query.offset, query.listDesc)
+		if query.paged {
+			result, err := mapIndex.ListAfter(query.after, query.limit, query.offset, query.listDesc, query.filter)
+			return query.projection.Apply(result), err
+		}
+		result, err := mapIndex.ListWhere(query.limit, query.offset, query.listDesc, query.filter)
+		return query.projection.Apply(result), err
+
+	case typeScanKey:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		if query.paged {
+			result, err := mapIndex.ScanAfter(query.keyRange, query.after, query.limit, query.offset, query.listDesc, query.filter)
+			return query.projection.Apply(result), err
+		}
+		result, err := mapIndex.Scan(query.keyRange, query.limit, query.offset, query.listDesc, query.filter)
+		return query.projection.Apply(result), err
 
 	case typeCount:
 		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, autoPageSize)
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return autoIndex.Count()
+		return autoIndex.CountWhere(query.filter)
 
 	case typeCountKey:
 		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
 		if err != nil {
 			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
 		}
-		return mapIndex.Count()
+		return mapIndex.CountWhere(query.filter)
+
+	case typeCas:
+		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, autoPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return autoIndex.CompareAndSwap(query.autoSel.Select(), query.expected, query.payload)
+
+	case typeCasKey:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return mapIndex.CompareAndSwap(query.mapSel.Select(), query.expected, query.payload)
+
+	case typeIncr:
+		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, autoPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return autoIndex.Increment(query.autoSel, query.delta)
+
+	case typeIncrKey:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return mapIndex.Increment(query.mapSel, query.delta)
+
+	case typeVacuumExpired:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return mapIndex.VacuumExpired()
 
 	case typeCreateAutoIndex:
-		return store.SingleResult(query.indexName), storageDriver.CreateAutoIndex(query.indexName)
+		return store.SingleResult(query.indexName), storageDriver.CreateAutoIndex(query.indexName, autoPageSize)
 
 	case typeCreateMapIndex:
-		return store.SingleResult(query.indexName), storageDriver.CreateMapIndex(query.indexName)
+		return store.SingleResult(query.indexName), storageDriver.CreateMapIndex(query.indexName, mapPageSize)
 
 	case typeDropAutoIndex:
-		return store.SingleResult(query.indexName), storageDriver.DropAutoIndex(query.indexName)
+		return store.SingleResult(query.indexName), dropAutoIndex(query.indexName, storageDriver)
 
 	case typeDropMapIndex:
-		return store.SingleResult(query.indexName), storageDriver.DropMapIndex(query.indexName)
+		return store.SingleResult(query.indexName), dropMapIndex(query.indexName, storageDriver)
+
+	case typeCreateValueIndex:
+		err := store.CreateValueIndex(storageDriver, query.indexName, query.valueIndexName, query.field, mapPageSize)
+		return store.SingleResult(query.valueIndexName), err
+
+	case typeQueryBy:
+		result, err := store.QueryByValue(storageDriver, query.indexName, query.value)
+		return query.projection.Apply(result), err
+
+	case typeRepageIndex:
+		return repageIndex(query, storageDriver)
+
+	case typeChanges:
+		return store.Changes(storageDriver, query.indexName, query.since, query.limit)
+
+	case typeEnableChangeLog:
+		return store.SingleResult(query.indexName), store.EnableChangeLog(storageDriver, query.indexName, autoPageSize)
+
+	case typeDisableChangeLog:
+		return store.SingleResult(query.indexName), store.DisableChangeLog(storageDriver, query.indexName)
+
+	case typeEnableHistory:
+		return store.SingleResult(query.indexName), store.EnableHistory(storageDriver, query.indexName, query.retention, mapPageSize)
+
+	case typeDisableHistory:
+		return store.SingleResult(query.indexName), store.DisableHistory(storageDriver, query.indexName)
+
+	case typeHistoryKey:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return mapIndex.History(query.mapSel.Select())
+
+	case typeRevertKey:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, mapPageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		return mapIndex.Revert(query.mapSel.Select(), query.version)
 	}
 
 	return store.EmptyResult(), errors.New("query keyword did not match any commands")
 }
+
+// dropAutoIndex drops an auto index, along with its change log
+func dropAutoIndex(indexName string, storageDriver driver.StorageDriver) error {
+	manifest, manifestErr := driver.ReadManifest(storageDriver, indexName)
+	err := storageDriver.DropAutoIndex(indexName)
+	if err != nil || manifestErr != nil || !manifest.ChangeLog {
+		return err
+	}
+	return store.DropChangeLog(storageDriver, indexName)
+}
+
+// dropMapIndex drops a map index, along with its change log and history. Value indexes are removed from the
+// manifest of their source index first, so that writes to the source index stop updating them
+func dropMapIndex(indexName string, storageDriver driver.StorageDriver) error {
+	manifest, manifestErr := driver.ReadManifest(storageDriver, indexName)
+	if manifestErr == nil && manifest.Source != "" {
+		return store.DropValueIndex(storageDriver, indexName)
+	}
+	err := storageDriver.DropMapIndex(indexName)
+	if err != nil || manifestErr != nil {
+		return err
+	}
+	if manifest.ChangeLog {
+		err = store.DropChangeLog(storageDriver, indexName)
+	}
+	if err == nil && manifest.HistoryVersions > 0 {
+		err = store.DropHistory(storageDriver, indexName)
+	}
+	return err
+}
+
+// repageIndex repartitions an index into pages of the requested size. The kind of the index is read from
+// its manifest, so indexes created before manifests were introduced must be adopted before repaging
+func repageIndex(query Operation, storageDriver driver.StorageDriver) (store.Result, error) {
+	manifest, err := driver.ReadManifest(storageDriver, query.indexName)
+	if err != nil {
+		if driver.IsMetaNotExist(err) {
+			return store.EmptyResult(), fmt.Errorf("index %s has no manifest: run create_auto_index or create_map_index to adopt it before repaging :: %w", query.indexName, err)
+		}
+		return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+	}
+
+	switch manifest.Kind {
+	case driver.KindAuto:
+		autoIndex, err := store.NewAutoIndex(query.indexName, storageDriver, manifest.PageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		err = autoIndex.Repartition(query.pageSize)
+		return store.SingleResult(query.indexName), err
+
+	case driver.KindMap:
+		mapIndex, err := store.NewMapIndex(query.indexName, storageDriver, manifest.PageSize)
+		if err != nil {
+			return store.EmptyResult(), fmt.Errorf("reading index %s failed: %w", query.indexName, err)
+		}
+		err = mapIndex.Repartition(query.pageSize)
+		return store.SingleResult(query.indexName), err
+	}
+
+	return store.EmptyResult(), fmt.Errorf("index %s has unknown kind '%s'", query.indexName, manifest.Kind)
+}
@@ -10,6 +10,7 @@ import (
 	"strconv"
 	"strings"
 	"testing"
+	"time"
 )
 
 // number of records to insert for batch operations
@@ -257,6 +258,270 @@ func TestExecuteMapUpdateOne(t *testing.T) {
 	util.Equals(t, queryRes.String(), updatedValue)
 }
 
+// swap a map index value only when it holds the expected value
+func TestExecuteMapCompareAndSwap(t *testing.T) {
+	autoIndex, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf("insert_key %s counter 1", mapIndex), &testConf)
+	util.Ok(t, err)
+
+	swapRes, err := Execute(fmt.Sprintf("cas_key %s counter 1 2", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "true", swapRes.String())
+
+	swapRes, err = Execute(fmt.Sprintf("cas_key %s counter 1 3", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "false", swapRes.String())
+
+	queryRes, err := Execute(fmt.Sprintf("query_key %s counter", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "2", queryRes.String())
+
+	_, err = Execute(fmt.Sprintf("insert %s pending", autoIndex), &testConf)
+	util.Ok(t, err)
+
+	swapRes, err = Execute(fmt.Sprintf("cas %s 1 pending done", autoIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "true", swapRes.String())
+
+	queryRes, err = Execute(fmt.Sprintf("query %s 1", autoIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "done", queryRes.String())
+}
+
+// increment map index values, creating missing keys
+func TestExecuteMapIncrement(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	incrRes, err := Execute(fmt.Sprintf("incr_key %s views", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "1", incrRes.String())
+
+	incrRes, err = Execute(fmt.Sprintf("incr_key %s [views,quota] -5", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "[-4,-5]", incrRes.String())
+
+	queryRes, err := Execute(fmt.Sprintf("query_key %s views", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "-4", queryRes.String())
+}
+
+// records inserted with a TTL are hidden once expired, and removed by vacuum_expired
+func TestExecuteMapTTL(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf("insert_key %s token ttl=1ms one-time", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("upsert_key %s session ttl=1h logged in", mapIndex), &testConf)
+	util.Ok(t, err)
+	time.Sleep(5 * time.Millisecond)
+
+	queryRes, err := Execute(fmt.Sprintf("query_key %s token", mapIndex), &testConf)
+	util.Assert(t, err != nil, "querying an expired record should return an error")
+	util.Assert(t, !queryRes.Valid(), "expired records should not be returned")
+
+	queryRes, err = Execute(fmt.Sprintf("query_key %s session", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "logged in", queryRes.String())
+
+	vacuumRes, err := Execute(fmt.Sprintf("vacuum_expired %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "1", vacuumRes.String())
+
+	countRes, err := Execute(fmt.Sprintf("count_key %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "1", countRes.String())
+}
+
+func TestExecuteValueIndex(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf(`insert_key %s alice {"team":"red"}`, mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("create_value_index %s test_by_team team", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf(`insert_key %s bob {"team":"red"}`, mapIndex), &testConf)
+	util.Ok(t, err)
+
+	queryRes, err := Execute("query_by test_by_team red", &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "alice\t{\"team\":\"red\"}\nbob\t{\"team\":\"red\"}\n", queryRes.String())
+
+	// value indexes are only written through their source index
+	for _, statement := range []string{`upsert_key test_by_team red ["carol"]`, "delete_key test_by_team red", "incr_key test_by_team count 1"} {
+		_, err = Execute(statement, &testConf)
+		util.Assert(t, err != nil, "%s should fail on a value index", statement)
+	}
+
+	// dropping the value index removes it from the source index, which can still be written
+	_, err = Execute("drop_map_index test_by_team", &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf(`update_key %s bob {"team":"blue"}`, mapIndex), &testConf)
+	util.Ok(t, err)
+}
+
+func TestExecuteChangeLog(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf("changes %s since=0", mapIndex), &testConf)
+	util.Assert(t, err != nil, "reading a change log before it is enabled should fail")
+	_, err = Execute(fmt.Sprintf("enable_change_log %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("insert_key %s alice 1", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("update_key %s alice 2", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("delete_key %s alice", mapIndex), &testConf)
+	util.Ok(t, err)
+
+	changesRes, err := Execute(fmt.Sprintf("changes %s since=1 1", mapIndex), &testConf)
+	util.Ok(t, err)
+	events, ok := changesRes.(store.ChangeListResult)
+	util.Assert(t, ok, "changes should return change events")
+	util.Equals(t, 1, len(events))
+	util.Equals(t, uint64(2), events[0].Seq)
+	util.Equals(t, store.ChangeUpdate, events[0].Op)
+	util.Equals(t, "1", *events[0].Old)
+	util.Equals(t, "2", *events[0].New)
+
+	// dropping the index drops its change log
+	_, err = Execute(fmt.Sprintf("drop_map_index %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("create_map_index %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("changes %s since=0", mapIndex), &testConf)
+	util.Assert(t, err != nil, "dropping an index should drop its change log")
+}
+
+func TestExecuteHistory(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf("insert_key %s alice 1", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("enable_history %s 5", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("update_key %s alice 2", mapIndex), &testConf)
+	util.Ok(t, err)
+
+	historyRes, err := Execute(fmt.Sprintf("history_key %s alice", mapIndex), &testConf)
+	util.Ok(t, err)
+	versions, ok := historyRes.(store.HistoryResult)
+	util.Assert(t, ok, "history_key should return record versions")
+	util.Equals(t, 2, len(versions))
+
+	queryRes, err := Execute(fmt.Sprintf("query_key %s alice at=1", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "1", queryRes.String())
+
+	_, err = Execute(fmt.Sprintf("revert_key %s alice 1", mapIndex), &testConf)
+	util.Ok(t, err)
+	queryRes, err = Execute(fmt.Sprintf("query_key %s alice", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "1", queryRes.String())
+
+	// dropping the index drops its history
+	_, err = Execute(fmt.Sprintf("drop_map_index %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("create_map_index %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf("enable_history %s 5", mapIndex), &testConf)
+	util.Ok(t, err)
+	historyRes, err = Execute(fmt.Sprintf("history_key %s alice", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Assert(t, !historyRes.Valid(), "dropping an index should drop its history")
+}
+
+func TestExecuteProjection(t *testing.T) {
+	autoIndex, _ := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf(`insert %s {"name":"ada","profile":{"email":"ada@example.com"}}`, autoIndex), &testConf)
+	util.Ok(t, err)
+	_, err = Execute(fmt.Sprintf(`insert %s {"name":"bob"}`, autoIndex), &testConf)
+	util.Ok(t, err)
+
+	queryRes, err := Execute(fmt.Sprintf("query %s 1 .profile.email", autoIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, `"ada@example.com"`, queryRes.String())
+
+	queryRes, err = Execute(fmt.Sprintf("query %s [1,2] .profile.email", autoIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, store.CollectionResult{`"ada@example.com"`, ""}, queryRes)
+
+	listRes, err := Execute(fmt.Sprintf("list %s 10 fields=name", autoIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "1\t{\"name\":\"ada\"}\n2\t{\"name\":\"bob\"}\n", listRes.String())
+}
+
+func TestExecuteWhere(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	for i := 1; i <= 6; i++ {
+		status := "open"
+		if i%2 == 0 {
+			status = "closed"
+		}
+		_, err := Execute(fmt.Sprintf(`insert_key %s order_%d {"status":"%s","total":%d}`, mapIndex, i, status, i*10), &testConf)
+		util.Ok(t, err)
+	}
+
+	listRes, err := Execute(fmt.Sprintf(`list_key %s 1 1 where .status = "open" .total`, mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "order_3\t30\n", listRes.String())
+
+	countRes, err := Execute(fmt.Sprintf("count_key %s where .status = open and .total > 20", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "2", countRes.String())
+}
+
+func TestExecuteListCursor(t *testing.T) {
+	autoIndex, _ := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	for i := 1; i <= 3; i++ {
+		_, err := Execute(fmt.Sprintf("insert %s value_%d", autoIndex, i), &testConf)
+		util.Ok(t, err)
+	}
+
+	listRes, err := Execute(fmt.Sprintf("list %s 2 cursor", autoIndex), &testConf)
+	util.Ok(t, err)
+	paged, ok := listRes.(store.PagedListResult)
+	util.Assert(t, ok, "a list requesting a cursor should return a paged result")
+	util.Equals(t, 2, len(paged.Items))
+	util.Assert(t, paged.Next != nil, "a full page should have a next cursor")
+
+	listRes, err = Execute(fmt.Sprintf("list %s 2 after=%s", autoIndex, paged.Next.String()), &testConf)
+	util.Ok(t, err)
+	jsonBytes, err := json.Marshal(listRes)
+	util.Ok(t, err)
+	util.Equals(t, `{"items":[{"key":3,"value":"value_3"}],"next":null}`, string(jsonBytes))
+}
+
+func TestExecuteScanKey(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	for _, key := range []string{"2024-01-05", "2024-02-10", "2024-03-01", "tenant42_a", "tenant42_b", "tenant4_a"} {
+		_, err := Execute(fmt.Sprintf("insert_key %s %s v", mapIndex, key), &testConf)
+		util.Ok(t, err)
+	}
+
+	scanRes, err := Execute(fmt.Sprintf("scan_key %s prefix=tenant42_", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "tenant42_a\tv\ntenant42_b\tv\n", scanRes.String())
+
+	scanRes, err = Execute(fmt.Sprintf("scan_key %s from=2024-01 to=2024-03", mapIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, "2024-01-05\tv\n2024-02-10\tv\n", scanRes.String())
+}
+
 // insert and update many records in a map index
 func TestExecuteMapUpdateMany(t *testing.T) {
 	_, mapIndex := createTestIndexes(t, &testConf)
@@ -580,6 +845,11 @@ func TestExecuteMapList(t *testing.T) {
 	listResArr := parseMapListResult(listRes)
 	util.Equals(t, nBatch, len(listResArr))
 
+	// keys should be listed in lexicographic order
+	for i := 1; i < len(listResArr); i++ {
+		util.Assert(t, listResArr[i-1].Key < listResArr[i].Key, fmt.Sprintf("keys should be sorted: %s < %s", listResArr[i-1].Key, listResArr[i].Key))
+	}
+
 	// test limit
 	limit := 10
 
@@ -665,24 +935,128 @@ func TestExecuteMapCount(t *testing.T) {
 }
 
 func TestExecuteQueryAutoArraySelector(t *testing.T) {
-	_, mapIndex := createTestIndexes(t, &testConf)
+	autoIndex, _ := createTestIndexes(t, &testConf)
 	defer dropTestIndexes(t, &testConf)
 
 	for i := 0; i < 3; i++ {
-		key := strconv.Itoa(i)
-		value := "testVal"
-		insertStmt := fmt.Sprintf("insert_key %s %s %s", mapIndex, key, value)
+		insertStmt := fmt.Sprintf("insert %s testVal", autoIndex)
 		_, err := Execute(insertStmt, &testConf)
 		util.Ok(t, err)
 	}
 
-	queryStr := fmt.Sprintf("query %s [1,2,3]", mapIndex)
+	queryStr := fmt.Sprintf("query %s [1,2,3]", autoIndex)
 	queryRes, err := Execute(queryStr, &testConf)
 	util.Ok(t, err)
 	util.Assert(t, queryRes.Valid(), "query result should be valid")
 
 }
 
+// auto index operations should be refused on map indexes and vice versa
+func TestExecuteIndexKindMismatch(t *testing.T) {
+	autoIndex, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	_, err := Execute(fmt.Sprintf("query %s [1,2,3]", mapIndex), &testConf)
+	util.Assert(t, err != nil, "auto index query on a map index should return an error")
+
+	_, err = Execute(fmt.Sprintf("insert_key %s key value", autoIndex), &testConf)
+	util.Assert(t, err != nil, "map index insert on an auto index should return an error")
+}
+
+// the page size recorded when an index is created should be used even if the configured page size changes
+func TestExecuteManifestPageSize(t *testing.T) {
+	autoIndex, _ := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	for i := 0; i < nBatch; i++ {
+		_, err := Execute(fmt.Sprintf("insert %s test_value_%d", autoIndex, i), &testConf)
+		util.Ok(t, err)
+	}
+
+	changedConf := config.Config{}
+	for key, value := range testConf {
+		changedConf[key] = value
+	}
+	changedConf["AUTO_PAGE_SIZE"] = "7"
+
+	queryRes, err := Execute(fmt.Sprintf("query %s [1:%d]", autoIndex, nBatch), &changedConf)
+	util.Ok(t, err)
+
+	resultArr := parseArrayResult(queryRes)
+	util.Equals(t, nBatch, len(resultArr))
+	for i, item := range resultArr {
+		util.Equals(t, fmt.Sprintf("test_value_%d", i), item)
+	}
+}
+
+// repaging an index should keep every record queryable under the new page size
+func TestExecuteRepageIndex(t *testing.T) {
+	autoIndex, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	for i := 0; i < nBatch; i++ {
+		_, err := Execute(fmt.Sprintf("insert %s test_value_%d", autoIndex, i), &testConf)
+		util.Ok(t, err)
+		_, err = Execute(fmt.Sprintf("insert_key %s test_key_%d test_value_%d", mapIndex, i, i), &testConf)
+		util.Ok(t, err)
+	}
+
+	res, err := Execute(fmt.Sprintf("repage_index %s 7", autoIndex), &testConf)
+	util.Ok(t, err)
+	util.Equals(t, autoIndex, res.String())
+
+	_, err = Execute(fmt.Sprintf("repage_index %s 13", mapIndex), &testConf)
+	util.Ok(t, err)
+
+	queryRes, err := Execute(fmt.Sprintf("query %s [1:%d]", autoIndex, nBatch), &testConf)
+	util.Ok(t, err)
+	resultArr := parseArrayResult(queryRes)
+	util.Equals(t, nBatch, len(resultArr))
+	for i, item := range resultArr {
+		util.Equals(t, fmt.Sprintf("test_value_%d", i), item)
+	}
+
+	for i := 0; i < nBatch; i++ {
+		queryRes, err := Execute(fmt.Sprintf("query_key %s test_key_%d", mapIndex, i), &testConf)
+		util.Ok(t, err)
+		util.Equals(t, fmt.Sprintf("test_value_%d", i), queryRes.String())
+	}
+
+	_, err = Execute("repage_index missing_index 10", &testConf)
+	util.Assert(t, err != nil, "repaging a missing index should return an error")
+}
+
+// map keys may contain colons, whitespace and line breaks, and may be of any length
+func TestExecuteMapUnrestrictedKeys(t *testing.T) {
+	_, mapIndex := createTestIndexes(t, &testConf)
+	defer dropTestIndexes(t, &testConf)
+
+	keys := []string{
+		"tenant:42:user",
+		`"https://example.com/?q=a b"`,
+		`"Jane Doe <jane@example.com>"`,
+		`"line\nbreak"`,
+		strings.Repeat("k", 500),
+	}
+	for i, key := range keys {
+		_, err := Execute(fmt.Sprintf("insert_key %s %s value_%d", mapIndex, key, i), &testConf)
+		util.Ok(t, err)
+	}
+
+	for i, key := range keys {
+		res, err := Execute(fmt.Sprintf("query_key %s %s", mapIndex, key), &testConf)
+		util.Ok(t, err)
+		util.Equals(t, fmt.Sprintf("value_%d", i), res.String())
+	}
+
+	listRes, err := Execute(fmt.Sprintf("list_key %s", mapIndex), &testConf)
+	util.Ok(t, err)
+	listed := parseMapListResult(listRes)
+	util.Equals(t, len(keys), len(listed))
+	util.Equals(t, "Jane Doe <jane@example.com>", listed[0].Key)
+	util.Equals(t, "line\nbreak", listed[3].Key)
+}
+
 func TestUnexpectedEndOfInputError(t *testing.T) {
 	_, mapIndex := createTestIndexes(t, &testConf)
 	defer dropTestIndexes(t, &testConf)
@@ -701,6 +1075,10 @@ func TestUnexpectedEndOfInputError(t *testing.T) {
 		"list_key",
 		"count",
 		"count_key",
+		"cas",
+		"cas_key",
+		"incr",
+		"incr_key",
 	}
 
 	for _, query := range missingIndexQueries {
@@ -718,6 +1096,10 @@ func TestUnexpectedEndOfInputError(t *testing.T) {
 		"delete %s",
 		"delete_key %s",
 		"upsert_key %s",
+		"cas %s",
+		"cas_key %s",
+		"incr %s",
+		"incr_key %s",
 	}
 
 	for _, format := range missingSelectorFormats {
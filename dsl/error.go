@@ -10,14 +10,23 @@ type Error struct {
 	InternalError   error
 	Message         string
 	RemainingTokens []string
+	// the 1-based character column of the query at which the error was found
+	Column int
 }
 
 const maxSnippetTokens = 5
 
 func (e Error) Error() string {
+	if e.Column > 0 {
+		return fmt.Sprintf("Syntax error at column %d '%s': %s", e.Column, e.makeSnippet(), e.Message)
+	}
 	return fmt.Sprintf("Syntax error at '%s': %s", e.makeSnippet(), e.Message)
 }
 
+func (e Error) Unwrap() error {
+	return e.InternalError
+}
+
 func (e Error) makeSnippet() string {
 	tokens := limit(e.RemainingTokens, maxSnippetTokens)
 	if len(tokens) > maxSnippetTokens {
@@ -26,18 +35,28 @@ func (e Error) makeSnippet() string {
 	return strings.Join(tokens, " ")
 }
 
-func syntaxError(badToken string, remaining []string, message string) error {
+func syntaxError(rawInput string, badToken token, message string) error {
 	return Error{
 		Message:         message,
-		RemainingTokens: remaining,
+		RemainingTokens: remainingTokens(rawInput, badToken.start),
+		Column:          column(rawInput, badToken.start),
 	}
 }
 
-func parsingError(badToken string, remaining []string, message string, err error) error {
+func parsingError(rawInput string, badToken token, message string, err error) error {
 	return Error{
 		Message:         message,
-		RemainingTokens: remaining,
+		RemainingTokens: remainingTokens(rawInput, badToken.start),
 		InternalError:   err,
+		Column:          column(rawInput, badToken.start),
+	}
+}
+
+func lexingError(rawInput string, offset int, message string) error {
+	return Error{
+		Message:         message,
+		RemainingTokens: remainingTokens(rawInput, offset),
+		Column:          column(rawInput, offset),
 	}
 }
 
@@ -45,7 +64,16 @@ func unexpectedEndOfInputError(rawInput, expectedTokenDescription string) error
 	return Error{
 		RemainingTokens: []string{rawInput + "[!]"},
 		Message:         fmt.Sprintf("expected %s", expectedTokenDescription),
+		Column:          column(rawInput, len(rawInput)),
+	}
+}
+
+// remainingTokens splits the input following an offset on whitespace, for displaying in error messages
+func remainingTokens(rawInput string, offset int) []string {
+	if offset > len(rawInput) {
+		offset = len(rawInput)
 	}
+	return strings.Fields(rawInput[offset:])
 }
 
 func limit(strs []string, limit int) []string {
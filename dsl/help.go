@@ -13,6 +13,52 @@ FLAGS:
 	-h,	--help
 		Display this help text.
 
+QUERY SYNTAX:
+Tokens are separated by any amount of whitespace. A token containing whitespace can be written as a string
+literal in double or single quotes, where \n, \r, \t, \\, \", \' and \uXXXX escapes may be used:
+	insert_key user_email "admin@example.com" "  a value\twith whitespace\n"
+The payload of insert, update and the map index writes is the rest of the query. A payload written as a
+single string literal is unquoted, any other payload is stored exactly as written.
+Syntax errors report the character column of the query where the error was found.
+
+PROJECTIONS:
+query, query_key, list, list_key, scan_key and query_by may end with a projection returning part of each
+JSON value instead of the whole value. The projection is applied by keybite before the results are returned.
+	.profile.email
+		Return the value found by following object keys and array indexes, as JSON.
+		Example: query user 12 .profile.email
+		Example: query_key post_tags hello .tags.0
+	fields=name,email
+		Return an object holding the listed top-level fields of object values.
+		Example: list user 10 desc fields=name,email
+Values which are not JSON, or don't contain the path, are returned empty.
+
+CURSORS:
+Listing with an offset reads every page before the offset. A list can instead return a cursor pointing
+after its last record, which a later list starts from, reading only the pages from the cursor onwards.
+Cursors follow the limit, offset and direction of list, list_key and scan_key, and precede a where clause.
+	cursor
+		Return the first records of the list with the cursor of the next page. With JSON output the result
+		is an object: {"items": [...], "next": "<cursor>"}. next is null once every record has been listed.
+		Example: list user 50 cursor
+	after=<cursor>
+		Return the records following a cursor, with the cursor of the next page. The direction and where
+		clause should match the list which returned the cursor.
+		Example: list user 50 after=eyJwIjoiMCIsImsiOiI1MCJ9
+
+FILTERS:
+list, list_key, scan_key, count and count_key accept a where clause after the list options, and before a
+projection. Records are filtered while the pages are read, and the limit and offset apply to the matching
+records.
+	where <operand> <operator> <value> [and <operand> <operator> <value> ...]
+		The operand is 'value' for the whole value, or a path like .status for part of a JSON value. JSON
+		strings are compared without their quotes. The operators are =, != (compared as numbers when both
+		sides are numbers, otherwise as strings), <, <=, >, >= (numbers only) and prefix. Records without
+		the path never match.
+		Example: list orders 50 where .status = "open"
+		Example: count_key orders where .status = open and .total >= 100
+		Example: list_key user_email where value prefix admin
+
 QUERY COMMANDS:
 - Auto-incrementing indexes (keybite assigns an integer ID):
 	query
@@ -33,30 +79,154 @@ QUERY COMMANDS:
 	count
 		Count the records in an index.
 		Example: count user
+	cas
+		Compare-and-swap: replace the value at an ID with a new value only if the current value equals the
+		expected value. The expected value is a single token, so quote it if it contains whitespace. The
+		comparison and the write happen under the index write lock. Returns true if the value was swapped,
+		false otherwise.
+		Example: cas user 10 admin@example.com admin2@example.com
+	incr
+		Add an integer delta to the values at the selected IDs, which must be 64-bit integers. The delta
+		defaults to 1 and may be negative. The values are updated under the index write lock, so concurrent
+		increments are never lost. Returns the new values.
+		Example: incr post_views [1:10] 2
 
 - Map indexes (user assigns a string or integer key)
+	Keys may be any string of any length. Keys containing whitespace must be quoted, and quoted keys
+	may use escapes like \" and \n. Several keys can be selected at once with an array: ["key one", key2]
 	query_key
-		Retrieve a value from a map index by key
+		Retrieve a value from a map index by key. Indexes keeping a history can read the value of a single
+		key at a version, or at an RFC 3339 timestamp, with at=<version|timestamp>.
 		Example: query_key user_email admin@example.com
+		Example: query_key user_email admin@example.com at=2024-01-02T15:04:05Z
 	insert_key
-		Insert a value into a map index with the specified key. Returns the key.
+		Insert a value into a map index with the specified key. Returns the key. An optional ttl=<duration>
+		before the value makes the record expire once the duration has passed, using Go duration syntax
+		like 90s, 30m or 24h. Expired records are hidden from every query, and their keys can be inserted
+		again. A value starting with 'ttl=' must be quoted.
 		Example: insert_key user_email admin@example.com 10
+		Example: insert_key session 5f2b ttl=30m {"user":10}
 	update_key
 		Update an existing value at the provided key. Returns the key.
 		Example: update_key user_email admin@example.com 9
 	upsert_key
-		If a record with the specified key exists, update it, else insert a new one. Returns the key
+		If a record with the specified key exists, update it, else insert a new one. Returns the key.
+		Takes an optional ttl=<duration> like insert_key. A record upserted without a TTL never expires,
+		even if the record it replaces did. update_key keeps the expiry time of the record.
 		Example: upsert_key user_email admin@example.com 9
+		Example: upsert_key session 5f2b ttl=30m {"user":9}
 	delete_key
 		Delete the record with the specified key if it exists.
 		Example: delete_key user_email admin@example.com
 	list_key
-		List the contents of an index in the order of the key hashes (roughly alphabetical,
-		but long keys can cause integer overflow and break alphabetization). Optional limit and offset.
+		List the contents of an index in lexicographic (byte-wise) order of the keys. Map indexes created
+		before ordered addressing are listed in the order of the key hashes until they are repaged.
+		Optional limit and offset.
 		Example: list_key user_email 10 50
+	scan_key
+		List the records of a range of keys, in the same order as list_key. prefix=<prefix> selects the keys
+		starting with a prefix, and from=<key> and to=<key> select the keys from a key (inclusive) up to
+		another key (exclusive). Options can be combined, and the list options of list_key may follow them.
+		Only the pages holding keys of the range are read. Map indexes created before ordered addressing
+		read every page until they are repaged.
+		Example: scan_key user_email prefix=tenant42_
+		Example: scan_key events from=2024-01 to=2024-03 100 desc
 	count_key
 		Count the records in an index.
 		Example: count user_email
+	cas_key
+		Compare-and-swap: replace the value at a key with a new value only if the current value equals the
+		expected value. Returns true if the value was swapped, false otherwise.
+		Example: cas_key counter visits 41 42
+	incr_key
+		Add an integer delta to the values at the selected keys, like incr. Missing keys are created with
+		the value of the delta. Records inserted with a TTL keep their expiry time. Returns the new values.
+		Example: incr_key counter visits -1
+	vacuum_expired
+		Remove expired records from the pages of a map index, returning the number of records removed.
+		Expired records are hidden from queries but keep using space until they are vacuumed, so this
+		should be run regularly, for example from a scheduled Lambda invocation. Each page is rewritten
+		under its own write lock.
+		Example: vacuum_expired session
+
+- Value indexes (find the keys of the records holding a value)
+	A value index is a map index mapping the values of a source index to the keys holding them. Every write
+	to the source index updates its value indexes while the source index is write locked. Servers which
+	opened the source index before a value index was created may not update it, so create value indexes
+	before writing to the source index from several servers. Value indexes can be read like other map indexes,
+	but writing to them directly fails.
+	create_value_index
+		Create a value index of an auto or map index, and index its existing records. An optional field
+		indexes a top-level field of values which are JSON objects instead of the whole value; string
+		fields are indexed without their quotes. Values without the field are not indexed. Drop a value
+		index with drop_map_index.
+		Example: create_value_index user user_by_email email
+	query_by
+		List the records of the source index holding a value, in key order. The value of each record is
+		checked, so records which no longer hold the value are left out.
+		Example: query_by user_by_email admin@example.com
+
+- Change logs (follow the writes to an index)
+	A change log records every write to an index as an event holding a sequence number, the operation
+	(insert, update or delete), the key, the old and new values and a timestamp. Events are stored in an
+	auto index named after the index with the suffix .changes. Servers which opened the index before its
+	change log was enabled may not record their writes, so enable change logs before writing to the index
+	from several servers.
+	enable_change_log
+		Start recording the writes to an auto or map index in its change log.
+		Example: enable_change_log user
+	disable_change_log
+		Stop recording the writes to an index and drop its change log.
+		Example: disable_change_log user
+	changes
+		List the events of the change log of an index following a sequence number, in order, with an
+		optional limit. Pass the sequence number of the last event read to continue reading, or since=0
+		to read every event.
+		Example: changes user since=0 100
+
+- History (read and restore earlier versions of map index records)
+	A map index can keep the latest versions of each record in a map index named after the index with the
+	suffix .history. Versions are numbered from 1 for each key, and deleting a record is recorded as a
+	version without a value. Servers which opened the index before its history was enabled may not record
+	their writes, so enable history before writing to the index from several servers.
+	enable_history
+		Keep the provided number of versions of each record of a map index. The existing records are
+		recorded as their first version. Running this again changes the number of versions kept.
+		Example: enable_history user_email 10
+	disable_history
+		Stop keeping versions of the records of an index and drop its history.
+		Example: disable_history user_email
+	history_key
+		List the versions kept for a key, oldest first.
+		Example: history_key user_email admin@example.com
+	revert_key
+		Restore the value of a key from one of its versions, which is recorded as a new version. Reverting
+		to a version recording a deletion deletes the key.
+		Example: revert_key user_email admin@example.com 3
+
+- Index management
+	create_auto_index
+		Create an auto index using the configured AUTO_PAGE_SIZE, which is recorded in the index manifest.
+		Running this against an index created before manifests were introduced writes its manifest.
+		Example: create_auto_index user
+	create_map_index
+		Create a map index using the configured MAP_PAGE_SIZE, which is recorded in the index manifest.
+		Running this against an index created before manifests were introduced writes its manifest.
+		Example: create_map_index user_email
+	drop_auto_index
+		Permanently delete an auto index and all of its data, including its change log.
+		Example: drop_auto_index user
+	drop_map_index
+		Permanently delete a map index and all of its data, including its change log and history.
+		Example: drop_map_index user_email
+	repage_index
+		Rewrite every page of an index using a new page size, and record the new size in the index manifest.
+		The new pages are written alongside the index while it is write locked and swapped in once complete,
+		so reads keep working until the swap. Indexes created before manifests were introduced must be
+		adopted with create_auto_index or create_map_index first. Repaging a map index created before
+		ordered addressing migrates it to ordered addressing; its records are held in memory while the
+		new pages are written.
+		Example: repage_index user 1000
 
 CONFIGURATION:
 Keybite requires some configuration to work. All configuration is pulled from the environment,
@@ -72,11 +242,15 @@ ENVIRONMENT VARS:
 		be transmitted across the network when retrieving records, so smaller sizes are preferable. In
 		local environments. Because IDs are automatically incremented in auto-indexes, each page will be
 		completely filled before a new page is created. When records are deleted, the size of a page will
-		be reduced.
+		be reduced. The page size is recorded in the index manifest when an index is created, so changing
+		this value only affects indexes created afterwards. Use repage_index to change the page size of an
+		existing index.
 	MAP_PAGE_SIZE
-		The number of records to store per file for map indexes. Since string keys are hashed to integers
-		and stored in a page file based on the hashed ID, map pages will usually be much more sparse than
-		auto pages. In most cases, the map page size should be quite a bit larger than the auto page size.
+		The maximum number of records to store per file for map indexes. Map pages hold contiguous ranges
+		of keys, located through a page directory stored with the index. A page which grows past the page
+		size is split into pages which are at least half full, so reading a key always reads the directory
+		and exactly one page. Deleting records does not merge pages. Like the auto page size, this value is
+		recorded in the index manifest when an index is created.
 	HTTP_PORT
 		Required when running as a standalone server. Unused when running in CLI or Lambda modes.
 	DRIVER
@@ -85,13 +259,23 @@ ENVIRONMENT VARS:
 	PAGE_EXTENSION=.kb
 		The file extension for keybite data files.
 	AWS_ACCESS_KEY_ID
-		The AWS access key ID. Only required when using the S3 driver. This environment variable is set
-		automatically in Lambda environments.
+		The AWS access key ID used by the S3 driver. Optional: the S3 driver resolves credentials through
+		the default AWS credential chain, which reads these environment variables, then the shared AWS
+		credentials file (see AWS_PROFILE), then the IAM role of the host. Lambda environments set these
+		variables automatically.
 	AWS_SECRET_ACCESS_KEY
-		The AWS access key ID and access key. Only required when using the S3 driver. This environment
-		variable is set automatically in Lambda environments.
+		The AWS secret access key used by the S3 driver with AWS_ACCESS_KEY_ID.
 	BUCKET_NAME
 		The name of the S3 bucket where keybite should store data.
+	S3_REGION=us-west-2
+		The region of the S3 bucket. Defaults to the region configured for AWS (AWS_REGION or the shared
+		AWS config file), or 'us-west-2'.
+	S3_ENDPOINT
+		The endpoint of an S3-compatible service like MinIO or LocalStack, for example
+		'http://localhost:9000'. AWS is used when unset.
+	S3_FORCE_PATH_STYLE=false
+		Set to 'true' to address the bucket in the path of request URLs instead of the host name, as most
+		S3-compatible services require.
 	ENVIRONMENT=linux
 		The environment in which keybite is running. Either 'linux' or 'lambda'.
 	LOG_LEVEL=debug
@@ -100,9 +284,31 @@ ENVIRONMENT VARS:
 	LOCK_DURATION_FS
 		Duration of write locks in milliseconds when using the filesystem driver. Unnecessary when using S3
 		driver.
+	FS_SYNC=full
+		How durable the writes of the filesystem driver are. Pages are always written to a temporary file
+		which is renamed over the page, so readers never see a partially written page. 'file' syncs each
+		file to the disk before it is renamed, 'full' also syncs the index directory after renames so that
+		writes survive a crash of the host, and 'none' leaves flushing to the operating system. Default is
+		'full'.
 	LOCK_DURATION_S3
 		Duration of write locks in milliseconds when using the S3 driver. Unnecessary when using filesystem
-		driver.
+		driver. The S3 driver writes a page only if it is unchanged since it was read, and retries writes
+		which conflict with another writer, so it only holds write locks while committing writes spanning
+		several pages. Transactions are not retried: a transaction conflicting with another writer fails.
+	PAGE_CACHE_SIZE_MB=0
+		The size in megabytes of the in-memory cache of pages shared by the requests served by a process,
+		like the HTTP server or a warm Lambda container. Pages written by the process are dropped from the
+		cache, and pages of indexes locked for writes are always read from storage. The hits and misses of
+		the cache are logged after each request at the debug log level. Unset or 0 disables the cache.
+	PAGE_CACHE_STALENESS=1000
+		The age in milliseconds after which cached pages are checked for writes by other processes. The S3
+		driver compares the ETag of stale pages with the bucket and keeps serving pages which are unchanged,
+		and the filesystem driver reads stale pages again. Reads may miss writes by other processes made
+		within this time, but the S3 driver still never overwrites them. Default is 1000.
+	QUERY_CONCURRENCY=8
+		The maximum number of queries of a single request executed at the same time by the HTTP and Lambda
+		servers. Queries run concurrently when they don't use each other's results and don't touch the same
+		index, or only read it. Set to 1 to execute queries one at a time.
 	
 
 `
@@ -0,0 +1,195 @@
+package dsl
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+/*
+This file implements the lexer for keybite's query DSL. Tokens are separated by any amount of whitespace
+and are read one at a time as the parser asks for them. A token is one of
+	- a string literal in double or single quotes, which may contain whitespace and escape sequences
+	- a selector in square brackets, which may contain whitespace and string literals
+	- any other run of non-whitespace characters
+*/
+
+// errEndOfInput is returned by the lexer when there are no more tokens
+var errEndOfInput = errors.New("end of input")
+
+// token is a single lexeme of a DSL query
+type token struct {
+	// the text of the token, with the quotes removed and escape sequences replaced for string literals
+	value string
+	// the text of the token as it appears in the query
+	raw string
+	// whether the token is a quoted string literal
+	literal bool
+	// byte offsets of the token in the query
+	start int
+	end   int
+}
+
+// lexer reads tokens from a DSL query
+type lexer struct {
+	input string
+	pos   int
+}
+
+func newLexer(input string) *lexer {
+	return &lexer{input: input}
+}
+
+// next reads the next token. At the end of the input errEndOfInput is returned
+func (l *lexer) next() (token, error) {
+	l.skipWhitespace()
+	start := l.pos
+	if start >= len(l.input) {
+		return token{start: start, end: start}, errEndOfInput
+	}
+
+	var err error
+	switch l.input[start] {
+	case '"', '\'':
+		err = l.skipLiteral()
+	case '[':
+		l.skipBrackets()
+	default:
+		l.skipBare()
+	}
+
+	tok := token{
+		raw:   l.input[start:l.pos],
+		start: start,
+		end:   l.pos,
+	}
+	tok.value = tok.raw
+	if err != nil {
+		return tok, lexingError(l.input, start, err.Error())
+	}
+
+	if tok.raw[0] == '"' || tok.raw[0] == '\'' {
+		tok.literal = true
+		tok.value, err = unquoteLiteral(tok.raw)
+		if err != nil {
+			return tok, lexingError(l.input, start, err.Error())
+		}
+	}
+
+	return tok, nil
+}
+
+func (l *lexer) skipWhitespace() {
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if !unicode.IsSpace(r) {
+			return
+		}
+		l.pos += size
+	}
+}
+
+func (l *lexer) skipBare() {
+	for l.pos < len(l.input) {
+		r, size := utf8.DecodeRuneInString(l.input[l.pos:])
+		if unicode.IsSpace(r) {
+			return
+		}
+		l.pos += size
+	}
+}
+
+// skipLiteral moves past a quoted string literal, including the closing quote
+func (l *lexer) skipLiteral() error {
+	quote := l.input[l.pos]
+	l.pos++
+	for l.pos < len(l.input) {
+		switch l.input[l.pos] {
+		case '\\':
+			l.pos += 2
+			continue
+		case quote:
+			l.pos++
+			return nil
+		}
+		l.pos++
+	}
+	l.pos = len(l.input)
+	return fmt.Errorf("unterminated string literal")
+}
+
+// skipBrackets moves past a bracketed selector. An unterminated selector runs to the end of the input,
+// and is reported by the selector parser
+func (l *lexer) skipBrackets() {
+	for l.pos < len(l.input) {
+		switch l.input[l.pos] {
+		case '"', '\'':
+			if l.skipLiteral() != nil {
+				return
+			}
+			continue
+		case ']':
+			l.pos++
+			return
+		}
+		l.pos++
+	}
+}
+
+// unquoteLiteral removes the quotes from a string literal and replaces its escape sequences. Supported
+// escapes are \n, \r, \t, \\, \", \' and \uXXXX
+func unquoteLiteral(raw string) (string, error) {
+	if len(raw) < 2 || raw[len(raw)-1] != raw[0] {
+		return "", fmt.Errorf("unterminated string literal")
+	}
+	body := raw[1 : len(raw)-1]
+	if !strings.Contains(body, `\`) {
+		return body, nil
+	}
+
+	var b strings.Builder
+	for i := 0; i < len(body); i++ {
+		if body[i] != '\\' {
+			b.WriteByte(body[i])
+			continue
+		}
+		i++
+		if i == len(body) {
+			return "", fmt.Errorf("unterminated escape sequence")
+		}
+		switch body[i] {
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		case 't':
+			b.WriteByte('\t')
+		case '\\', '"', '\'':
+			b.WriteByte(body[i])
+		case 'u':
+			if i+5 > len(body) {
+				return "", fmt.Errorf("invalid unicode escape sequence")
+			}
+			code, err := strconv.ParseUint(body[i+1:i+5], 16, 32)
+			if err != nil {
+				return "", fmt.Errorf("invalid unicode escape sequence '\\u%s'", body[i+1:i+5])
+			}
+			b.WriteRune(rune(code))
+			i += 4
+		default:
+			return "", fmt.Errorf("invalid escape sequence '\\%c'", body[i])
+		}
+	}
+	return b.String(), nil
+}
+
+// column returns the 1-based character column of a byte offset in the input
+func column(input string, offset int) int {
+	if offset > len(input) {
+		offset = len(input)
+	}
+	return utf8.RuneCountInString(input[:offset]) + 1
+}
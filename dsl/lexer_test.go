@@ -0,0 +1,71 @@
+package dsl
+
+import (
+	"keybite/util"
+	"testing"
+)
+
+func lexAll(t *testing.T, input string) []token {
+	t.Helper()
+	lex := newLexer(input)
+	tokens := []token{}
+	for {
+		tok, err := lex.next()
+		if err == errEndOfInput {
+			return tokens
+		}
+		util.Ok(t, err)
+		tokens = append(tokens, tok)
+	}
+}
+
+func tokenValues(tokens []token) []string {
+	values := make([]string, len(tokens))
+	for i, tok := range tokens {
+		values[i] = tok.value
+	}
+	return values
+}
+
+func TestLexerWhitespace(t *testing.T) {
+	tokens := lexAll(t, "  query_key\tmy_index   [a, b]\n ")
+	util.Equals(t, []string{"query_key", "my_index", "[a, b]"}, tokenValues(tokens))
+	util.Equals(t, 2, tokens[0].start)
+	util.Equals(t, 12, tokens[1].start)
+	util.Equals(t, 29, tokens[2].end)
+
+	util.Equals(t, 0, len(lexAll(t, " \t\n")))
+}
+
+func TestLexerLiterals(t *testing.T) {
+	tokens := lexAll(t, `"a b" 'c "d"' "" ["e f",'g]h']`)
+	util.Equals(t, []string{"a b", `c "d"`, "", `["e f",'g]h']`}, tokenValues(tokens))
+	util.Equals(t, []bool{true, true, true, false}, []bool{tokens[0].literal, tokens[1].literal, tokens[2].literal, tokens[3].literal})
+	util.Equals(t, `'c "d"'`, tokens[1].raw)
+}
+
+func TestLexerEscapes(t *testing.T) {
+	tokens := lexAll(t, `"line\nbreak" 'it\'s' "tab\there" "back\\slash" "café" "\"quoted\""`)
+	util.Equals(t, []string{"line\nbreak", "it's", "tab\there", `back\slash`, "café", `"quoted"`}, tokenValues(tokens))
+}
+
+func TestLexerErrors(t *testing.T) {
+	invalid := map[string]int{
+		`query_key idx "unterminated`: 15,
+		`query_key idx 'a\q'`:         15,
+		`query_key idx "\u00g1"`:      15,
+		`é "\`:                        3,
+	}
+
+	for input, expectedColumn := range invalid {
+		lex := newLexer(input)
+		var err error
+		for err == nil {
+			_, err = lex.next()
+		}
+		util.Assert(t, err != errEndOfInput, "lexing '"+input+"' should return an error")
+		dslErr, ok := err.(Error)
+		util.Assert(t, ok, "lexing error should be a dsl.Error")
+		util.Equals(t, expectedColumn, dslErr.Column)
+	}
+}
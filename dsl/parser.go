@@ -4,9 +4,9 @@ import (
 	"fmt"
 	"keybite/store"
 	"keybite/util/log"
-	"regexp"
 	"strconv"
 	"strings"
+	"time"
 )
 
 /*
@@ -38,6 +38,43 @@ const (
 	stepDeleteKeyIndexName
 	stepListIndexName
 	stepListKeyIndexName
+	stepRepageIndexName
+	stepFinalPageSize
+	stepCasIndexName
+	stepCasKeyIndexName
+	stepCasAutoSelector
+	stepCasMapSelector
+	stepCasExpected
+	stepIncrIndexName
+	stepIncrKeyIndexName
+	stepIncrAutoSelector
+	stepIncrMapSelector
+	stepFinalOptionalDelta
+	stepOptionalTTL
+	stepCreateValueIndexSourceName
+	stepValueIndexName
+	stepFinalOptionalField
+	stepQueryByIndexName
+	stepFinalValue
+	stepFinalOptionalProjection
+	stepCountIndexName
+	stepOptionalWhereOrProjection
+	stepWhereOperand
+	stepWhereOperator
+	stepWhereValue
+	stepOptionalAndOrProjection
+	stepOptionalCursor
+	stepScanKeyIndexName
+	stepScanKeyRange
+	stepChangesIndexName
+	stepChangesSince
+	stepFinalOptionalLimit
+	stepOptionalAt
+	stepEnableHistoryIndexName
+	stepFinalRetention
+	stepHistoryIndexName
+	stepHistoryKey
+	stepFinalVersion
 )
 
 type operationType int
@@ -60,6 +97,22 @@ const (
 	typeCreateMapIndex
 	typeDropAutoIndex
 	typeDropMapIndex
+	typeRepageIndex
+	typeCas
+	typeCasKey
+	typeIncr
+	typeIncrKey
+	typeVacuumExpired
+	typeCreateValueIndex
+	typeQueryBy
+	typeScanKey
+	typeChanges
+	typeEnableChangeLog
+	typeDisableChangeLog
+	typeEnableHistory
+	typeDisableHistory
+	typeHistoryKey
+	typeRevertKey
 )
 
 // Operation is a query
@@ -72,51 +125,183 @@ type Operation struct {
 	mapSel    store.MapSelector
 	payload   string
 	listDesc  bool
+	pageSize  int
+	expected  string
+	delta     int64
+	ttl       time.Duration
+	// the value index created from the index, and the indexed field of its values
+	valueIndexName string
+	field          string
+	// the value looked up in a value index
+	value string
+	// the part of each value returned by queries and lists
+	projection store.Projection
+	// the records listed or counted
+	filter store.Filter
+	// whether a list returns the cursor of its next page, and the cursor it starts after
+	paged bool
+	after store.Cursor
+	// the keys scanned by scan_key
+	keyRange store.KeyRange
+	// the sequence number of the last change log event already read
+	since uint64
+	// the number of versions of each record kept in the history of an index, and the version restored
+	retention int
+	version   uint64
+	// the point in time a key is read at, nil for reads of the current value
+	at *store.PointInTime
+}
+
+// ttlPrefix starts the optional TTL of map index inserts and upserts
+const ttlPrefix = "ttl="
+
+// keywordCursor requests the cursor of the next page of a list, and afterPrefix starts the cursor a list
+// continues from
+const (
+	keywordCursor = "cursor"
+	afterPrefix   = "after="
+)
+
+// sincePrefix starts the sequence number a change log is read from
+const sincePrefix = "since="
+
+// atPrefix starts the version or timestamp a point-in-time read of a key selects
+const atPrefix = "at="
+
+// options of scan_key selecting a range of keys
+const (
+	prefixOption = "prefix="
+	fromOption   = "from="
+	toOption     = "to="
+)
+
+// keywords of where clauses
+const (
+	keywordWhere = "where"
+	keywordAnd   = "and"
+	// compares whole values instead of a path of JSON values
+	keywordValue = "value"
+)
+
+// fieldsPrefix starts a projection of top-level fields, and pathPrefix starts a projection of a path
+const (
+	fieldsPrefix = "fields="
+	pathPrefix   = "."
+)
+
+// keywordWrites indicates if the operation of each keyword modifies its index
+var keywordWrites = map[string]bool{
+	"query":              false,
+	"query_key":          false,
+	"insert":             true,
+	"insert_key":         true,
+	"update":             true,
+	"update_key":         true,
+	"upsert_key":         true,
+	"delete":             true,
+	"delete_key":         true,
+	"list":               false,
+	"list_key":           false,
+	"count":              false,
+	"count_key":          false,
+	"create_auto_index":  true,
+	"create_map_index":   true,
+	"drop_auto_index":    true,
+	"drop_map_index":     true,
+	"repage_index":       true,
+	"cas":                true,
+	"cas_key":            true,
+	"incr":               true,
+	"incr_key":           true,
+	"vacuum_expired":     true,
+	"scan_key":           false,
+	"changes":            false,
+	"enable_change_log":  true,
+	"disable_change_log": true,
+	"enable_history":     true,
+	"disable_history":    true,
+	"history_key":        false,
+	"revert_key":         true,
+	// create_value_index and query_by access both a value index and its source index, so they are left out
+	// to be executed after every earlier query, and before every later query
 }
 
 // parser parses DSL into query objects
 type parser struct {
-	// the head of the parser against the list of tokens
-	i int
 	// the raw DSL query string
-	raw    string
-	tokens []string
+	raw string
+	// the lexer reading tokens from the query
+	lex *lexer
+	// the token at the head of the parser, and the error encountered reading it
+	tok    token
+	tokErr error
 	// the state of the parser state machine
 	nextStep step
+	// the compared path and operator of the where clause condition being parsed
+	wherePath     []string
+	whereOperator string
+	// the options of the key range being parsed, by option name
+	rangeOptions map[string]string
 }
 
-// the regular expression used to naively split DSL into tokens
-var tokenizeExp = regexp.MustCompile(" ")
-
 // newParser constructs a parser
 func newParser(dsl string) parser {
-	return parser{
+	p := parser{
 		raw:      dsl,
-		tokens:   tokenizeExp.Split(dsl, -1),
+		lex:      newLexer(dsl),
 		nextStep: stepInitial,
 	}
+	p.tok, p.tokErr = p.lex.next()
+	return p
 }
 
 func (p parser) current() (string, error) {
-	if len(p.tokens) > p.i {
-		return p.tokens[p.i], nil
-	}
-	return "", fmt.Errorf("end of input")
+	return p.tok.value, p.tokErr
 }
 
 func (p *parser) increment() {
-	p.i++
+	p.tok, p.tokErr = p.lex.next()
 }
 
-func (p parser) remaining() []string {
-	return p.tokens[p.i:]
+// missing returns the error for a required token which could not be read
+func (p parser) missing(expectedTokenDescription string) error {
+	if p.tokErr == errEndOfInput {
+		return unexpectedEndOfInputError(p.raw, expectedTokenDescription)
+	}
+	return p.tokErr
+}
+
+// optional returns the value of an optional token, which is empty at the end of the input
+func (p parser) optional() (string, error) {
+	if p.tokErr == errEndOfInput {
+		return "", nil
+	}
+	return p.tok.value, p.tokErr
+}
+
+// payload returns the remainder of the query starting at the current token. A payload consisting of a single
+// string literal is unquoted, any other payload is returned exactly as written
+func (p parser) payload() string {
+	if p.tokErr == nil && p.tok.literal && strings.TrimSpace(p.raw[p.tok.end:]) == "" {
+		return p.tok.value
+	}
+	return p.raw[p.tok.start:]
+}
+
+// mapSelector parses the current token into a map selector. A string literal always selects a single key
+func (p parser) mapSelector() (store.MapSelector, error) {
+	if p.tok.literal {
+		selector := store.NewMapSingleSelector(p.tok.value)
+		return &selector, nil
+	}
+	return ParseMapSelector(p.tok.value)
 }
 
 // Parse the provided query
 func (p parser) Parse() (o Operation, dslErr error) {
 	var err error
-	if len(p.tokens) == 0 {
-		dslErr = unexpectedEndOfInputError(p.raw, "operation keyword")
+	if p.tokErr != nil {
+		dslErr = p.missing("operation keyword")
 		return
 	}
 	for {
@@ -172,11 +357,11 @@ func (p parser) Parse() (o Operation, dslErr error) {
 
 			case "count":
 				o.oType = typeCount
-				p.nextStep = stepFinalIndexName
+				p.nextStep = stepCountIndexName
 
 			case "count_key":
 				o.oType = typeCountKey
-				p.nextStep = stepFinalIndexName
+				p.nextStep = stepCountIndexName
 
 			case "create_auto_index":
 				o.oType = typeCreateAutoIndex
@@ -194,14 +379,78 @@ func (p parser) Parse() (o Operation, dslErr error) {
 				o.oType = typeDropMapIndex
 				p.nextStep = stepFinalIndexName
 
+			case "repage_index":
+				o.oType = typeRepageIndex
+				p.nextStep = stepRepageIndexName
+
+			case "cas":
+				o.oType = typeCas
+				p.nextStep = stepCasIndexName
+
+			case "cas_key":
+				o.oType = typeCasKey
+				p.nextStep = stepCasKeyIndexName
+
+			case "incr":
+				o.oType = typeIncr
+				p.nextStep = stepIncrIndexName
+
+			case "incr_key":
+				o.oType = typeIncrKey
+				p.nextStep = stepIncrKeyIndexName
+
+			case "vacuum_expired":
+				o.oType = typeVacuumExpired
+				p.nextStep = stepFinalIndexName
+
+			case "create_value_index":
+				o.oType = typeCreateValueIndex
+				p.nextStep = stepCreateValueIndexSourceName
+
+			case "query_by":
+				o.oType = typeQueryBy
+				p.nextStep = stepQueryByIndexName
+
+			case "scan_key":
+				o.oType = typeScanKey
+				p.nextStep = stepScanKeyIndexName
+
+			case "changes":
+				o.oType = typeChanges
+				p.nextStep = stepChangesIndexName
+
+			case "enable_change_log":
+				o.oType = typeEnableChangeLog
+				p.nextStep = stepFinalIndexName
+
+			case "disable_change_log":
+				o.oType = typeDisableChangeLog
+				p.nextStep = stepFinalIndexName
+
+			case "enable_history":
+				o.oType = typeEnableHistory
+				p.nextStep = stepEnableHistoryIndexName
+
+			case "disable_history":
+				o.oType = typeDisableHistory
+				p.nextStep = stepFinalIndexName
+
+			case "history_key":
+				o.oType = typeHistoryKey
+				p.nextStep = stepHistoryIndexName
+
+			case "revert_key":
+				o.oType = typeRevertKey
+				p.nextStep = stepHistoryIndexName
+
 			default:
-				dslErr = syntaxError(keyword, p.remaining(), "unknown keyword")
+				dslErr = syntaxError(p.raw, p.tok, "unknown keyword")
 				return
 			}
 		case stepQueryIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepFinalAutoSelector
@@ -209,7 +458,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepQueryKeyIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepFinalMapSelector
@@ -217,7 +466,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepInsertIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepFinalPayload
@@ -225,7 +474,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepUpdateInsertKeyIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepUpdateInsertKeyMapSelector
@@ -233,7 +482,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepUpdateIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepUpdateAutoSelector
@@ -241,7 +490,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepDeleteIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepFinalAutoSelector
@@ -249,7 +498,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepDeleteKeyIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepFinalMapSelector
@@ -257,7 +506,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepListIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepListOptionalLimitOrDirection
@@ -265,18 +514,200 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepListKeyIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			p.nextStep = stepListOptionalLimitOrDirection
 
+		case stepCountIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepOptionalWhereOrProjection
+
+		case stepRepageIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepFinalPageSize
+
+		case stepCasIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepCasAutoSelector
+
+		case stepCasKeyIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepCasMapSelector
+
+		case stepIncrIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepIncrAutoSelector
+
+		case stepIncrKeyIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepIncrMapSelector
+
+		case stepCreateValueIndexSourceName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepValueIndexName
+
+		case stepValueIndexName:
+			o.valueIndexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("value index name")
+				return
+			}
+			if o.valueIndexName == o.indexName {
+				dslErr = syntaxError(p.raw, p.tok, "a value index cannot have the name of its source index")
+				return
+			}
+			p.nextStep = stepFinalOptionalField
+
+		case stepScanKeyIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.rangeOptions = map[string]string{}
+			p.nextStep = stepScanKeyRange
+
+		case stepScanKeyRange:
+			// one or more range options precede the list options
+			option, value, isOption := p.rangeOption()
+			if !isOption {
+				if len(p.rangeOptions) == 0 {
+					if p.tokErr == errEndOfInput {
+						dslErr = p.missing("key range")
+					} else {
+						dslErr = syntaxError(p.raw, p.tok, "expected a key range: prefix=<prefix>, from=<key> or to=<key>")
+					}
+					return
+				}
+				p.nextStep = stepListOptionalLimitOrDirection
+				continue
+			}
+			if _, repeated := p.rangeOptions[option]; repeated {
+				dslErr = syntaxError(p.raw, p.tok, "repeated key range option "+option)
+				return
+			}
+			p.rangeOptions[option] = value
+			from, to := p.rangeOptions[fromOption], p.rangeOptions[toOption]
+			if from != "" && to != "" && from >= to {
+				dslErr = syntaxError(p.raw, p.tok, "the start of a key range must be before its end")
+				return
+			}
+			o.keyRange = store.NewKeyRange(p.rangeOptions[prefixOption], from, to)
+
+		case stepChangesIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepChangesSince
+
+		case stepChangesSince:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("since=<sequence number>")
+				return
+			}
+			if p.tok.literal || !strings.HasPrefix(token, sincePrefix) {
+				dslErr = syntaxError(p.raw, p.tok, "expected since=<sequence number>")
+				return
+			}
+			o.since, err = strconv.ParseUint(strings.TrimPrefix(token, sincePrefix), 10, 64)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid sequence number", err)
+				return
+			}
+			p.nextStep = stepFinalOptionalLimit
+
+		case stepEnableHistoryIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepFinalRetention
+
+		case stepHistoryIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepHistoryKey
+
+		case stepHistoryKey:
+			_, err := p.current()
+			if err != nil {
+				dslErr = p.missing("map index selector")
+				return
+			}
+			o.mapSel, err = p.mapSelector()
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
+				return
+			}
+			if o.mapSel.Length() > 1 {
+				dslErr = syntaxError(p.raw, p.tok, "history commands accept a single key")
+				return
+			}
+			if o.oType == typeHistoryKey {
+				return
+			}
+			p.nextStep = stepFinalVersion
+
+		case stepQueryByIndexName:
+			o.indexName, err = p.current()
+			if err != nil {
+				dslErr = p.missing("index name")
+				return
+			}
+			p.nextStep = stepFinalValue
+
 		case stepListOptionalLimitOrDirection:
-			// optional token, error can be ignored
-			token, _ := p.current()
-			// if token is a direction, set the direction and treat as final token
+			token, err := p.optional()
+			if err != nil {
+				dslErr = err
+				return
+			}
+			// a cursor, where clause or projection ends the list options
+			if p.isListClause() {
+				p.nextStep = stepOptionalCursor
+				continue
+			}
+			// if token is a direction, set the direction and expect the optional clauses
 			if desc, isDirection := parseDirection(token); isDirection {
 				o.listDesc = desc
-				return
+				p.nextStep = stepOptionalCursor
+				break
 			}
 
 			// else treat as limit
@@ -284,7 +715,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 			if err != nil {
 				// if token is not empty, limit was invalid
 				if token != "" {
-					dslErr = parsingError(token, p.remaining(), "invalid limit", err)
+					dslErr = parsingError(p.raw, p.tok, "invalid limit", err)
 					return
 				}
 			}
@@ -293,7 +724,7 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepFinalIndexName:
 			o.indexName, err = p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "index name")
+				dslErr = p.missing("index name")
 				return
 			}
 			return
@@ -301,91 +732,434 @@ func (p parser) Parse() (o Operation, dslErr error) {
 		case stepFinalAutoSelector:
 			token, err := p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "auto index selector")
+				dslErr = p.missing("auto index selector")
 				return
 			}
 			o.autoSel, err = ParseAutoSelector(token)
 			if err != nil {
-				dslErr = parsingError(token, p.remaining(), "invalid selector", err)
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
 				return
 			}
-			return
+			if o.oType != typeQuery {
+				return
+			}
+			p.nextStep = stepFinalOptionalProjection
 
 		case stepFinalMapSelector:
-			token, err := p.current()
+			_, err := p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "map index selector")
+				dslErr = p.missing("map index selector")
 				return
 			}
-			o.mapSel, err = ParseMapSelector(token)
+			o.mapSel, err = p.mapSelector()
 			if err != nil {
-				dslErr = parsingError(token, p.remaining(), "invalid selector", err)
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
 				return
 			}
-			return
+			if o.oType != typeQueryKey {
+				return
+			}
+			p.nextStep = stepOptionalAt
 
 		case stepFinalPayload:
-			payload := strings.Join(p.remaining(), " ")
-			if payload == "" {
-				dslErr = unexpectedEndOfInputError(p.raw, "insert payload")
+			if p.tokErr == errEndOfInput {
+				dslErr = p.missing("insert payload")
+				return
+			}
+			o.payload = p.payload()
+			return
+
+		case stepFinalPageSize:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("page size")
+				return
+			}
+			o.pageSize, err = strconv.Atoi(token)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid page size", err)
+				return
+			}
+			if o.pageSize < 1 {
+				dslErr = syntaxError(p.raw, p.tok, "page size must be a positive integer")
 				return
 			}
-			o.payload = payload
 			return
 
 		case stepListOptionalOffsetOrDirection:
-			// optional token, error can be ignored
-			token, _ := p.current()
-			// if token is a direction, treat as final token
+			token, err := p.optional()
+			if err != nil {
+				dslErr = err
+				return
+			}
+			if p.isListClause() {
+				p.nextStep = stepOptionalCursor
+				continue
+			}
+			// if token is a direction, expect the optional clauses
 			if desc, isDirection := parseDirection(token); isDirection {
 				o.listDesc = desc
-				return
+				p.nextStep = stepOptionalCursor
+				break
 			}
 
 			o.offset, err = strconv.Atoi(token)
 			if err != nil {
 				// if token is not empty, offset was invalid
 				if token != "" {
-					dslErr = parsingError(token, p.remaining(), "invalid offset", err)
+					dslErr = parsingError(p.raw, p.tok, "invalid offset", err)
 					return
 				}
 			}
 			p.nextStep = stepFinalOptionalDirection
 
 		case stepUpdateInsertKeyMapSelector:
+			_, err := p.current()
+			if err != nil {
+				dslErr = p.missing("map index selector")
+				return
+			}
+			o.mapSel, err = p.mapSelector()
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
+				return
+			}
+			if o.oType == typeInsertKey || o.oType == typeUpsertKey {
+				p.nextStep = stepOptionalTTL
+			} else {
+				p.nextStep = stepFinalPayload
+			}
+
+		case stepUpdateAutoSelector:
 			token, err := p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "map index selector")
+				dslErr = p.missing("auto index selector")
 				return
 			}
-			o.mapSel, err = ParseMapSelector(token)
+			o.autoSel, err = ParseAutoSelector(token)
 			if err != nil {
-				dslErr = parsingError(token, p.remaining(), "invalid selector", err)
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
 				return
 			}
 			p.nextStep = stepFinalPayload
 
-		case stepUpdateAutoSelector:
+		case stepCasAutoSelector:
 			token, err := p.current()
 			if err != nil {
-				dslErr = unexpectedEndOfInputError(p.raw, "auto index selector")
+				dslErr = p.missing("auto index selector")
 				return
 			}
 			o.autoSel, err = ParseAutoSelector(token)
 			if err != nil {
-				dslErr = parsingError(token, p.remaining(), "invalid selector", err)
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
+				return
+			}
+			if o.autoSel.Length() > 1 {
+				dslErr = syntaxError(p.raw, p.tok, "compare-and-swap accepts a single ID")
+				return
+			}
+			p.nextStep = stepCasExpected
+
+		case stepCasMapSelector:
+			_, err := p.current()
+			if err != nil {
+				dslErr = p.missing("map index selector")
+				return
+			}
+			o.mapSel, err = p.mapSelector()
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
+				return
+			}
+			if o.mapSel.Length() > 1 {
+				dslErr = syntaxError(p.raw, p.tok, "compare-and-swap accepts a single key")
+				return
+			}
+			p.nextStep = stepCasExpected
+
+		case stepCasExpected:
+			o.expected, err = p.current()
+			if err != nil {
+				dslErr = p.missing("expected value")
+				return
+			}
+			p.nextStep = stepFinalPayload
+
+		case stepIncrAutoSelector:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("auto index selector")
+				return
+			}
+			o.autoSel, err = ParseAutoSelector(token)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
+				return
+			}
+			p.nextStep = stepFinalOptionalDelta
+
+		case stepIncrMapSelector:
+			_, err := p.current()
+			if err != nil {
+				dslErr = p.missing("map index selector")
+				return
+			}
+			o.mapSel, err = p.mapSelector()
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid selector", err)
+				return
+			}
+			p.nextStep = stepFinalOptionalDelta
+
+		case stepFinalOptionalDelta:
+			token, err := p.optional()
+			if err != nil {
+				dslErr = err
+				return
+			}
+			// the delta defaults to 1
+			o.delta = 1
+			if token != "" {
+				o.delta, err = strconv.ParseInt(token, 10, 64)
+				if err != nil {
+					dslErr = parsingError(p.raw, p.tok, "invalid delta", err)
+					return
+				}
+			}
+			return
+
+		case stepOptionalTTL:
+			// a ttl=<duration> option may precede the payload. A payload starting with 'ttl=' must be quoted
+			if p.tokErr != nil || p.tok.literal || !strings.HasPrefix(p.tok.value, ttlPrefix) {
+				p.nextStep = stepFinalPayload
+				continue
+			}
+			o.ttl, err = time.ParseDuration(strings.TrimPrefix(p.tok.value, ttlPrefix))
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid ttl", err)
+				return
+			}
+			if o.ttl <= 0 {
+				dslErr = syntaxError(p.raw, p.tok, "ttl must be a positive duration")
 				return
 			}
 			p.nextStep = stepFinalPayload
 
+		case stepOptionalAt:
+			if p.tokErr != nil || p.tok.literal || !strings.HasPrefix(p.tok.value, atPrefix) {
+				p.nextStep = stepFinalOptionalProjection
+				continue
+			}
+			if o.mapSel.Length() > 1 {
+				dslErr = syntaxError(p.raw, p.tok, "point-in-time reads accept a single key")
+				return
+			}
+			at, err := parsePointInTime(strings.TrimPrefix(p.tok.value, atPrefix))
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid point in time", err)
+				return
+			}
+			o.at = &at
+			p.nextStep = stepFinalOptionalProjection
+
+		case stepFinalRetention:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("number of versions")
+				return
+			}
+			o.retention, err = strconv.Atoi(token)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid number of versions", err)
+				return
+			}
+			if o.retention < 1 {
+				dslErr = syntaxError(p.raw, p.tok, "number of versions must be a positive integer")
+				return
+			}
+			return
+
+		case stepFinalVersion:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("version")
+				return
+			}
+			o.version, err = strconv.ParseUint(token, 10, 64)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid version", err)
+				return
+			}
+			return
+
+		case stepFinalOptionalLimit:
+			token, err := p.optional()
+			if err != nil {
+				dslErr = err
+				return
+			}
+			if token != "" {
+				o.limit, err = strconv.Atoi(token)
+				if err != nil {
+					dslErr = parsingError(p.raw, p.tok, "invalid limit", err)
+					return
+				}
+				if o.limit < 0 {
+					dslErr = syntaxError(p.raw, p.tok, "limit must not be negative")
+					return
+				}
+			}
+			return
+
+		case stepFinalOptionalField:
+			o.field, err = p.optional()
+			if err != nil {
+				dslErr = err
+			}
+			return
+
+		case stepFinalValue:
+			o.value, err = p.current()
+			if err != nil {
+				dslErr = p.missing("value")
+				return
+			}
+			p.nextStep = stepFinalOptionalProjection
+
 		case stepFinalOptionalDirection:
-			// optional token, error can be ignored
-			token, _ := p.current()
+			token, err := p.optional()
+			if err != nil {
+				dslErr = err
+				return
+			}
+			if p.isListClause() {
+				p.nextStep = stepOptionalCursor
+				continue
+			}
 			if desc, isDirection := parseDirection(token); isDirection {
 				o.listDesc = desc
-				// if token is not a valid direction and isn't empty, invalid syntax
-			} else if token != "" {
-				dslErr = syntaxError(token, p.remaining(), "invalid direction")
+				p.nextStep = stepOptionalCursor
+				break
+			}
+			// if token is not a valid direction and isn't empty, invalid syntax
+			if token != "" {
+				dslErr = syntaxError(p.raw, p.tok, "invalid direction")
+			}
+			return
+
+		case stepOptionalCursor:
+			if p.tokErr != nil || p.tok.literal {
+				p.nextStep = stepOptionalWhereOrProjection
+				continue
+			}
+			if p.tok.value == keywordCursor {
+				o.paged = true
+			} else if strings.HasPrefix(p.tok.value, afterPrefix) {
+				o.paged = true
+				o.after, err = store.ParseCursor(strings.TrimPrefix(p.tok.value, afterPrefix))
+				if err != nil {
+					dslErr = parsingError(p.raw, p.tok, "invalid cursor", err)
+					return
+				}
+			} else {
+				p.nextStep = stepOptionalWhereOrProjection
+				continue
+			}
+			p.nextStep = stepOptionalWhereOrProjection
+
+		case stepOptionalWhereOrProjection:
+			if p.isWhere() {
+				p.nextStep = stepWhereOperand
+				break
+			}
+			if o.oType == typeCount || o.oType == typeCountKey {
+				token, err := p.optional()
+				if err != nil {
+					dslErr = err
+				} else if token != "" {
+					dslErr = syntaxError(p.raw, p.tok, "expected a where clause")
+				}
+				return
+			}
+			p.nextStep = stepFinalOptionalProjection
+			continue
+
+		case stepWhereOperand:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("where clause operand")
+				return
+			}
+			switch {
+			case !p.tok.literal && token == keywordValue:
+				p.wherePath = nil
+			case !p.tok.literal && strings.HasPrefix(token, pathPrefix):
+				p.wherePath, err = parsePath(token)
+				if err != nil {
+					dslErr = parsingError(p.raw, p.tok, "invalid where clause operand", err)
+					return
+				}
+			default:
+				dslErr = syntaxError(p.raw, p.tok, "invalid where clause operand: expected 'value' or a path like .status")
+				return
+			}
+			p.nextStep = stepWhereOperator
+
+		case stepWhereOperator:
+			p.whereOperator, err = p.current()
+			if err != nil {
+				dslErr = p.missing("where clause operator")
+				return
+			}
+			p.nextStep = stepWhereValue
+
+		case stepWhereValue:
+			token, err := p.current()
+			if err != nil {
+				dslErr = p.missing("where clause value")
+				return
+			}
+			condition, err := store.NewCondition(p.wherePath, p.whereOperator, token)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid where clause", err)
+				return
+			}
+			o.filter = o.filter.And(condition)
+			p.nextStep = stepOptionalAndOrProjection
+
+		case stepOptionalAndOrProjection:
+			if p.tokErr == nil && !p.tok.literal && p.tok.value == keywordAnd {
+				p.nextStep = stepWhereOperand
+				break
+			}
+			if o.oType == typeCount || o.oType == typeCountKey {
+				token, err := p.optional()
+				if err != nil {
+					dslErr = err
+				} else if token != "" {
+					dslErr = syntaxError(p.raw, p.tok, "expected 'and'")
+				}
+				return
+			}
+			p.nextStep = stepFinalOptionalProjection
+			continue
+
+		case stepFinalOptionalProjection:
+			token, err := p.optional()
+			if err != nil {
+				dslErr = err
+				return
+			}
+			if token == "" {
+				return
+			}
+			if !p.isProjection() {
+				dslErr = syntaxError(p.raw, p.tok, "invalid projection: expected a path like .profile.email or fields=name,email")
+				return
+			}
+			o.projection, err = parseProjection(token)
+			if err != nil {
+				dslErr = parsingError(p.raw, p.tok, "invalid projection", err)
 			}
 			return
 
@@ -399,6 +1173,86 @@ func (p parser) Parse() (o Operation, dslErr error) {
 	}
 }
 
+// isProjection reports whether the current token is a projection. A string literal is never a projection
+func (p parser) isProjection() bool {
+	if p.tokErr != nil || p.tok.literal {
+		return false
+	}
+	return strings.HasPrefix(p.tok.value, pathPrefix) || strings.HasPrefix(p.tok.value, fieldsPrefix)
+}
+
+// parseProjection parses a path like .profile.email, or a list of top-level fields like fields=name,email
+func parseProjection(token string) (store.Projection, error) {
+	if strings.HasPrefix(token, fieldsPrefix) {
+		fields := strings.Split(strings.TrimPrefix(token, fieldsPrefix), ",")
+		for _, field := range fields {
+			if field == "" {
+				return store.Projection{}, fmt.Errorf("empty field name in '%s'", token)
+			}
+		}
+		return store.NewFieldsProjection(fields), nil
+	}
+
+	path, err := parsePath(token)
+	if err != nil {
+		return store.Projection{}, err
+	}
+	return store.NewPathProjection(path), nil
+}
+
+// parsePath parses a path of object keys and array indexes like .items.0.price
+func parsePath(token string) ([]string, error) {
+	path := strings.Split(strings.TrimPrefix(token, pathPrefix), ".")
+	for _, segment := range path {
+		if segment == "" {
+			return nil, fmt.Errorf("empty path segment in '%s'", token)
+		}
+	}
+	return path, nil
+}
+
+// parsePointInTime parses a version number like 3, or an RFC 3339 timestamp like 2024-01-02T15:04:05Z
+func parsePointInTime(token string) (store.PointInTime, error) {
+	if version, err := strconv.ParseUint(token, 10, 64); err == nil {
+		if version == 0 {
+			return store.PointInTime{}, fmt.Errorf("versions are numbered from 1")
+		}
+		return store.AtVersion(version), nil
+	}
+	at, err := time.Parse(time.RFC3339Nano, token)
+	if err != nil {
+		return store.PointInTime{}, fmt.Errorf("expected a version number or an RFC 3339 timestamp: %w", err)
+	}
+	return store.AtTime(at), nil
+}
+
+// rangeOption returns the name and value of a key range option, or false if the current token is not one
+func (p parser) rangeOption() (string, string, bool) {
+	if p.tokErr != nil || p.tok.literal {
+		return "", "", false
+	}
+	for _, option := range []string{prefixOption, fromOption, toOption} {
+		if strings.HasPrefix(p.tok.value, option) {
+			return option, strings.TrimPrefix(p.tok.value, option), true
+		}
+	}
+	return "", "", false
+}
+
+// isListClause reports whether the current token starts one of the clauses following the list options
+func (p parser) isListClause() bool {
+	if p.tokErr != nil || p.tok.literal {
+		return false
+	}
+	isCursor := p.tok.value == keywordCursor || strings.HasPrefix(p.tok.value, afterPrefix)
+	return isCursor || p.isWhere() || p.isProjection()
+}
+
+// isWhere reports whether the current token starts a where clause
+func (p parser) isWhere() bool {
+	return p.tokErr == nil && !p.tok.literal && p.tok.value == keywordWhere
+}
+
 // parse a token that may indicate a sort direction, defaulting to false
 func parseDirection(token string) (desc bool, isDirection bool) {
 	if token == "asc" {
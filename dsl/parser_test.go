@@ -1,8 +1,11 @@
 package dsl
 
 import (
+	"fmt"
+	"keybite/store"
 	"keybite/util"
 	"testing"
+	"time"
 )
 
 func TestParseQuery(t *testing.T) {
@@ -255,6 +258,361 @@ func TestParseDropMapIndex(t *testing.T) {
 	util.Equals(t, 0, queryObj.offset)
 }
 
+func TestParseRepageIndex(t *testing.T) {
+	repageText := "repage_index my_index 500"
+	repageParser := newParser(repageText)
+	queryObj, err := repageParser.Parse()
+	util.Ok(t, err)
+
+	util.Equals(t, typeRepageIndex, queryObj.oType)
+	util.Equals(t, "my_index", queryObj.indexName)
+	util.Equals(t, 500, queryObj.pageSize)
+
+	for _, badText := range []string{"repage_index my_index", "repage_index my_index abc", "repage_index my_index 0"} {
+		_, err = newParser(badText).Parse()
+		util.Assert(t, err != nil, "parsing "+badText+" should return an error")
+	}
+}
+
+func TestParseCas(t *testing.T) {
+	casText := "cas auto_default 3 old new value"
+	queryObj, err := newParser(casText).Parse()
+	util.Ok(t, err)
+
+	util.Equals(t, typeCas, queryObj.oType)
+	util.Equals(t, "auto_default", queryObj.indexName)
+	util.Equals(t, uint64(3), queryObj.autoSel.Select())
+	util.Equals(t, "old", queryObj.expected)
+	util.Equals(t, "new value", queryObj.payload)
+
+	_, err = newParser("cas auto_default [1,2] old new").Parse()
+	util.Assert(t, err != nil, "cas with several IDs should fail to parse")
+	_, err = newParser("cas auto_default 3 old").Parse()
+	util.Assert(t, err != nil, "cas without a new value should fail to parse")
+}
+
+func TestParseCasKey(t *testing.T) {
+	casKeyText := `cas_key map_default "the key" "old value" "new value"`
+	queryObj, err := newParser(casKeyText).Parse()
+	util.Ok(t, err)
+
+	util.Equals(t, typeCasKey, queryObj.oType)
+	util.Equals(t, "map_default", queryObj.indexName)
+	util.Equals(t, "the key", queryObj.mapSel.Select())
+	util.Equals(t, "old value", queryObj.expected)
+	util.Equals(t, "new value", queryObj.payload)
+
+	_, err = newParser("cas_key map_default [a,b] old new").Parse()
+	util.Assert(t, err != nil, "cas_key with several keys should fail to parse")
+	_, err = newParser("cas_key map_default theKey").Parse()
+	util.Assert(t, err != nil, "cas_key without an expected value should fail to parse")
+}
+
+func TestParseIncr(t *testing.T) {
+	queryObj, err := newParser("incr auto_default [1:3]").Parse()
+	util.Ok(t, err)
+
+	util.Equals(t, typeIncr, queryObj.oType)
+	util.Equals(t, "auto_default", queryObj.indexName)
+	util.Equals(t, 3, queryObj.autoSel.Length())
+	util.Equals(t, int64(1), queryObj.delta)
+
+	queryObj, err = newParser("incr auto_default 3 -10").Parse()
+	util.Ok(t, err)
+	util.Equals(t, int64(-10), queryObj.delta)
+
+	_, err = newParser("incr auto_default 3 ten").Parse()
+	util.Assert(t, err != nil, "incr with an invalid delta should fail to parse")
+}
+
+func TestParseIncrKey(t *testing.T) {
+	queryObj, err := newParser(`incr_key map_default "page views" 5`).Parse()
+	util.Ok(t, err)
+
+	util.Equals(t, typeIncrKey, queryObj.oType)
+	util.Equals(t, "map_default", queryObj.indexName)
+	util.Equals(t, "page views", queryObj.mapSel.Select())
+	util.Equals(t, int64(5), queryObj.delta)
+
+	queryObj, err = newParser("incr_key map_default [a,b]").Parse()
+	util.Ok(t, err)
+	util.Equals(t, 2, queryObj.mapSel.Length())
+	util.Equals(t, int64(1), queryObj.delta)
+}
+
+func TestParseTTL(t *testing.T) {
+	queryObj, err := newParser("insert_key sessions abc ttl=30m session data").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeInsertKey, queryObj.oType)
+	util.Equals(t, 30*time.Minute, queryObj.ttl)
+	util.Equals(t, "session data", queryObj.payload)
+
+	queryObj, err = newParser("upsert_key sessions abc ttl=1h30m data").Parse()
+	util.Ok(t, err)
+	util.Equals(t, 90*time.Minute, queryObj.ttl)
+
+	// a quoted payload is never a ttl
+	queryObj, err = newParser(`insert_key sessions abc "ttl=30m"`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, time.Duration(0), queryObj.ttl)
+	util.Equals(t, "ttl=30m", queryObj.payload)
+
+	invalid := []string{
+		"insert_key sessions abc ttl=soon data",
+		"insert_key sessions abc ttl=-5m data",
+		"upsert_key sessions abc ttl=5m",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseValueIndex(t *testing.T) {
+	queryObj, err := newParser("create_value_index users users_by_email email").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeCreateValueIndex, queryObj.oType)
+	util.Equals(t, "users", queryObj.indexName)
+	util.Equals(t, "users_by_email", queryObj.valueIndexName)
+	util.Equals(t, "email", queryObj.field)
+
+	queryObj, err = newParser("create_value_index users users_by_value").Parse()
+	util.Ok(t, err)
+	util.Equals(t, "", queryObj.field)
+
+	queryObj, err = newParser(`query_by users_by_email "admin@example.com"`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeQueryBy, queryObj.oType)
+	util.Equals(t, "users_by_email", queryObj.indexName)
+	util.Equals(t, "admin@example.com", queryObj.value)
+
+	invalid := []string{
+		"create_value_index users",
+		"create_value_index users users",
+		"query_by users_by_email",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseProjection(t *testing.T) {
+	value := `{"name":"ada","profile":{"email":"ada@example.com"}}`
+	projections := map[string]string{
+		"query users 12 .profile.email":                 `"ada@example.com"`,
+		"query_key users ada .profile":                  `{"email":"ada@example.com"}`,
+		"list users fields=name":                        `{"name":"ada"}`,
+		"list users 10 fields=profile,name":             `{"profile":{"email":"ada@example.com"},"name":"ada"}`,
+		"list_key users 10 5 .name":                     `"ada"`,
+		"list_key users 10 5 desc fields=name":          `{"name":"ada"}`,
+		"list_key users desc .name":                     `"ada"`,
+		"query_by users_by_email ada@example.com .name": `"ada"`,
+	}
+	for query, expected := range projections {
+		queryObj, err := newParser(query).Parse()
+		util.Ok(t, err)
+		util.Equals(t, store.SingleResult(expected), queryObj.projection.Apply(store.SingleResult(value)))
+	}
+
+	queryObj, err := newParser("list_key users 10 5 desc fields=name").Parse()
+	util.Ok(t, err)
+	util.Equals(t, 10, queryObj.limit)
+	util.Equals(t, 5, queryObj.offset)
+	util.Assert(t, queryObj.listDesc, "list direction should be parsed before a projection")
+
+	invalid := []string{
+		"query users 12 profile",
+		"query users 12 .profile..email",
+		"query users 12 .",
+		"list users fields=",
+		"list users fields=name,,email",
+		"list users 10 5 desc name",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseWhere(t *testing.T) {
+	queryObj, err := newParser(`list orders 50 where .status = "open"`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, 50, queryObj.limit)
+	util.Assert(t, queryObj.filter.Match(`{"status":"open"}`), "open orders should match")
+	util.Assert(t, !queryObj.filter.Match(`{"status":"closed"}`), "closed orders should not match")
+
+	queryObj, err = newParser(`list_key orders 10 5 desc where .total >= 10 and value prefix {"status" fields=total`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, 5, queryObj.offset)
+	util.Assert(t, queryObj.listDesc, "list direction should be parsed before a where clause")
+	util.Assert(t, queryObj.filter.Match(`{"status":"open","total":12}`), "orders over 10 should match")
+	util.Assert(t, !queryObj.filter.Match(`{"status":"open","total":8}`), "orders under 10 should not match")
+	util.Equals(t, store.SingleResult(`{"total":12}`), queryObj.projection.Apply(store.SingleResult(`{"status":"open","total":12}`)))
+
+	queryObj, err = newParser("count_key orders where .total < 10").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeCountKey, queryObj.oType)
+	util.Equals(t, "orders", queryObj.indexName)
+	util.Assert(t, !queryObj.filter.Empty(), "count should be filtered")
+
+	invalid := []string{
+		"list orders where",
+		"list orders where .status",
+		"list orders where .status =",
+		"list orders where status = open",
+		"list orders where .status ~ open",
+		"list orders where .total > ten",
+		"list orders where .status = open or .total > 1",
+		"count orders fields=total",
+		"count orders where .total > 1 .total",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseCursor(t *testing.T) {
+	queryObj, err := newParser("list users 50 cursor").Parse()
+	util.Ok(t, err)
+	util.Equals(t, 50, queryObj.limit)
+	util.Assert(t, queryObj.paged, "cursor should request the cursor of the next page")
+
+	queryObj, err = newParser("list_key users 50 desc after=eyJwIjoiMyIsImsiOiJhIiwiZCI6dHJ1ZX0 where value = a fields=name").Parse()
+	util.Ok(t, err)
+	util.Assert(t, queryObj.paged, "after should request the cursor of the next page")
+	util.Assert(t, queryObj.listDesc, "list direction should be parsed before a cursor")
+	util.Equals(t, "eyJwIjoiMyIsImsiOiJhIiwiZCI6dHJ1ZX0", queryObj.after.String())
+	util.Assert(t, !queryObj.filter.Empty(), "a where clause may follow a cursor")
+
+	_, err = newParser("list users 50 after=invalid!").Parse()
+	util.Assert(t, err != nil, "parsing an invalid cursor should fail")
+}
+
+func TestParseScanKey(t *testing.T) {
+	queryObj, err := newParser("scan_key users prefix=tenant42_").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeScanKey, queryObj.oType)
+	util.Equals(t, "users", queryObj.indexName)
+	util.Equals(t, store.NewKeyRange("tenant42_", "", ""), queryObj.keyRange)
+
+	queryObj, err = newParser("scan_key events from=2024-01 to=2024-03 10 desc cursor where .kind = login .user").Parse()
+	util.Ok(t, err)
+	util.Equals(t, store.NewKeyRange("", "2024-01", "2024-03"), queryObj.keyRange)
+	util.Equals(t, 10, queryObj.limit)
+	util.Assert(t, queryObj.listDesc, "scan direction should be parsed")
+	util.Assert(t, queryObj.paged, "scans should accept cursors")
+	util.Assert(t, !queryObj.filter.Empty(), "scans should accept where clauses")
+
+	invalid := []string{
+		"scan_key users",
+		"scan_key users 10",
+		"scan_key users prefix=a prefix=b",
+		"scan_key users from=b to=a",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseChanges(t *testing.T) {
+	queryObj, err := newParser("changes users since=42 100").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeChanges, queryObj.oType)
+	util.Equals(t, "users", queryObj.indexName)
+	util.Equals(t, uint64(42), queryObj.since)
+	util.Equals(t, 100, queryObj.limit)
+
+	queryObj, err = newParser("changes users since=0").Parse()
+	util.Ok(t, err)
+	util.Equals(t, 0, queryObj.limit)
+
+	queryObj, err = newParser("enable_change_log users").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeEnableChangeLog, queryObj.oType)
+	util.Equals(t, "users", queryObj.indexName)
+
+	invalid := []string{
+		"changes users",
+		"changes users 42",
+		"changes users since=-1",
+		`changes users "since=1"`,
+		"changes users since=1 ten",
+		"changes users since=1 -1",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseHistory(t *testing.T) {
+	queryObj, err := newParser("enable_history users 10").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeEnableHistory, queryObj.oType)
+	util.Equals(t, 10, queryObj.retention)
+
+	queryObj, err = newParser(`history_key users "alice smith"`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeHistoryKey, queryObj.oType)
+	util.Equals(t, "alice smith", queryObj.mapSel.Select())
+
+	queryObj, err = newParser("revert_key users alice 3").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeRevertKey, queryObj.oType)
+	util.Equals(t, uint64(3), queryObj.version)
+
+	queryObj, err = newParser("query_key users alice at=3 .email").Parse()
+	util.Ok(t, err)
+	util.Equals(t, store.AtVersion(3), *queryObj.at)
+	util.Equals(t, store.NewPathProjection([]string{"email"}), queryObj.projection)
+
+	queryObj, err = newParser("query_key users alice at=2024-01-02T15:04:05Z").Parse()
+	util.Ok(t, err)
+	util.Equals(t, store.AtTime(time.Date(2024, 1, 2, 15, 4, 5, 0, time.UTC)), *queryObj.at)
+
+	queryObj, err = newParser("query_key users alice").Parse()
+	util.Ok(t, err)
+	util.Assert(t, queryObj.at == nil, "reads without at= should read the current value")
+
+	invalid := []string{
+		"enable_history users",
+		"enable_history users 0",
+		"history_key users",
+		"history_key users [a,b]",
+		"revert_key users alice",
+		"revert_key users alice latest",
+		"query_key users alice at=0",
+		"query_key users alice at=yesterday",
+		"query_key users [a,b] at=1",
+	}
+	for _, query := range invalid {
+		_, err = newParser(query).Parse()
+		util.Assert(t, err != nil, fmt.Sprintf("parsing '%s' should fail", query))
+	}
+}
+
+func TestParseQuotedKeys(t *testing.T) {
+	queryObj, err := newParser(`insert_key map_default "tenant:42 user\n" a "quoted" payload`).Parse()
+	util.Ok(t, err)
+	util.Assert(t, queryObj.mapSel.Next(), "insert_key selector != DSL selected")
+	util.Equals(t, "tenant:42 user\n", queryObj.mapSel.Select())
+	util.Equals(t, `a "quoted" payload`, queryObj.payload)
+
+	queryObj, err = newParser(`query_key map_default ["a b","c,d",e:f]`).Parse()
+	util.Ok(t, err)
+	keys := []string{}
+	for queryObj.mapSel.Next() {
+		keys = append(keys, queryObj.mapSel.Select())
+	}
+	util.Equals(t, []string{"a b", "c,d", "e:f"}, keys)
+
+	_, err = newParser(`query_key map_default ["a b]`).Parse()
+	util.Assert(t, err != nil, "unterminated quoted key should return an error")
+}
+
 // Test errors
 
 func TestParseKeywordError(t *testing.T) {
@@ -290,3 +648,93 @@ func TestInvalidAutoSelector(t *testing.T) {
 		util.Assert(t, err != nil, "invalid auto selector returns error")
 	}
 }
+
+func TestParseWhitespace(t *testing.T) {
+	queryObj, err := newParser("  list_key   map_default\t10  desc ").Parse()
+	util.Ok(t, err)
+	util.Equals(t, typeListKey, queryObj.oType)
+	util.Equals(t, "map_default", queryObj.indexName)
+	util.Equals(t, 10, queryObj.limit)
+	util.Assert(t, queryObj.listDesc, "list direction != DSL direction")
+
+	queryObj, err = newParser("query  default  [6, 7 ,8]").Parse()
+	util.Ok(t, err)
+	ids := []uint64{}
+	for queryObj.autoSel.Next() {
+		ids = append(ids, queryObj.autoSel.Select())
+	}
+	util.Equals(t, []uint64{6, 7, 8}, ids)
+}
+
+func TestParsePayloadLiterals(t *testing.T) {
+	// bare payloads are kept exactly as written
+	queryObj, err := newParser("insert default  spaced   payload ").Parse()
+	util.Ok(t, err)
+	util.Equals(t, "spaced   payload ", queryObj.payload)
+
+	// a single literal payload is unquoted, keeping surrounding whitespace
+	queryObj, err = newParser(`update_key map_default key "  padded\tvalue\n"`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, "  padded\tvalue\n", queryObj.payload)
+
+	queryObj, err = newParser(`insert default 'single quoted'`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, "single quoted", queryObj.payload)
+
+	// a literal followed by other text is not a single literal, so the payload is kept as written
+	queryObj, err = newParser(`insert default "a" b`).Parse()
+	util.Ok(t, err)
+	util.Equals(t, `"a" b`, queryObj.payload)
+
+	// quoted keys are literals even when they resemble selectors
+	queryObj, err = newParser(`query_key map_default "[not, an array]"`).Parse()
+	util.Ok(t, err)
+	util.Assert(t, queryObj.mapSel.Next(), "query_key selector != DSL selected")
+	util.Equals(t, "[not, an array]", queryObj.mapSel.Select())
+}
+
+func TestParseErrorColumn(t *testing.T) {
+	errorColumns := map[string]int{
+		"unknown my_index":             1,
+		"list  my_index h":             16,
+		"query my_index 1:2":           16,
+		"repage_index my_index 0":      23,
+		"query_key idx \"unterminated": 15,
+		"query_key":                    10,
+		"insert é":                     9,
+	}
+
+	for query, expectedColumn := range errorColumns {
+		_, err := newParser(query).Parse()
+		util.Assert(t, err != nil, "query '"+query+"' should return an error")
+		dslErr, ok := err.(Error)
+		util.Assert(t, ok, "parsing error should be a dsl.Error")
+		util.Equals(t, expectedColumn, dslErr.Column)
+	}
+}
+
+func TestTarget(t *testing.T) {
+	indexName, writes, ok := Target(`insert_key  "my index" :key value`)
+	util.Assert(t, ok, "target of insert_key should be found")
+	util.Equals(t, "my index", indexName)
+	util.Assert(t, writes, "insert_key writes to its index")
+
+	indexName, writes, ok = Target("query users :id")
+	util.Assert(t, ok, "target of query should be found")
+	util.Equals(t, "users", indexName)
+	util.Assert(t, !writes, "query only reads its index")
+
+	for _, input := range []string{"", "unknown users", "insert"} {
+		_, _, ok = Target(input)
+		util.Assert(t, !ok, "target of '"+input+"' should not be found")
+	}
+
+	// every keyword known to the parser must declare whether it writes
+	for keyword := range keywordWrites {
+		_, err := newParser(keyword + " my_index").Parse()
+		if err != nil {
+			dslErr, _ := err.(Error)
+			util.Assert(t, dslErr.Message != "unknown keyword", "keyword '"+keyword+"' is not known to the parser")
+		}
+	}
+}
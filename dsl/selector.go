@@ -13,6 +13,9 @@ Tools for parsing selectors
 
 // ParseAutoSelector parses a string into a selector. Acceptable formats are 6, [6:10], [6, 7, 8]
 func ParseAutoSelector(token string) (store.AutoSelector, error) {
+	if token == "" {
+		return store.EmptySelector(), fmt.Errorf("invalid auto selector: empty selector")
+	}
 	if token[0] == '[' {
 		body, err := StripBrackets(token)
 		if err != nil {
@@ -43,24 +46,80 @@ func ParseAutoSelector(token string) (store.AutoSelector, error) {
 	return &selector, err
 }
 
-// ParseMapSelector parses a selection of map keys
+// ParseMapSelector parses a selection of map keys. Acceptable formats are key, "quoted key", [key1, key2] and
+// ["quoted key", 'key2']. Quoted keys may contain any character, using escapes like \" and \n
 func ParseMapSelector(token string) (store.MapSelector, error) {
+	if token == "" {
+		return &store.MapSingleSelector{}, fmt.Errorf("invalid map selector: empty selector")
+	}
 	// if selection resembles an array, try to create an array selector
 	if token[0] == '[' {
 		body, err := StripBrackets(token)
 		if err != nil {
 			return &store.MapArraySelector{}, fmt.Errorf("invalid map selector: %s", err.Error())
 		}
-		collection := strings.Split(body, ",")
+		collection, err := parseKeyCollection(body)
+		if err != nil {
+			return &store.MapArraySelector{}, fmt.Errorf("invalid map selector: %s", err.Error())
+		}
 		selector := store.NewMapArraySelector(collection)
 		return &selector, nil
 	}
 
 	// else treat it as a single selection
-	selector := store.NewMapSingleSelector(token)
+	key, err := parseKey(token)
+	if err != nil {
+		return &store.MapSingleSelector{}, fmt.Errorf("invalid map selector: %s", err.Error())
+	}
+	selector := store.NewMapSingleSelector(key)
 	return &selector, nil
 }
 
+// parseKey unquotes a quoted map key, bare keys are returned as-is
+func parseKey(token string) (string, error) {
+	if !strings.HasPrefix(token, `"`) && !strings.HasPrefix(token, "'") {
+		return token, nil
+	}
+	key, err := unquoteLiteral(token)
+	if err != nil {
+		return "", fmt.Errorf("invalid quoted key %s: %w", token, err)
+	}
+	return key, nil
+}
+
+// [key1, "key 2"]
+func parseKeyCollection(body string) ([]string, error) {
+	keys := []string{}
+	start := 0
+	var quote byte
+	for i := 0; i <= len(body); i++ {
+		if i < len(body) {
+			switch {
+			case quote != 0 && body[i] == '\\':
+				i++
+				continue
+			case quote != 0 && body[i] == quote:
+				quote = 0
+			case quote == 0 && (body[i] == '"' || body[i] == '\''):
+				quote = body[i]
+			}
+			if quote != 0 || body[i] != ',' {
+				continue
+			}
+		}
+		key, err := parseKey(strings.TrimSpace(body[start:i]))
+		if err != nil {
+			return keys, err
+		}
+		keys = append(keys, key)
+		start = i + 1
+	}
+	if quote != 0 {
+		return keys, fmt.Errorf("unterminated quoted key")
+	}
+	return keys, nil
+}
+
 // StripBrackets removes surrounding square brackets
 func StripBrackets(token string) (string, error) {
 	if !strings.HasSuffix(token, "]") {
@@ -77,7 +136,7 @@ func parseCollection(token string) ([]uint64, error) {
 	strs := strings.Split(token, ",")
 	vals := make([]uint64, len(strs))
 	for i, str := range strs {
-		id, err := strconv.ParseUint(str, 10, 64)
+		id, err := strconv.ParseUint(strings.TrimSpace(str), 10, 64)
 		if err != nil {
 			return vals, fmt.Errorf("error parsing query selector '%s': %w", token, err)
 		}
@@ -93,11 +152,11 @@ func parseRange(token string) (min uint64, max uint64, err error) {
 	if len(parts) != 2 {
 		return 0, 0, fmt.Errorf("invalid range selection: must specify min:max")
 	}
-	min, err = strconv.ParseUint(parts[0], 10, 64)
+	min, err = strconv.ParseUint(strings.TrimSpace(parts[0]), 10, 64)
 	if err != nil {
 		return 0, 0, fmt.Errorf("invalid range selection: min and max must be positive integers")
 	}
-	max, err = strconv.ParseUint(parts[1], 10, 64)
+	max, err = strconv.ParseUint(strings.TrimSpace(parts[1]), 10, 64)
 	if err != nil {
 		return 0, 0, fmt.Errorf("invalid range selection: min and max must be positive integers")
 	}
@@ -0,0 +1,96 @@
+package server
+
+import (
+	"errors"
+	"fmt"
+	"keybite/dsl"
+	"keybite/store"
+	"keybite/store/driver"
+	"strings"
+)
+
+// Error represents a request-level error which prevented a query from executing
+type Error struct {
+	InternalError error
+	Message       string
+	Code          string
+}
+
+func (e Error) Error() string {
+	return e.Message
+}
+
+func (e Error) Unwrap() error {
+	return e.InternalError
+}
+
+// error codes reported in enveloped responses, alongside the codes of store and driver errors
+const (
+	errCodeSyntax             = "ERR_SYNTAX"
+	errCodeCircularDependency = "ERR_CIRCULAR_DEPENDENCY"
+	errCodeDependencyFailed   = "ERR_DEPENDENCY_FAILED"
+	errCodeQueryFailed        = "ERR_QUERY_FAILED"
+	errCodeRolledBack         = "ERR_TRANSACTION_ROLLED_BACK"
+)
+
+// errCircularDependency indicates a query could not be executed because it is part of, or depends on, a
+// circular dependency
+func errCircularDependency(depVars []string) error {
+	return Error{
+		Message: fmt.Sprintf("circular dependency on variable(s) '%s'", strings.Join(depVars, "', '")),
+		Code:    errCodeCircularDependency,
+	}
+}
+
+// errDependencyFailed indicates a query could not be executed because a query it depends on has no result
+func errDependencyFailed(depVar string) error {
+	return Error{
+		Message: fmt.Sprintf("failed executing query with variable ':%s': variable not set in request resolution", depVar),
+		Code:    errCodeDependencyFailed,
+	}
+}
+
+// errRolledBack indicates the writes of a query were discarded because its transaction was rolled back
+func errRolledBack(reason string, err error) error {
+	return Error{
+		Message:       fmt.Sprintf("transaction rolled back: %s", reason),
+		Code:          errCodeRolledBack,
+		InternalError: err,
+	}
+}
+
+// QueryError describes why a query failed in an enveloped response. Column is the character column of a
+// syntax error in the executed query
+type QueryError struct {
+	Code    string `json:"code"`
+	Message string `json:"message"`
+	Column  int    `json:"column,omitempty"`
+}
+
+// describeError finds the outermost structured error in an error chain and describes it for a client
+func describeError(err error) *QueryError {
+	description := &QueryError{
+		Code:    errCodeQueryFailed,
+		Message: err.Error(),
+	}
+
+	for current := err; current != nil; current = errors.Unwrap(current) {
+		switch e := current.(type) {
+		case dsl.Error:
+			description.Code = errCodeSyntax
+			description.Column = e.Column
+			return description
+		case Error:
+			description.Code = e.Code
+			return description
+		case store.Error:
+			description.Code = e.Code
+			return description
+		case driver.Error:
+			description.Code = e.Code
+			return description
+		}
+	}
+
+	return description
+}
@@ -0,0 +1,162 @@
+package server
+
+import (
+	"fmt"
+	"keybite/config"
+	"keybite/dsl"
+	"keybite/store"
+	"keybite/store/driver"
+	"keybite/util/log"
+	"strings"
+	"sync"
+)
+
+// executor executes the queries of a request concurrently, following the dependency graph of the request
+type executor struct {
+	request Request
+	conf    *config.Config
+	driver  driver.StorageDriver
+	// guards results and errs
+	mutex   sync.Mutex
+	results ResultSet
+	// the errors of failed queries by key
+	errs map[string]error
+	// set when a query of a transactional request fails, so the remaining queries are not executed
+	aborted bool
+}
+
+func newExecutor(request Request, conf *config.Config, storageDriver driver.StorageDriver) *executor {
+	return &executor{
+		request: request,
+		conf:    conf,
+		driver:  storageDriver,
+		results: make(ResultSet, request.Len()),
+		errs:    map[string]error{},
+	}
+}
+
+// run executes the queries of the execution graph, starting at most concurrency queries at a time. Queries
+// blocked by circular dependencies are never ready, so they are not executed. Ready queries are started in the
+// order they appear in the request
+func (e *executor) run(waitingOn []int, dependents [][]int, concurrency int) {
+	if concurrency < 1 {
+		concurrency = 1
+	}
+
+	ready := readyQueue{}
+	for i := range e.request.entries {
+		if waitingOn[i] == 0 {
+			ready.push(i)
+		}
+	}
+
+	done := make(chan int)
+	running := 0
+	for ready.len() > 0 || running > 0 {
+		for ready.len() > 0 && running < concurrency {
+			running++
+			go func(position int) {
+				e.resolve(position)
+				done <- position
+			}(ready.pop())
+		}
+
+		finished := <-done
+		running--
+		for _, dependent := range dependents[finished] {
+			waitingOn[dependent]--
+			if waitingOn[dependent] == 0 {
+				ready.push(dependent)
+			}
+		}
+	}
+}
+
+// resolve executes the query at the provided position and records its result. The queries it depends on
+// must already be resolved
+func (e *executor) resolve(position int) {
+	entry := e.request.entries[position]
+
+	e.mutex.Lock()
+	aborted := e.aborted
+	toExecute, err := entry.query.Complete(e.results)
+	e.mutex.Unlock()
+
+	if aborted {
+		e.fail(entry.key, errRolledBack("an earlier query failed", nil))
+		return
+	}
+
+	var result store.Result
+	if err == nil {
+		result, err = dsl.ExecuteWithDriver(toExecute, e.conf, e.driver)
+	}
+
+	if err != nil {
+		e.fail(entry.key, err)
+		return
+	}
+
+	if !strings.HasPrefix(entry.key, NoResultWantedPrefix) {
+		e.mutex.Lock()
+		e.results[entry.key] = result
+		e.mutex.Unlock()
+	}
+}
+
+// fail records the error of a query, and logs it
+func (e *executor) fail(key string, err error) {
+	e.mutex.Lock()
+	e.results[key] = store.EmptyResult()
+	e.errs[key] = err
+	if e.request.transaction {
+		e.aborted = true
+	}
+	e.mutex.Unlock()
+
+	LogQueryErrorInfo(key, err)
+}
+
+// finishTransaction commits the staged writes of a transactional request if every query succeeded, and
+// otherwise rolls them back. When the writes are not committed, the queries which succeeded fail
+func (e *executor) finishTransaction(staging *driver.StagingDriver) {
+	var reason string
+	var cause error
+	for _, entry := range e.request.entries {
+		if err, failed := e.errs[entry.key]; failed {
+			reason = fmt.Sprintf("query ':%s' failed", entry.key)
+			cause = err
+			break
+		}
+	}
+
+	if cause == nil {
+		err := staging.Commit()
+		if err == nil {
+			return
+		}
+		reason = "commit failed"
+		cause = err
+	} else if err := staging.Rollback(); err != nil {
+		log.Warnf("releasing locks after rolling back transaction failed: %s", err.Error())
+	}
+
+	for _, entry := range e.request.entries {
+		if _, failed := e.errs[entry.key]; !failed {
+			e.fail(entry.key, errRolledBack(reason, cause))
+		}
+	}
+}
+
+// envelopes wraps the results and errors of the executed queries in envelopes
+func (e *executor) envelopes() ResultSet {
+	envelopes := make(ResultSet, len(e.results))
+	for key, result := range e.results {
+		if err, failed := e.errs[key]; failed {
+			envelopes[key] = Envelope{Error: describeError(err)}
+			continue
+		}
+		envelopes[key] = Envelope{Value: result}
+	}
+	return envelopes
+}
@@ -48,7 +48,7 @@ func (h QueryHandler) ServeHTTP(w http.ResponseWriter, req *http.Request) {
 	err := decoder.Decode(&request)
 	if err != nil {
 		log.Infof("%s: client %s JSON request could not be decoded: %s", req.RequestURI, req.RemoteAddr, err.Error())
-		errText := "JSON error: could not parse client request. Query object should be a single object with depth 1"
+		errText := "JSON error: could not parse client request. Query object should be a single object with depth 1: " + err.Error()
 		respondError(w, errText, http.StatusBadRequest)
 		return
 	}
@@ -2,11 +2,10 @@ package server
 
 import (
 	"fmt"
-	"keybite/config"
 	"keybite/dsl"
-	"keybite/store"
 	"regexp"
 	"strconv"
+	"strings"
 )
 
 var findVariableRegex = regexp.MustCompile(`\B:\w+`)
@@ -52,8 +51,8 @@ func (q *Query) setQueryFormat() {
 	q.fmt = findVariableRegex.ReplaceAllLiteralString(q.raw, "%s")
 }
 
-// LinkDependencies populates the query's dependency pointers from a
-func (q *Query) LinkDependencies(queries Request) error {
+// LinkDependencies populates the query's dependency pointers from the queries of a request by key
+func (q *Query) LinkDependencies(queries map[string]*Query) error {
 	for _, depVar := range q.depVars {
 		dep, ok := queries[depVar]
 		if !ok {
@@ -76,21 +75,26 @@ func (q *Query) Complete(list ResultSet) (string, error) {
 		if value := list[key]; value.Valid() {
 			variableValues = append(variableValues, list[key].String())
 		} else {
-			return "", fmt.Errorf("failed executing query with variable ':%s': variable not set in request resolution", key)
+			return "", errDependencyFailed(key)
 		}
 	}
 	// have to convert results to interface slice for fmt.Sprintf to work
 	return fmt.Sprintf(q.fmt, strSliceToInterfaceSlice(variableValues)...), nil
 }
 
-// Execute the query and get the result
-func (q Query) Execute(conf *config.Config, results ResultSet) (store.Result, error) {
-	toExecute, err := q.Complete(results)
-	if err != nil {
-		return store.EmptyResult(), err
+// indexAccess returns the index the query reads or modifies, and whether it modifies the index. Queries with
+// a variable in their keyword or index name may access any index, and known is false for them
+func (q Query) indexAccess() (indexName string, writes bool, known bool) {
+	fields := strings.Fields(q.raw)
+	if len(fields) > 2 {
+		fields = fields[:2]
 	}
-
-	return dsl.Execute(toExecute, conf)
+	for _, field := range fields {
+		if findVariableRegex.MatchString(field) {
+			return "", false, false
+		}
+	}
+	return dsl.Target(q.raw)
 }
 
 // StripStringPrefixes removes n characters from each string in the given slice
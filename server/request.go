@@ -1,9 +1,12 @@
 package server
 
 import (
+	"bytes"
+	"encoding/json"
 	"fmt"
 	"keybite/config"
 	"keybite/store"
+	"keybite/store/driver"
 	"keybite/util/log"
 	"strings"
 )
@@ -11,76 +14,401 @@ import (
 // NoResultWantedPrefix should be used in JSON queries to indicate that no response value is desired, but the query should still be executed
 const NoResultWantedPrefix = "_"
 
-// Request is a mapped collection of requests marshalled from JSON
-type Request map[string]*Query
+// request options are set with keys starting with this prefix instead of a query
+const optionPrefix = "$"
 
-// LinkQueryDependencies populates the `deps` field of each request query based on the other queries
-func (r *Request) LinkQueryDependencies() error {
-	for _, q := range *r {
-		err := q.LinkDependencies(*r)
+// OrderOption is the request option selecting the order in which queries are executed
+const OrderOption = "$order"
+
+// TransactionOption is the request option which commits the writes of every query together, or none of them if
+// any query fails
+const TransactionOption = "$transaction"
+
+// EnvelopeOption is the request option which wraps each result in an Envelope, reporting why failed queries failed
+const EnvelopeOption = "$envelope"
+
+// Execution orders for the OrderOption request option
+const (
+	// queries are executed after the queries they depend on, otherwise in the order they appear in the request
+	OrderDependency = "dependency"
+	// queries are executed strictly in the order they appear in the request
+	OrderSequential = "sequential"
+)
+
+// Request is a collection of named queries unmarshalled from a JSON object
+type Request struct {
+	// the queries of the request in the order they appear in the JSON body
+	entries []requestEntry
+	// the queries of the request by key, for resolving variables
+	queries map[string]*Query
+	// the order queries are executed in
+	order string
+	// whether results are wrapped in envelopes
+	envelope bool
+	// whether writes are committed together
+	transaction bool
+}
+
+type requestEntry struct {
+	key   string
+	query *Query
+}
+
+// UnmarshalJSON reads a request from a JSON object, keeping the order of its keys. Keys starting with
+// NoResultWantedPrefix may appear several times, and each of their queries is executed. When any other key
+// appears more than once, the last query replaces the earlier ones
+func (r *Request) UnmarshalJSON(data []byte) error {
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	token, err := decoder.Token()
+	if err != nil {
+		return err
+	}
+	if delim, ok := token.(json.Delim); !ok || delim != '{' {
+		return fmt.Errorf("request must be a JSON object")
+	}
+
+	*r = Request{
+		queries: map[string]*Query{},
+		order:   OrderDependency,
+	}
+	for decoder.More() {
+		token, err := decoder.Token()
 		if err != nil {
 			return err
 		}
+		key := token.(string)
+
+		if strings.HasPrefix(key, optionPrefix) {
+			err = r.setOption(key, decoder)
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		query := &Query{}
+		err = decoder.Decode(query)
+		if err != nil {
+			return fmt.Errorf("invalid query ':%s': %w", key, err)
+		}
+		r.add(key, query)
 	}
-	return nil
+
+	// consume the closing brace
+	_, err = decoder.Token()
+	return err
 }
 
-// ExecuteQueries executes all queries in the request
-// Query dependency pointers must be set before calling this function
-func (r Request) ExecuteQueries(conf *config.Config) ResultSet {
-	results := make(ResultSet, len(r))
-	for key, query := range r {
-		result, err := query.Execute(conf, results)
+// setOption decodes the value of a request option
+func (r *Request) setOption(key string, decoder *json.Decoder) error {
+	switch key {
+	case OrderOption:
+		var order string
+		err := decoder.Decode(&order)
 		if err != nil {
-			log.Infof("error executing query DSL: %s", err.Error())
-			results[key] = store.EmptyResult()
-			continue
+			return fmt.Errorf("invalid value for request option '%s': %w", key, err)
+		}
+		if order != OrderDependency && order != OrderSequential {
+			return fmt.Errorf("invalid value for request option '%s': expected '%s' or '%s', got '%s'", key, OrderDependency, OrderSequential, order)
+		}
+		r.order = order
+		return nil
+	case EnvelopeOption:
+		err := decoder.Decode(&r.envelope)
+		if err != nil {
+			return fmt.Errorf("invalid value for request option '%s': %w", key, err)
+		}
+		return nil
+	case TransactionOption:
+		err := decoder.Decode(&r.transaction)
+		if err != nil {
+			return fmt.Errorf("invalid value for request option '%s': %w", key, err)
+		}
+		return nil
+	default:
+		return fmt.Errorf("unknown request option '%s'", key)
+	}
+}
+
+// add appends a query to the request
+func (r *Request) add(key string, query *Query) {
+	if r.queries == nil {
+		r.queries = map[string]*Query{}
+	}
+	if _, exists := r.queries[key]; exists && !strings.HasPrefix(key, NoResultWantedPrefix) {
+		for i, entry := range r.entries {
+			if entry.key == key {
+				r.entries = append(r.entries[:i], r.entries[i+1:]...)
+				break
+			}
 		}
-		results[key] = result
 	}
+	r.entries = append(r.entries, requestEntry{key: key, query: query})
+	r.queries[key] = query
+}
+
+// Len returns the number of queries in the request
+func (r Request) Len() int {
+	return len(r.entries)
+}
 
-	return results
+// Enveloped indicates if results are wrapped in envelopes
+func (r Request) Enveloped() bool {
+	return r.envelope
 }
 
-type keyList []string
+// Transactional indicates if the writes of the request are committed together
+func (r Request) Transactional() bool {
+	return r.transaction
+}
+
+// Sequential indicates if queries are executed strictly in the order they appear in the request
+func (r Request) Sequential() bool {
+	return r.order == OrderSequential
+}
 
-func (l keyList) contains(key string) bool {
-	for _, member := range l {
-		if member == key {
-			return true
+// LinkQueryDependencies populates the `deps` field of each request query based on the other queries. In
+// sequential requests, queries may only depend on queries which appear before them
+func (r *Request) LinkQueryDependencies() error {
+	seen := map[string]bool{}
+	for _, entry := range r.entries {
+		err := entry.query.LinkDependencies(r.queries)
+		if err != nil {
+			return err
+		}
+		if r.Sequential() {
+			for _, depVar := range entry.query.depVars {
+				if !seen[depVar] {
+					return fmt.Errorf("query ':%s' depends on variable ':%s' which is not declared before it in a sequential request", entry.key, depVar)
+				}
+			}
 		}
+		seen[entry.key] = true
 	}
-	return false
+	return nil
 }
 
-// ResolveQuery resolves a query into a resultset
-func ResolveQuery(key string, q Query, conf *config.Config, results ResultSet, seen keyList) error {
-	seen = append(seen, key)
-	// resolve q's deps
-	for i, dep := range q.deps {
-		depKey := q.depVars[i]
-		if !results.HasKey(depKey) {
-			if seen.contains(depKey) {
-				results[key] = store.EmptyResult()
-				return fmt.Errorf("circular dependency on variable '%s'", depKey)
+// dependencyGraph returns the number of queries each query of the request waits on, and the positions of the
+// queries waiting on each query. In sequential requests, each query waits on the query before it
+// Query dependency pointers must be set before calling this function
+func (r Request) dependencyGraph() (waitingOn []int, dependents [][]int) {
+	waitingOn = make([]int, len(r.entries))
+	dependents = make([][]int, len(r.entries))
+
+	if r.Sequential() {
+		for i := 1; i < len(r.entries); i++ {
+			waitingOn[i] = 1
+			dependents[i-1] = []int{i}
+		}
+		return waitingOn, dependents
+	}
+
+	positions := make(map[*Query][]int, len(r.entries))
+	for i, entry := range r.entries {
+		positions[entry.query] = append(positions[entry.query], i)
+	}
+
+	for i, entry := range r.entries {
+		for _, dep := range entry.query.deps {
+			for _, depPosition := range positions[dep] {
+				waitingOn[i]++
+				dependents[depPosition] = append(dependents[depPosition], i)
 			}
-			err := ResolveQuery(depKey, *dep, conf, results, seen)
-			if err != nil {
-				return err
+		}
+	}
+
+	return waitingOn, dependents
+}
+
+// executionOrder returns the positions of the request's queries in the order they are started when executed
+// one at a time. Queries are sorted topologically by their dependencies, and queries which are ready to execute
+// at the same time are executed in the order they appear in the request. The positions of queries which cannot
+// be executed because they are part of a circular dependency, or depend on one, are returned separately
+// Query dependency pointers must be set before calling this function
+func (r Request) executionOrder() (order []int, blocked []int) {
+	waitingOn, dependents := r.dependencyGraph()
+
+	ready := readyQueue{}
+	for i := range r.entries {
+		if waitingOn[i] == 0 {
+			ready.push(i)
+		}
+	}
+
+	for ready.len() > 0 {
+		next := ready.pop()
+		order = append(order, next)
+
+		for _, dependent := range dependents[next] {
+			waitingOn[dependent]--
+			if waitingOn[dependent] == 0 {
+				ready.push(dependent)
 			}
 		}
 	}
 
-	// resolve q
-	res, err := q.Execute(conf, results)
-	if err != nil {
-		results[key] = store.EmptyResult()
-		return err
+	for i := range r.entries {
+		if waitingOn[i] > 0 {
+			blocked = append(blocked, i)
+		}
 	}
 
-	if !strings.HasPrefix(key, NoResultWantedPrefix) {
-		results[key] = res
+	return order, blocked
+}
+
+// executionGraph extends the dependency graph of the request so that queries reading or modifying the same
+// index run in execution order. Reads of an index wait on the last query modifying it, and queries modifying an
+// index wait on every earlier query reading or modifying it, so executing independent queries concurrently
+// gives the same results as executing them one at a time. Queries modifying an index also modify the indexes
+// derived from it, returned by derivedIndexes, and are executed like queries which may access any index when
+// those cannot be found. The positions of queries blocked by circular dependencies are returned separately, as
+// they are never executed
+// Query dependency pointers must be set before calling this function
+func (r Request) executionGraph(derivedIndexes func(indexName string) ([]string, bool)) (waitingOn []int, dependents [][]int, blocked []int) {
+	order, blocked := r.executionOrder()
+	waitingOn, dependents = r.dependencyGraph()
+	if r.Sequential() {
+		return waitingOn, dependents, blocked
 	}
 
-	return nil
+	tracker := newAccessTracker()
+	for _, position := range order {
+		indexName, writes, known := r.entries[position].query.indexAccess()
+		indexNames := []string{indexName}
+		if known && writes {
+			derived, ok := derivedIndexes(indexName)
+			indexNames = append(indexNames, derived...)
+			known = ok
+		}
+		for _, before := range tracker.access(position, indexNames, writes, !known) {
+			waitingOn[position]++
+			dependents[before] = append(dependents[before], position)
+		}
+	}
+
+	return waitingOn, dependents, blocked
+}
+
+// accessTracker records the queries reading and modifying each index, in execution order
+type accessTracker struct {
+	lastWrite       map[string]int
+	readsSinceWrite map[string][]int
+	// queries which may access any index wait on every earlier query, and every later query waits on them
+	lastBarrier  int
+	sinceBarrier []int
+}
+
+func newAccessTracker() *accessTracker {
+	return &accessTracker{
+		lastWrite:       map[string]int{},
+		readsSinceWrite: map[string][]int{},
+		lastBarrier:     -1,
+	}
+}
+
+// access records an access to indexes, returning the positions of the queries it must wait on
+func (t *accessTracker) access(position int, indexNames []string, writes bool, anyIndex bool) []int {
+	waitOn := []int{}
+	if t.lastBarrier >= 0 {
+		waitOn = append(waitOn, t.lastBarrier)
+	}
+
+	if anyIndex {
+		waitOn = append(waitOn, t.sinceBarrier...)
+		t.lastWrite = map[string]int{}
+		t.readsSinceWrite = map[string][]int{}
+		t.lastBarrier = position
+		t.sinceBarrier = nil
+		return waitOn
+	}
+
+	for _, indexName := range indexNames {
+		if lastWrite, ok := t.lastWrite[indexName]; ok {
+			waitOn = append(waitOn, lastWrite)
+		}
+		if writes {
+			waitOn = append(waitOn, t.readsSinceWrite[indexName]...)
+			t.lastWrite[indexName] = position
+			t.readsSinceWrite[indexName] = nil
+		} else {
+			t.readsSinceWrite[indexName] = append(t.readsSinceWrite[indexName], position)
+		}
+	}
+	t.sinceBarrier = append(t.sinceBarrier, position)
+
+	return waitOn
+}
+
+// derivedIndexLookup returns a function finding the indexes derived from an index with a storage driver, which
+// reads the manifest of each index once
+func derivedIndexLookup(storageDriver driver.StorageDriver) func(indexName string) ([]string, bool) {
+	found := map[string][]string{}
+	return func(indexName string) ([]string, bool) {
+		if derived, ok := found[indexName]; ok {
+			return derived, true
+		}
+		derived, err := store.DerivedIndexes(storageDriver, indexName)
+		if err != nil {
+			log.Warnf("reading the indexes derived from index %s failed, writes to it wait on every other query :: %s", indexName, err.Error())
+			return nil, false
+		}
+		found[indexName] = derived
+		return derived, true
+	}
+}
+
+// readyQueue holds the positions of queries which are ready to execute
+type readyQueue []int
+
+func (q *readyQueue) push(position int) {
+	*q = append(*q, position)
+}
+
+func (q readyQueue) len() int {
+	return len(q)
+}
+
+// pop removes and returns the ready query appearing first in the request
+func (q *readyQueue) pop() int {
+	first := 0
+	for i := range *q {
+		if (*q)[i] < (*q)[first] {
+			first = i
+		}
+	}
+	position := (*q)[first]
+	*q = append((*q)[:first], (*q)[first+1:]...)
+	return position
+}
+
+// ExecuteQueries executes all queries in the request, logging query errors, which are also reported in the
+// results of enveloped requests. Queries are started in execution order, and queries which don't depend on
+// each other or access the same index are executed concurrently using the provided storage driver, up to the
+// provided number of queries at a time. The writes of transactional requests are staged until every query has
+// succeeded, then committed together, and if any query fails every query of the request fails
+// Query dependency pointers must be set before calling this function
+func (r Request) ExecuteQueries(conf *config.Config, storageDriver driver.StorageDriver, concurrency int) ResultSet {
+	var staging *driver.StagingDriver
+	if r.transaction {
+		staging = store.NewTransaction(storageDriver)
+		storageDriver = staging
+	}
+
+	e := newExecutor(r, conf, driver.NewCoalescingDriver(storageDriver))
+	waitingOn, dependents, blocked := r.executionGraph(derivedIndexLookup(storageDriver))
+
+	for _, i := range blocked {
+		entry := r.entries[i]
+		e.fail(entry.key, errCircularDependency(entry.query.depVars))
+	}
+
+	e.run(waitingOn, dependents, concurrency)
+	if staging != nil {
+		e.finishTransaction(staging)
+	}
+
+	if r.envelope {
+		return e.envelopes()
+	}
+	return e.results
 }
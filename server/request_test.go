@@ -0,0 +1,397 @@
+package server
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"keybite/config"
+	"keybite/util"
+	"os"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+func newTestConf(t *testing.T) (config.Config, func()) {
+	dataDir, err := ioutil.TempDir("", "keybite_server_testing")
+	util.Ok(t, err)
+
+	conf := config.Config(map[string]string{
+		"AUTO_PAGE_SIZE":   "100",
+		"MAP_PAGE_SIZE":    "1000",
+		"DRIVER":           "filesystem",
+		"DATA_DIR":         dataDir,
+		"ENVIRONMENT":      "linux",
+		"LOG_LEVEL":        "info",
+		"PAGE_EXTENSION":   ".kb",
+		"LOCK_DURATION_FS": "50",
+	})
+	return conf, func() { os.RemoveAll(dataDir) }
+}
+
+func decodeRequest(t *testing.T, body string) Request {
+	request := Request{}
+	err := json.Unmarshal([]byte(body), &request)
+	util.Ok(t, err)
+	err = request.LinkQueryDependencies()
+	util.Ok(t, err)
+	return request
+}
+
+func orderedKeys(r Request, positions []int) []string {
+	keys := []string{}
+	for _, i := range positions {
+		keys = append(keys, r.entries[i].key)
+	}
+	return keys
+}
+
+func TestRequestKeepsDocumentOrder(t *testing.T) {
+	request := decodeRequest(t, `{"c": "count a", "_": "count b", "a": "count c", "_": "count d", "c": "count e"}`)
+	util.Equals(t, 4, request.Len())
+	util.Equals(t, []string{"_", "a", "_", "c"}, orderedKeys(request, []int{0, 1, 2, 3}))
+	util.Equals(t, "count b", request.entries[0].query.raw)
+	util.Equals(t, "count e", request.entries[3].query.raw)
+	util.Assert(t, !request.Sequential(), "requests are dependency ordered by default")
+}
+
+func TestRequestOptions(t *testing.T) {
+	request := decodeRequest(t, `{"a": "count a", "$order": "sequential"}`)
+	util.Assert(t, request.Sequential(), "request with sequential order option should be sequential")
+	util.Equals(t, 1, request.Len())
+
+	invalid := []string{
+		`{"$order": "random"}`,
+		`{"$order": 1}`,
+		`{"$envelope": "yes"}`,
+		`{"$transaction": 1}`,
+		`{"$unknown": "option"}`,
+		`{"a": 1}`,
+		`["count a"]`,
+	}
+	for _, body := range invalid {
+		err := json.Unmarshal([]byte(body), &Request{})
+		util.Assert(t, err != nil, "decoding request "+body+" should return an error")
+	}
+}
+
+func TestExecutionOrder(t *testing.T) {
+	request := decodeRequest(t, `{
+		"d": "insert x :b :a",
+		"a": "insert x a",
+		"b": "insert x :a",
+		"e": "insert x e",
+		"c": "insert x c"
+	}`)
+	order, blocked := request.executionOrder()
+	util.Equals(t, []string{"a", "b", "d", "e", "c"}, orderedKeys(request, order))
+	util.Equals(t, 0, len(blocked))
+
+	// the order is the same every time
+	for i := 0; i < 20; i++ {
+		repeated, _ := request.executionOrder()
+		util.Equals(t, order, repeated)
+	}
+}
+
+func TestExecutionOrderCircularDependency(t *testing.T) {
+	request := decodeRequest(t, `{
+		"a": "insert x :b",
+		"b": "insert x :a",
+		"c": "insert x :a",
+		"d": "insert x d",
+		"e": "insert x :e"
+	}`)
+	order, blocked := request.executionOrder()
+	util.Equals(t, []string{"d"}, orderedKeys(request, order))
+	util.Equals(t, []string{"a", "b", "c", "e"}, orderedKeys(request, blocked))
+}
+
+func TestSequentialExecutionOrder(t *testing.T) {
+	request := decodeRequest(t, `{"$order": "sequential", "b": "insert x b", "a": "insert x :b", "c": "insert x c"}`)
+	order, blocked := request.executionOrder()
+	util.Equals(t, []string{"b", "a", "c"}, orderedKeys(request, order))
+	util.Equals(t, 0, len(blocked))
+
+	request = Request{}
+	err := json.Unmarshal([]byte(`{"$order": "sequential", "a": "insert x :b", "b": "insert x b"}`), &request)
+	util.Ok(t, err)
+	err = request.LinkQueryDependencies()
+	util.Assert(t, err != nil, "sequential query depending on a later query should return an error")
+}
+
+func TestHandleRequestOrder(t *testing.T) {
+	conf, cleanup := newTestConf(t)
+	defer cleanup()
+
+	setup := decodeRequest(t, `{
+		"$order": "sequential",
+		"_": "create_auto_index users",
+		"_": "create_map_index user_names"
+	}`)
+	_, err := HandleRequest(&setup, &conf)
+	util.Ok(t, err)
+
+	for i := 0; i < 5; i++ {
+		request := decodeRequest(t, `{
+			"name": "insert_key user_names :first Luke",
+			"first": "insert users luke@skywalker.net",
+			"second": "insert users leia@organa.net",
+			"count": "count users"
+		}`)
+		results, err := HandleRequest(&request, &conf)
+		util.Ok(t, err)
+
+		firstID := uint64(i*2 + 1)
+		util.Equals(t, strconv.FormatUint(firstID, 10), results["first"].String())
+		util.Equals(t, strconv.FormatUint(firstID+1, 10), results["second"].String())
+		util.Equals(t, strconv.FormatUint(firstID, 10), results["name"].String())
+		util.Equals(t, strconv.FormatUint(firstID+1, 10), results["count"].String())
+	}
+}
+
+func TestExecutionGraphIndexAccess(t *testing.T) {
+	request := decodeRequest(t, `{
+		"a": "insert users a",
+		"b": "query users 1",
+		"c": "count users",
+		"d": "insert users d",
+		"e": "insert names e",
+		"op": "count ops",
+		"f": ":op users 1",
+		"g": "query names 1"
+	}`)
+	waitingOn, dependents, blocked := request.executionGraph(noDerivedIndexes)
+	util.Equals(t, 0, len(blocked))
+
+	// reads wait on the last write, writes wait on the reads before them, and queries with a variable keyword
+	// wait on every earlier query
+	util.Equals(t, []int{0, 1, 1, 3, 0, 0, 7, 1}, waitingOn)
+	util.Equals(t, []int{1, 2, 3, 6}, dependents[0])
+	util.Equals(t, []int{3, 6}, dependents[1])
+	util.Equals(t, []int{3, 6}, dependents[2])
+	util.Equals(t, []int{6}, dependents[3])
+	util.Equals(t, []int{6}, dependents[4])
+	util.Equals(t, []int{6, 6}, dependents[5])
+	util.Equals(t, []int{7}, dependents[6])
+}
+
+func noDerivedIndexes(indexName string) ([]string, bool) {
+	return nil, true
+}
+
+// test that writes to an index are ordered with accesses to the indexes derived from it
+func TestExecutionGraphDerivedIndexes(t *testing.T) {
+	request := decodeRequest(t, `{
+		"a": "list users.changes",
+		"b": "upsert_key users a 1",
+		"c": "query_key users_by_value 1",
+		"d": "upsert_key names a 1",
+		"e": "count users"
+	}`)
+	derivedIndexes := func(indexName string) ([]string, bool) {
+		if indexName == "names" {
+			return nil, false
+		}
+		return []string{indexName + ".changes", "users_by_value"}, true
+	}
+	waitingOn, dependents, blocked := request.executionGraph(derivedIndexes)
+	util.Equals(t, 0, len(blocked))
+
+	// writes to an index whose derived indexes cannot be found wait on every earlier query
+	util.Equals(t, []int{0, 1, 1, 3, 1}, waitingOn)
+	util.Equals(t, []int{1, 3}, dependents[0])
+	util.Equals(t, []int{2, 3}, dependents[1])
+	util.Equals(t, []int{3}, dependents[2])
+	util.Equals(t, []int{4}, dependents[3])
+}
+
+func TestHandleRequestConcurrent(t *testing.T) {
+	conf, cleanup := newTestConf(t)
+	defer cleanup()
+	conf["QUERY_CONCURRENCY"] = "4"
+
+	setup := decodeRequest(t, `{"_": "create_auto_index users", "_": "create_map_index emails"}`)
+	_, err := HandleRequest(&setup, &conf)
+	util.Ok(t, err)
+
+	body := "{"
+	for i := 0; i < 20; i++ {
+		id := strconv.Itoa(i)
+		body += `"user` + id + `": "insert users user` + id + `", `
+		body += `"email` + id + `": "insert_key emails user` + id + `@example.com :user` + id + `", `
+		body += `"query` + id + `": "query users :user` + id + `", `
+	}
+	body += `"count": "count users"}`
+
+	request := decodeRequest(t, body)
+	results, err := HandleRequest(&request, &conf)
+	util.Ok(t, err)
+
+	for i := 0; i < 20; i++ {
+		id := strconv.Itoa(i)
+		util.Equals(t, strconv.Itoa(i+1), results["user"+id].String())
+		util.Equals(t, "user"+id+"@example.com", results["email"+id].String())
+		util.Equals(t, "user"+id, results["query"+id].String())
+	}
+	util.Equals(t, "20", results["count"].String())
+
+	conf["QUERY_CONCURRENCY"] = "0"
+	_, err = HandleRequest(&request, &conf)
+	util.Assert(t, err != nil, "invalid concurrency should return an error")
+}
+
+func TestHandleRequestEnvelope(t *testing.T) {
+	conf, cleanup := newTestConf(t)
+	defer cleanup()
+
+	// the missing key belongs to a page which exists
+	setup := decodeRequest(t, `{"_": "create_auto_index users", "_": "create_map_index emails", "_": "insert_key emails somebody 1"}`)
+	_, err := HandleRequest(&setup, &conf)
+	util.Ok(t, err)
+
+	request := decodeRequest(t, `{
+		"$envelope": true,
+		"id": "insert users luke",
+		"user": "query users :id",
+		"missingKey": "query_key emails nobody",
+		"missingIndex": "query planets 1",
+		"syntax": "query users [1:",
+		"dependent": "query users :missingIndex",
+		"circleA": "query users :circleB",
+		"circleB": "query users :circleA",
+		"_": "insert users leia"
+	}`)
+	results, err := HandleRequest(&request, &conf)
+	util.Ok(t, err)
+
+	codes := map[string]string{}
+	for key, result := range results {
+		envelope := result.(Envelope)
+		if envelope.Error != nil {
+			codes[key] = envelope.Error.Code
+		}
+	}
+	util.Equals(t, map[string]string{
+		"missingKey":   "ERR_KEY_NOT_EXIST",
+		"missingIndex": "ERR_INDEX_NOT_EXIST",
+		"syntax":       "ERR_SYNTAX",
+		"dependent":    "ERR_DEPENDENCY_FAILED",
+		"circleA":      "ERR_CIRCULAR_DEPENDENCY",
+		"circleB":      "ERR_CIRCULAR_DEPENDENCY",
+	}, codes)
+	util.Equals(t, 13, results["syntax"].(Envelope).Error.Column)
+	util.Assert(t, results["user"].Valid(), "successful query envelope should be valid")
+	util.Assert(t, !results["missingKey"].Valid(), "failed query envelope should not be valid")
+	util.Equals(t, "Key 'nobody' not found in index 'emails'", results["missingKey"].(Envelope).Error.Message)
+
+	data, err := json.Marshal(map[string]interface{}{"id": results["id"], "syntax": results["syntax"]})
+	util.Ok(t, err)
+	util.Equals(t, `{"id":{"value":1},"syntax":{"error":{"code":"ERR_SYNTAX","message":"Syntax error at column 13 '[1:': invalid selector","column":13}}}`, string(data))
+
+	// without the envelope option, failed queries are null
+	request = decodeRequest(t, `{"missingKey": "query_key emails nobody"}`)
+	results, err = HandleRequest(&request, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "", results["missingKey"].String())
+}
+
+func TestHandleRequestTransaction(t *testing.T) {
+	conf, cleanup := newTestConf(t)
+	defer cleanup()
+
+	setup := decodeRequest(t, `{"_": "create_auto_index users", "_": "create_map_index emails", "_": "insert_key emails taken@example.com 0"}`)
+	_, err := HandleRequest(&setup, &conf)
+	util.Ok(t, err)
+
+	// a failed query rolls back every write of the request
+	request := decodeRequest(t, `{
+		"$transaction": true,
+		"$envelope": true,
+		"userId": "insert users luke",
+		"_": "insert_key emails taken@example.com :userId"
+	}`)
+	results, err := HandleRequest(&request, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "ERR_TRANSACTION_ROLLED_BACK", results["userId"].(Envelope).Error.Code)
+	util.Equals(t, "ERR_KEY_ALREADY_EXIST", results["_"].(Envelope).Error.Code)
+
+	count := decodeRequest(t, `{"users": "count users", "email": "query_key emails taken@example.com"}`)
+	results, err = HandleRequest(&count, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "0", results["users"].String())
+	util.Equals(t, "0", results["email"].String())
+
+	// queries of a transaction read their own staged writes, and are committed together
+	request = decodeRequest(t, `{
+		"$transaction": true,
+		"userId": "insert users leia",
+		"email": "insert_key emails leia@example.com :userId",
+		"user": "query users :userId",
+		"count": "count users"
+	}`)
+	results, err = HandleRequest(&request, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "1", results["userId"].String())
+	util.Equals(t, "leia", results["user"].String())
+	util.Equals(t, "1", results["count"].String())
+
+	check := decodeRequest(t, `{"email": "query_key emails leia@example.com"}`)
+	results, err = HandleRequest(&check, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "1", results["email"].String())
+
+	// creating indexes cannot be part of a transaction
+	request = decodeRequest(t, `{"$transaction": true, "$envelope": true, "_": "create_auto_index planets"}`)
+	results, err = HandleRequest(&request, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "ERR_NOT_TRANSACTIONAL", results["_"].(Envelope).Error.Code)
+}
+
+// writes which go through the write-ahead log outside of transactions are staged by transactions
+func TestHandleRequestTransactionLoggedWrites(t *testing.T) {
+	conf, cleanup := newTestConf(t)
+	defer cleanup()
+
+	setup := decodeRequest(t, `{
+		"$order": "sequential",
+		"_": "create_map_index settings",
+		"_": "create_auto_index users",
+		"_": "enable_change_log users",
+		"_": "create_map_index emails",
+		"_": "enable_history emails 5",
+		"_": "create_map_index colors",
+		"_": "create_value_index colors colors_by_value"
+	}`)
+	_, err := HandleRequest(&setup, &conf)
+	util.Ok(t, err)
+
+	request := decodeRequest(t, `{
+		"$transaction": true,
+		"$envelope": true,
+		"multi": "upsert_key settings [a, b] multi",
+		"changeLog": "insert users luke",
+		"history": "upsert_key emails luke luke@example.com",
+		"valueIndex": "upsert_key colors sky blue"
+	}`)
+	results, err := HandleRequest(&request, &conf)
+	util.Ok(t, err)
+	for key, result := range results {
+		envelope := result.(Envelope)
+		util.Assert(t, envelope.Error == nil, "transactional query %s should succeed, got %v", key, envelope.Error)
+	}
+
+	check := decodeRequest(t, `{
+		"a": "query_key settings a",
+		"b": "query_key settings b",
+		"changes": "changes users since=0",
+		"history": "history_key emails luke",
+		"byValue": "query_by colors_by_value blue"
+	}`)
+	results, err = HandleRequest(&check, &conf)
+	util.Ok(t, err)
+	util.Equals(t, "multi", results["a"].String())
+	util.Equals(t, "multi", results["b"].String())
+	util.Assert(t, strings.Contains(results["changes"].String(), "luke"), "the change log should record the transactional insert, got %s", results["changes"].String())
+	util.Assert(t, strings.Contains(results["history"].String(), "luke@example.com"), "the history should record the transactional upsert, got %s", results["history"].String())
+	util.Assert(t, strings.Contains(results["byValue"].String(), "sky"), "the value index should record the transactional upsert, got %s", results["byValue"].String())
+}
@@ -11,6 +11,25 @@ type NullableString struct {
 // ResultSet is a set of query results used when serving the JSON API
 type ResultSet map[string]store.Result
 
+// Envelope holds either the result of a query or the reason it failed, for requests using EnvelopeOption
+type Envelope struct {
+	Value store.Result `json:"value,omitempty"`
+	Error *QueryError  `json:"error,omitempty"`
+}
+
+// String returns the string encoding of the query result, which is empty if the query failed
+func (e Envelope) String() string {
+	if e.Value == nil {
+		return ""
+	}
+	return e.Value.String()
+}
+
+// Valid indicates whether the query was resolved successfully
+func (e Envelope) Valid() bool {
+	return e.Error == nil && e.Value != nil && e.Value.Valid()
+}
+
 // MarshalJSON makes the string fulfill the Marshaler interface
 func (s NullableString) MarshalJSON() ([]byte, error) {
 	if !s.valid {
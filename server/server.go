@@ -4,29 +4,61 @@ import (
 	"errors"
 	"fmt"
 	"keybite/config"
+	"keybite/store/driver"
 	"keybite/util/log"
 	"strings"
 )
 
+// the number of queries of a request executed at the same time when QUERY_CONCURRENCY is not configured
+const defaultQueryConcurrency = 8
+
 // HandleRequest handles a request and returns a resultset or a fatal error
-// if the request could not be completed
+// if the request could not be completed. Queries are executed after the queries they depend on, and otherwise
+// in the order they appear in the request, or strictly in request order for sequential requests. Queries which
+// don't depend on each other are executed concurrently, sharing reads of the same pages
 func HandleRequest(request *Request, conf *config.Config) (ResultSet, error) {
-	response := make(ResultSet)
 	err := request.LinkQueryDependencies()
 	if err != nil {
 		fatalErr := fmt.Errorf("error linking query dependencies: %s", err.Error())
-		return response, fatalErr
+		return make(ResultSet), fatalErr
+	}
+
+	concurrency, err := queryConcurrency(conf)
+	if err != nil {
+		return make(ResultSet), err
+	}
+
+	storageDriver, err := driver.GetConfiguredDriver(conf)
+	if err != nil {
+		return make(ResultSet), err
 	}
 
-	seen := keyList{}
-	for key, query := range *request {
-		err := ResolveQuery(key, *query, conf, response, seen)
-		if err != nil {
-			LogQueryErrorInfo(key, err)
-			continue
-		}
+	results := request.ExecuteQueries(conf, storageDriver, concurrency)
+	logPageCacheStats(storageDriver)
+	return results, nil
+}
+
+// logPageCacheStats logs the counters of the page cache shared by the requests of the process, if pages are cached
+func logPageCacheStats(storageDriver driver.StorageDriver) {
+	cachingDriver, ok := storageDriver.(*driver.CachingDriver)
+	if !ok {
+		return
+	}
+	stats := cachingDriver.Stats()
+	log.Debugf("page cache :: %d hits, %d misses, %d revalidations, %d evictions, %d pages cached in %d bytes",
+		stats.Hits, stats.Misses, stats.Revalidations, stats.Evictions, stats.Pages, stats.Bytes)
+}
+
+// queryConcurrency returns the maximum number of queries of a request executed at the same time
+func queryConcurrency(conf *config.Config) (int, error) {
+	if conf.GetStringOrEmpty("QUERY_CONCURRENCY") == "" {
+		return defaultQueryConcurrency, nil
+	}
+	concurrency, err := conf.GetInt("QUERY_CONCURRENCY")
+	if err != nil || concurrency < 1 {
+		return 0, fmt.Errorf("invalid QUERY_CONCURRENCY from environment: must be a positive integer")
 	}
-	return response, nil
+	return concurrency, nil
 }
 
 // StartConfiguredServer starts the appropriate server based on the environment env variable
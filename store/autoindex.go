@@ -12,14 +12,31 @@ type AutoIndex struct {
 	Name     string
 	pageSize int
 	driver   driver.StorageDriver
+	// the value indexes updated by writes to the index
+	valueIndexes []driver.ValueIndex
+	// whether writes to the index are recorded in its change log
+	changeLog bool
 }
 
-// NewAutoIndex returns an index object, validating that index data exists in the data directory
-func NewAutoIndex(name string, driver driver.StorageDriver, pageSize int) (AutoIndex, error) {
+// NewAutoIndex returns an index object, validating that index data exists in the data directory.
+// The page size recorded in the index manifest takes precedence over the provided page size, and writes
+// interrupted before they were complete are recovered from the write-ahead log of the index
+func NewAutoIndex(name string, storageDriver driver.StorageDriver, pageSize int) (AutoIndex, error) {
+	manifest, err := openManifest(storageDriver, name, driver.KindAuto, pageSize)
+	if err != nil {
+		return AutoIndex{}, err
+	}
+	err = recoverWriteAheadLog(storageDriver, name, manifest)
+	if err != nil {
+		return AutoIndex{}, err
+	}
+
 	return AutoIndex{
-		Name:     name,
-		pageSize: pageSize,
-		driver:   driver,
+		Name:         name,
+		pageSize:     manifest.PageSize,
+		driver:       storageDriver,
+		valueIndexes: manifest.ValueIndexes,
+		changeLog:    manifest.ChangeLog,
 	}, nil
 }
 
@@ -31,20 +48,59 @@ func (i AutoIndex) readPage(pageID uint64) (Page, error) {
 		return Page{}, err
 	}
 
-	return Page{
+	page := Page{
 		vals:        vals,
 		name:        pageIDStr,
 		orderedKeys: orderedKeys,
-	}, nil
+	}
+	if i.tracksChanges() {
+		page.track()
+	}
+	return page, nil
 }
 
 // write a page to storage using a mutex for concurrency safety
 func (i AutoIndex) writePage(p Page) error {
 	return wrapInWriteLock(i.driver, i.Name, func() error {
-		return i.driver.WritePage(p.vals, p.orderedKeys, p.name, i.Name)
+		return i.persistPage(p)
 	})
 }
 
+// tracksChanges indicates whether the pages of the index record their modified records
+func (i AutoIndex) tracksChanges() bool {
+	return len(i.valueIndexes) > 0 || i.changeLog
+}
+
+// logsWrite reports whether a write of a number of records goes through the write-ahead log of the index,
+// because it may write several pages, or because the driver writes conditionally and the write is retried on
+// conflicts. Writes staged for a transaction are committed by the transaction
+func (i AutoIndex) logsWrite(records int) bool {
+	return !i.driver.IsStaged() && (records > 1 || i.tracksChanges() || i.driver.WritesConditionally())
+}
+
+// logged runs a write through the write-ahead log of the index
+func (i AutoIndex) logged(write func(i AutoIndex) (Result, error)) (Result, error) {
+	return withWriteAheadLog(i.driver, i.Name, func(staging driver.StorageDriver) (Result, error) {
+		i.driver = staging
+		return write(i)
+	})
+}
+
+// persistPage writes a page to storage, then applies its modified records to the value indexes and change log
+// of the index. The caller must hold the index write lock
+func (i AutoIndex) persistPage(p Page) error {
+	err := i.driver.WritePage(p.vals, p.orderedKeys, p.name, i.Name)
+	if err != nil || !i.tracksChanges() {
+		return err
+	}
+	changes := p.takeChanges()
+	err = updateValueIndexes(i.driver, i.valueIndexes, changes)
+	if err != nil || !i.changeLog {
+		return err
+	}
+	return appendChanges(i.driver, i.Name, changes)
+}
+
 // Query queries the index for the provided ID
 func (i AutoIndex) Query(s AutoSelector) (Result, error) {
 	// if there are multiple query selections, return a collection result
@@ -122,11 +178,15 @@ func (i AutoIndex) getLatestPage() (Page, uint64, error) {
 			return Page{}, 0, fmt.Errorf("error determining page ID from filename '%s' :: %w", fileName, err)
 		}
 
-		return Page{
+		page := Page{
 			vals:        vals,
 			name:        fileName,
 			orderedKeys: orderedKeys,
-		}, pageID, nil
+		}
+		if i.tracksChanges() {
+			page.track()
+		}
+		return page, pageID, nil
 	}
 
 	// else create the initial page
@@ -147,11 +207,17 @@ func (i AutoIndex) createEmptyPage(id uint64) (Page, error) {
 		return Page{}, err
 	}
 	page := EmptyPage(fileName)
+	if i.tracksChanges() {
+		page.track()
+	}
 	return page, nil
 }
 
 // Insert a value into this index's latest page, returning its ID
 func (i AutoIndex) Insert(val string) (result Result, err error) {
+	if i.logsWrite(1) {
+		return i.logged(func(i AutoIndex) (Result, error) { return i.Insert(val) })
+	}
 	latestPage, latestPageID, err := i.getLatestPage()
 	if err != nil {
 		return
@@ -183,6 +249,9 @@ func (i AutoIndex) Insert(val string) (result Result, err error) {
 
 // Update a value stored in the index. Attempting to update a value not yet stored returns an error
 func (i AutoIndex) Update(s AutoSelector, newVal string) (Result, error) {
+	if i.logsWrite(s.Length()) {
+		return i.logged(func(i AutoIndex) (Result, error) { return i.Update(s, newVal) })
+	}
 	// if there are multiple query selections, update all
 	if s.Length() > 1 {
 		insertedIDs := make(CollectionResult, 0, s.Length())
@@ -268,6 +337,9 @@ func (i AutoIndex) Update(s AutoSelector, newVal string) (Result, error) {
 
 // Delete a value stored in the autoindex
 func (i AutoIndex) Delete(s AutoSelector) (Result, error) {
+	if i.logsWrite(s.Length()) {
+		return i.logged(func(i AutoIndex) (Result, error) { return i.Delete(s) })
+	}
 	if s.Length() > 1 {
 		deletedIDs := make(CollectionResult, 0, s.Length())
 		var lastPageID uint64
@@ -351,9 +423,50 @@ func (i AutoIndex) Delete(s AutoSelector) (Result, error) {
 
 // List a subset of results from the index
 func (i AutoIndex) List(limit, offset int, desc bool) (ListResult, error) {
+	return i.ListWhere(limit, offset, desc, Filter{})
+}
+
+// ListWhere lists a subset of the records matching a filter. The filter is applied while the pages are read,
+// and the limit and offset apply to the matching records
+func (i AutoIndex) ListWhere(limit, offset int, desc bool, f Filter) (ListResult, error) {
+	results, _, err := i.listFrom(Cursor{}, limit, offset, desc, f)
+	return results, err
+}
+
+// ListAfter lists the records matching a filter which follow a cursor, skipping the pages before it without
+// reading them. The result holds the cursor of the next page when the limit was reached
+func (i AutoIndex) ListAfter(after Cursor, limit, offset int, desc bool, f Filter) (PagedListResult, error) {
+	err := after.checkDirection(desc)
+	if err != nil {
+		return PagedListResult{}, err
+	}
+	results, last, err := i.listFrom(after, limit, offset, desc, f)
+	if err != nil {
+		return PagedListResult{}, err
+	}
+	paged := PagedListResult{Items: results}
+	if limit > 0 && len(results) == limit {
+		paged.Next = &last
+	}
+	return paged, nil
+}
+
+// listFrom lists the records following a cursor, returning the cursor of the last record listed
+func (i AutoIndex) listFrom(after Cursor, limit, offset int, desc bool, f Filter) (ListResult, Cursor, error) {
+	var afterPageID, afterID uint64
+	if after.started() {
+		var pageErr, keyErr error
+		afterPageID, pageErr = strconv.ParseUint(after.page, 10, 64)
+		afterID, keyErr = strconv.ParseUint(after.key, 10, 64)
+		if pageErr != nil || keyErr != nil {
+			return ListResult{}, after, errInvalidCursor(after.String(), fmt.Errorf("cursor does not belong to an auto index"))
+		}
+	}
+	last := after
+
 	pageNames, err := i.driver.ListPages(i.Name, desc)
 	if err != nil {
-		return ListResult{}, err
+		return ListResult{}, last, err
 	}
 
 	// keep track of the number of records read for limit
@@ -372,17 +485,23 @@ PageLoop:
 			// filename could not be parsed
 			err = errBadData(i.Name, fileName, err)
 			log.Error(err.Error())
-			return ListResult{}, err
+			return ListResult{}, last, err
+		}
+
+		// pages before the cursor are never read
+		if after.started() && ((!desc && pageID < afterPageID) || (desc && pageID > afterPageID)) {
+			continue PageLoop
 		}
 
 		page, err := i.readPage(pageID)
 		if err != nil {
-			return ListResult{}, err
+			return ListResult{}, last, err
 		}
 
-		// if this page is excluded by the offset, move along
-		if (recordsRead + page.Length()) <= offset {
-			recordsRead += page.Length()
+		// if this page is excluded by the offset, move along. The records matching a filter, and the records of
+		// the page holding the cursor, are only known once they are read
+		if f.Empty() && !(after.started() && pageID == afterPageID) && (recordsSkipped+page.Length()) <= offset {
+			recordsSkipped += page.Length()
 			continue PageLoop
 		}
 
@@ -394,6 +513,13 @@ PageLoop:
 		// read any relevant records from the page
 	RecordLoop:
 		for _, key := range orderedKeys {
+			if after.started() && ((!desc && key <= afterID) || (desc && key >= afterID)) {
+				continue RecordLoop
+			}
+			if !f.Match(page.vals[key]) {
+				continue RecordLoop
+			}
+
 			// skip offset values
 			if recordsSkipped < offset {
 				recordsSkipped++
@@ -405,15 +531,21 @@ PageLoop:
 			}
 
 			results = append(results, AutoListItem{Key: key, Value: page.vals[key]})
+			last = Cursor{page: pageIDStr, key: strconv.FormatUint(key, 10), desc: desc}
 			recordsRead++
 		}
 	}
 
-	return results, nil
+	return results, last, nil
 }
 
 // Count the number of records present in the index
 func (i AutoIndex) Count() (Result, error) {
+	return i.CountWhere(Filter{})
+}
+
+// CountWhere counts the records matching a filter
+func (i AutoIndex) CountWhere(f Filter) (Result, error) {
 	var count uint64
 	pageNames, err := i.driver.ListPages(i.Name, false)
 	if err != nil {
@@ -435,7 +567,15 @@ func (i AutoIndex) Count() (Result, error) {
 			return EmptyResult(), err
 		}
 
-		count += uint64(page.Length())
+		if f.Empty() {
+			count += uint64(page.Length())
+			continue
+		}
+		for _, val := range page.vals {
+			if f.Match(val) {
+				count++
+			}
+		}
 	}
 
 	countStr := strconv.FormatUint(count, 10)
@@ -17,7 +17,7 @@ var testLockDuration = time.Millisecond * 50
 func newTestingIndex(t *testing.T) AutoIndex {
 	indexName := "test_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateAutoIndex(indexName)
+	driver.CreateAutoIndex(indexName, testPageSize)
 	index, err := NewAutoIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 	return index
@@ -54,7 +54,7 @@ func TestAutoIndexInsertQueryOne(t *testing.T) {
 func TestAutoInsertQueryMany(t *testing.T) {
 	dri := driver.NewMemoryDriver()
 	indexName := "test_index"
-	err := dri.CreateAutoIndex(indexName)
+	err := dri.CreateAutoIndex(indexName, testPageSize)
 	index, err := NewAutoIndex(indexName, &dri, testPageSize)
 	util.Ok(t, err)
 	numRecords := (testPageSize * 2) + 1
@@ -96,7 +96,7 @@ func TestAutoInsertQueryMany(t *testing.T) {
 func TestAutoIndexDeleteOne(t *testing.T) {
 	dri := driver.NewMemoryDriver()
 	indexName := "test_index"
-	err := dri.CreateAutoIndex(indexName)
+	err := dri.CreateAutoIndex(indexName, testPageSize)
 	index, err := NewAutoIndex(indexName, &dri, testPageSize)
 	util.Ok(t, err)
 
@@ -226,7 +226,7 @@ func TestAutoIndexUpdateMany(t *testing.T) {
 func TestAutoIndexList(t *testing.T) {
 	indexName := "test_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateAutoIndex(indexName)
+	driver.CreateAutoIndex(indexName, testPageSize)
 	index, err := NewAutoIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -262,7 +262,7 @@ func TestAutoIndexList(t *testing.T) {
 func TestAutoIndexCount(t *testing.T) {
 	indexName := "test_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateAutoIndex(indexName)
+	driver.CreateAutoIndex(indexName, testPageSize)
 	index, err := NewAutoIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -283,3 +283,25 @@ func TestAutoIndexCount(t *testing.T) {
 
 	util.Equals(t, strconv.Itoa(numInserts), result.String())
 }
+
+func TestNewAutoIndexManifest(t *testing.T) {
+	indexName := "test_index"
+	dri := driver.NewMemoryDriver()
+	err := dri.CreateAutoIndex(indexName, testPageSize)
+	util.Ok(t, err)
+
+	// the page size in the manifest should win over the provided page size
+	index, err := NewAutoIndex(indexName, &dri, testPageSize*2)
+	util.Ok(t, err)
+	util.Equals(t, testPageSize, index.pageSize)
+
+	mapIndexName := "test_map_index"
+	err = dri.CreateMapIndex(mapIndexName, testPageSize)
+	util.Ok(t, err)
+
+	_, err = NewAutoIndex(mapIndexName, &dri, testPageSize)
+	util.Assert(t, err != nil, "opening a map index as an auto index should return an error")
+
+	_, err = NewMapIndex(indexName, &dri, testPageSize)
+	util.Assert(t, err != nil, "opening an auto index as a map index should return an error")
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"keybite/store/driver"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The change log of an index records every modification of its records, so that consumers can follow writes
+to an index. It is stored in an auto index named after the index with the change log suffix, where each
+record is an event and its ID is the sequence number of the event. Events are appended while the index is
+write locked, once the modified page has been written, so they are ordered like the writes of the index
+*/
+
+// suffix of the auto index holding the change log of an index
+const changeLogSuffix = ".changes"
+
+// operations recorded by change events
+const (
+	ChangeInsert = "insert"
+	ChangeUpdate = "update"
+	ChangeDelete = "delete"
+)
+
+// ChangeEvent is a modification of a record recorded in a change log. Old and New are nil when the record
+// did not exist before the change, or no longer exists after it
+type ChangeEvent struct {
+	Seq  uint64    `json:"seq"`
+	Op   string    `json:"op"`
+	Key  string    `json:"key"`
+	Old  *string   `json:"old"`
+	New  *string   `json:"new"`
+	Time time.Time `json:"time"`
+}
+
+// ChangeListResult contains the events of a change log
+type ChangeListResult []ChangeEvent
+
+// String returns a string encoding of the result, with one event per line
+func (r ChangeListResult) String() string {
+	var b strings.Builder
+	for _, event := range r {
+		old, new := "", ""
+		if event.Old != nil {
+			old = *event.Old
+		}
+		if event.New != nil {
+			new = *event.New
+		}
+		fmt.Fprintf(&b, "%d\t%s\t%s\t%s\t%s\t%s\n", event.Seq, event.Time.Format(time.RFC3339Nano), event.Op, event.Key, old, new)
+	}
+	return b.String()
+}
+
+// Valid indicates whether the result was resolved successfully
+func (r ChangeListResult) Valid() bool {
+	return len(r) > 0
+}
+
+// ChangeLogName returns the name of the auto index holding the change log of an index
+func ChangeLogName(indexName string) string {
+	return indexName + changeLogSuffix
+}
+
+// newChangeEvent returns the event recording a change, or false if the record was left unchanged
+func newChangeEvent(change valueChange, at time.Time) (ChangeEvent, bool) {
+	event := ChangeEvent{Key: change.key, Time: at}
+	if change.before.present {
+		old := change.before.value
+		event.Old = &old
+	}
+	if change.after.present {
+		new := change.after.value
+		event.New = &new
+	}
+
+	switch {
+	case event.Old == nil && event.New == nil:
+		return event, false
+	case event.Old == nil:
+		event.Op = ChangeInsert
+	case event.New == nil:
+		event.Op = ChangeDelete
+	case *event.Old == *event.New:
+		return event, false
+	default:
+		event.Op = ChangeUpdate
+	}
+	return event, true
+}
+
+// appendChanges records modifications of the records of an index in its change log
+func appendChanges(d driver.StorageDriver, indexName string, changes []valueChange) error {
+	at := now().UTC()
+	events := make([]string, 0, len(changes))
+	for _, change := range changes {
+		event, changed := newChangeEvent(change, at)
+		if !changed {
+			continue
+		}
+		data, err := json.Marshal(event)
+		if err != nil {
+			return err
+		}
+		events = append(events, string(data))
+	}
+	if len(events) == 0 {
+		return nil
+	}
+
+	changeLog, err := NewAutoIndex(ChangeLogName(indexName), d, 1)
+	if err != nil {
+		return fmt.Errorf("appending to the change log of index %s failed: %w", indexName, err)
+	}
+	return changeLog.appendMany(events)
+}
+
+// appendMany inserts values into the index under a single write lock, creating pages as they fill up
+func (i AutoIndex) appendMany(vals []string) error {
+	return wrapInWriteLock(i.driver, i.Name, func() error {
+		page, pageID, err := i.getLatestPage()
+		if err != nil {
+			return err
+		}
+
+		for _, val := range vals {
+			nextID := page.MaxKey() + 1
+			if page.minKey > nextID {
+				nextID = page.minKey
+			}
+			insertPageID := autoPageID(nextID, i.pageSize)
+			if insertPageID > pageID {
+				err = i.persistPage(page)
+				if err != nil {
+					return err
+				}
+				page, err = i.createEmptyPage(insertPageID)
+				if err != nil {
+					return err
+				}
+				page.SetMinimumKey(nextID)
+				pageID = insertPageID
+			}
+			page.Append(val)
+		}
+
+		return i.persistPage(page)
+	})
+}
+
+// EnableChangeLog starts recording the writes to an index in its change log, creating the change log if
+// needed. Servers which opened the index before its change log was enabled may not record their writes
+func EnableChangeLog(d driver.StorageDriver, indexName string, pageSize int) error {
+	return updateManifest(d, indexName, "enabling its change log", func(manifest *driver.IndexManifest) error {
+		_, err := driver.ReadManifest(d, ChangeLogName(indexName))
+		if driver.IsIndexNotExist(err) {
+			err = d.CreateAutoIndex(ChangeLogName(indexName), pageSize)
+		}
+		if err != nil {
+			return err
+		}
+		manifest.ChangeLog = true
+		return nil
+	})
+}
+
+// DisableChangeLog stops recording the writes to an index, and drops its change log
+func DisableChangeLog(d driver.StorageDriver, indexName string) error {
+	err := updateManifest(d, indexName, "disabling its change log", func(manifest *driver.IndexManifest) error {
+		manifest.ChangeLog = false
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return DropChangeLog(d, indexName)
+}
+
+// DropChangeLog drops the change log of an index, if it has one
+func DropChangeLog(d driver.StorageDriver, indexName string) error {
+	err := d.DropAutoIndex(ChangeLogName(indexName))
+	if driver.IsIndexNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// Changes returns the events of the change log of an index following a sequence number, in order. A limit
+// of 0 returns every event
+func Changes(d driver.StorageDriver, indexName string, since uint64, limit int) (ChangeListResult, error) {
+	changeLog, err := NewAutoIndex(ChangeLogName(indexName), d, 1)
+	if err != nil {
+		if driver.IsIndexNotExist(err) {
+			return ChangeListResult{}, errChangeLogNotEnabled(indexName, err)
+		}
+		return ChangeListResult{}, err
+	}
+
+	after := Cursor{}
+	if since > 0 {
+		after = Cursor{page: strconv.FormatUint(autoPageID(since, changeLog.pageSize), 10), key: strconv.FormatUint(since, 10)}
+	}
+	records, _, err := changeLog.listFrom(after, limit, 0, false, Filter{})
+	if err != nil {
+		return ChangeListResult{}, err
+	}
+
+	events := make(ChangeListResult, len(records))
+	for j, record := range records {
+		item := record.(AutoListItem)
+		err = json.Unmarshal([]byte(item.Value), &events[j])
+		if err != nil {
+			return ChangeListResult{}, errBadData(changeLog.Name, strconv.FormatUint(item.Key, 10), err)
+		}
+		events[j].Seq = item.Key
+	}
+	return events, nil
+}
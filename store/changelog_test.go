@@ -0,0 +1,126 @@
+package store
+
+import (
+	"keybite/store/driver"
+	"keybite/util"
+	"testing"
+	"time"
+)
+
+// changeOps returns the operations and keys of change events
+func changeOps(events ChangeListResult) []string {
+	ops := make([]string, len(events))
+	for i, event := range events {
+		ops[i] = event.Op + " " + event.Key
+	}
+	return ops
+}
+
+func TestNewChangeEvent(t *testing.T) {
+	at := time.Unix(1600000000, 0)
+	present := func(value string) recordState { return recordState{value: value, present: true} }
+
+	event, changed := newChangeEvent(valueChange{key: "a", after: present("1")}, at)
+	util.Assert(t, changed, "new records should be recorded")
+	util.Equals(t, ChangeInsert, event.Op)
+	util.Assert(t, event.Old == nil, "inserts should have no old value")
+	util.Equals(t, "1", *event.New)
+
+	event, changed = newChangeEvent(valueChange{key: "a", before: present("1"), after: present("2")}, at)
+	util.Assert(t, changed, "modified records should be recorded")
+	util.Equals(t, ChangeUpdate, event.Op)
+
+	event, changed = newChangeEvent(valueChange{key: "a", before: present("1")}, at)
+	util.Assert(t, changed, "deleted records should be recorded")
+	util.Equals(t, ChangeDelete, event.Op)
+	util.Assert(t, event.New == nil, "deletes should have no new value")
+
+	_, changed = newChangeEvent(valueChange{key: "a", before: present("1"), after: present("1")}, at)
+	util.Assert(t, !changed, "records overwritten with the same value should not be recorded")
+	_, changed = newChangeEvent(valueChange{key: "a"}, at)
+	util.Assert(t, !changed, "records inserted and deleted before being written should not be recorded")
+}
+
+func TestAutoIndexChangeLog(t *testing.T) {
+	index := newTestingIndex(t)
+	_, err := index.Insert("before")
+	util.Ok(t, err)
+
+	_, err = Changes(index.driver, index.Name, 0, 0)
+	util.Assert(t, err != nil, "reading a change log before it is enabled should fail")
+	err = EnableChangeLog(index.driver, index.Name, testPageSize)
+	util.Ok(t, err)
+
+	index, err = NewAutoIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	// enough inserts to fill several pages of the index and its change log
+	for j := 0; j < testPageSize*2; j++ {
+		_, err = index.Insert("value")
+		util.Ok(t, err)
+	}
+	sel := NewArraySelector([]uint64{1, 2})
+	_, err = index.Update(&sel, "updated")
+	util.Ok(t, err)
+	single := NewSingleSelector(2)
+	_, err = index.Delete(&single)
+	util.Ok(t, err)
+
+	events, err := Changes(index.driver, index.Name, 0, 0)
+	util.Ok(t, err)
+	util.Equals(t, testPageSize*2+3, len(events))
+	for j, event := range events {
+		util.Equals(t, uint64(j+1), event.Seq)
+	}
+	// writes made before the change log was enabled are not recorded
+	util.Equals(t, "insert 2", changeOps(events[:1])[0])
+	util.Equals(t, []string{"update 1", "update 2", "delete 2"}, changeOps(events[len(events)-3:]))
+	util.Equals(t, "before", *events[len(events)-3].Old)
+	util.Equals(t, "updated", *events[len(events)-3].New)
+
+	// consumers continue from the last sequence number read
+	events, err = Changes(index.driver, index.Name, uint64(testPageSize*2+1), 1)
+	util.Ok(t, err)
+	util.Equals(t, []string{"update 2"}, changeOps(events))
+
+	err = DisableChangeLog(index.driver, index.Name)
+	util.Ok(t, err)
+	_, err = Changes(index.driver, index.Name, 0, 0)
+	util.Assert(t, err != nil, "disabling a change log should drop it")
+}
+
+func TestMapIndexChangeLog(t *testing.T) {
+	index := newTestingMapIndex(t)
+	err := EnableChangeLog(index.driver, index.Name, testPageSize)
+	util.Ok(t, err)
+	index, err = NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+
+	alice := NewMapSingleSelector("alice")
+	_, err = index.Insert(&alice, "1")
+	util.Ok(t, err)
+	_, err = index.Upsert(&alice, "2")
+	util.Ok(t, err)
+	// writes which leave the value unchanged are not recorded
+	_, err = index.Upsert(&alice, "2")
+	util.Ok(t, err)
+	bob := NewMapSingleSelector("bob")
+	_, err = index.Upsert(&bob, "3")
+	util.Ok(t, err)
+	_, err = index.Delete(&alice)
+	util.Ok(t, err)
+
+	events, err := Changes(index.driver, index.Name, 0, 0)
+	util.Ok(t, err)
+	util.Equals(t, []string{"insert alice", "update alice", "insert bob", "delete alice"}, changeOps(events))
+	util.Equals(t, "2", *events[3].Old)
+
+	// repartitioning does not change any record, so it is not recorded
+	err = index.Repartition(testPageSize * 2)
+	util.Ok(t, err)
+	manifest, err := driver.ReadManifest(index.driver, index.Name)
+	util.Ok(t, err)
+	util.Assert(t, manifest.ChangeLog, "repartitioning should keep the change log enabled")
+	events, err = Changes(index.driver, index.Name, 4, 0)
+	util.Ok(t, err)
+	util.Equals(t, 0, len(events))
+}
@@ -0,0 +1,101 @@
+package store
+
+import (
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+)
+
+// Cursor marks the position of the last record returned by a list, so that the next list can start reading
+// at the page holding it instead of reading every page before an offset. The zero value starts at the first
+// record
+type Cursor struct {
+	// the name of the page holding the last record, empty before the first record
+	page string
+	key  string
+	desc bool
+}
+
+// cursorData is the encoded form of a cursor
+type cursorData struct {
+	Page string `json:"p"`
+	Key  string `json:"k"`
+	Desc bool   `json:"d,omitempty"`
+}
+
+// String returns the opaque encoding of the cursor
+func (c Cursor) String() string {
+	// encoding strings and a bool cannot fail
+	data, _ := json.Marshal(cursorData{Page: c.page, Key: c.key, Desc: c.desc})
+	return base64.RawURLEncoding.EncodeToString(data)
+}
+
+// started reports whether the cursor points to a record rather than the start of the index
+func (c Cursor) started() bool {
+	return c.page != ""
+}
+
+// ParseCursor decodes a cursor returned by a previous list
+func ParseCursor(encoded string) (Cursor, error) {
+	data, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil {
+		return Cursor{}, errInvalidCursor(encoded, err)
+	}
+	decoded := cursorData{}
+	err = json.Unmarshal(data, &decoded)
+	if err != nil {
+		return Cursor{}, errInvalidCursor(encoded, err)
+	}
+	if decoded.Page == "" {
+		return Cursor{}, errInvalidCursor(encoded, fmt.Errorf("cursor has no page"))
+	}
+	return Cursor{page: decoded.Page, key: decoded.Key, desc: decoded.Desc}, nil
+}
+
+// checkDirection verifies that a cursor continues a list in the requested direction
+func (c Cursor) checkDirection(desc bool) error {
+	if c.started() && c.desc != desc {
+		return errInvalidCursor(c.String(), fmt.Errorf("cursor continues a list in the other direction"))
+	}
+	return nil
+}
+
+// PagedListResult contains a page of a list result and the cursor continuing it
+type PagedListResult struct {
+	Items ListResult
+	// the cursor of the next page, nil when every record has been listed
+	Next *Cursor
+}
+
+// pagedListJSON is the JSON encoding of a paged list result
+type pagedListJSON struct {
+	Items ListResult `json:"items"`
+	Next  *string    `json:"next"`
+}
+
+// MarshalJSON returns a JSON byte array representation of the result
+func (r PagedListResult) MarshalJSON() ([]byte, error) {
+	encoded := pagedListJSON{Items: r.Items}
+	if encoded.Items == nil {
+		encoded.Items = ListResult{}
+	}
+	if r.Next != nil {
+		next := r.Next.String()
+		encoded.Next = &next
+	}
+	return json.Marshal(encoded)
+}
+
+// String returns a string encoding of the result, ending with the cursor of the next page if there is one
+func (r PagedListResult) String() string {
+	str := r.Items.String()
+	if r.Next != nil {
+		str += fmt.Sprintf("next\t%s\n", r.Next.String())
+	}
+	return str
+}
+
+// Valid indicates whether the result was resolved successfully
+func (r PagedListResult) Valid() bool {
+	return r.Items.Valid()
+}
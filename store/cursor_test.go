@@ -0,0 +1,104 @@
+package store
+
+import (
+	"fmt"
+	"keybite/store/driver"
+	"keybite/util"
+	"testing"
+)
+
+// readCountingDriver counts page reads
+type readCountingDriver struct {
+	*driver.MemoryDriver
+	reads int
+}
+
+func (d *readCountingDriver) ReadPage(filename string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
+	d.reads++
+	return d.MemoryDriver.ReadPage(filename, indexName, pageSize)
+}
+
+func (d *readCountingDriver) ReadMapPage(filename string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	d.reads++
+	return d.MemoryDriver.ReadMapPage(filename, indexName, pageSize)
+}
+
+func TestParseCursor(t *testing.T) {
+	cursor := Cursor{page: "3", key: "a key", desc: true}
+	parsed, err := ParseCursor(cursor.String())
+	util.Ok(t, err)
+	util.Equals(t, cursor, parsed)
+
+	for _, invalid := range []string{"", "not base64!", "bm90IGpzb24", Cursor{key: "a"}.String()} {
+		_, err = ParseCursor(invalid)
+		util.Assert(t, err != nil, "parsing cursor '"+invalid+"' should fail")
+	}
+}
+
+func TestAutoIndexListAfter(t *testing.T) {
+	memory := driver.NewMemoryDriver()
+	d := &readCountingDriver{MemoryDriver: &memory}
+	err := d.CreateAutoIndex("test_index", testPageSize)
+	util.Ok(t, err)
+	index, err := NewAutoIndex("test_index", d, testPageSize)
+	util.Ok(t, err)
+	for i := 1; i <= 25; i++ {
+		_, err = index.Insert(fmt.Sprintf("value_%d", i))
+		util.Ok(t, err)
+	}
+
+	listed := []uint64{}
+	cursor := Cursor{}
+	for {
+		d.reads = 0
+		paged, err := index.ListAfter(cursor, 7, 0, false, Filter{})
+		util.Ok(t, err)
+		for _, item := range paged.Items {
+			listed = append(listed, item.(AutoListItem).Key)
+		}
+		if paged.Next == nil {
+			break
+		}
+		cursor = *paged.Next
+		// at most the page holding the cursor and the page after it are read
+		util.Assert(t, d.reads <= 2, fmt.Sprintf("list after a cursor read %d pages", d.reads))
+	}
+
+	util.Equals(t, 25, len(listed))
+	for i, id := range listed {
+		util.Equals(t, uint64(i+1), id)
+	}
+
+	_, err = index.ListAfter(cursor, 7, 0, true, Filter{})
+	util.Assert(t, err != nil, "a cursor should not continue a list in the other direction")
+}
+
+func TestMapIndexListAfter(t *testing.T) {
+	index := newTestingMapIndex(t)
+	for i := 0; i < 35; i++ {
+		sel := NewMapSingleSelector(fmt.Sprintf("key_%02d", i))
+		_, err := index.Insert(&sel, "value")
+		util.Ok(t, err)
+	}
+
+	isValue, err := NewCondition(nil, OpEqual, "value")
+	util.Ok(t, err)
+	listed := []string{}
+	cursor := Cursor{}
+	for {
+		paged, err := index.ListAfter(cursor, 4, 0, true, Filter{}.And(isValue))
+		util.Ok(t, err)
+		for _, item := range paged.Items {
+			listed = append(listed, item.(MapListItem).Key)
+		}
+		if paged.Next == nil {
+			break
+		}
+		cursor = *paged.Next
+	}
+
+	util.Equals(t, 35, len(listed))
+	for i, key := range listed {
+		util.Equals(t, fmt.Sprintf("key_%02d", 34-i), key)
+	}
+}
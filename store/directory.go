@@ -0,0 +1,176 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"keybite/store/driver"
+	"sort"
+)
+
+// the page directory of an ordered map index is stored as index metadata
+const directoryMetaName = "directory"
+
+// pageDirectory maps ranges of keys to the pages of a map index with ordered addressing. Each page holds the
+// keys from its low key (inclusive) up to the low key of the next page (exclusive), and the first page always
+// starts at the empty string, so every possible key belongs to exactly one page
+type pageDirectory struct {
+	Pages    []directoryEntry `json:"pages"`
+	NextPage uint64           `json:"nextPage"`
+}
+
+type directoryEntry struct {
+	Low  string `json:"low"`
+	Page uint64 `json:"page"`
+}
+
+// newPageDirectory returns the directory of an empty index, where page 0 holds every key
+func newPageDirectory() *pageDirectory {
+	return &pageDirectory{
+		Pages:    []directoryEntry{{Low: "", Page: 0}},
+		NextPage: 1,
+	}
+}
+
+// readPageDirectory reads the page directory of an index. Nothing is written to the directory until the first
+// page of an index is split, so a missing directory is the directory of an index with a single page
+func readPageDirectory(d driver.StorageDriver, indexName string) (*pageDirectory, error) {
+	data, err := d.ReadMeta(indexName, directoryMetaName)
+	if err != nil {
+		if driver.IsMetaNotExist(err) {
+			return newPageDirectory(), nil
+		}
+		return nil, err
+	}
+
+	dir := pageDirectory{}
+	err = json.Unmarshal(data, &dir)
+	if err != nil || len(dir.Pages) == 0 {
+		if err == nil {
+			err = fmt.Errorf("page directory contains no pages")
+		}
+		return nil, errBadData(indexName, directoryMetaName, err)
+	}
+
+	return &dir, nil
+}
+
+// write persists the page directory of an index
+func (dir pageDirectory) write(d driver.StorageDriver, indexName string) error {
+	data, err := json.Marshal(dir)
+	if err != nil {
+		return err
+	}
+	return d.WriteMeta(indexName, directoryMetaName, data)
+}
+
+// position returns the position in the directory of the page holding the key
+func (dir pageDirectory) position(key string) int {
+	// find the first page starting after the key, the key belongs to the page before it
+	return sort.Search(len(dir.Pages), func(i int) bool {
+		return dir.Pages[i].Low > key
+	}) - 1
+}
+
+// pageFor returns the ID of the page holding the key
+func (dir pageDirectory) pageFor(key string) uint64 {
+	return dir.Pages[dir.position(key)].Page
+}
+
+// pagePosition returns the position of a page in the directory, or false if the directory does not contain it
+func (dir pageDirectory) pagePosition(pageID uint64) (int, bool) {
+	for i, entry := range dir.Pages {
+		if entry.Page == pageID {
+			return i, true
+		}
+	}
+	return 0, false
+}
+
+// contains reports whether the key belongs to the page at the provided position
+func (dir pageDirectory) contains(position int, key string) bool {
+	if key < dir.Pages[position].Low {
+		return false
+	}
+	return position+1 == len(dir.Pages) || key < dir.Pages[position+1].Low
+}
+
+// pageIDs returns the page IDs of the directory in key order
+func (dir pageDirectory) pageIDs(desc bool) []uint64 {
+	return dir.pageIDsInRange(KeyRange{}, desc)
+}
+
+// pageIDsInRange returns the IDs of the pages holding keys of a range in key order
+func (dir pageDirectory) pageIDsInRange(r KeyRange, desc bool) []uint64 {
+	start := dir.position(r.low())
+	end := len(dir.Pages)
+	if high, bounded := r.high(); bounded {
+		// pages starting at or after the end of the range hold none of its keys
+		end = sort.Search(len(dir.Pages), func(i int) bool {
+			return dir.Pages[i].Low >= high
+		})
+		if end <= start {
+			end = start + 1
+		}
+	}
+
+	ids := make([]uint64, 0, end-start)
+	for _, entry := range dir.Pages[start:end] {
+		ids = append(ids, entry.Page)
+	}
+	if desc {
+		return copyAndReverseUint64Slice(ids)
+	}
+	return ids
+}
+
+// split assigns new pages starting at each of the provided low keys, which must be sorted and fall within
+// the range of the page being split. The IDs of the new pages are returned in the order of the low keys
+func (dir *pageDirectory) split(pageID uint64, lows []string) ([]uint64, error) {
+	position, ok := dir.pagePosition(pageID)
+	if !ok {
+		return nil, fmt.Errorf("page %d is not in the page directory", pageID)
+	}
+
+	newEntries := make([]directoryEntry, len(lows))
+	newIDs := make([]uint64, len(lows))
+	for i, low := range lows {
+		if !dir.contains(position, low) {
+			return nil, fmt.Errorf("key '%s' does not belong to page %d", low, pageID)
+		}
+		newIDs[i] = dir.NextPage
+		newEntries[i] = directoryEntry{Low: low, Page: dir.NextPage}
+		dir.NextPage++
+	}
+
+	pages := make([]directoryEntry, 0, len(dir.Pages)+len(newEntries))
+	pages = append(pages, dir.Pages[:position+1]...)
+	pages = append(pages, newEntries...)
+	pages = append(pages, dir.Pages[position+1:]...)
+	dir.Pages = pages
+
+	return newIDs, nil
+}
+
+// splitKeys divides sorted keys into runs of at most pageSize keys. Runs are filled from the left so that keys
+// appended in order leave full pages behind, and the last two runs are balanced so that no run is less than
+// half full
+func splitKeys(keys []string, pageSize int) [][]string {
+	runs := [][]string{}
+	for start := 0; start < len(keys); start += pageSize {
+		end := start + pageSize
+		if end > len(keys) {
+			end = len(keys)
+		}
+		runs = append(runs, keys[start:end])
+	}
+
+	last := len(runs) - 1
+	if last > 0 && len(runs[last]) < pageSize/2 {
+		combined := keys[(last-1)*pageSize:]
+		half := len(combined) / 2
+		runs[last-1] = combined[:half]
+		runs[last] = combined[half:]
+	}
+
+	return runs
+}
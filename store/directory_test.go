@@ -0,0 +1,50 @@
+package store
+
+import (
+	"keybite/util"
+	"testing"
+)
+
+func TestSplitKeys(t *testing.T) {
+	keys := []string{"a", "b", "c", "d", "e", "f", "g", "h", "i", "j", "k"}
+
+	// keys appended in order leave full pages behind
+	runs := splitKeys(keys[:10], 4)
+	util.Equals(t, [][]string{{"a", "b", "c", "d"}, {"e", "f", "g", "h"}, {"i", "j"}}, runs)
+
+	// a nearly empty last run is balanced with the run before it
+	runs = splitKeys(keys, 10)
+	util.Equals(t, [][]string{{"a", "b", "c", "d", "e"}, {"f", "g", "h", "i", "j", "k"}}, runs)
+
+	runs = splitKeys(keys[:3], 10)
+	util.Equals(t, [][]string{{"a", "b", "c"}}, runs)
+}
+
+func TestPageDirectory(t *testing.T) {
+	dir := newPageDirectory()
+	util.Equals(t, uint64(0), dir.pageFor(""))
+	util.Equals(t, uint64(0), dir.pageFor("zzz"))
+
+	newIDs, err := dir.split(0, []string{"g", "p"})
+	util.Ok(t, err)
+	util.Equals(t, []uint64{1, 2}, newIDs)
+
+	util.Equals(t, uint64(0), dir.pageFor("apple"))
+	util.Equals(t, uint64(1), dir.pageFor("g"))
+	util.Equals(t, uint64(1), dir.pageFor("orange"))
+	util.Equals(t, uint64(2), dir.pageFor("pear"))
+
+	newIDs, err = dir.split(1, []string{"k"})
+	util.Ok(t, err)
+	util.Equals(t, []uint64{3}, newIDs)
+	util.Equals(t, []uint64{0, 1, 3, 2}, dir.pageIDs(false))
+	util.Equals(t, []uint64{2, 3, 1, 0}, dir.pageIDs(true))
+
+	position, ok := dir.pagePosition(3)
+	util.Assert(t, ok, "directory should contain split page")
+	util.Assert(t, dir.contains(position, "kiwi"), "page should contain keys within its range")
+	util.Assert(t, !dir.contains(position, "peach"), "page should not contain keys past its range")
+
+	_, err = dir.split(1, []string{"z"})
+	util.Assert(t, err != nil, "splitting a page at a key outside its range should return an error")
+}
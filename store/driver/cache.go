@@ -0,0 +1,430 @@
+package driver
+
+import (
+	"container/list"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+/*
+The page cache keeps decoded pages in memory between queries, so that warm Lambda containers and the HTTP server
+don't read the same pages again for every request. Pages written through a caching driver are dropped from the
+cache, and all pages of an index are dropped when the index is created, dropped or replaced through it. Pages
+written by other processes keep being served from the cache until the cached page is older than the staleness
+bound of the cache. A stale page is then revalidated: drivers which can read the version of a page without
+reading the page itself, like the S3 driver with ETags, keep serving the cached page while its version is
+unchanged, and the pages of other drivers are read again. Pages of an index locked through a caching driver
+are always read from the wrapped driver, so that a read-modify-write holding the write lock never works from a
+page written by another process which holds no write lock of its own, like a Lambda container on EFS.
+
+Cached pages don't weaken conditional writes: the S3 driver writes a page served from the cache on the condition
+that it still has the cached version, so a write based on a stale page fails with a write conflict, which drops
+the page from the cache before the write is retried
+*/
+
+// bytes counted for each record of a cached page in addition to its key and value
+const cachedRecordOverhead = 32
+
+// PageCache is a size-bounded cache of decoded pages which evicts the least recently used pages first. A page
+// cache is shared by the caching drivers of a process which read the same data
+type PageCache struct {
+	mutex sync.Mutex
+	// maximum estimated size of the cached pages in bytes
+	capacity int
+	// age after which cached pages are revalidated
+	staleAfter time.Duration
+	// estimated size of the cached pages in bytes
+	size int
+	// cached pages, most recently used first
+	lru     *list.List
+	entries map[string]*list.Element
+	// incremented after every write to an index, so that pages read before a write are not cached
+	generations map[string]uint64
+	stats       PageCacheStats
+}
+
+// PageCacheStats counts the page reads served by a page cache
+type PageCacheStats struct {
+	// reads served from the cache, including reads of revalidated pages
+	Hits uint64
+	// reads sent to the wrapped driver
+	Misses uint64
+	// stale pages found unchanged when revalidated
+	Revalidations uint64
+	// pages evicted to bound the size of the cache
+	Evictions uint64
+	// number of cached pages and their estimated size in bytes
+	Pages int
+	Bytes int
+}
+
+// cachedPage is a page held by the page cache
+type cachedPage struct {
+	key       string
+	indexName string
+	// autoPageResult or mapPageResult, which is never modified once cached
+	page interface{}
+	// version of the page reported by the driver, or the empty string
+	version string
+	size    int
+	// when the page was read or last revalidated
+	fetched time.Time
+}
+
+// NewPageCache creates a page cache holding up to capacity bytes of pages, which are revalidated once they are
+// older than staleAfter
+func NewPageCache(capacity int, staleAfter time.Duration) *PageCache {
+	return &PageCache{
+		capacity:    capacity,
+		staleAfter:  staleAfter,
+		lru:         list.New(),
+		entries:     map[string]*list.Element{},
+		generations: map[string]uint64{},
+	}
+}
+
+// Stats returns the counters of the cache
+func (c *PageCache) Stats() PageCacheStats {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	stats := c.stats
+	stats.Pages = c.lru.Len()
+	stats.Bytes = c.size
+	return stats
+}
+
+// pageCacheKey identifies a cached page. Page names are cached without their extension, as they are staged
+func pageCacheKey(kind string, indexName string, fileName string) string {
+	return stagedWriteKey(kind, indexName, strings.TrimSuffix(fileName, filepath.Ext(fileName)))
+}
+
+// lookup returns a cached page, if any, and the generation of its index to store a page read in its place
+func (c *PageCache) lookup(key string, indexName string) (cachedPage, bool, uint64) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	generation := c.generations[indexName]
+	element, ok := c.entries[key]
+	if !ok {
+		return cachedPage{}, false, generation
+	}
+	c.lru.MoveToFront(element)
+	return *element.Value.(*cachedPage), true, generation
+}
+
+// fresh reports whether a cached page is recent enough to be served without revalidating it
+func (c *PageCache) fresh(entry cachedPage) bool {
+	return time.Since(entry.fetched) <= c.staleAfter
+}
+
+// hit counts a read served from the cache. A revalidated page is fresh again if it still has the version
+// which was revalidated
+func (c *PageCache) hit(entry cachedPage, revalidated bool) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	c.stats.Hits++
+	if !revalidated {
+		return
+	}
+	c.stats.Revalidations++
+	if element, ok := c.entries[entry.key]; ok {
+		cached := element.Value.(*cachedPage)
+		if cached.version == entry.version {
+			cached.fetched = time.Now()
+		}
+	}
+}
+
+// miss counts a read sent to the wrapped driver
+func (c *PageCache) miss() {
+	c.mutex.Lock()
+	c.stats.Misses++
+	c.mutex.Unlock()
+}
+
+// store caches a page read at a time, unless its index was written since the generation was looked up. Least
+// recently used pages are evicted until the cache fits its capacity
+func (c *PageCache) store(key string, indexName string, generation uint64, page interface{}, version string, fetched time.Time) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	if c.generations[indexName] != generation {
+		return
+	}
+	c.remove(key)
+
+	size := cachedSize(page)
+	if size > c.capacity {
+		return
+	}
+	entry := &cachedPage{key: key, indexName: indexName, page: page, version: version, size: size, fetched: fetched}
+	c.entries[key] = c.lru.PushFront(entry)
+	c.size += size
+
+	for c.size > c.capacity {
+		c.remove(c.lru.Back().Value.(*cachedPage).key)
+		c.stats.Evictions++
+	}
+}
+
+// remove drops a page from the cache. The mutex must be held
+func (c *PageCache) remove(key string) {
+	element, ok := c.entries[key]
+	if !ok {
+		return
+	}
+	c.lru.Remove(element)
+	delete(c.entries, key)
+	c.size -= element.Value.(*cachedPage).size
+}
+
+// invalidatePage drops a written page from the cache
+func (c *PageCache) invalidatePage(key string, indexName string) {
+	c.mutex.Lock()
+	c.generations[indexName]++
+	c.remove(key)
+	c.mutex.Unlock()
+}
+
+// invalidateIndexes drops every page of the indexes from the cache
+func (c *PageCache) invalidateIndexes(indexNames ...string) {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	for _, indexName := range indexNames {
+		c.generations[indexName]++
+		for element := c.lru.Front(); element != nil; {
+			next := element.Next()
+			if entry := element.Value.(*cachedPage); entry.indexName == indexName {
+				c.remove(entry.key)
+			}
+			element = next
+		}
+	}
+}
+
+// cachedSize estimates the memory held by a decoded page
+func cachedSize(page interface{}) int {
+	size := 0
+	switch page := page.(type) {
+	case autoPageResult:
+		for _, val := range page.vals {
+			size += 8 + len(val) + cachedRecordOverhead
+		}
+	case mapPageResult:
+		// map keys are held by the map and the ordered keys
+		for key, val := range page.vals {
+			size += 2*len(key) + len(val) + cachedRecordOverhead
+		}
+		size += 8 * len(page.expiries)
+	}
+	return size
+}
+
+// versionedDriver is implemented by drivers which report the version of each page they read, and can read the
+// current version of a page without reading the page
+type versionedDriver interface {
+	readPageVersion(fileName string, indexName string, pageSize int) (autoPageResult, string, error)
+	readMapPageVersion(fileName string, indexName string, pageSize int) (mapPageResult, string, error)
+	pageVersion(fileName string, indexName string) (string, error)
+	// record the version of a page served from the cache, which writing the page is conditional on
+	observePageVersion(fileName string, indexName string, version string)
+}
+
+// CachingDriver wraps a storage driver to serve page reads from a page cache. Every caller receives its own
+// copy of a cached page. Metadata files and page listings are always read from the wrapped driver
+type CachingDriver struct {
+	StorageDriver
+	cache *PageCache
+	mutex sync.Mutex
+	// indexes locked through the driver, whose pages are read from the wrapped driver
+	locked map[string]bool
+}
+
+// NewCachingDriver wraps a storage driver to cache the pages it reads in a page cache
+func NewCachingDriver(d StorageDriver, cache *PageCache) *CachingDriver {
+	return &CachingDriver{StorageDriver: d, cache: cache, locked: map[string]bool{}}
+}
+
+// Stats returns the counters of the page cache
+func (c *CachingDriver) Stats() PageCacheStats {
+	return c.cache.Stats()
+}
+
+// read serves a page from the cache, revalidating it when it is stale, or reads it with fetch and caches a copy
+// of it. Pages served from the cache are shared, so they must be copied before being returned
+func (c *CachingDriver) read(kind string, fileName string, indexName string, fetch func() (interface{}, string, error)) (interface{}, bool, error) {
+	key := pageCacheKey(kind, indexName, fileName)
+	entry, ok, generation := c.cache.lookup(key, indexName)
+	ok = ok && !c.holdsLock(indexName)
+	if ok && c.cache.fresh(entry) {
+		c.cache.hit(entry, false)
+		c.observe(fileName, indexName, entry.version)
+		return entry.page, true, nil
+	}
+	if ok && c.unchanged(fileName, indexName, entry.version) {
+		c.cache.hit(entry, true)
+		c.observe(fileName, indexName, entry.version)
+		return entry.page, true, nil
+	}
+
+	c.cache.miss()
+	fetched := time.Now()
+	page, version, err := fetch()
+	if err != nil {
+		return page, false, err
+	}
+	switch p := page.(type) {
+	case autoPageResult:
+		c.cache.store(key, indexName, generation, p.copy(), version, fetched)
+	case mapPageResult:
+		c.cache.store(key, indexName, generation, p.copy(), version, fetched)
+	}
+	return page, false, nil
+}
+
+// unchanged reports whether the version of a page in the wrapped driver matches a cached version
+func (c *CachingDriver) unchanged(fileName string, indexName string, version string) bool {
+	versioned, ok := c.StorageDriver.(versionedDriver)
+	if !ok || version == "" {
+		return false
+	}
+	current, err := versioned.pageVersion(fileName, indexName)
+	return err == nil && current == version
+}
+
+// observe tells the wrapped driver which version of a page was served from the cache
+func (c *CachingDriver) observe(fileName string, indexName string, version string) {
+	if versioned, ok := c.StorageDriver.(versionedDriver); ok {
+		versioned.observePageVersion(fileName, indexName, version)
+	}
+}
+
+// holdsLock reports whether the write lock of an index is held through the driver
+func (c *CachingDriver) holdsLock(indexName string) bool {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+	return c.locked[indexName]
+}
+
+// LockIndex locks an index, or extends the lock, reading its pages from the wrapped driver until it is unlocked
+func (c *CachingDriver) LockIndex(indexName string) error {
+	err := c.StorageDriver.LockIndex(indexName)
+	if err != nil {
+		return err
+	}
+	c.mutex.Lock()
+	c.locked[indexName] = true
+	c.mutex.Unlock()
+	return nil
+}
+
+// UnlockIndex releases every lock of an index
+func (c *CachingDriver) UnlockIndex(indexName string) error {
+	c.mutex.Lock()
+	delete(c.locked, indexName)
+	c.mutex.Unlock()
+	return c.StorageDriver.UnlockIndex(indexName)
+}
+
+// ReadPage reads an auto index page, from the cache when possible
+func (c *CachingDriver) ReadPage(filename string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
+	result, cached, err := c.read(writeAutoPage, filename, indexName, func() (interface{}, string, error) {
+		if versioned, ok := c.StorageDriver.(versionedDriver); ok {
+			return versioned.readPageVersion(filename, indexName, pageSize)
+		}
+		vals, orderedKeys, err := c.StorageDriver.ReadPage(filename, indexName, pageSize)
+		return autoPageResult{vals: vals, orderedKeys: orderedKeys}, "", err
+	})
+	page := result.(autoPageResult)
+	if cached {
+		page = page.copy()
+	}
+	return page.vals, page.orderedKeys, err
+}
+
+// ReadMapPage reads a map index page, from the cache when possible
+func (c *CachingDriver) ReadMapPage(filename string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	result, cached, err := c.read(writeMapPage, filename, indexName, func() (interface{}, string, error) {
+		if versioned, ok := c.StorageDriver.(versionedDriver); ok {
+			return versioned.readMapPageVersion(filename, indexName, pageSize)
+		}
+		vals, orderedKeys, expiries, err := c.StorageDriver.ReadMapPage(filename, indexName, pageSize)
+		return mapPageResult{vals: vals, orderedKeys: orderedKeys, expiries: expiries}, "", err
+	})
+	page := result.(mapPageResult)
+	if cached {
+		page = page.copy()
+	}
+	return page.vals, page.orderedKeys, page.expiries, err
+}
+
+// WritePage writes an auto index page
+func (c *CachingDriver) WritePage(vals map[uint64]string, orderedKeys []uint64, filename string, indexName string) error {
+	defer c.cache.invalidatePage(pageCacheKey(writeAutoPage, indexName, filename), indexName)
+	return c.StorageDriver.WritePage(vals, orderedKeys, filename, indexName)
+}
+
+// WriteMapPage writes a map index page
+func (c *CachingDriver) WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, filename string, indexName string) error {
+	defer c.cache.invalidatePage(pageCacheKey(writeMapPage, indexName, filename), indexName)
+	return c.StorageDriver.WriteMapPage(vals, orderedKeys, expiries, filename, indexName)
+}
+
+// CreateAutoIndex creates an auto index
+func (c *CachingDriver) CreateAutoIndex(indexName string, pageSize int) error {
+	defer c.cache.invalidateIndexes(indexName)
+	return c.StorageDriver.CreateAutoIndex(indexName, pageSize)
+}
+
+// CreateMapIndex creates a map index
+func (c *CachingDriver) CreateMapIndex(indexName string, pageSize int) error {
+	defer c.cache.invalidateIndexes(indexName)
+	return c.StorageDriver.CreateMapIndex(indexName, pageSize)
+}
+
+// DropAutoIndex drops an auto index
+func (c *CachingDriver) DropAutoIndex(indexName string) error {
+	defer c.cache.invalidateIndexes(indexName)
+	return c.StorageDriver.DropAutoIndex(indexName)
+}
+
+// DropMapIndex drops a map index
+func (c *CachingDriver) DropMapIndex(indexName string) error {
+	defer c.cache.invalidateIndexes(indexName)
+	return c.StorageDriver.DropMapIndex(indexName)
+}
+
+// ReplaceIndex replaces the pages and metadata of an index with those of another index
+func (c *CachingDriver) ReplaceIndex(indexName string, replacementName string) error {
+	defer c.cache.invalidateIndexes(indexName, replacementName)
+	return c.StorageDriver.ReplaceIndex(indexName, replacementName)
+}
+
+// CommitWrites writes a set of staged writes, dropping the written pages from the cache
+func (c *CachingDriver) CommitWrites(writes WriteSet) error {
+	defer func() {
+		for _, w := range writes.writes {
+			if w.kind != writeMeta {
+				c.cache.invalidatePage(pageCacheKey(w.kind, w.indexName, w.name), w.indexName)
+			}
+		}
+	}()
+	return c.StorageDriver.CommitWrites(writes)
+}
+
+var (
+	sharedPageCachesMutex sync.Mutex
+	sharedPageCaches      = map[string]*PageCache{}
+)
+
+// sharedPageCache returns the page cache of the process for the data at a location, creating it on first use
+func sharedPageCache(location string, capacity int, staleAfter time.Duration) *PageCache {
+	sharedPageCachesMutex.Lock()
+	defer sharedPageCachesMutex.Unlock()
+	cache, ok := sharedPageCaches[location]
+	if !ok {
+		cache = NewPageCache(capacity, staleAfter)
+		sharedPageCaches[location] = cache
+	}
+	return cache
+}
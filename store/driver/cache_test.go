@@ -0,0 +1,248 @@
+package driver
+
+import (
+	"keybite/config"
+	"keybite/util"
+	"os"
+	"testing"
+	"time"
+)
+
+func newCachedMemoryDriver(t *testing.T, indexName string, capacity int, staleAfter time.Duration) (*MemoryDriver, *CachingDriver) {
+	m := NewMemoryDriver()
+	err := m.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = m.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	return &m, NewCachingDriver(&m, NewPageCache(capacity, staleAfter))
+}
+
+func TestCachingDriverServesCopies(t *testing.T) {
+	indexName := "test_map_index"
+	_, c := newCachedMemoryDriver(t, indexName, 1<<20, time.Hour)
+
+	vals, orderedKeys, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	vals["a"] = "changed by caller"
+	orderedKeys[0] = "changed by caller"
+
+	for i := 0; i < 2; i++ {
+		vals, orderedKeys, _, err = c.ReadMapPage("0"+pageExtension, indexName, pageSize)
+		util.Ok(t, err)
+		util.Equals(t, map[string]string{"a": "1"}, vals)
+		util.Equals(t, []string{"a"}, orderedKeys)
+		vals["a"] = "changed by caller"
+	}
+
+	stats := c.Stats()
+	util.Equals(t, uint64(1), stats.Misses)
+	util.Equals(t, uint64(2), stats.Hits)
+	util.Equals(t, 1, stats.Pages)
+}
+
+func TestCachingDriverInvalidatesWrites(t *testing.T) {
+	indexName := "test_map_index"
+	_, c := newCachedMemoryDriver(t, indexName, 1<<20, time.Hour)
+
+	_, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	err = c.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+
+	// pages committed together
+	staging := NewStagingDriver(c)
+	err = staging.WriteMapPage(map[string]string{"a": "3"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	err = staging.WriteMeta(indexName, "test", []byte("meta"))
+	util.Ok(t, err)
+	err = staging.Commit()
+	util.Ok(t, err)
+	vals, _, _, err = c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "3", vals["a"])
+
+	err = c.DropMapIndex(indexName)
+	util.Ok(t, err)
+	_, _, _, err = c.ReadMapPage("0", indexName, pageSize)
+	util.Assert(t, IsIndexNotExist(err), "reading a page of a dropped index should return a missing index error, got %v", err)
+
+	stats := c.Stats()
+	util.Equals(t, uint64(4), stats.Misses)
+	util.Equals(t, uint64(0), stats.Hits)
+	util.Equals(t, 0, stats.Pages)
+}
+
+func TestCachingDriverEvictsLeastRecentlyUsed(t *testing.T) {
+	indexName := "test_auto_index"
+	m := NewMemoryDriver()
+	err := m.CreateAutoIndex(indexName, pageSize)
+	util.Ok(t, err)
+	for _, fileName := range []string{"0", "1", "2"} {
+		err = m.WritePage(map[uint64]string{1: "value"}, []uint64{1}, fileName, indexName)
+		util.Ok(t, err)
+	}
+	pageBytes := cachedSize(autoPageResult{vals: map[uint64]string{1: "value"}})
+	c := NewCachingDriver(&m, NewPageCache(2*pageBytes, time.Hour))
+
+	for _, fileName := range []string{"0", "1", "0", "2"} {
+		_, _, err = c.ReadPage(fileName, indexName, pageSize)
+		util.Ok(t, err)
+	}
+	stats := c.Stats()
+	util.Equals(t, uint64(1), stats.Evictions)
+	util.Equals(t, 2, stats.Pages)
+	util.Equals(t, 2*pageBytes, stats.Bytes)
+
+	// page 1 was the least recently used
+	_, _, err = c.ReadPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	_, _, err = c.ReadPage("1", indexName, pageSize)
+	util.Ok(t, err)
+	stats = c.Stats()
+	util.Equals(t, uint64(2), stats.Hits)
+	util.Equals(t, uint64(4), stats.Misses)
+}
+
+// test that stale pages of drivers which don't report page versions are read again
+func TestCachingDriverRereadsStalePages(t *testing.T) {
+	indexName := "test_map_index"
+	m, c := newCachedMemoryDriver(t, indexName, 1<<20, 0)
+
+	_, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	// written by another process
+	err = m.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+	util.Equals(t, uint64(2), c.Stats().Misses)
+}
+
+func TestCachingDriverRevalidatesS3Pages(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+	c := NewCachingDriver(bd, NewPageCache(1<<20, 0))
+
+	indexName := "test_map_index"
+	err := c.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = c.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	for i := 0; i < 2; i++ {
+		vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+		util.Ok(t, err)
+		util.Equals(t, "1", vals["a"])
+	}
+	stats := c.Stats()
+	util.Equals(t, uint64(1), stats.Misses)
+	util.Equals(t, uint64(1), stats.Revalidations)
+
+	stub.put(indexName+"/0"+pageExtension, []byte("a:concurrent\n"))
+	vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "concurrent", vals["a"])
+	util.Equals(t, uint64(2), c.Stats().Misses)
+}
+
+// test that writing a stale page served from the cache fails with a write conflict
+func TestCachingDriverConditionalWrite(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+	c := NewCachingDriver(bd, NewPageCache(1<<20, time.Hour))
+
+	indexName := "test_map_index"
+	err := c.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = c.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	_, _, _, err = c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+
+	stub.put(indexName+"/0"+pageExtension, []byte("a:concurrent\n"))
+	// the driver of another request sharing the cache, which has not read the page itself
+	other := bd
+	other.versions = newObjectVersions()
+	c = NewCachingDriver(other, c.cache)
+	vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "1", vals["a"])
+
+	err = c.WriteMapPage(map[string]string{"a": "stale"}, []string{"a"}, nil, "0", indexName)
+	util.Assert(t, IsWriteConflict(err), "writing a stale cached page should return a write conflict, got %v", err)
+
+	// the conflicting page was dropped from the cache
+	vals, _, _, err = c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "concurrent", vals["a"])
+	err = c.WriteMapPage(map[string]string{"a": "latest"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+}
+
+// test that the drivers configured for the same data share a page cache
+func TestConfiguredPageCache(t *testing.T) {
+	conf := config.Config{
+		"DRIVER":             "filesystem",
+		"PAGE_EXTENSION":     pageExtension,
+		"DATA_DIR":           ".",
+		"LOCK_DURATION_FS":   "50",
+		"PAGE_CACHE_SIZE_MB": "1",
+	}
+	first, err := GetConfiguredDriver(&conf)
+	util.Ok(t, err)
+	second, err := GetConfiguredDriver(&conf)
+	util.Ok(t, err)
+
+	firstCache, ok := first.(*CachingDriver)
+	util.Assert(t, ok, "a driver configured with a page cache should be a caching driver, got %T", first)
+	secondCache, ok := second.(*CachingDriver)
+	util.Assert(t, ok, "a driver configured with a page cache should be a caching driver, got %T", second)
+	util.Assert(t, firstCache.cache == secondCache.cache, "drivers configured for the same data should share a page cache")
+	util.Equals(t, 1<<20, firstCache.cache.capacity)
+	util.Equals(t, defaultPageCacheStalenessMs*time.Millisecond, firstCache.cache.staleAfter)
+
+	conf["DATA_DIR"] = os.TempDir()
+	other, err := GetConfiguredDriver(&conf)
+	util.Ok(t, err)
+	util.Assert(t, other.(*CachingDriver).cache != firstCache.cache, "drivers configured for other data should not share a page cache")
+
+	conf["PAGE_CACHE_SIZE_MB"] = "0"
+	uncached, err := GetConfiguredDriver(&conf)
+	util.Ok(t, err)
+	_, ok = uncached.(FilesystemDriver)
+	util.Assert(t, ok, "a driver configured without a page cache should not be wrapped, got %T", uncached)
+}
+
+// test that the pages of an index locked through the driver are read from the wrapped driver
+func TestCachingDriverBypassesLockedIndexes(t *testing.T) {
+	indexName := "test_map_index"
+	m, c := newCachedMemoryDriver(t, indexName, 1<<20, time.Hour)
+
+	_, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	// written by another process
+	err = m.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	err = c.LockIndex(indexName)
+	util.Ok(t, err)
+	// extending the lock
+	err = c.LockIndex(indexName)
+	util.Ok(t, err)
+	vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+	err = c.UnlockIndex(indexName)
+	util.Ok(t, err)
+
+	// the page read holding the lock is cached
+	vals, _, _, err = c.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+	stats := c.Stats()
+	util.Equals(t, uint64(2), stats.Misses)
+	util.Equals(t, uint64(1), stats.Hits)
+}
@@ -0,0 +1,216 @@
+package driver
+
+import (
+	"fmt"
+	"sync"
+)
+
+// CoalescingDriver wraps a storage driver shared by queries running at the same time. Concurrent reads of the
+// same page or metadata file are sent to the wrapped driver once, and every caller receives its own copy of
+// the result. A read never shares the result of a read which started before the last write to its index
+// completed, so readers holding the index write lock always see the latest data
+type CoalescingDriver struct {
+	StorageDriver
+	mutex sync.Mutex
+	// incremented after every write to an index
+	generations map[string]uint64
+	// reads in progress by key
+	flights map[string]*flight
+}
+
+// flight is a read in progress
+type flight struct {
+	done   chan struct{}
+	result interface{}
+	err    error
+	// the number of callers waiting on the read, excluding the caller performing it
+	waiting int
+}
+
+type autoPageResult struct {
+	vals        map[uint64]string
+	orderedKeys []uint64
+}
+
+type mapPageResult struct {
+	vals        map[string]string
+	orderedKeys []string
+	expiries    map[string]int64
+}
+
+// copy returns a copy of the page which can be modified without changing the page
+func (p autoPageResult) copy() autoPageResult {
+	vals := make(map[uint64]string, len(p.vals))
+	for key, val := range p.vals {
+		vals[key] = val
+	}
+	return autoPageResult{vals: vals, orderedKeys: append([]uint64{}, p.orderedKeys...)}
+}
+
+// copy returns a copy of the page which can be modified without changing the page
+func (p mapPageResult) copy() mapPageResult {
+	vals := make(map[string]string, len(p.vals))
+	for key, val := range p.vals {
+		vals[key] = val
+	}
+	expiries := make(map[string]int64, len(p.expiries))
+	for key, expiry := range p.expiries {
+		expiries[key] = expiry
+	}
+	return mapPageResult{vals: vals, orderedKeys: append([]string{}, p.orderedKeys...), expiries: expiries}
+}
+
+// NewCoalescingDriver wraps a storage driver to share the results of concurrent reads
+func NewCoalescingDriver(d StorageDriver) *CoalescingDriver {
+	return &CoalescingDriver{
+		StorageDriver: d,
+		generations:   map[string]uint64{},
+		flights:       map[string]*flight{},
+	}
+}
+
+// read performs a read, or waits for an identical read in progress and returns its result. Results are
+// shared between callers, so they must be copied before being returned
+func (c *CoalescingDriver) read(operation string, indexName string, name string, fetch func() (interface{}, error)) (interface{}, error) {
+	c.mutex.Lock()
+	key := fmt.Sprintf("%s\x00%s\x00%s\x00%d", operation, indexName, name, c.generations[indexName])
+	if f, ok := c.flights[key]; ok {
+		f.waiting++
+		c.mutex.Unlock()
+		<-f.done
+		return f.result, f.err
+	}
+	f := &flight{done: make(chan struct{})}
+	c.flights[key] = f
+	c.mutex.Unlock()
+
+	f.result, f.err = fetch()
+
+	c.mutex.Lock()
+	delete(c.flights, key)
+	c.mutex.Unlock()
+	close(f.done)
+
+	return f.result, f.err
+}
+
+// invalidate stops reads of an index which are in progress from being shared with later reads
+func (c *CoalescingDriver) invalidate(indexNames ...string) {
+	c.mutex.Lock()
+	for _, indexName := range indexNames {
+		c.generations[indexName]++
+	}
+	c.mutex.Unlock()
+}
+
+// ReadPage reads an auto index page, sharing the read with concurrent callers
+func (c *CoalescingDriver) ReadPage(filename string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
+	result, err := c.read("page", indexName, fmt.Sprintf("%s\x00%d", filename, pageSize), func() (interface{}, error) {
+		vals, orderedKeys, err := c.StorageDriver.ReadPage(filename, indexName, pageSize)
+		return autoPageResult{vals: vals, orderedKeys: orderedKeys}, err
+	})
+	page := result.(autoPageResult)
+	if err != nil {
+		return page.vals, page.orderedKeys, err
+	}
+
+	page = page.copy()
+	return page.vals, page.orderedKeys, nil
+}
+
+// ReadMapPage reads a map index page, sharing the read with concurrent callers
+func (c *CoalescingDriver) ReadMapPage(filename string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	result, err := c.read("mapPage", indexName, fmt.Sprintf("%s\x00%d", filename, pageSize), func() (interface{}, error) {
+		vals, orderedKeys, expiries, err := c.StorageDriver.ReadMapPage(filename, indexName, pageSize)
+		return mapPageResult{vals: vals, orderedKeys: orderedKeys, expiries: expiries}, err
+	})
+	page := result.(mapPageResult)
+	if err != nil {
+		return page.vals, page.orderedKeys, page.expiries, err
+	}
+
+	page = page.copy()
+	return page.vals, page.orderedKeys, page.expiries, nil
+}
+
+// ListPages lists the pages of an index, sharing the read with concurrent callers
+func (c *CoalescingDriver) ListPages(indexName string, desc bool) ([]string, error) {
+	result, err := c.read("list", indexName, fmt.Sprintf("%t", desc), func() (interface{}, error) {
+		return c.StorageDriver.ListPages(indexName, desc)
+	})
+	pageNames, _ := result.([]string)
+	if err != nil {
+		return pageNames, err
+	}
+	return append([]string{}, pageNames...), nil
+}
+
+// ReadMeta reads a metadata file, sharing the read with concurrent callers
+func (c *CoalescingDriver) ReadMeta(indexName string, metaName string) ([]byte, error) {
+	result, err := c.read("meta", indexName, metaName, func() (interface{}, error) {
+		return c.StorageDriver.ReadMeta(indexName, metaName)
+	})
+	data, _ := result.([]byte)
+	if err != nil {
+		return data, err
+	}
+	return append([]byte{}, data...), nil
+}
+
+// WritePage writes an auto index page
+func (c *CoalescingDriver) WritePage(vals map[uint64]string, orderedKeys []uint64, filename string, indexName string) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.WritePage(vals, orderedKeys, filename, indexName)
+}
+
+// WriteMapPage writes a map index page
+func (c *CoalescingDriver) WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, filename string, indexName string) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.WriteMapPage(vals, orderedKeys, expiries, filename, indexName)
+}
+
+// WriteMeta writes a metadata file
+func (c *CoalescingDriver) WriteMeta(indexName string, metaName string, data []byte) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.WriteMeta(indexName, metaName, data)
+}
+
+// CreateAutoIndex creates an auto index
+func (c *CoalescingDriver) CreateAutoIndex(indexName string, pageSize int) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.CreateAutoIndex(indexName, pageSize)
+}
+
+// CreateMapIndex creates a map index
+func (c *CoalescingDriver) CreateMapIndex(indexName string, pageSize int) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.CreateMapIndex(indexName, pageSize)
+}
+
+// DropAutoIndex drops an auto index
+func (c *CoalescingDriver) DropAutoIndex(indexName string) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.DropAutoIndex(indexName)
+}
+
+// DropMapIndex drops a map index
+func (c *CoalescingDriver) DropMapIndex(indexName string) error {
+	defer c.invalidate(indexName)
+	return c.StorageDriver.DropMapIndex(indexName)
+}
+
+// ReplaceIndex replaces the pages and metadata of an index with those of another index
+func (c *CoalescingDriver) ReplaceIndex(indexName string, replacementName string) error {
+	defer c.invalidate(indexName, replacementName)
+	return c.StorageDriver.ReplaceIndex(indexName, replacementName)
+}
+
+// CommitWrites writes a set of staged writes
+func (c *CoalescingDriver) CommitWrites(writes WriteSet) error {
+	indexNames := make([]string, 0, writes.Len())
+	for _, w := range writes.writes {
+		indexNames = append(indexNames, w.indexName)
+	}
+	defer c.invalidate(indexNames...)
+	return c.StorageDriver.CommitWrites(writes)
+}
@@ -0,0 +1,122 @@
+package driver
+
+import (
+	"keybite/util"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// blockingDriver counts map page reads, and blocks them until released
+type blockingDriver struct {
+	*MemoryDriver
+	reads   int32
+	started chan struct{}
+	release chan struct{}
+}
+
+func (d *blockingDriver) ReadMapPage(filename string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	atomic.AddInt32(&d.reads, 1)
+	d.started <- struct{}{}
+	<-d.release
+	return d.MemoryDriver.ReadMapPage(filename, indexName, pageSize)
+}
+
+func newBlockingDriver(t *testing.T, indexName string) *blockingDriver {
+	m := NewMemoryDriver()
+	err := m.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = m.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	return &blockingDriver{
+		MemoryDriver: &m,
+		started:      make(chan struct{}, 10),
+		release:      make(chan struct{}),
+	}
+}
+
+// waitForWaiting waits until the number of callers waiting on reads in progress reaches n
+func waitForWaiting(t *testing.T, c *CoalescingDriver, n int) {
+	deadline := time.Now().Add(5 * time.Second)
+	for time.Now().Before(deadline) {
+		c.mutex.Lock()
+		waiting := 0
+		for _, f := range c.flights {
+			waiting += f.waiting
+		}
+		c.mutex.Unlock()
+		if waiting == n {
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+	t.Fatalf("timed out waiting for %d callers to join reads in progress", n)
+}
+
+func TestCoalescingDriverSharesReads(t *testing.T) {
+	indexName := "test_map_index"
+	d := newBlockingDriver(t, indexName)
+	c := NewCoalescingDriver(d)
+
+	const callers = 5
+	results := make([]map[string]string, callers)
+	wg := sync.WaitGroup{}
+	for i := 0; i < callers; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			vals, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+			util.Ok(t, err)
+			results[i] = vals
+		}(i)
+	}
+
+	<-d.started
+	waitForWaiting(t, c, callers-1)
+	close(d.release)
+	wg.Wait()
+
+	util.Equals(t, int32(1), atomic.LoadInt32(&d.reads))
+	for _, vals := range results {
+		util.Equals(t, map[string]string{"a": "1"}, vals)
+	}
+
+	// every caller receives its own copy of the page
+	results[0]["a"] = "changed"
+	util.Equals(t, "1", results[1]["a"])
+}
+
+func TestCoalescingDriverWriteInvalidatesReads(t *testing.T) {
+	indexName := "test_map_index"
+	d := newBlockingDriver(t, indexName)
+	c := NewCoalescingDriver(d)
+
+	wg := sync.WaitGroup{}
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		_, _, _, err := c.ReadMapPage("0", indexName, pageSize)
+		util.Ok(t, err)
+	}()
+	<-d.started
+
+	// a read started after a write completes must not share the read started before it
+	err := c.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	var vals map[string]string
+	go func() {
+		defer wg.Done()
+		vals, _, _, err = c.ReadMapPage("0", indexName, pageSize)
+		util.Ok(t, err)
+	}()
+	<-d.started
+
+	close(d.release)
+	wg.Wait()
+
+	util.Equals(t, int32(2), atomic.LoadInt32(&d.reads))
+	util.Equals(t, "2", vals["a"])
+}
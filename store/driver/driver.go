@@ -15,15 +15,33 @@ import (
 // vary by driver and environment)
 type StorageDriver interface {
 	ReadPage(filename string, indexName string, pageSize int) (map[uint64]string, []uint64, error)
-	ReadMapPage(filename string, indexName string, pageSize int) (map[string]string, []string, error)
 	WritePage(vals map[uint64]string, orderedKeys []uint64, filename string, indexName string) error
-	WriteMapPage(vals map[string]string, orderedKeys []string, filename string, indexName string) error
-	CreateAutoIndex(indexName string) error
-	CreateMapIndex(indexName string) error
+	// map pages also hold the expiry time of expiring records, in milliseconds since the epoch
+	ReadMapPage(filename string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error)
+	WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, filename string, indexName string) error
+	// create an index, recording its kind and page size in the index manifest
+	CreateAutoIndex(indexName string, pageSize int) error
+	CreateMapIndex(indexName string, pageSize int) error
 	DropAutoIndex(indexName string) error
 	DropMapIndex(indexName string) error
+	// replace the pages and metadata of an index with those of another index of the same kind,
+	// removing the replacement index
+	ReplaceIndex(indexName string, replacementName string) error
+	// write a set of staged page and metadata writes together. Each driver documents how close to
+	// all-or-nothing its commits are
+	CommitWrites(writes WriteSet) error
 	// return an ascending-sorted list of pagefiles in the index datadir
 	ListPages(indexName string, desc bool) ([]string, error)
+	// read a metadata file (like the index manifest) stored alongside the index pages
+	ReadMeta(indexName string, metaName string) ([]byte, error)
+	// persist a metadata file alongside the index pages
+	WriteMeta(indexName string, metaName string, data []byte) error
+	// report whether writing a file which changed since it was read fails with a write conflict error, in
+	// which case writers retry their writes on conflicts instead of locking indexes
+	WritesConditionally() bool
+	// report whether writes are staged for a transaction or the write-ahead log instead of being written.
+	// Drivers wrapping another driver report whether the wrapped driver stages its writes
+	IsStaged() bool
 	// check if an index is locked by another request process, returning the time at which it was locked if true
 	IndexIsLocked(indexName string) (bool, time.Time, error)
 	// lock an index
@@ -34,65 +52,127 @@ type StorageDriver interface {
 
 const lockfileExtension = ".lock"
 
-// GetConfiguredDriver returns the correct driver based on config
+// default age after which cached pages are revalidated, in milliseconds
+const defaultPageCacheStalenessMs = 1000
+
+// GetConfiguredDriver returns the correct driver based on config. When a page cache is configured, the driver
+// caches pages in a cache shared by the drivers of the process which read the same data
 func GetConfiguredDriver(conf *config.Config) (StorageDriver, error) {
-	driverType, err := conf.GetString("DRIVER")
+	d, location, err := configuredStorageDriver(conf)
 	if err != nil {
 		return nil, err
 	}
 
-	pageExtension, err := conf.GetString("PAGE_EXTENSION")
+	cache, err := configuredPageCache(conf, location)
 	if err != nil {
 		return nil, err
 	}
+	if cache == nil {
+		return d, nil
+	}
+	return NewCachingDriver(d, cache), nil
+}
+
+// configuredStorageDriver returns the driver selected by config, along with the location of the data it reads
+func configuredStorageDriver(conf *config.Config) (StorageDriver, string, error) {
+	driverType, err := conf.GetString("DRIVER")
+	if err != nil {
+		return nil, "", err
+	}
+
+	pageExtension, err := conf.GetString("PAGE_EXTENSION")
+	if err != nil {
+		return nil, "", err
+	}
 
 	switch strings.ToLower(driverType) {
 	case "filesystem":
 		dataDir, err := conf.GetString("DATA_DIR")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		lockMs, err := conf.GetInt64("LOCK_DURATION_FS")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		lockDuration := toMillisDuration(lockMs)
 
-		return NewFilesystemDriver(dataDir, pageExtension, lockDuration)
-
-	case "s3":
-		bucketName, err := conf.GetString("BUCKET_NAME")
+		syncLevel, err := ParseSyncLevel(conf.GetStringOrEmpty("FS_SYNC"))
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
-		accessKeyID, err := conf.GetString("AWS_ACCESS_KEY_ID")
+		d, err := NewFilesystemDriver(dataDir, pageExtension, lockDuration, syncLevel)
+		return d, "filesystem\x00" + dataDir + "\x00" + pageExtension, err
+
+	case "s3":
+		bucketName, err := conf.GetString("BUCKET_NAME")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
-		accessKeySecret, err := conf.GetString("AWS_SECRET_ACCESS_KEY")
+		options, err := configuredBucketOptions(conf)
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
-		accessKeyToken := conf.GetStringOrEmpty("AWS_SESSION_TOKEN")
-
 		lockMs, err := conf.GetInt64("LOCK_DURATION_S3")
 		if err != nil {
-			return nil, err
+			return nil, "", err
 		}
 
 		lockDuration := toMillisDuration(lockMs)
 
-		return NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, accessKeyToken, lockDuration)
+		d, err := NewBucketDriver(pageExtension, bucketName, options, lockDuration)
+		return d, "s3\x00" + options.Endpoint + "\x00" + bucketName + "\x00" + pageExtension, err
 
 	default:
 		err := fmt.Errorf("there is no driver available with name %s", driverType)
+		return nil, "", err
+	}
+}
+
+// configuredPageCache returns the page cache of the process for the data at a location, or nil when no page
+// cache is configured
+func configuredPageCache(conf *config.Config, location string) (*PageCache, error) {
+	if conf.GetStringOrEmpty("PAGE_CACHE_SIZE_MB") == "" {
+		return nil, nil
+	}
+	sizeMB, err := conf.GetInt("PAGE_CACHE_SIZE_MB")
+	if err != nil {
 		return nil, err
 	}
+	if sizeMB <= 0 {
+		return nil, nil
+	}
+
+	stalenessMs := int64(defaultPageCacheStalenessMs)
+	if conf.GetStringOrEmpty("PAGE_CACHE_STALENESS") != "" {
+		stalenessMs, err = conf.GetInt64("PAGE_CACHE_STALENESS")
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return sharedPageCache(location, sizeMB<<20, toMillisDuration(stalenessMs)), nil
+}
+
+// configuredBucketOptions reads the location of the S3 service from config
+func configuredBucketOptions(conf *config.Config) (BucketOptions, error) {
+	options := BucketOptions{
+		Region:   conf.GetStringOrEmpty("S3_REGION"),
+		Endpoint: conf.GetStringOrEmpty("S3_ENDPOINT"),
+	}
+	if forcePathStyle := conf.GetStringOrEmpty("S3_FORCE_PATH_STYLE"); forcePathStyle != "" {
+		var err error
+		options.ForcePathStyle, err = strconv.ParseBool(forcePathStyle)
+		if err != nil {
+			return options, fmt.Errorf("invalid S3_FORCE_PATH_STYLE '%s': %w", forcePathStyle, err)
+		}
+	}
+	return options, nil
 }
 
 func isLockfile(path string) bool {
@@ -32,6 +32,10 @@ const (
 	errCodeInternalStorageFailure = "ERR_INTERNAL_DRIVER_FAILURE"
 	errCodeDataDirNotExist        = "ERR_DATA_DIR_NOT_EXIST"
 	errCodePageNotExist           = "ERR_PAGE_NOT_EXIST"
+	errCodeMetaNotExist           = "ERR_META_NOT_EXIST"
+	errCodeInvalidManifest        = "ERR_INVALID_MANIFEST"
+	errCodeNotTransactional       = "ERR_NOT_TRANSACTIONAL"
+	errCodeWriteConflict          = "ERR_WRITE_CONFLICT"
 )
 
 // errIndexNotExist indicates the requested index could not be found
@@ -134,3 +138,46 @@ func IsPageNotExist(err error) bool {
 
 	return false
 }
+
+// errMetaNotExist indicates the index exists, but the requested metadata file does not
+func errMetaNotExist(indexName, metaName string, err error) Error {
+	return Error{
+		InternalErr: err,
+		Message:     fmt.Sprintf("Metadata '%s' not found in index '%s'", metaName, indexName),
+		Code:        errCodeMetaNotExist,
+	}
+}
+
+// IsMetaNotExist indicates if an error is a missing metadata error
+func IsMetaNotExist(err error) bool {
+	e, ok := err.(Error)
+	if ok && e.Code == errCodeMetaNotExist {
+		return true
+	}
+
+	return false
+}
+
+// errInvalidManifest indicates an index manifest cannot be written because its settings are invalid
+func errInvalidManifest(indexName string, err error) Error {
+	return Error{
+		InternalErr: err,
+		Message:     fmt.Sprintf("Invalid manifest for index '%s': %s", indexName, err.Error()),
+		Code:        errCodeInvalidManifest,
+	}
+}
+
+// errWriteConflict indicates a file was changed by another writer since it was read, so it was not overwritten
+func errWriteConflict(indexName, fileName string, err error) Error {
+	return Error{
+		InternalErr: err,
+		Message:     fmt.Sprintf("File '%s' in index '%s' was changed by another writer", fileName, indexName),
+		Code:        errCodeWriteConflict,
+	}
+}
+
+// IsWriteConflict indicates if an error is a write conflict error
+func IsWriteConflict(err error) bool {
+	e, ok := err.(Error)
+	return ok && e.Code == errCodeWriteConflict
+}
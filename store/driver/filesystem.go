@@ -1,7 +1,6 @@
 package driver
 
 import (
-	"bufio"
 	"fmt"
 	"io/ioutil"
 	"keybite/util/log"
@@ -9,18 +8,53 @@ import (
 	"path"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 )
 
+// extension of the temporary files written before they are renamed over page and metadata files
+const tempFileExtension = ".tmp"
+
+// SyncLevel controls how durable the writes of the filesystem driver are. Files are always written to a
+// temporary file which is renamed over the file it replaces, so readers never observe a partially written
+// file, but a write may be lost or torn by a crash of the host unless it is synced to the disk
+type SyncLevel int
+
+const (
+	// SyncNone leaves flushing writes to the operating system
+	SyncNone SyncLevel = iota
+	// SyncFile syncs each file to the disk before it is renamed into place
+	SyncFile
+	// SyncFull also syncs the directory holding each renamed file, so that the rename survives a crash
+	SyncFull
+)
+
+// ParseSyncLevel parses a sync level from its name: 'none', 'file' or 'full'. The empty string selects full
+func ParseSyncLevel(name string) (SyncLevel, error) {
+	switch strings.ToLower(name) {
+	case "none":
+		return SyncNone, nil
+	case "file":
+		return SyncFile, nil
+	case "full", "":
+		return SyncFull, nil
+	default:
+		return SyncFull, fmt.Errorf("invalid filesystem sync level '%s': must be one of 'none', 'file' or 'full'", name)
+	}
+}
+
 // FilesystemDriver enables writing and reading indexes from local filesystem
 type FilesystemDriver struct {
 	dataDir       string
 	pageExtension string
 	lockDuration  time.Duration
+	syncLevel     SyncLevel
+	// generations of the indexes seen by the driver
+	generations *indexGenerations
 }
 
 // NewFilesystemDriver instantiates a new filesystem storage driver
-func NewFilesystemDriver(dataDir string, pageExtension string, lockDuration time.Duration) (FilesystemDriver, error) {
+func NewFilesystemDriver(dataDir string, pageExtension string, lockDuration time.Duration, syncLevel SyncLevel) (FilesystemDriver, error) {
 	_, err := os.Stat(dataDir)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -33,107 +67,72 @@ func NewFilesystemDriver(dataDir string, pageExtension string, lockDuration time
 		dataDir:       dataDir,
 		pageExtension: pageExtension,
 		lockDuration:  lockDuration,
+		syncLevel:     syncLevel,
+		generations:   newIndexGenerations(),
 	}, nil
 }
 
 // ReadPage reads a file into a map
 func (d FilesystemDriver) ReadPage(fileName string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
-	vals := make(map[uint64]string, pageSize)
-	orderedKeys := make([]uint64, 0, pageSize)
-
 	pageFile, err := d.openPageFile(indexName, fileName)
 	if err != nil {
-		return vals, orderedKeys, err
+		return map[uint64]string{}, []uint64{}, err
 	}
 	defer pageFile.Close()
 
-	scanner := bufio.NewScanner(pageFile)
-	i := 0
-	for scanner.Scan() {
-		key, value, err := stringToKeyValue(scanner.Text())
-		if err != nil {
-			return vals, orderedKeys, errBadIndexData(indexName, fileName, err)
-		}
-		vals[key] = unescapeNewlines(value)
-		orderedKeys = append(orderedKeys, key)
-		i++
+	vals, orderedKeys, err := decodePage(pageFile, pageSize)
+	if err != nil {
+		return vals, orderedKeys, errBadIndexData(indexName, fileName, err)
 	}
 
 	return vals, orderedKeys, nil
 }
 
 // ReadMapPage reads a file into a map page
-func (d FilesystemDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, error) {
-	vals := map[string]string{}
-	orderedKeys := make([]string, 0, pageSize)
-
+func (d FilesystemDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
 	pageFile, err := d.openPageFile(indexName, fileName)
 	if err != nil {
-		return vals, orderedKeys, err
+		return map[string]string{}, []string{}, map[string]int64{}, err
 	}
 	defer pageFile.Close()
 
-	scanner := bufio.NewScanner(pageFile)
-	for scanner.Scan() {
-		key, value, err := stringToMapKeyValue(scanner.Text())
-		if err != nil {
-			return vals, orderedKeys, errBadIndexData(indexName, fileName, err)
-		}
-		vals[key] = unescapeNewlines(value)
-		orderedKeys = append(orderedKeys, key)
+	vals, orderedKeys, expiries, err := decodeMapPage(pageFile, pageSize)
+	if err != nil {
+		return vals, orderedKeys, expiries, errBadIndexData(indexName, fileName, err)
 	}
 
-	return vals, orderedKeys, nil
+	return vals, orderedKeys, expiries, nil
 }
 
 // WritePage persists a new or updated page as a file in the datadir
 func (d FilesystemDriver) WritePage(vals map[uint64]string, orderedKeys []uint64, fileName string, indexName string) error {
-	file, err := d.openOrCreatPageFileForWrite(indexName, fileName)
-	defer file.Close()
-
-	// truncate file before writing
-	err = file.Truncate(0)
+	filePath := d.pagePath(indexName, fileName)
+	err := d.replaceFile(filePath, encodePage(vals, orderedKeys))
 	if err != nil {
-		return errInternalDriverFailure("truncating page file for update", err)
-	}
-
-	for _, key := range orderedKeys {
-		line := fmt.Sprintf("%d:%s\n", key, escapeNewlines(vals[key]))
-		_, err = file.Write([]byte(line))
-		if err != nil {
-			return errInternalDriverFailure("writing data to file", err)
+		if os.IsNotExist(err) {
+			return errIndexNotExist(indexName, err)
 		}
+		return errInternalDriverFailure("writing index page", err)
 	}
-
 	return nil
 }
 
 // WriteMapPage persists a new or updated map page as a file in the dataDir
-func (d FilesystemDriver) WriteMapPage(vals map[string]string, orderedKeys []string, fileName string, indexName string) error {
-	file, err := d.openOrCreatPageFileForWrite(indexName, fileName)
-	defer file.Close()
-
-	// truncate file before writing
-	err = file.Truncate(0)
+func (d FilesystemDriver) WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, fileName string, indexName string) error {
+	filePath := d.pagePath(indexName, fileName)
+	err := d.replaceFile(filePath, encodeMapPage(vals, orderedKeys, expiries))
 	if err != nil {
-		return errInternalDriverFailure("truncating page file for update", err)
-	}
-
-	for _, key := range orderedKeys {
-		line := fmt.Sprintf("%s:%s\n", key, escapeNewlines(vals[key]))
-		_, err = file.Write([]byte(line))
-		if err != nil {
-			return errInternalDriverFailure("writing data to file", err)
+		if os.IsNotExist(err) {
+			return errIndexNotExist(indexName, err)
 		}
+		return errInternalDriverFailure("writing index page", err)
 	}
-
 	return nil
 }
 
-// ListPages lists the page files in the data directory
+// ListPages lists the page files of the current generation of an index
 func (d FilesystemDriver) ListPages(indexName string, desc bool) ([]string, error) {
-	indexPath := path.Join(d.dataDir, indexName)
-	files, err := ioutil.ReadDir(indexPath)
+	files, err := ioutil.ReadDir(d.generationPath(indexName))
 	if err != nil {
 		if os.IsNotExist(err) {
 			return []string{}, errIndexNotExist(indexName, err)
@@ -144,8 +143,8 @@ func (d FilesystemDriver) ListPages(indexName string, desc bool) ([]string, erro
 	fileNames := []string{}
 	for _, file := range files {
 		fName := file.Name()
-		// exclude lock files from results
-		if isLockfile(fName) {
+		// exclude lock, metadata, temporary and uncommitted transaction files, and generation folders, from results
+		if file.IsDir() || isLockfile(fName) || isMetaFile(fName) || isTempFile(fName) || isTransactionFile(fName) {
 			continue
 		}
 		fileNames = append(fileNames, fName)
@@ -154,27 +153,72 @@ func (d FilesystemDriver) ListPages(indexName string, desc bool) ([]string, erro
 	return sortFileNames(fileNames, d.pageExtension, desc), nil
 }
 
-// CreateAutoIndex creates the folder for an auto index in the data dir
-func (d FilesystemDriver) CreateAutoIndex(indexName string) error {
+// CreateAutoIndex creates the folder and manifest for an auto index in the data dir
+func (d FilesystemDriver) CreateAutoIndex(indexName string, pageSize int) error {
+	return d.createIndex(indexName, NewManifest(KindAuto, pageSize))
+}
+
+// CreateMapIndex creates the folder and manifest for a map index in the data dir
+func (d FilesystemDriver) CreateMapIndex(indexName string, pageSize int) error {
+	return d.createIndex(indexName, NewManifest(KindMap, pageSize))
+}
+
+func (d FilesystemDriver) createIndex(indexName string, manifest IndexManifest) error {
 	indexPath := path.Join(d.dataDir, indexName)
 	err := os.Mkdir(indexPath, 0755)
 	if err != nil {
-		return errInternalDriverFailure("create auto index", err)
+		if !os.IsExist(err) {
+			return errInternalDriverFailure("create "+manifest.Kind+" index", err)
+		}
+		// the folder may belong to an index created before manifests were introduced
+		if err := ensureNoManifest(d, indexName); err != nil {
+			return err
+		}
 	}
-	return nil
+	return WriteManifest(d, indexName, manifest)
 }
 
-// CreateMapIndex creates the folder for a map index in the data dir
-func (d FilesystemDriver) CreateMapIndex(indexName string) error {
-	indexPath := path.Join(d.dataDir, indexName)
-	err := os.Mkdir(indexPath, 0755)
+// ReadMeta reads a metadata file from an index folder
+func (d FilesystemDriver) ReadMeta(indexName string, metaName string) ([]byte, error) {
+	filePath := d.metaPath(indexName, metaName)
+	data, err := ioutil.ReadFile(filePath)
+	if err != nil {
+		if os.IsNotExist(err) {
+			indexExists, existsErr := d.indexExists(indexName)
+			if existsErr != nil {
+				return data, existsErr
+			}
+			if !indexExists {
+				return data, errIndexNotExist(indexName, err)
+			}
+			return data, errMetaNotExist(indexName, metaName, err)
+		}
+		return data, errInternalDriverFailure("reading index metadata", err)
+	}
+	if metaName == manifestMetaName {
+		d.generations.observeManifest(indexName, data)
+	}
+	return data, nil
+}
+
+// WriteMeta persists a metadata file in an index folder
+func (d FilesystemDriver) WriteMeta(indexName string, metaName string, data []byte) error {
+	filePath := d.metaPath(indexName, metaName)
+	err := d.replaceFile(filePath, data)
 	if err != nil {
-		return errInternalDriverFailure("create map index", err)
+		if os.IsNotExist(err) {
+			return errIndexNotExist(indexName, err)
+		}
+		return errInternalDriverFailure("writing index metadata", err)
+	}
+	if metaName == manifestMetaName {
+		d.generations.observeManifest(indexName, data)
 	}
 	return nil
 }
 
-// LockIndex creates a lockfile in the specified index
+// LockIndex creates a lockfile in the specified index. The index may have been replaced while the lock was
+// awaited, so the generation of the index is read again from its manifest once it is locked
 func (d FilesystemDriver) LockIndex(indexName string) error {
 	log.Debugf("locking index %s for writes", indexName)
 	lockExpires := time.Now().Add(d.lockDuration)
@@ -189,6 +233,7 @@ func (d FilesystemDriver) LockIndex(indexName string) error {
 	}
 
 	defer file.Close()
+	d.generations.forget(indexName)
 	return nil
 }
 
@@ -211,6 +256,16 @@ func (d FilesystemDriver) UnlockIndex(indexName string) error {
 	return nil
 }
 
+// WritesConditionally is false, since filesystem writers lock indexes
+func (d FilesystemDriver) WritesConditionally() bool {
+	return false
+}
+
+// IsStaged is false, since writes are written to files immediately
+func (d FilesystemDriver) IsStaged() bool {
+	return false
+}
+
 // IndexIsLocked checks if an index is locked by another request process, returning the time at which the lock expires
 func (d FilesystemDriver) IndexIsLocked(indexName string) (bool, time.Time, error) {
 	log.Debugf("checking index %s for write locks", indexName)
@@ -245,6 +300,7 @@ func (d FilesystemDriver) IndexIsLocked(indexName string) (bool, time.Time, erro
 
 // DropAutoIndex permanently deletes all the data and directory for an auto index
 func (d FilesystemDriver) DropAutoIndex(indexName string) error {
+	defer d.generations.forget(indexName)
 	indexPath := path.Join(d.dataDir, indexName)
 	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
 		return errIndexNotExist(indexName, err)
@@ -258,6 +314,7 @@ func (d FilesystemDriver) DropAutoIndex(indexName string) error {
 
 // DropMapIndex permanently deletes all the data and directory for a map index
 func (d FilesystemDriver) DropMapIndex(indexName string) error {
+	defer d.generations.forget(indexName)
 	indexPath := path.Join(d.dataDir, indexName)
 	if _, err := os.Stat(indexPath); os.IsNotExist(err) {
 		return errIndexNotExist(indexName, err)
@@ -269,6 +326,190 @@ func (d FilesystemDriver) DropMapIndex(indexName string) error {
 	return nil
 }
 
+// ReplaceIndex moves the current generation of the replacement index into the next generation of the index,
+// then switches the index to it by writing the manifest of the replacement as the manifest of the index. The
+// manifest is replaced atomically, so readers find either the original index or the replacement, never a
+// missing index. The previous generation and the replacement index are removed once the manifest is written,
+// so, as with the bucket driver, a request which opened the index before it was replaced may find its pages
+// missing. A replace interrupted before the manifest is written leaves the original index in place, along with
+// an unused generation which the next replace removes
+func (d FilesystemDriver) ReplaceIndex(indexName string, replacementName string) error {
+	replacement, err := ReadManifest(d, replacementName)
+	if err != nil {
+		return err
+	}
+	generation := 0
+	manifest, err := ReadManifest(d, indexName)
+	if err == nil {
+		generation = manifest.Generation
+	} else if !IsMetaNotExist(err) {
+		return err
+	}
+
+	indexPath := path.Join(d.dataDir, indexName)
+	currentPath := path.Join(d.dataDir, generationFolder(indexName, generation))
+	newPath := path.Join(d.dataDir, generationFolder(indexName, generation+1))
+	replacementPath := path.Join(d.dataDir, generationFolder(replacementName, replacement.Generation))
+
+	// generations left behind by interrupted replaces
+	folders, err := ioutil.ReadDir(indexPath)
+	if err != nil {
+		return errInternalDriverFailure("reading index folder", err)
+	}
+	for _, folder := range folders {
+		folderPath := path.Join(indexPath, folder.Name())
+		if folder.IsDir() && strings.HasPrefix(folder.Name(), generationFolderPrefix) && folderPath != currentPath {
+			err = os.RemoveAll(folderPath)
+			if err != nil {
+				return errInternalDriverFailure("removing unused index generation", err)
+			}
+		}
+	}
+
+	err = os.Rename(replacementPath, newPath)
+	if err != nil {
+		return errInternalDriverFailure("moving replacement index into place", err)
+	}
+	replacement.Generation = generation + 1
+	err = WriteManifest(d, indexName, replacement)
+	if err != nil {
+		// put the replacement back, leaving the original index in place
+		if restoreErr := os.Rename(newPath, replacementPath); restoreErr != nil {
+			log.Errorf("restoring replacement index %s after failed replacement failed: %s", replacementName, restoreErr.Error())
+		}
+		return err
+	}
+
+	// the manifest and lockfiles of the replacement, and every file of the previous generation, are left over
+	d.removeFiles(newPath, func(fileName string) bool {
+		return fileName == manifestMetaName+metaExtension || isLockfile(fileName)
+	})
+	if generation == 0 {
+		d.removeFiles(indexPath, func(fileName string) bool {
+			return fileName != manifestMetaName+metaExtension && !isLockfile(fileName)
+		})
+	} else if err := os.RemoveAll(currentPath); err != nil {
+		log.Warnf("removing replaced generation of index %s failed: %s", indexName, err.Error())
+	}
+	err = os.RemoveAll(path.Join(d.dataDir, replacementName))
+	if err != nil {
+		log.Warnf("removing replacement index %s failed: %s", replacementName, err.Error())
+	}
+	d.generations.forget(replacementName)
+
+	err = d.syncDir(d.dataDir)
+	if err != nil {
+		return errInternalDriverFailure("syncing data directory", err)
+	}
+	return nil
+}
+
+// removeFiles removes the files of a folder selected by their name, leaving its subfolders
+func (d FilesystemDriver) removeFiles(folderPath string, selected func(fileName string) bool) {
+	files, err := ioutil.ReadDir(folderPath)
+	if err != nil {
+		log.Warnf("reading folder %s to remove files failed: %s", folderPath, err.Error())
+		return
+	}
+	for _, file := range files {
+		if file.IsDir() || !selected(file.Name()) {
+			continue
+		}
+		if err := os.Remove(path.Join(folderPath, file.Name())); err != nil && !os.IsNotExist(err) {
+			log.Warnf("removing file %s failed: %s", file.Name(), err.Error())
+		}
+	}
+}
+
+// CommitWrites writes a set of staged page and metadata files. Each file is first written to a temporary
+// file beside it, and the temporary files are only renamed into place once all of them have been written, so
+// a failed write leaves every index unchanged. Each rename is atomic, but readers may observe some of the
+// renamed files before the rest, and a crash while renaming leaves part of the set applied
+func (d FilesystemDriver) CommitWrites(writes WriteSet) error {
+	tempPaths := make([]string, 0, writes.Len())
+	removeTempFiles := func() {
+		for _, tempPath := range tempPaths {
+			if err := os.Remove(tempPath); err != nil && !os.IsNotExist(err) {
+				log.Warnf("removing uncommitted transaction file %s failed: %s", tempPath, err.Error())
+			}
+		}
+	}
+
+	for _, w := range writes.writes {
+		filePath := d.stagedWritePath(w)
+		tempPath := filePath + transactionFileExtension
+		err := d.writeSyncedFile(tempPath, w.data)
+		if err == nil {
+			// files keep their mode when they are replaced
+			err = os.Chmod(tempPath, replacedFileMode(filePath))
+		}
+		if err != nil {
+			removeTempFiles()
+			if os.IsNotExist(err) {
+				return errIndexNotExist(w.indexName, err)
+			}
+			return errInternalDriverFailure("writing transaction file", err)
+		}
+		tempPaths = append(tempPaths, tempPath)
+	}
+
+	dirs := map[string]bool{}
+	for i, w := range writes.writes {
+		filePath := d.stagedWritePath(w)
+		err := os.Rename(tempPaths[i], filePath)
+		if err != nil {
+			log.Errorf("committing transaction failed after %d of %d files were written: %s", i, writes.Len(), err.Error())
+			removeTempFiles()
+			return errInternalDriverFailure("moving transaction file into place", err)
+		}
+		dirs[path.Dir(filePath)] = true
+	}
+
+	for dir := range dirs {
+		err := d.syncDir(dir)
+		if err != nil {
+			return errInternalDriverFailure("syncing index directory", err)
+		}
+	}
+
+	return nil
+}
+
+// stagedWritePath returns the path of the file written by a staged write
+func (d FilesystemDriver) stagedWritePath(w stagedWrite) string {
+	if w.kind == writeMeta {
+		return d.metaPath(w.indexName, w.name)
+	}
+	return d.pagePath(w.indexName, w.name)
+}
+
+// generationPath returns the folder holding the current generation of an index, reading the manifest of the
+// index when the driver has not seen it. Indexes without a readable manifest are stored in generation 0
+func (d FilesystemDriver) generationPath(indexName string) string {
+	generation, ok := d.generations.get(indexName)
+	if !ok {
+		manifest, err := ReadManifest(d, indexName)
+		if err == nil {
+			generation = manifest.Generation
+		}
+	}
+	return path.Join(d.dataDir, generationFolder(indexName, generation))
+}
+
+// pagePath returns the path of a page of an index
+func (d FilesystemDriver) pagePath(indexName string, fileName string) string {
+	return path.Join(d.generationPath(indexName), addSuffixIfNotExist(fileName, d.pageExtension))
+}
+
+// metaPath returns the path of a metadata file of an index. The manifest is kept in the index folder, since it
+// records the generation
+func (d FilesystemDriver) metaPath(indexName string, metaName string) string {
+	if metaName == manifestMetaName {
+		return path.Join(d.dataDir, indexName, metaName+metaExtension)
+	}
+	return path.Join(d.generationPath(indexName), metaName+metaExtension)
+}
+
 // check if index directory exists in data dir
 func (d FilesystemDriver) indexExists(indexName string) (bool, error) {
 	_, err := os.Stat(path.Join(d.dataDir, indexName))
@@ -283,7 +524,7 @@ func (d FilesystemDriver) indexExists(indexName string) (bool, error) {
 
 // helper for opening page file pointers
 func (d FilesystemDriver) openPageFile(indexName, fileName string) (*os.File, error) {
-	filePath := path.Join(d.dataDir, indexName, addSuffixIfNotExist(fileName, d.pageExtension))
+	filePath := d.pagePath(indexName, fileName)
 	pageFile, err := os.Open(filePath)
 	if err != nil {
 		if os.IsNotExist(err) {
@@ -302,18 +543,76 @@ func (d FilesystemDriver) openPageFile(indexName, fileName string) (*os.File, er
 	return pageFile, nil
 }
 
-func (d FilesystemDriver) openOrCreatPageFileForWrite(indexName, fileName string) (*os.File, error) {
-	filePath := path.Join(d.dataDir, indexName, addSuffixIfNotExist(fileName, d.pageExtension))
-	file, err := os.OpenFile(filePath, os.O_RDWR, 0755)
+// replacedFileMode returns the mode of a file which is about to be replaced, so that the file keeps it, or 0644
+// for new files
+func replacedFileMode(filePath string) os.FileMode {
+	if info, err := os.Stat(filePath); err == nil {
+		return info.Mode().Perm()
+	}
+	return 0644
+}
+
+// replaceFile writes data to a temporary file beside a file and renames it over the file, so that readers
+// observe either the previous or the new contents of the file, never a partial write. The file keeps its mode,
+// and new files are created with mode 0644
+func (d FilesystemDriver) replaceFile(filePath string, data []byte) error {
+	mode := replacedFileMode(filePath)
+
+	tempFile, err := ioutil.TempFile(path.Dir(filePath), path.Base(filePath)+".*"+tempFileExtension)
 	if err != nil {
-		if os.IsNotExist(err) {
-			file, err = os.Create(filePath)
-			if err != nil {
-				return file, errInternalDriverFailure("creating index page", err)
-			}
-		} else {
-			return file, errInternalDriverFailure("reading index page", err)
+		return err
+	}
+	tempPath := tempFile.Name()
+	tempFile.Close()
+
+	// temporary files are created with mode 0600
+	err = os.Chmod(tempPath, mode)
+	if err == nil {
+		err = d.writeSyncedFile(tempPath, data)
+	}
+	if err == nil {
+		err = os.Rename(tempPath, filePath)
+	}
+	if err != nil {
+		if removeErr := os.Remove(tempPath); removeErr != nil && !os.IsNotExist(removeErr) {
+			log.Warnf("removing temporary file %s failed: %s", tempPath, removeErr.Error())
 		}
+		return err
+	}
+
+	return d.syncDir(path.Dir(filePath))
+}
+
+// writeSyncedFile writes data to a file, syncing it to the disk unless the sync level is none
+func (d FilesystemDriver) writeSyncedFile(filePath string, data []byte) error {
+	file, err := os.OpenFile(filePath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(data)
+	if err == nil && d.syncLevel >= SyncFile {
+		err = file.Sync()
 	}
-	return file, nil
+	closeErr := file.Close()
+	if err != nil {
+		return err
+	}
+	return closeErr
+}
+
+// syncDir syncs a directory to the disk when the sync level is full, so that renames into it are durable
+func (d FilesystemDriver) syncDir(dirPath string) error {
+	if d.syncLevel < SyncFull {
+		return nil
+	}
+	dir, err := os.Open(dirPath)
+	if err != nil {
+		return err
+	}
+	defer dir.Close()
+	return dir.Sync()
+}
+
+func isTempFile(path string) bool {
+	return filepath.Ext(path) == tempFileExtension
 }
@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"io/ioutil"
 	"keybite/config"
 	"keybite/util"
 	"os"
@@ -22,11 +23,11 @@ func TestFSCreateAutoIndex(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index"
-	err = fsd.CreateAutoIndex(indexName)
+	err = fsd.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	if _, err := os.Stat(path.Join(dirName, indexName)); os.IsNotExist(err) {
@@ -42,11 +43,11 @@ func TestFSCreateMapIndex(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index"
-	err = fsd.CreateMapIndex(indexName)
+	err = fsd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	if _, err := os.Stat(path.Join(dirName, indexName)); os.IsNotExist(err) {
@@ -58,7 +59,7 @@ func TestFSCreateMapIndex(t *testing.T) {
 func TestFSNewFilesystemDriver(t *testing.T) {
 	dirName := "test_data"
 
-	_, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	_, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	if err == nil {
 		t.Logf("attempting to instantiate filesystem driver on missing directory %s should fail", dirName)
 		t.FailNow()
@@ -69,7 +70,7 @@ func TestFSNewFilesystemDriver(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	_, err = NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	_, err = NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 }
 
@@ -81,11 +82,11 @@ func TestFSWritePageReadPage(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index"
-	err = fsd.CreateMapIndex(indexName)
+	err = fsd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	testMap := map[uint64]string{
@@ -118,11 +119,11 @@ func TestFSWriteMapPageReadMapPage(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index"
-	err = fsd.CreateMapIndex(indexName)
+	err = fsd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	testMap := map[string]string{
@@ -137,10 +138,10 @@ func TestFSWriteMapPageReadMapPage(t *testing.T) {
 	_, err = os.Create(testDataPath)
 	util.Ok(t, err)
 
-	err = fsd.WriteMapPage(testMap, testKeys, testFileName, indexName)
+	err = fsd.WriteMapPage(testMap, testKeys, nil, testFileName, indexName)
 	util.Ok(t, err)
 
-	vals, _, err := fsd.ReadMapPage(testFileName, indexName, 10)
+	vals, _, _, err := fsd.ReadMapPage(testFileName, indexName, 10)
 	util.Ok(t, err)
 
 	util.Equals(t, "hello", vals["1"])
@@ -155,11 +156,11 @@ func TestFSListPages(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index"
-	err = fsd.CreateMapIndex(indexName)
+	err = fsd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	testFileNames := []string{"1", "2", "3", "6", "5", "4", "10", "500"}
@@ -207,11 +208,11 @@ func TestFSLockUnlockIndex(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index"
-	err = fsd.CreateMapIndex(indexName)
+	err = fsd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	err = fsd.LockIndex(indexName)
@@ -242,11 +243,11 @@ func TestFSDropAutoIndex(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	driver, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	driver, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index_drop"
-	err = driver.CreateAutoIndex(indexName)
+	err = driver.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	// test drop existing index
@@ -275,11 +276,11 @@ func TestFSDropMapIndex(t *testing.T) {
 
 	defer os.RemoveAll(dirName)
 
-	driver, err := NewFilesystemDriver(dirName, ".kb", testLockDuration)
+	driver, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
 	util.Ok(t, err)
 
 	indexName := "test_index_drop"
-	err = driver.CreateMapIndex(indexName)
+	err = driver.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	// test drop existing index
@@ -297,3 +298,284 @@ func TestFSDropMapIndex(t *testing.T) {
 	}
 
 }
+
+// test that creating an index writes its manifest, and that indexes without a manifest can be adopted
+func TestFSManifest(t *testing.T) {
+	dirName := "test_data"
+	err := os.Mkdir(dirName, 0755)
+	util.Ok(t, err)
+
+	defer os.RemoveAll(dirName)
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
+	util.Ok(t, err)
+
+	indexName := "test_index"
+	err = fsd.CreateAutoIndex(indexName, pageSize)
+	util.Ok(t, err)
+
+	manifest, err := ReadManifest(fsd, indexName)
+	util.Ok(t, err)
+	util.Equals(t, KindAuto, manifest.Kind)
+	util.Equals(t, pageSize, manifest.PageSize)
+
+	// manifest should not be listed as a page
+	pages, err := fsd.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, 0, len(pages))
+
+	err = fsd.CreateAutoIndex(indexName, pageSize)
+	util.Assert(t, err != nil, "creating an index with a manifest twice should return an error")
+
+	// an index folder created before manifests were introduced
+	legacyIndexName := "legacy_index"
+	err = os.Mkdir(path.Join(dirName, legacyIndexName), 0755)
+	util.Ok(t, err)
+
+	_, err = ReadManifest(fsd, legacyIndexName)
+	util.Assert(t, IsMetaNotExist(err), "reading a missing manifest should return a missing metadata error")
+
+	err = fsd.CreateMapIndex(legacyIndexName, 50)
+	util.Ok(t, err)
+
+	manifest, err = ReadManifest(fsd, legacyIndexName)
+	util.Ok(t, err)
+	util.Equals(t, KindMap, manifest.Kind)
+	util.Equals(t, 50, manifest.PageSize)
+}
+
+// test that replacing an index swaps in the replacement's pages and manifest and removes the replacement
+func TestFSReplaceIndex(t *testing.T) {
+	dirName := "test_data"
+	err := os.Mkdir(dirName, 0755)
+	util.Ok(t, err)
+
+	defer os.RemoveAll(dirName)
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
+	util.Ok(t, err)
+
+	indexName, replacementName := "test_index", "test_index_replacement"
+	err = fsd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = fsd.CreateMapIndex(replacementName, pageSize*2)
+	util.Ok(t, err)
+
+	err = fsd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, "1", indexName)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "replaced"}, []string{"a"}, nil, "0", replacementName)
+	util.Ok(t, err)
+
+	err = fsd.ReplaceIndex(indexName, replacementName)
+	util.Ok(t, err)
+
+	pages, err := fsd.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, []string{"0.kb"}, pages)
+
+	vals, _, _, err := fsd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "replaced", vals["a"])
+
+	manifest, err := ReadManifest(fsd, indexName)
+	util.Ok(t, err)
+	util.Equals(t, pageSize*2, manifest.PageSize)
+
+	util.Equals(t, 1, manifest.Generation)
+
+	_, err = os.Stat(path.Join(dirName, replacementName))
+	util.Assert(t, os.IsNotExist(err), "replacement index folder should be removed")
+	_, err = os.Stat(path.Join(dirName, indexName, "1.kb"))
+	util.Assert(t, os.IsNotExist(err), "pages of the replaced generation should be removed")
+
+	// a second replace moves the index on to the next generation, and a new driver finds it from the manifest
+	err = fsd.CreateMapIndex(replacementName, pageSize)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"b": "replaced again"}, []string{"b"}, nil, "2", replacementName)
+	util.Ok(t, err)
+	err = fsd.ReplaceIndex(indexName, replacementName)
+	util.Ok(t, err)
+
+	reopened, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
+	util.Ok(t, err)
+	pages, err = reopened.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, []string{"2.kb"}, pages)
+	vals, _, _, err = reopened.ReadMapPage("2", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "replaced again", vals["b"])
+
+	_, err = os.Stat(path.Join(dirName, indexName, "gen1"))
+	util.Assert(t, os.IsNotExist(err), "replaced generation folder should be removed")
+	_, err = os.Stat(path.Join(dirName, indexName, "gen2", "2.kb"))
+	util.Ok(t, err)
+
+	err = fsd.ReplaceIndex(indexName, replacementName)
+	util.Assert(t, IsIndexNotExist(err), "replacing with a missing index should return a missing index error")
+}
+
+// test that a replace interrupted before the manifest is written leaves the original index in place, and that
+// the next replace removes the generation it left behind
+func TestFSReplaceIndexInterrupted(t *testing.T) {
+	dirName := "test_data"
+	err := os.Mkdir(dirName, 0755)
+	util.Ok(t, err)
+
+	defer os.RemoveAll(dirName)
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
+	util.Ok(t, err)
+
+	indexName, replacementName := "test_index", "test_index_replacement"
+	err = fsd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	// the replacement was moved into the next generation, but the manifest still points to the first
+	err = os.MkdirAll(path.Join(dirName, indexName, "gen1"), 0755)
+	util.Ok(t, err)
+	err = ioutil.WriteFile(path.Join(dirName, indexName, "gen1", "0.kb"), encodeMapPage(map[string]string{"a": "abandoned"}, []string{"a"}, nil), 0644)
+	util.Ok(t, err)
+
+	vals, _, _, err := fsd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "original", vals["a"])
+
+	err = fsd.CreateMapIndex(replacementName, pageSize)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "replaced"}, []string{"a"}, nil, "1", replacementName)
+	util.Ok(t, err)
+	err = fsd.ReplaceIndex(indexName, replacementName)
+	util.Ok(t, err)
+
+	pages, err := fsd.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, []string{"1.kb"}, pages)
+}
+
+// test that pages are replaced whole at every sync level, leaving no temporary files behind
+func TestFSReplacePage(t *testing.T) {
+	dirName := "test_data"
+	err := os.Mkdir(dirName, 0755)
+	util.Ok(t, err)
+
+	defer os.RemoveAll(dirName)
+
+	for _, syncLevel := range []SyncLevel{SyncNone, SyncFile, SyncFull} {
+		fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, syncLevel)
+		util.Ok(t, err)
+
+		indexName := "test_index_" + strconv.Itoa(int(syncLevel))
+		err = fsd.CreateMapIndex(indexName, pageSize)
+		util.Ok(t, err)
+
+		err = fsd.WriteMapPage(map[string]string{"a": "long original value", "b": "original"}, []string{"a", "b"}, nil, "0", indexName)
+		util.Ok(t, err)
+		err = fsd.WriteMapPage(map[string]string{"a": "short"}, []string{"a"}, nil, "0", indexName)
+		util.Ok(t, err)
+
+		vals, orderedKeys, _, err := fsd.ReadMapPage("0", indexName, pageSize)
+		util.Ok(t, err)
+		util.Equals(t, map[string]string{"a": "short"}, vals)
+		util.Equals(t, []string{"a"}, orderedKeys)
+
+		err = fsd.WritePage(map[uint64]string{1: "one"}, []uint64{1}, "1", indexName)
+		util.Ok(t, err)
+
+		files, err := ioutil.ReadDir(path.Join(dirName, indexName))
+		util.Ok(t, err)
+		for _, file := range files {
+			util.Assert(t, !isTempFile(file.Name()), "temporary file %s left behind", file.Name())
+		}
+
+		// temporary files left by an interrupted write are not pages
+		err = ioutil.WriteFile(path.Join(dirName, indexName, "0.kb.123"+tempFileExtension), []byte("a:parti"), 0644)
+		util.Ok(t, err)
+		pages, err := fsd.ListPages(indexName, false)
+		util.Ok(t, err)
+		util.Equals(t, []string{"0.kb", "1.kb"}, pages)
+	}
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "b"}, []string{"a"}, nil, "0", "missing_index")
+	util.Assert(t, IsIndexNotExist(err), "writing to a missing index should return a missing index error")
+}
+
+// test that replaced pages keep their mode, and new pages are readable by everyone
+func TestFSReplacePageMode(t *testing.T) {
+	dirName := "test_data"
+	err := os.Mkdir(dirName, 0755)
+	util.Ok(t, err)
+	defer os.RemoveAll(dirName)
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncNone)
+	util.Ok(t, err)
+	indexName := "test_index"
+	err = fsd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	pagePath := path.Join(dirName, indexName, "0.kb")
+
+	err = fsd.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	info, err := os.Stat(pagePath)
+	util.Ok(t, err)
+	util.Equals(t, os.FileMode(0644), info.Mode().Perm())
+
+	err = os.Chmod(pagePath, 0640)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	info, err = os.Stat(pagePath)
+	util.Ok(t, err)
+	util.Equals(t, os.FileMode(0640), info.Mode().Perm())
+}
+
+// test that committing several files keeps the mode of the files they replace
+func TestFSCommitWritesMode(t *testing.T) {
+	dirName := "test_data"
+	err := os.Mkdir(dirName, 0755)
+	util.Ok(t, err)
+	defer os.RemoveAll(dirName)
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncNone)
+	util.Ok(t, err)
+	indexName := "test_index"
+	err = fsd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = fsd.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	pagePath := path.Join(dirName, indexName, "0.kb")
+	err = os.Chmod(pagePath, 0640)
+	util.Ok(t, err)
+
+	staging := NewStagingDriver(fsd)
+	err = staging.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+	err = staging.WriteMapPage(map[string]string{"b": "1"}, []string{"b"}, nil, "1", indexName)
+	util.Ok(t, err)
+	err = staging.Commit()
+	util.Ok(t, err)
+
+	info, err := os.Stat(pagePath)
+	util.Ok(t, err)
+	util.Equals(t, os.FileMode(0640), info.Mode().Perm())
+	info, err = os.Stat(path.Join(dirName, indexName, "1.kb"))
+	util.Ok(t, err)
+	util.Equals(t, os.FileMode(0644), info.Mode().Perm())
+}
+
+// test that sync levels are parsed from their names
+func TestParseSyncLevel(t *testing.T) {
+	for name, expected := range map[string]SyncLevel{"none": SyncNone, "file": SyncFile, "FULL": SyncFull, "": SyncFull} {
+		syncLevel, err := ParseSyncLevel(name)
+		util.Ok(t, err)
+		util.Equals(t, expected, syncLevel)
+	}
+
+	_, err := ParseSyncLevel("always")
+	util.Assert(t, err != nil, "parsing an unknown sync level should return an error")
+}
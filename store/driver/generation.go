@@ -0,0 +1,61 @@
+package driver
+
+import (
+	"encoding/json"
+	"path"
+	"strconv"
+	"sync"
+)
+
+// Drivers which cannot replace every file of an index at once, like the bucket and filesystem drivers, store
+// the pages and metadata files of each index in generations, and replace an index by writing its manifest
+// once the replacement is in place as the next generation. The layout is described with the bucket driver
+
+// prefix of the subfolders holding generations of an index after the first
+const generationFolderPrefix = "gen"
+
+// indexGenerations holds the generations of the indexes seen by a driver
+type indexGenerations struct {
+	mutex       sync.Mutex
+	generations map[string]int
+}
+
+func newIndexGenerations() *indexGenerations {
+	return &indexGenerations{generations: map[string]int{}}
+}
+
+func (g *indexGenerations) get(indexName string) (int, bool) {
+	g.mutex.Lock()
+	defer g.mutex.Unlock()
+	generation, ok := g.generations[indexName]
+	return generation, ok
+}
+
+func (g *indexGenerations) set(indexName string, generation int) {
+	g.mutex.Lock()
+	g.generations[indexName] = generation
+	g.mutex.Unlock()
+}
+
+func (g *indexGenerations) forget(indexName string) {
+	g.mutex.Lock()
+	delete(g.generations, indexName)
+	g.mutex.Unlock()
+}
+
+// observeManifest records the generation of an index from the contents of its manifest
+func (g *indexGenerations) observeManifest(indexName string, data []byte) {
+	manifest := IndexManifest{}
+	if err := json.Unmarshal(data, &manifest); err != nil {
+		return
+	}
+	g.set(indexName, manifest.Generation)
+}
+
+// generationFolder returns the folder holding a generation of an index
+func generationFolder(indexName string, generation int) string {
+	if generation == 0 {
+		return indexName
+	}
+	return path.Join(indexName, generationFolderPrefix+strconv.Itoa(generation))
+}
@@ -0,0 +1,139 @@
+package driver
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"time"
+)
+
+// IndexManifest describes the layout of an index. It is written when the index is created
+// and read every time the index is opened, so that settings which determine where records
+// live (like the page size) cannot drift with the environment after data has been written
+type IndexManifest struct {
+	Kind       string    `json:"kind"`
+	PageSize   int       `json:"pageSize"`
+	Addressing string    `json:"addressing,omitempty"`
+	Version    int       `json:"version"`
+	Created    time.Time `json:"created"`
+	// the value indexes maintained from the records of the index
+	ValueIndexes []ValueIndex `json:"valueIndexes,omitempty"`
+	// the index whose records a value index is derived from. Empty for indexes which are not value indexes
+	Source string `json:"source,omitempty"`
+	// whether writes to the index are recorded in its change log
+	ChangeLog bool `json:"changeLog,omitempty"`
+	// the number of versions of each record kept in the history of a map index. No history is kept when 0
+	HistoryVersions int `json:"historyVersions,omitempty"`
+	// whether the write-ahead log of the index may hold an intent. It is set before an intent is recorded and
+	// cleared after the intent is cleared, so that the log is only read when an index is opened during or
+	// after an interrupted write
+	WriteAheadLog bool `json:"writeAheadLog,omitempty"`
+	// the generation holding the pages and metadata of the index, for drivers which replace an index by
+	// writing the replacement as a new generation. Generation 0 is stored directly in the index folder
+	Generation int `json:"generation,omitempty"`
+}
+
+// ValueIndex identifies a map index which maps the values of another index to the keys holding them
+type ValueIndex struct {
+	Name string `json:"name"`
+	// the top-level field of JSON object values which is indexed. The whole value is indexed when empty
+	Field string `json:"field,omitempty"`
+}
+
+const (
+	// KindAuto is the manifest kind of an auto-incrementing index
+	KindAuto = "auto"
+	// KindMap is the manifest kind of a map index
+	KindMap = "map"
+	// ManifestVersion is the index format version written to new manifests
+	ManifestVersion = 3
+	// WriteAheadLogManifestVersion is the first manifest version recording whether the write-ahead log of the
+	// index may hold an intent. The log of indexes with older manifests is read every time they are opened
+	WriteAheadLogManifestVersion = 3
+)
+
+const (
+	// AddressingHash places map keys in pages by the hash of the key. Map indexes created before
+	// version 2 of the manifest use hash addressing
+	AddressingHash = "hash"
+	// AddressingOrdered places map keys in key-ordered pages located through a page directory
+	AddressingOrdered = "ordered"
+)
+
+// metadata files are stored alongside an index's pages, but are never listed as pages
+const metaExtension = ".meta"
+const manifestMetaName = "manifest"
+
+// NewManifest creates a manifest for a new index of the provided kind. New map indexes use ordered addressing
+func NewManifest(kind string, pageSize int) IndexManifest {
+	manifest := IndexManifest{
+		Kind:     kind,
+		PageSize: pageSize,
+		Version:  ManifestVersion,
+		Created:  time.Now().UTC(),
+	}
+	if kind == KindMap {
+		manifest.Addressing = AddressingOrdered
+	}
+	return manifest
+}
+
+// OrderedKeys reports whether the manifest describes a map index with key-ordered pages
+func (m IndexManifest) OrderedKeys() bool {
+	return m.Kind == KindMap && m.Addressing == AddressingOrdered
+}
+
+// MayHaveWriteAheadLog reports whether the write-ahead log of the index must be read to find out whether it holds
+// an intent
+func (m IndexManifest) MayHaveWriteAheadLog() bool {
+	return m.WriteAheadLog || m.Version < WriteAheadLogManifestVersion
+}
+
+// ReadManifest reads the manifest of an index. Indexes created before manifests were
+// introduced have none, in which case a missing metadata error is returned
+func ReadManifest(d StorageDriver, indexName string) (IndexManifest, error) {
+	manifest := IndexManifest{}
+	data, err := d.ReadMeta(indexName, manifestMetaName)
+	if err != nil {
+		return manifest, err
+	}
+
+	err = json.Unmarshal(data, &manifest)
+	if err != nil {
+		return manifest, errBadIndexData(indexName, manifestMetaName+metaExtension, err)
+	}
+
+	return manifest, nil
+}
+
+// WriteManifest persists the manifest of an index
+func WriteManifest(d StorageDriver, indexName string, manifest IndexManifest) error {
+	if manifest.PageSize < 1 {
+		return errInvalidManifest(indexName, fmt.Errorf("page size must be a positive integer, got %d", manifest.PageSize))
+	}
+
+	data, err := json.Marshal(manifest)
+	if err != nil {
+		return errInternalDriverFailure("encoding index manifest", err)
+	}
+
+	return d.WriteMeta(indexName, manifestMetaName, data)
+}
+
+// ensureNoManifest is used when creating an index whose storage location already exists.
+// An index created before manifests were introduced can be adopted by creating it again,
+// but an index that already has a manifest cannot be created twice
+func ensureNoManifest(d StorageDriver, indexName string) error {
+	_, err := ReadManifest(d, indexName)
+	if err == nil {
+		return errIndexAlreadyExist(indexName, fmt.Errorf("index '%s' already has a manifest", indexName))
+	}
+	if IsMetaNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+func isMetaFile(path string) bool {
+	return filepath.Ext(path) == metaExtension
+}
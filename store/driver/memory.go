@@ -1,6 +1,7 @@
 package driver
 
 import (
+	"bytes"
 	"fmt"
 	"keybite/util"
 	"sort"
@@ -31,6 +32,7 @@ type memoryAutoPage struct {
 type memoryAutoIndex struct {
 	pages            map[string]*memoryAutoPage
 	orderedPageNames []string
+	meta             map[string][]byte
 }
 
 func (i *memoryAutoIndex) addPage(page *memoryAutoPage, name string) {
@@ -45,12 +47,14 @@ func (i *memoryAutoIndex) addPage(page *memoryAutoPage, name string) {
 type memoryMapPage struct {
 	vals        map[string]string
 	orderedKeys []string
+	expiries    map[string]int64
 }
 
 // memoryMapIndex is an in-memory map index
 type memoryMapIndex struct {
 	pages            map[string]*memoryMapPage
 	orderedPageNames []string
+	meta             map[string][]byte
 }
 
 func (i *memoryMapIndex) addPage(page *memoryMapPage, name string) {
@@ -77,18 +81,18 @@ func (d MemoryDriver) ReadPage(fileName string, indexName string, pageSize int)
 }
 
 // ReadMapPage reads a map page
-func (d MemoryDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, error) {
+func (d MemoryDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
 	_, ok := d.mapIndexes[indexName]
 	if !ok {
-		return map[string]string{}, []string{}, errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
+		return map[string]string{}, []string{}, map[string]int64{}, errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
 	}
 
 	page, ok := d.mapIndexes[indexName].pages[fileName]
 	if !ok {
-		return map[string]string{}, []string{}, errPageNotExist(indexName, fileName, fmt.Errorf("index has no page '%s'", fileName))
+		return map[string]string{}, []string{}, map[string]int64{}, errPageNotExist(indexName, fileName, fmt.Errorf("index has no page '%s'", fileName))
 	}
 
-	return page.vals, page.orderedKeys, nil
+	return page.vals, page.orderedKeys, page.expiries, nil
 }
 
 // WritePage commits an auto page to the memory store
@@ -107,7 +111,7 @@ func (d *MemoryDriver) WritePage(vals map[uint64]string, orderedKeys []uint64, f
 }
 
 // WriteMapPage commits a map page to the memory store
-func (d *MemoryDriver) WriteMapPage(vals map[string]string, orderedKeys []string, fileName string, indexName string) error {
+func (d *MemoryDriver) WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, fileName string, indexName string) error {
 	_, ok := d.mapIndexes[indexName]
 	if !ok {
 		return errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
@@ -116,6 +120,7 @@ func (d *MemoryDriver) WriteMapPage(vals map[string]string, orderedKeys []string
 	d.mapIndexes[indexName].addPage(&memoryMapPage{
 		vals,
 		orderedKeys,
+		expiries,
 	}, fileName)
 
 	return nil
@@ -141,26 +146,81 @@ func (d MemoryDriver) ListPages(indexName string, desc bool) ([]string, error) {
 }
 
 // CreateAutoIndex creates an empty auto index in the memory store
-func (d MemoryDriver) CreateAutoIndex(indexName string) error {
+func (d MemoryDriver) CreateAutoIndex(indexName string, pageSize int) error {
+	if _, exists := d.autoIndexes[indexName]; exists {
+		return errIndexAlreadyExist(indexName, fmt.Errorf("memory driver already contains index %s", indexName))
+	}
 	d.autoIndexes[indexName] = &memoryAutoIndex{
 		pages:            make(map[string]*memoryAutoPage, 10),
 		orderedPageNames: []string{},
+		meta:             make(map[string][]byte, 1),
 	}
-	return nil
+	return WriteManifest(&d, indexName, NewManifest(KindAuto, pageSize))
 }
 
 // CreateMapIndex creates an empty map index in the memory store
-func (d MemoryDriver) CreateMapIndex(indexName string) error {
+func (d MemoryDriver) CreateMapIndex(indexName string, pageSize int) error {
+	if _, exists := d.mapIndexes[indexName]; exists {
+		return errIndexAlreadyExist(indexName, fmt.Errorf("memory driver already contains index %s", indexName))
+	}
 	d.mapIndexes[indexName] = &memoryMapIndex{
 		pages:            make(map[string]*memoryMapPage, 10),
 		orderedPageNames: []string{},
+		meta:             make(map[string][]byte, 1),
+	}
+	return WriteManifest(&d, indexName, NewManifest(KindMap, pageSize))
+}
+
+// indexMeta returns the metadata store of an index, regardless of its kind
+func (d MemoryDriver) indexMeta(indexName string) (map[string][]byte, bool) {
+	if index, ok := d.autoIndexes[indexName]; ok {
+		return index.meta, true
+	}
+	if index, ok := d.mapIndexes[indexName]; ok {
+		return index.meta, true
+	}
+	return nil, false
+}
+
+// ReadMeta reads a metadata file from the memory store
+func (d MemoryDriver) ReadMeta(indexName string, metaName string) ([]byte, error) {
+	meta, ok := d.indexMeta(indexName)
+	if !ok {
+		return []byte{}, errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
 	}
+
+	data, ok := meta[metaName]
+	if !ok {
+		return []byte{}, errMetaNotExist(indexName, metaName, fmt.Errorf("index has no metadata '%s'", metaName))
+	}
+
+	return data, nil
+}
+
+// WriteMeta commits a metadata file to the memory store
+func (d MemoryDriver) WriteMeta(indexName string, metaName string, data []byte) error {
+	meta, ok := d.indexMeta(indexName)
+	if !ok {
+		return errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
+	}
+
+	meta[metaName] = data
 	return nil
 }
 
 // indexes are updated instantaneously with this driver so locking is unnecessary
 // there are no file writes or network ops
 
+// WritesConditionally is false, since writes are never interleaved with other writers
+func (d MemoryDriver) WritesConditionally() bool {
+	return false
+}
+
+// IsStaged is false, since writes are applied immediately
+func (d MemoryDriver) IsStaged() bool {
+	return false
+}
+
 // IndexIsLocked indicates if the index is locked for writes. always false for this driver
 func (d MemoryDriver) IndexIsLocked(indexName string) (bool, time.Time, error) {
 	return false, time.Now(), nil
@@ -206,7 +266,7 @@ func (d MemoryDriver) DeepInspect() string {
 func (d MemoryDriver) DropAutoIndex(indexName string) error {
 	_, exists := d.autoIndexes[indexName]
 	if !exists {
-		return fmt.Errorf("failed deleting memory index '%s': does not exist", indexName)
+		return errIndexNotExist(indexName, fmt.Errorf("failed deleting memory index '%s': does not exist", indexName))
 	}
 	delete(d.autoIndexes, indexName)
 	return nil
@@ -216,8 +276,78 @@ func (d MemoryDriver) DropAutoIndex(indexName string) error {
 func (d MemoryDriver) DropMapIndex(indexName string) error {
 	_, exists := d.mapIndexes[indexName]
 	if !exists {
-		return fmt.Errorf("failed deleting memory index '%s': does not exist", indexName)
+		return errIndexNotExist(indexName, fmt.Errorf("failed deleting memory index '%s': does not exist", indexName))
 	}
 	delete(d.mapIndexes, indexName)
 	return nil
 }
+
+// ReplaceIndex swaps the contents of an index for those of the replacement index, then removes the replacement
+func (d MemoryDriver) ReplaceIndex(indexName string, replacementName string) error {
+	if replacement, ok := d.autoIndexes[replacementName]; ok {
+		if _, exists := d.autoIndexes[indexName]; !exists {
+			return errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
+		}
+		d.autoIndexes[indexName] = replacement
+		delete(d.autoIndexes, replacementName)
+		return nil
+	}
+
+	if replacement, ok := d.mapIndexes[replacementName]; ok {
+		if _, exists := d.mapIndexes[indexName]; !exists {
+			return errIndexNotExist(indexName, fmt.Errorf("memory driver does not contain index %s", indexName))
+		}
+		d.mapIndexes[indexName] = replacement
+		delete(d.mapIndexes, replacementName)
+		return nil
+	}
+
+	return errIndexNotExist(replacementName, fmt.Errorf("memory driver does not contain index %s", replacementName))
+}
+
+// CommitWrites applies a set of staged writes. Every write is checked and decoded before any is applied, and
+// applying them cannot fail, so either all or none of the writes are applied
+func (d *MemoryDriver) CommitWrites(writes WriteSet) error {
+	autoPages := make([]*memoryAutoPage, len(writes.writes))
+	mapPages := make([]*memoryMapPage, len(writes.writes))
+	for i, w := range writes.writes {
+		var err error
+		switch w.kind {
+		case writeAutoPage:
+			if _, ok := d.autoIndexes[w.indexName]; !ok {
+				return errIndexNotExist(w.indexName, fmt.Errorf("memory driver does not contain index %s", w.indexName))
+			}
+			page := memoryAutoPage{}
+			page.vals, page.orderedKeys, err = decodePage(bytes.NewReader(w.data), 0)
+			autoPages[i] = &page
+		case writeMapPage:
+			if _, ok := d.mapIndexes[w.indexName]; !ok {
+				return errIndexNotExist(w.indexName, fmt.Errorf("memory driver does not contain index %s", w.indexName))
+			}
+			page := memoryMapPage{}
+			page.vals, page.orderedKeys, page.expiries, err = decodeMapPage(bytes.NewReader(w.data), 0)
+			mapPages[i] = &page
+		case writeMeta:
+			if _, ok := d.indexMeta(w.indexName); !ok {
+				return errIndexNotExist(w.indexName, fmt.Errorf("memory driver does not contain index %s", w.indexName))
+			}
+		}
+		if err != nil {
+			return errBadIndexData(w.indexName, w.name, err)
+		}
+	}
+
+	for i, w := range writes.writes {
+		switch w.kind {
+		case writeAutoPage:
+			d.autoIndexes[w.indexName].addPage(autoPages[i], w.name)
+		case writeMapPage:
+			d.mapIndexes[w.indexName].addPage(mapPages[i], w.name)
+		case writeMeta:
+			meta, _ := d.indexMeta(w.indexName)
+			meta[w.name] = w.data
+		}
+	}
+
+	return nil
+}
@@ -14,7 +14,7 @@ func TestMemoryDriverWriteAutoIndexPage(t *testing.T) {
 
 	indexName := "test_index"
 
-	err := d.CreateAutoIndex(indexName)
+	err := d.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	vals := map[uint64]string{
@@ -40,7 +40,7 @@ func TestMemoryDriverWriteMapIndexPage(t *testing.T) {
 	d := NewMemoryDriver()
 
 	indexName := "test_map_index"
-	err := d.CreateMapIndex(indexName)
+	err := d.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	vals := map[string]string{
@@ -48,10 +48,10 @@ func TestMemoryDriverWriteMapIndexPage(t *testing.T) {
 	}
 	keys := []string{"testKey"}
 
-	err = d.WriteMapPage(vals, keys, "1", indexName)
+	err = d.WriteMapPage(vals, keys, nil, "1", indexName)
 	util.Ok(t, err)
 
-	readPage, readKeys, err := d.ReadMapPage("1", indexName, pageSize)
+	readPage, readKeys, _, err := d.ReadMapPage("1", indexName, pageSize)
 	util.Ok(t, err)
 
 	retrieved, ok := readPage["testKey"]
@@ -66,7 +66,7 @@ func TestMemoryDriverListPages(t *testing.T) {
 	d := NewMemoryDriver()
 
 	indexName := "test_index"
-	err := d.CreateAutoIndex(indexName)
+	err := d.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	expected := []string{}
@@ -107,7 +107,7 @@ func TestMemoryDriverWriteManyAutoIndexPages(t *testing.T) {
 	d := NewMemoryDriver()
 	indexName := "test_index"
 
-	err := d.CreateAutoIndex(indexName)
+	err := d.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	filenames := []string{"1", "2", "3", "4", "5"}
@@ -136,7 +136,7 @@ func TestMemoryDriverDropAutoIndex(t *testing.T) {
 	d := NewMemoryDriver()
 
 	indexName := "test_auto_index_drop"
-	err := d.CreateAutoIndex(indexName)
+	err := d.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	vals := map[uint64]string{
@@ -160,7 +160,7 @@ func TestMemoryDriverDropMapIndex(t *testing.T) {
 	d := NewMemoryDriver()
 
 	indexName := "test_map_index_drop"
-	err := d.CreateMapIndex(indexName)
+	err := d.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	vals := map[string]string{
@@ -169,13 +169,65 @@ func TestMemoryDriverDropMapIndex(t *testing.T) {
 
 	keys := []string{"1"}
 
-	err = d.WriteMapPage(vals, keys, "1", indexName)
+	err = d.WriteMapPage(vals, keys, nil, "1", indexName)
 	util.Ok(t, err)
 
 	// delete index
 	err = d.DropMapIndex(indexName)
 	util.Ok(t, err)
 
-	_, _, err = d.ReadMapPage("1", indexName, pageSize)
+	_, _, _, err = d.ReadMapPage("1", indexName, pageSize)
 	util.Assert(t, err != nil, "error should be non-nill reading page from deleted index")
 }
+
+func TestMemoryDriverManifest(t *testing.T) {
+	d := NewMemoryDriver()
+
+	indexName := "test_index"
+	err := d.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+
+	manifest, err := ReadManifest(&d, indexName)
+	util.Ok(t, err)
+	util.Equals(t, KindMap, manifest.Kind)
+	util.Equals(t, pageSize, manifest.PageSize)
+	util.Equals(t, ManifestVersion, manifest.Version)
+
+	err = d.CreateMapIndex(indexName, pageSize)
+	util.Assert(t, err != nil, "creating an existing index should return an error")
+
+	_, err = ReadManifest(&d, "missing_index")
+	util.Assert(t, IsIndexNotExist(err), "reading the manifest of a missing index should return a missing index error")
+}
+
+func TestMemoryDriverReplaceIndex(t *testing.T) {
+	d := NewMemoryDriver()
+
+	indexName, replacementName := "test_index", "test_index_replacement"
+	err := d.CreateAutoIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = d.CreateAutoIndex(replacementName, pageSize*2)
+	util.Ok(t, err)
+
+	err = d.WritePage(map[uint64]string{1: "original"}, []uint64{1}, "0", indexName)
+	util.Ok(t, err)
+	err = d.WritePage(map[uint64]string{1: "replaced"}, []uint64{1}, "0", replacementName)
+	util.Ok(t, err)
+
+	err = d.ReplaceIndex(indexName, replacementName)
+	util.Ok(t, err)
+
+	vals, _, err := d.ReadPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "replaced", vals[1])
+
+	manifest, err := ReadManifest(&d, indexName)
+	util.Ok(t, err)
+	util.Equals(t, pageSize*2, manifest.PageSize)
+
+	_, err = d.ListPages(replacementName, false)
+	util.Assert(t, err != nil, "replacement index should be removed")
+
+	err = d.ReplaceIndex(indexName, replacementName)
+	util.Assert(t, IsIndexNotExist(err), "replacing with a missing index should return a missing index error")
+}
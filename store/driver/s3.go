@@ -1,19 +1,20 @@
 package driver
 
 import (
-	"bufio"
+	"bytes"
 	"fmt"
 	"io"
+	"io/ioutil"
 	"keybite/util/log"
-	"os"
+	"net/url"
 	"path"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/awserr"
-	"github.com/aws/aws-sdk-go/aws/credentials"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
 	"github.com/aws/aws-sdk-go/service/s3/s3manager"
@@ -21,37 +22,55 @@ import (
 
 const s3ErrNotFound = "NotFound"
 
+// region of buckets used when neither the bucket options nor the AWS configuration provide one
+const defaultBucketRegion = "us-west-2"
+
 // BucketDriver enables writing and reading indices from a remote S3 bucket
 type BucketDriver struct {
-	bucketName      string
-	accessKeyID     string
-	accessKeySecret string
-	pageExtension   string
-	s3Client        *s3.S3
-	session         *session.Session
-	s3Downloader    *s3manager.Downloader
-	s3Uploader      *s3manager.Uploader
-	lockDuration    time.Duration
-}
-
-// NewBucketDriver instantiates a new bucket storage driver
-func NewBucketDriver(
-	pageExtension string,
-	bucketName string,
-	accessKeyID string,
-	accessKeySecret string,
-	accessKeyToken string,
-	lockDuration time.Duration,
-) (BucketDriver, error) {
-	creds := credentials.NewStaticCredentials(accessKeyID, accessKeySecret, accessKeyToken)
-	session, err := session.NewSession(&aws.Config{
-		Region:      aws.String("us-west-2"),
-		Credentials: creds,
-	},
-	)
+	bucketName    string
+	pageExtension string
+	s3Client      *s3.S3
+	session       *session.Session
+	s3Uploader    *s3manager.Uploader
+	lockDuration  time.Duration
+	// versions of the objects read and written, which writes are conditional on
+	versions *objectVersions
+	// generations of the indexes seen by the driver
+	generations *indexGenerations
+}
+
+// BucketOptions locate the S3 service holding the bucket of a bucket driver
+type BucketOptions struct {
+	// region of the bucket. When empty, the region configured for the AWS SDK is used, or us-west-2
+	Region string
+	// endpoint of an S3-compatible service like MinIO or LocalStack. When empty, AWS is used
+	Endpoint string
+	// address the bucket in the path of request URLs instead of the host name, as most S3-compatible services
+	// require
+	ForcePathStyle bool
+}
+
+// NewBucketDriver instantiates a new bucket storage driver. Credentials are resolved through the default AWS
+// credential chain: environment variables, the shared credentials file, then the IAM role of the host
+func NewBucketDriver(pageExtension string, bucketName string, options BucketOptions, lockDuration time.Duration) (BucketDriver, error) {
+	awsConfig := aws.NewConfig().WithS3ForcePathStyle(options.ForcePathStyle)
+	if options.Region != "" {
+		awsConfig = awsConfig.WithRegion(options.Region)
+	}
+	if options.Endpoint != "" {
+		awsConfig = awsConfig.WithEndpoint(options.Endpoint)
+	}
+
+	session, err := session.NewSessionWithOptions(session.Options{
+		Config:            *awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
 	if err != nil {
 		return BucketDriver{}, errInternalDriverFailure("authenticating s3", err)
 	}
+	if aws.StringValue(session.Config.Region) == "" {
+		session.Config.Region = aws.String(defaultBucketRegion)
+	}
 
 	client := s3.New(session)
 
@@ -65,154 +84,89 @@ func NewBucketDriver(
 	}
 
 	return BucketDriver{
-		bucketName:      bucketName,
-		accessKeyID:     accessKeyID,
-		accessKeySecret: accessKeySecret,
-		pageExtension:   pageExtension,
-		s3Client:        client,
-		session:         session,
-		lockDuration:    lockDuration,
+		bucketName:    bucketName,
+		pageExtension: pageExtension,
+		s3Client:      client,
+		session:       session,
+		lockDuration:  lockDuration,
+		versions:      newObjectVersions(),
+		generations:   newIndexGenerations(),
 	}, nil
 }
 
 // ReadPage reads the contents of a page into a map
 func (d BucketDriver) ReadPage(fileName string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
-	d.setDownloaderIfNil()
-
-	// download the remote file into a local temp file to read into memory
-	// @TODO this can be improved by implementing a WriterAt and writing the
-	// download's contents to a string instead of writing then reading a temp file
-	tempFile, err := d.createTemporaryFile(fileName, indexName)
-	if err != nil {
-		return map[uint64]string{}, []uint64{}, err
-	}
-	defer tempFile.Close()
-
-	err = d.downloadToFile(fileName, indexName, tempFile)
-	if err != nil {
-		return map[uint64]string{}, []uint64{}, err
-	}
-
-	vals := make(map[uint64]string, pageSize)
-	orderedKeys := make([]uint64, 0, pageSize)
-
-	scanner := bufio.NewScanner(tempFile)
-	i := 0
-	for scanner.Scan() {
-		key, value, err := stringToKeyValue(scanner.Text())
-		if err != nil {
-			return vals, orderedKeys, errBadIndexData(indexName, fileName, err)
-		}
-		vals[key] = unescapeNewlines(value)
-		orderedKeys = append(orderedKeys, key)
-		i++
-	}
-
-	return vals, orderedKeys, nil
-
+	page, _, err := d.readPageVersion(fileName, indexName, pageSize)
+	return page.vals, page.orderedKeys, err
 }
 
 // ReadMapPage reads a remote file into a map page
-func (d BucketDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, error) {
-	d.setDownloaderIfNil()
-
-	// download the remote file into a local temp file to read into memory
-	// @TODO this can be improved by implementing a WriterAt and writing the
-	// download's contents to a string instead of writing then reading a temp file
-	tempFile, err := d.createTemporaryFile(fileName, indexName)
-	if err != nil {
-		return map[string]string{}, []string{}, err
-	}
-
-	defer tempFile.Close()
-
-	vals := make(map[string]string, pageSize)
-	orderedKeys := make([]string, 0, pageSize)
-
-	err = d.downloadToFile(fileName, indexName, tempFile)
-	if err != nil {
-		return vals, orderedKeys, err
-	}
-
-	scanner := bufio.NewScanner(tempFile)
-	i := 0
-	for scanner.Scan() {
-		key, value, err := stringToMapKeyValue(scanner.Text())
-		if err != nil {
-			return vals, orderedKeys, errBadIndexData(indexName, fileName, err)
-		}
-		vals[key] = unescapeNewlines(value)
-		orderedKeys = append(orderedKeys, key)
-		i++
-	}
-
-	return vals, orderedKeys, nil
+func (d BucketDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	page, _, err := d.readMapPageVersion(fileName, indexName, pageSize)
+	return page.vals, page.orderedKeys, page.expiries, err
 }
 
 // WritePage persists a new or updated page as a file in the remote bucket
 func (d BucketDriver) WritePage(vals map[uint64]string, orderedKeys []uint64, fileName string, indexName string) error {
-	d.setUploaderIfNil()
-
-	pageReader := newPageReader(vals, orderedKeys)
-	cleanFileName := addSuffixIfNotExist(fileName, d.pageExtension)
-	filePath := path.Join(indexName, cleanFileName)
-
-	// upload temporary file to S3
-	_, err := d.s3Uploader.Upload(&s3manager.UploadInput{
-		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(filePath),
-		Body:   pageReader,
-	})
-
+	filePath, err := d.pageKey(indexName, fileName)
 	if err != nil {
-		return errInternalDriverFailure("writing to s3 bucket", err)
+		return err
 	}
-
-	return nil
+	return d.putObject(indexName, fileName, filePath, newPageReader(vals, orderedKeys))
 }
 
 // WriteMapPage persists a new or updated map page as a file in the remote bucket
-func (d BucketDriver) WriteMapPage(vals map[string]string, orderedKeys []string, fileName string, indexName string) error {
-	d.setUploaderIfNil()
-
-	pageReader := newMapPageReader(vals, orderedKeys)
-	cleanFileName := addSuffixIfNotExist(fileName, d.pageExtension)
-	filePath := path.Join(indexName, cleanFileName)
+func (d BucketDriver) WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, fileName string, indexName string) error {
+	filePath, err := d.pageKey(indexName, fileName)
+	if err != nil {
+		return err
+	}
+	return d.putObject(indexName, fileName, filePath, newMapPageReader(vals, orderedKeys, expiries))
+}
 
-	// upload to S3
-	_, err := d.s3Uploader.Upload(&s3manager.UploadInput{
+// putObject uploads an object on the condition that it is unchanged since the driver last observed it
+func (d BucketDriver) putObject(indexName string, fileName string, key string, body io.ReadSeeker) error {
+	out, err := d.s3Client.PutObjectWithContext(aws.BackgroundContext(), &s3.PutObjectInput{
 		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(filePath),
-		Body:   pageReader,
-	})
-
+		Key:    aws.String(key),
+		Body:   body,
+	}, d.versions.condition(key))
 	if err != nil {
+		if isS3ConflictErr(err) {
+			d.versions.forget(key)
+			return errWriteConflict(indexName, fileName, err)
+		}
 		return errInternalDriverFailure("writing to s3 bucket", err)
 	}
 
+	d.versions.observe(key, out.ETag)
 	return nil
 }
 
-// ListPages lists the page files in the bucket
+// ListPages lists the page files of the current generation of an index in the bucket
 func (d BucketDriver) ListPages(indexName string, desc bool) ([]string, error) {
-	prefix := indexName + "/"
-	resp, err := d.s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(d.bucketName),
-		Prefix: aws.String(prefix),
-	})
-
+	folder, err := d.folder(indexName)
+	if err != nil {
+		return []string{}, err
+	}
+	objects, err := d.listObjects(folder + "/")
 	if err != nil {
 		if isS3NotExistErr(err) {
 			return []string{}, errIndexNotExist(indexName, err)
 		}
 		return []string{}, errInternalDriverFailure("reading contents of bucket folder", err)
 	}
+	d.versions.observeListing(folder, objects, true)
 
 	pages := []string{}
-	for _, item := range resp.Contents {
+	for _, item := range objects {
 		itemName := path.Base(*item.Key)
-		// the folder marker is just an empty file, don't include it in results
-		if itemName == indexName {
+		// the folder marker is just an empty file, don't include it in results, nor objects of other generations
+		if itemName == indexName || !inFolder(*item.Key, folder) {
+			continue
+		}
+		// neither are lock or metadata files
+		if isLockfile(itemName) || isMetaFile(itemName) {
 			continue
 		}
 		// strip prefixes
@@ -222,54 +176,61 @@ func (d BucketDriver) ListPages(indexName string, desc bool) ([]string, error) {
 	return sortFileNames(pages, d.pageExtension, desc), nil
 }
 
-// create a temporary file
-func (d BucketDriver) createTemporaryFile(fileName string, indexName string) (*os.File, error) {
-	currentMillis := timeToMillis(time.Now())
-	tempName := fmt.Sprintf("%s-%s-%d%s.tmp", indexName, fileName, currentMillis, d.pageExtension)
-	tempPath := path.Join("/tmp", tempName)
-	file, err := os.Create(tempPath)
-	if err != nil {
-		return file, errInternalDriverFailure("creating temporary data file", err)
-	}
-	return file, nil
-
+// buffers holding downloaded pages while they are decoded
+var pageBuffers = sync.Pool{
+	New: func() interface{} { return new(bytes.Buffer) },
 }
 
-func (d BucketDriver) downloadToFile(fileName string, indexName string, dest *os.File) error {
-	remotePath := path.Join(indexName, addSuffixIfNotExist(fileName, d.pageExtension))
-	_, err := d.s3Downloader.Download(dest,
-		&s3.GetObjectInput{
-			Bucket: aws.String(d.bucketName),
-			Key:    aws.String(remotePath),
-		},
-	)
+// buffers which grew larger than this while downloading a page are not reused
+const maxPooledPageBuffer = 4 << 20
 
+// downloadPage downloads a page into a pooled in-memory buffer and decodes it, returning the version of the
+// page. The buffer is reused once decoding returns, so decode must copy the data it keeps. Download failures
+// are reported separately from pages which cannot be decoded
+func (d BucketDriver) downloadPage(fileName string, indexName string, decode func(page io.Reader) error) (string, error) {
+	remotePath, err := d.pageKey(indexName, fileName)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.s3Client.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(d.bucketName),
+		Key:    aws.String(remotePath),
+	})
 	if err != nil {
 		if isS3NotExistErr(err) {
+			d.versions.observeMissing(remotePath)
 			if d.indexExists(indexName) {
-				return errPageNotExist(indexName, fileName, err)
+				return "", errPageNotExist(indexName, fileName, err)
 			}
-			return errIndexNotExist(indexName, err)
+			return "", errIndexNotExist(indexName, err)
 		}
 		log.Errorf("error fetching remote file %s", remotePath)
-		return errInternalDriverFailure("downloading s3 file", err)
+		return "", errInternalDriverFailure("downloading s3 file", err)
 	}
+	defer resp.Body.Close()
 
-	_, err = dest.Seek(0, io.SeekStart)
+	buf := pageBuffers.Get().(*bytes.Buffer)
+	buf.Reset()
+	defer func() {
+		if buf.Cap() <= maxPooledPageBuffer {
+			pageBuffers.Put(buf)
+		}
+	}()
+
+	if size := aws.Int64Value(resp.ContentLength); size > 0 {
+		buf.Grow(int(size))
+	}
+	_, err = buf.ReadFrom(resp.Body)
 	if err != nil {
-		return errInternalDriverFailure("resetting file cursor in tempfile", err)
+		return "", errInternalDriverFailure("downloading s3 file", err)
 	}
+	d.versions.observe(remotePath, resp.ETag)
 
-	return nil
-}
-
-func (d *BucketDriver) setDownloaderIfNil() {
-	if d.s3Downloader != nil {
-		return
+	err = decode(buf)
+	if err != nil {
+		return "", errBadIndexData(indexName, fileName, err)
 	}
-
-	downloader := s3manager.NewDownloader(d.session)
-	d.s3Downloader = downloader
+	return objectVersion(resp.ETag, resp.LastModified), nil
 }
 
 func (d *BucketDriver) setUploaderIfNil() {
@@ -281,8 +242,22 @@ func (d *BucketDriver) setUploaderIfNil() {
 	d.s3Uploader = uploader
 }
 
-// CreateAutoIndex creates the folder for an auto index in the data dir
-func (d BucketDriver) CreateAutoIndex(indexName string) error {
+// CreateAutoIndex creates the folder and manifest for an auto index in the data dir
+func (d BucketDriver) CreateAutoIndex(indexName string, pageSize int) error {
+	return d.createIndex(indexName, NewManifest(KindAuto, pageSize))
+}
+
+// CreateMapIndex creates the folder and manifest for a map index in the data dir
+func (d BucketDriver) CreateMapIndex(indexName string, pageSize int) error {
+	return d.createIndex(indexName, NewManifest(KindMap, pageSize))
+}
+
+func (d BucketDriver) createIndex(indexName string, manifest IndexManifest) error {
+	// the folder may belong to an index created before manifests were introduced
+	if err := ensureNoManifest(d, indexName); err != nil {
+		return err
+	}
+
 	// trailing slash in key represents a "folder" in s3
 	// https://docs.aws.amazon.com/AmazonS3/latest/user-guide/using-folders.html
 	indexKey := indexName + "/"
@@ -293,28 +268,65 @@ func (d BucketDriver) CreateAutoIndex(indexName string) error {
 	})
 
 	if err != nil {
-		return errInternalDriverFailure("creating auto index", err)
+		return errInternalDriverFailure("creating "+manifest.Kind+" index", err)
 	}
 
-	return nil
+	return WriteManifest(d, indexName, manifest)
 }
 
-// CreateMapIndex creates the folder for a map index in the data dir
-func (d BucketDriver) CreateMapIndex(indexName string) error {
-	// trailing slash in key represents a "folder" in s3
-	// https://docs.aws.amazon.com/AmazonS3/latest/user-guide/using-folders.html
-	indexKey := indexName + "/"
-	_, err := d.s3Client.PutObject(&s3.PutObjectInput{
+// ReadMeta reads a metadata file from the index folder in the remote bucket
+func (d BucketDriver) ReadMeta(indexName string, metaName string) ([]byte, error) {
+	remotePath, err := d.metaKey(indexName, metaName)
+	if err != nil {
+		return []byte{}, err
+	}
+	resp, err := d.s3Client.GetObject(&s3.GetObjectInput{
 		Bucket: aws.String(d.bucketName),
-		Key:    aws.String(indexKey),
-		Body:   nil,
+		Key:    aws.String(remotePath),
 	})
+	if err != nil {
+		if isS3NotExistErr(err) {
+			d.versions.observeMissing(remotePath)
+			return []byte{}, errMetaNotExist(indexName, metaName, err)
+		}
+		return []byte{}, errInternalDriverFailure("downloading s3 file", err)
+	}
+	defer resp.Body.Close()
+	d.versions.observe(remotePath, resp.ETag)
 
+	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return errInternalDriverFailure("creating map index", err)
+		return data, errInternalDriverFailure("reading s3 file", err)
+	}
+	if metaName == manifestMetaName {
+		d.generations.observeManifest(indexName, data)
 	}
 
-	return nil
+	return data, nil
+}
+
+// WriteMeta persists a metadata file of the current generation of an index in the remote bucket
+func (d BucketDriver) WriteMeta(indexName string, metaName string, data []byte) error {
+	remotePath, err := d.metaKey(indexName, metaName)
+	if err != nil {
+		return err
+	}
+	err = d.putObject(indexName, metaName+metaExtension, remotePath, bytes.NewReader(data))
+	if err == nil && metaName == manifestMetaName {
+		d.generations.observeManifest(indexName, data)
+	}
+	return err
+}
+
+// WritesConditionally is true, since pages and metadata files are written only if they are unchanged since
+// they were read
+func (d BucketDriver) WritesConditionally() bool {
+	return true
+}
+
+// IsStaged is false, since writes are uploaded immediately
+func (d BucketDriver) IsStaged() bool {
+	return false
 }
 
 // IndexIsLocked checks if the specified index is locked and returns the timestamp it expires at
@@ -376,37 +388,23 @@ func (d BucketDriver) LockIndex(indexName string) error {
 	return nil
 }
 
-// UnlockIndex deletes all write lockfiles in an index
+// UnlockIndex deletes all write lockfiles in an index, including those written to extend the lock
 func (d BucketDriver) UnlockIndex(indexName string) error {
 	log.Debugf("unlocking index %s for writes", indexName)
-	prefix := indexName + "/"
-
-	resp, err := d.s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(d.bucketName),
-		Prefix: aws.String(prefix),
-	})
+	keys, err := d.listObjectKeys(indexName + "/")
 	if err != nil {
 		return errInternalDriverFailure("reading index contents", err)
 	}
 
-	var loopErr error
-	for _, item := range resp.Contents {
-		itemName := path.Base(*item.Key)
-		if isLockfile(itemName) {
-			_, err := d.s3Client.DeleteObject(&s3.DeleteObjectInput{
-				Bucket: aws.String(d.bucketName),
-				Key:    aws.String(*item.Key),
-			})
-			if err != nil {
-				loopErr = err
-				log.Errorf("deleting lockfile '%s' in index '%s' failed: %w", itemName, indexName, err)
-				continue
-			}
+	lockfiles := []string{}
+	for _, key := range keys {
+		if inFolder(key, indexName) && isLockfile(path.Base(key)) {
+			lockfiles = append(lockfiles, key)
 		}
 	}
-
-	if loopErr != nil {
-		return errInternalDriverFailure("deleting lockfile in index", loopErr)
+	err = d.deleteObjectKeys(lockfiles)
+	if err != nil {
+		return errInternalDriverFailure("deleting lockfile in index", err)
 	}
 	return nil
 }
@@ -415,6 +413,7 @@ func (d BucketDriver) UnlockIndex(indexName string) error {
 func (d BucketDriver) DropAutoIndex(indexName string) error {
 	// get list of object keys matching directory prefix
 	prefix := indexName + "/"
+	defer d.generations.forget(indexName)
 
 	resp, err := d.s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: aws.String(d.bucketName),
@@ -425,6 +424,9 @@ func (d BucketDriver) DropAutoIndex(indexName string) error {
 	}
 
 	numItems := len(resp.Contents)
+	if numItems == 0 {
+		return errIndexNotExist(indexName, fmt.Errorf("no objects found with prefix '%s'", prefix))
+	}
 	deleteObjects := make([]*s3.ObjectIdentifier, numItems)
 
 	for i, item := range resp.Contents {
@@ -454,6 +456,7 @@ func (d BucketDriver) DropAutoIndex(indexName string) error {
 func (d BucketDriver) DropMapIndex(indexName string) error {
 	// get list of object keys matching directory prefix
 	prefix := indexName + "/"
+	defer d.generations.forget(indexName)
 
 	resp, err := d.s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
 		Bucket: aws.String(d.bucketName),
@@ -464,6 +467,9 @@ func (d BucketDriver) DropMapIndex(indexName string) error {
 	}
 
 	numItems := len(resp.Contents)
+	if numItems == 0 {
+		return errIndexNotExist(indexName, fmt.Errorf("no objects found with prefix '%s'", prefix))
+	}
 	deleteObjects := make([]*s3.ObjectIdentifier, numItems)
 
 	for i, item := range resp.Contents {
@@ -489,10 +495,228 @@ func (d BucketDriver) DropMapIndex(indexName string) error {
 	return nil
 }
 
+// ReplaceIndex copies the current generation of the replacement index into a new generation of the index,
+// switches the index to it by writing the manifest of the replacement as the manifest of the index, then deletes
+// the previous generation and the replacement index. Writing the manifest is the only change readers can observe,
+// so they see either the original index or the replacement.
+//
+// Writers which don't lock the index may change it while the replacement is built, so the index is only
+// replaced if the manifest and every object of the current generation are unchanged since the driver last read
+// or listed them. Otherwise the new generation is deleted again, and a write conflict is returned
+func (d BucketDriver) ReplaceIndex(indexName string, replacementName string) error {
+	replacementKeys, err := d.listObjectKeys(replacementName + "/")
+	if err != nil {
+		return errInternalDriverFailure("reading replacement index contents", err)
+	}
+	if len(replacementKeys) == 0 {
+		return errIndexNotExist(replacementName, fmt.Errorf("no objects found with prefix '%s/'", replacementName))
+	}
+	manifest, err := ReadManifest(d, replacementName)
+	if err != nil {
+		return err
+	}
+	replacementFolder := generationFolder(replacementName, manifest.Generation)
+
+	currentFolder, err := d.folder(indexName)
+	if err != nil {
+		return err
+	}
+	generation, _ := d.generations.get(indexName)
+	newFolder := generationFolder(indexName, generation+1)
+
+	indexObjects, err := d.listObjects(indexName + "/")
+	if err != nil {
+		return errInternalDriverFailure("reading index contents", err)
+	}
+	// objects of generations left behind by interrupted replaces
+	currentKeys := []string{}
+	unusedKeys := []string{}
+	for _, item := range indexObjects {
+		key := *item.Key
+		switch {
+		case !isGenerationObject(key, indexName):
+		case inFolder(key, currentFolder):
+			currentKeys = append(currentKeys, key)
+		default:
+			unusedKeys = append(unusedKeys, key)
+		}
+	}
+	err = d.deleteObjectKeys(unusedKeys)
+	if err != nil {
+		return errInternalDriverFailure("deleting unused index generation", err)
+	}
+
+	newKeys := []string{}
+	for _, key := range replacementKeys {
+		if !inFolder(key, replacementFolder) || !isGenerationObject(key, replacementName) {
+			continue
+		}
+		newKey := path.Join(newFolder, path.Base(key))
+		resp, err := d.s3Client.CopyObject(&s3.CopyObjectInput{
+			Bucket:     aws.String(d.bucketName),
+			CopySource: aws.String(url.PathEscape(path.Join(d.bucketName, key))),
+			Key:        aws.String(newKey),
+		})
+		if err != nil {
+			return errInternalDriverFailure("copying replacement page", err)
+		}
+		if resp.CopyObjectResult != nil {
+			d.versions.observe(newKey, resp.CopyObjectResult.ETag)
+		}
+		newKeys = append(newKeys, newKey)
+	}
+
+	manifest.Generation = generation + 1
+	err = d.unchangedSince(indexName, currentFolder)
+	if err == nil {
+		err = WriteManifest(d, indexName, manifest)
+	}
+	if err != nil {
+		if deleteErr := d.deleteObjectKeys(newKeys); deleteErr != nil {
+			log.Warnf("deleting unused generation of index %s failed: %s", indexName, deleteErr.Error())
+		}
+		return err
+	}
+
+	err = d.deleteObjectKeys(currentKeys)
+	if err != nil {
+		return errInternalDriverFailure("deleting replaced pages", err)
+	}
+	err = d.deleteObjectKeys(replacementKeys)
+	if err != nil {
+		return errInternalDriverFailure("deleting replacement index", err)
+	}
+	d.generations.forget(replacementName)
+	return nil
+}
+
+// unchangedSince returns a write conflict when an object in the folder of the current generation of an index
+// was changed or created since the driver last read or listed it
+func (d BucketDriver) unchangedSince(indexName string, folder string) error {
+	objects, err := d.listObjects(folder + "/")
+	if err != nil {
+		return errInternalDriverFailure("reading index contents", err)
+	}
+	for _, item := range objects {
+		key := *item.Key
+		if !inFolder(key, folder) || !isGenerationObject(key, indexName) {
+			continue
+		}
+		if !d.versions.unchanged(key, item.ETag) {
+			return errWriteConflict(indexName, path.Base(key), fmt.Errorf("object %s changed while the index was replaced", key))
+		}
+	}
+	return nil
+}
+
+// CommitWrites uploads a set of staged page and metadata files. S3 cannot write several objects atomically,
+// so the existing contents of each object are read before any upload. Each object is uploaded on the condition
+// that it is unchanged since the driver last observed it. If an upload fails, the objects already uploaded are
+// restored to their previous contents, or deleted if they are new, and a failed condition is returned as a write
+// conflict. Readers may observe part of the set while it is uploaded or restored, and a crash while uploading
+// leaves part of the set applied
+func (d BucketDriver) CommitWrites(writes WriteSet) error {
+	type previousObject struct {
+		key    string
+		data   []byte
+		exists bool
+	}
+
+	previous := make([]previousObject, writes.Len())
+	for i, w := range writes.writes {
+		key, err := d.stagedWriteKey(w)
+		if err != nil {
+			return err
+		}
+		previous[i].key = key
+		// the last object is never restored, since nothing is uploaded after it
+		if i == writes.Len()-1 {
+			break
+		}
+		out, err := d.s3Client.GetObject(&s3.GetObjectInput{
+			Bucket: aws.String(d.bucketName),
+			Key:    aws.String(key),
+		})
+		if err != nil {
+			if isS3NotExistErr(err) {
+				continue
+			}
+			return errInternalDriverFailure("reading s3 object before commit", err)
+		}
+		previous[i].data, err = ioutil.ReadAll(out.Body)
+		out.Body.Close()
+		if err != nil {
+			return errInternalDriverFailure("reading s3 object before commit", err)
+		}
+		previous[i].exists = true
+	}
+
+	for i, w := range writes.writes {
+		err := d.putObject(w.indexName, w.name, previous[i].key, bytes.NewReader(w.data))
+		if err == nil {
+			continue
+		}
+
+		// restore the objects already uploaded
+		for _, object := range previous[:i] {
+			var restoreErr error
+			if object.exists {
+				restoreErr = d.putObject(w.indexName, w.name, object.key, bytes.NewReader(object.data))
+			} else {
+				_, restoreErr = d.s3Client.DeleteObject(&s3.DeleteObjectInput{
+					Bucket: aws.String(d.bucketName),
+					Key:    aws.String(object.key),
+				})
+				d.versions.forget(object.key)
+			}
+			if restoreErr != nil {
+				log.Errorf("restoring %s after failed commit failed: %s", object.key, restoreErr.Error())
+			}
+		}
+		return err
+	}
+
+	return nil
+}
+
+// stagedWriteKey returns the object key written by a staged write
+func (d BucketDriver) stagedWriteKey(w stagedWrite) (string, error) {
+	if w.kind == writeMeta {
+		return d.metaKey(w.indexName, w.name)
+	}
+	return d.pageKey(w.indexName, w.name)
+}
+
+// listObjectKeys lists the keys of every object with the provided prefix
+func (d BucketDriver) listObjectKeys(prefix string) ([]string, error) {
+	objects, err := d.listObjects(prefix)
+	keys := make([]string, len(objects))
+	for i, item := range objects {
+		keys[i] = *item.Key
+	}
+	return keys, err
+}
+
+// listObjects lists every object with the provided prefix, requesting as many listings as needed
+func (d BucketDriver) listObjects(prefix string) ([]*s3.Object, error) {
+	objects := []*s3.Object{}
+	err := d.s3Client.ListObjectsV2Pages(&s3.ListObjectsV2Input{
+		Bucket: aws.String(d.bucketName),
+		Prefix: aws.String(prefix),
+	}, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		objects = append(objects, page.Contents...)
+		return true
+	})
+	return objects, err
+}
+
 // deletePage (for testing purposes)
 func (d BucketDriver) deletePage(indexName string, fileName string) error {
-	filePath := path.Join(indexName, fileName)
-	_, err := d.s3Client.DeleteObject(&s3.DeleteObjectInput{
+	filePath, err := d.pageKey(indexName, fileName)
+	if err != nil {
+		return err
+	}
+	_, err = d.s3Client.DeleteObject(&s3.DeleteObjectInput{
 		Bucket: aws.String(d.bucketName),
 		Key:    aws.String(filePath),
 	})
@@ -512,11 +736,11 @@ func (d BucketDriver) deletePage(indexName string, fileName string) error {
 }
 
 func (d BucketDriver) indexExists(indexName string) bool {
+	// the folder marker of the index
 	_, err := d.s3Client.HeadObject(&s3.HeadObjectInput{
-		Bucket: aws.String("bucket_name"),
-		Key:    aws.String("object_key"),
+		Bucket: aws.String(d.bucketName),
+		Key:    aws.String(indexName + "/"),
 	})
-	fmt.Println("err", err)
 	if err != nil {
 		return !isS3NotExistErr(err)
 	}
@@ -542,23 +766,11 @@ func isS3BucketNotExistErr(in error) bool {
 }
 
 // newPageReader constructs a page reader for an auto index page
-func newPageReader(vals map[uint64]string, orderedKeys []uint64) io.Reader {
-	var body string
-	for _, key := range orderedKeys {
-		line := fmt.Sprintf("%d:%s\n", key, escapeNewlines(vals[key]))
-		body += line
-	}
-
-	return strings.NewReader(body)
+func newPageReader(vals map[uint64]string, orderedKeys []uint64) io.ReadSeeker {
+	return bytes.NewReader(encodePage(vals, orderedKeys))
 }
 
 // newMapPageReader constructs a page reader for a map page
-func newMapPageReader(vals map[string]string, orderedKeys []string) io.Reader {
-	var body string
-	for _, key := range orderedKeys {
-		line := fmt.Sprintf("%s:%s\n", key, escapeNewlines(vals[key]))
-		body += line
-	}
-
-	return strings.NewReader(body)
+func newMapPageReader(vals map[string]string, orderedKeys []string, expiries map[string]int64) io.ReadSeeker {
+	return bytes.NewReader(encodeMapPage(vals, orderedKeys, expiries))
 }
@@ -2,17 +2,20 @@ package driver
 
 import (
 	"fmt"
+	"io"
+	"io/ioutil"
 	"keybite/config"
 	"keybite/util"
+	"os"
+	"path"
 	"strconv"
 	"strings"
 	"testing"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
-	"github.com/aws/aws-sdk-go/aws/credentials"
-	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
 )
 
 const pageExtension string = ".kb"
@@ -27,68 +30,38 @@ func init() {
 	}
 }
 
-func getEnvCreds() (accessKeyID string, accessKeySecret string, bucketName string, err error) {
-	accessKeyID, err = conf.GetString("AWS_ACCESS_KEY_ID")
-	if err != nil {
-		return
-	}
-
-	accessKeySecret, err = conf.GetString("AWS_SECRET_ACCESS_KEY")
-	if err != nil {
-		return
-	}
-
-	bucketName, err = conf.GetString("BUCKET_NAME")
-	if err != nil {
-		return
-	}
-
-	return
-}
-
-func getAWSSessionAndS3Client(accessKeyID string, accessKeySecret string) (sess *session.Session, client s3.S3, err error) {
-	creds := credentials.NewStaticCredentials(accessKeyID, accessKeySecret, "")
-	sess, err = session.NewSession(&aws.Config{
-		Region:      aws.String("us-west-2"),
-		Credentials: creds,
-	})
-	if err != nil {
-		return
-	}
+// newTestBucketDriver instantiates a bucket driver for the bucket and S3 service configured in test.env or the
+// environment. Set S3_ENDPOINT, S3_FORCE_PATH_STYLE=true and S3_REGION to run the suite against a local
+// S3-compatible service like MinIO
+func newTestBucketDriver(t *testing.T, lockDuration time.Duration) BucketDriver {
+	bucketName, err := conf.GetString("BUCKET_NAME")
+	util.Ok(t, err)
+	options, err := configuredBucketOptions(&conf)
+	util.Ok(t, err)
 
-	client = *s3.New(sess)
-	return
+	bd, err := NewBucketDriver(pageExtension, bucketName, options, lockDuration)
+	util.Ok(t, err)
+	return bd
 }
 
 // test instantiating a bucket driver with AWS creds in test.env
 func TestNewBucketDriver(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	_, err = NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	newTestBucketDriver(t, testLockDuration)
 }
 
 // test creating an auto index in an s3 bucket
 func TestBucketCreateAutoIndex(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_index"
-	err = bd.CreateAutoIndex(indexName)
+	err := bd.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropAutoIndex(indexName)
 
 	// check that file/folder was created in bucket
-	_, client, err := getAWSSessionAndS3Client(accessKeyID, accessKeySecret)
-	util.Ok(t, err)
-
-	res, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucketName),
+	res, err := bd.s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bd.bucketName),
 	})
 	util.Ok(t, err)
 
@@ -103,23 +76,16 @@ func TestBucketCreateAutoIndex(t *testing.T) {
 
 // test creating a map index in an s3 bucket
 func TestBucketCreateMapIndex(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_index"
-	err = bd.CreateMapIndex(indexName)
+	err := bd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 	defer bd.DropMapIndex(indexName)
 
 	// check that file/folder was created in bucket
-	_, client, err := getAWSSessionAndS3Client(accessKeyID, accessKeySecret)
-	util.Ok(t, err)
-
-	res, err := client.ListObjectsV2(&s3.ListObjectsV2Input{
-		Bucket: aws.String(bucketName),
+	res, err := bd.s3Client.ListObjectsV2(&s3.ListObjectsV2Input{
+		Bucket: aws.String(bd.bucketName),
 	})
 	util.Ok(t, err)
 
@@ -132,14 +98,10 @@ func TestBucketCreateMapIndex(t *testing.T) {
 }
 
 func TestBucketWritePageReadPage(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_index"
-	err = bd.CreateAutoIndex(indexName)
+	err := bd.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropAutoIndex(indexName)
@@ -169,14 +131,10 @@ func TestBucketWritePageReadPage(t *testing.T) {
 }
 
 func TestBucketWriteReadMapPage(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_map_index"
-	err = bd.CreateMapIndex(indexName)
+	err := bd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropMapIndex(indexName)
@@ -190,12 +148,12 @@ func TestBucketWriteReadMapPage(t *testing.T) {
 
 	const fileName = "0"
 
-	err = bd.WriteMapPage(testVals, testKeys, fileName, indexName)
+	err = bd.WriteMapPage(testVals, testKeys, nil, fileName, indexName)
 	util.Ok(t, err)
 
 	defer bd.deletePage(indexName, fileName)
 
-	vals, _, err := bd.ReadMapPage(fileName, indexName, 10)
+	vals, _, _, err := bd.ReadMapPage(fileName, indexName, 10)
 	util.Ok(t, err)
 
 	for key, val := range testVals {
@@ -206,14 +164,10 @@ func TestBucketWriteReadMapPage(t *testing.T) {
 }
 
 func TestBucketDriverListPages(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_index_2"
-	err = bd.CreateMapIndex(indexName)
+	err := bd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropAutoIndex(indexName)
@@ -227,7 +181,7 @@ func TestBucketDriverListPages(t *testing.T) {
 
 	testFileNames := []string{"1", "2", "3", "6", "5", "4", "10", "500"}
 	for _, fileName := range testFileNames {
-		err = bd.WriteMapPage(testVals, testKeys, fileName, indexName)
+		err = bd.WriteMapPage(testVals, testKeys, nil, fileName, indexName)
 		util.Ok(t, err)
 	}
 
@@ -264,16 +218,12 @@ func TestBucketDriverListPages(t *testing.T) {
 }
 
 func TestBucketDriverLockUnlockIndex(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
 	longerLockDuration := toMillisDuration(500)
 
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", longerLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, longerLockDuration)
 
 	indexName := "test_index_3"
-	err = bd.CreateMapIndex(indexName)
+	err := bd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropAutoIndex(indexName)
@@ -298,13 +248,9 @@ func TestBucketDriverLockUnlockIndex(t *testing.T) {
 }
 
 func TestBucketDriverErrNotExist(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
 	longerLockDuration := toMillisDuration(500)
 
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", longerLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, longerLockDuration)
 
 	indexName := "test_index_notexist"
 
@@ -317,14 +263,10 @@ func TestBucketDriverErrNotExist(t *testing.T) {
 }
 
 func TestBucketDriverDropAutoIndex(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_map_index"
-	err = bd.CreateAutoIndex(indexName)
+	err := bd.CreateAutoIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropAutoIndex(indexName)
@@ -351,14 +293,10 @@ func TestBucketDriverDropAutoIndex(t *testing.T) {
 }
 
 func TestBucketDriverDropMapIndex(t *testing.T) {
-	accessKeyID, accessKeySecret, bucketName, err := getEnvCreds()
-	util.Ok(t, err)
-
-	bd, err := NewBucketDriver(pageExtension, bucketName, accessKeyID, accessKeySecret, "", testLockDuration)
-	util.Ok(t, err)
+	bd := newTestBucketDriver(t, testLockDuration)
 
 	indexName := "test_map_index"
-	err = bd.CreateMapIndex(indexName)
+	err := bd.CreateMapIndex(indexName, pageSize)
 	util.Ok(t, err)
 
 	defer bd.DropAutoIndex(indexName)
@@ -372,7 +310,7 @@ func TestBucketDriverDropMapIndex(t *testing.T) {
 
 	const fileName = "0"
 
-	err = bd.WriteMapPage(testVals, testKeys, fileName, indexName)
+	err = bd.WriteMapPage(testVals, testKeys, nil, fileName, indexName)
 	util.Ok(t, err)
 
 	err = bd.DropMapIndex(indexName)
@@ -383,3 +321,279 @@ func TestBucketDriverDropMapIndex(t *testing.T) {
 	t.Log(pages)
 	util.Equals(t, 0, len(pages))
 }
+
+// test that pages changed by another writer since they were read are not overwritten
+func TestConditionalPageWrite(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+
+	indexName := "test_map_index"
+	err := bd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+
+	err = bd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	_, _, _, err = bd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	stub.put(indexName+"/0"+pageExtension, []byte("a:concurrent\n"))
+
+	err = bd.WriteMapPage(map[string]string{"a": "stale"}, []string{"a"}, nil, "0", indexName)
+	util.Assert(t, IsWriteConflict(err), "overwriting a page changed since it was read should return a write conflict, got %v", err)
+
+	// the write succeeds once the page is read again
+	vals, _, _, err := bd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "concurrent", vals["a"])
+	err = bd.WriteMapPage(map[string]string{"a": "latest"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	// pages missing from a listing are only created if no other writer created them first
+	_, err = bd.ListPages(indexName, false)
+	util.Ok(t, err)
+	stub.put(indexName+"/1"+pageExtension, []byte("b:concurrent\n"))
+	err = bd.WriteMapPage(map[string]string{"b": "stale"}, []string{"b"}, nil, "1", indexName)
+	util.Assert(t, IsWriteConflict(err), "creating a page created by another writer should return a write conflict, got %v", err)
+}
+
+// test that a commit conflicting with another writer restores the objects it already uploaded
+func TestConditionalCommitWrites(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+
+	indexName := "test_map_index"
+	err := bd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	for _, fileName := range []string{"0", "1"} {
+		err = bd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, fileName, indexName)
+		util.Ok(t, err)
+	}
+	original, _ := stub.get(indexName + "/0" + pageExtension)
+
+	writes := WriteSet{}
+	for _, fileName := range []string{"0", "1"} {
+		_, _, _, err = bd.ReadMapPage(fileName, indexName, pageSize)
+		util.Ok(t, err)
+		writes.add(stagedWrite{kind: writeMapPage, indexName: indexName, name: fileName, data: []byte("a:committed\n")})
+	}
+	stub.put(indexName+"/1"+pageExtension, []byte("a:concurrent\n"))
+
+	err = bd.CommitWrites(writes)
+	util.Assert(t, IsWriteConflict(err), "committing over a page changed since it was read should return a write conflict, got %v", err)
+
+	restored, _ := stub.get(indexName + "/0" + pageExtension)
+	util.Equals(t, string(original), string(restored))
+	concurrent, _ := stub.get(indexName + "/1" + pageExtension)
+	util.Equals(t, "a:concurrent\n", string(concurrent))
+}
+
+// test that replacing an index writes the replacement as a new generation, which readers switch to with the
+// manifest, and that objects left by an interrupted replace are discarded
+func TestReplaceIndexGenerations(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+
+	indexName := "test_map_index"
+	replacementName := indexName + ".repage"
+	err := bd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	for _, fileName := range []string{"0", "1"} {
+		err = bd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, fileName, indexName)
+		util.Ok(t, err)
+	}
+	err = bd.WriteMeta(indexName, "directory", []byte("original"))
+	util.Ok(t, err)
+
+	// a reader which opened the index before the replace
+	reader := bd
+	reader.versions = newObjectVersions()
+	reader.generations = newIndexGenerations()
+	_, err = ReadManifest(reader, indexName)
+	util.Ok(t, err)
+
+	replace := func(value string, replacementPageSize int) {
+		err := bd.CreateMapIndex(replacementName, replacementPageSize)
+		util.Ok(t, err)
+		err = bd.WriteMapPage(map[string]string{"a": value}, []string{"a"}, nil, "0", replacementName)
+		util.Ok(t, err)
+		err = bd.ReplaceIndex(indexName, replacementName)
+		util.Ok(t, err)
+	}
+	replace("replaced", 2*pageSize)
+
+	for _, key := range []string{"/0" + pageExtension, "/1" + pageExtension, "/directory" + metaExtension} {
+		_, ok := stub.get(indexName + key)
+		util.Assert(t, !ok, "objects of the replaced generation should be deleted, found %s", key)
+	}
+	_, ok := stub.get(indexName + "/gen1/0" + pageExtension)
+	util.Assert(t, ok, "the replacement should be written to the next generation")
+	keys, err := bd.listObjectKeys(replacementName + "/")
+	util.Ok(t, err)
+	util.Equals(t, 0, len(keys))
+
+	// the generation is read from the manifest
+	other := bd
+	other.versions = newObjectVersions()
+	other.generations = newIndexGenerations()
+	manifest, err := ReadManifest(other, indexName)
+	util.Ok(t, err)
+	util.Equals(t, 1, manifest.Generation)
+	util.Equals(t, 2*pageSize, manifest.PageSize)
+	pages, err := other.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, []string{"0" + pageExtension}, pages)
+	vals, _, _, err := other.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "replaced", vals["a"])
+	_, err = other.ReadMeta(indexName, "directory")
+	util.Assert(t, IsMetaNotExist(err), "metadata of the replaced generation should not be read, got %v", err)
+
+	// the reader keeps reading the generation it opened
+	_, _, _, err = reader.ReadMapPage("1", indexName, pageSize)
+	util.Assert(t, IsPageNotExist(err), "pages of a replaced generation should be missing, got %v", err)
+
+	// an object left in the next generation by an interrupted replace
+	stub.put(indexName+"/gen2/9"+pageExtension, []byte("a:interrupted\n"))
+	replace("replaced again", pageSize)
+	_, ok = stub.get(indexName + "/gen2/9" + pageExtension)
+	util.Assert(t, !ok, "objects left by an interrupted replace should be deleted")
+	pages, err = bd.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, []string{"0" + pageExtension}, pages)
+	vals, _, _, err = bd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "replaced again", vals["a"])
+}
+
+// test that an index changed by a writer which doesn't lock it since it was read is not replaced
+func TestReplaceIndexConflict(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+
+	indexName := "test_map_index"
+	replacementName := indexName + ".repage"
+	err := bd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+	err = bd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, "0", indexName)
+	util.Ok(t, err)
+
+	// the repartition reads the index holding its lock, extended after each page
+	_, err = ReadManifest(bd, indexName)
+	util.Ok(t, err)
+	for i := 0; i < 2; i++ {
+		err = bd.LockIndex(indexName)
+		util.Ok(t, err)
+	}
+	_, err = bd.ListPages(indexName, false)
+	util.Ok(t, err)
+	err = bd.CreateMapIndex(replacementName, pageSize)
+	util.Ok(t, err)
+	err = bd.WriteMapPage(map[string]string{"a": "original"}, []string{"a"}, nil, "0", replacementName)
+	util.Ok(t, err)
+
+	// written by another process meanwhile
+	stub.put(indexName+"/1"+pageExtension, []byte("b:concurrent\n"))
+
+	err = bd.ReplaceIndex(indexName, replacementName)
+	util.Assert(t, IsWriteConflict(err), "replacing an index changed since it was listed should return a write conflict, got %v", err)
+	manifest, err := ReadManifest(bd, indexName)
+	util.Ok(t, err)
+	util.Equals(t, 0, manifest.Generation)
+	_, ok := stub.get(indexName + "/gen1/0" + pageExtension)
+	util.Assert(t, !ok, "the new generation should be deleted after a conflict")
+	concurrent, _ := stub.get(indexName + "/1" + pageExtension)
+	util.Equals(t, "b:concurrent\n", string(concurrent))
+
+	// every lockfile is deleted, including those extending the lock
+	err = bd.UnlockIndex(indexName)
+	util.Ok(t, err)
+	locked, _, err := bd.IndexIsLocked(indexName)
+	util.Ok(t, err)
+	util.Assert(t, !locked, "the index should not be locked once unlocked")
+
+	// a repartition run again replaces the index
+	_, err = bd.ListPages(indexName, false)
+	util.Ok(t, err)
+	err = bd.ReplaceIndex(indexName, replacementName)
+	util.Ok(t, err)
+}
+
+// test that pages are downloaded into reused buffers, and that missing and malformed pages are reported
+func TestDownloadPage(t *testing.T) {
+	bd, stub := newStubBucketDriver(t)
+
+	indexName := "test_map_index"
+	err := bd.CreateMapIndex(indexName, pageSize)
+	util.Ok(t, err)
+
+	for _, value := range []string{strings.Repeat("long value ", 100), "short"} {
+		err = bd.WriteMapPage(map[string]string{"a": value}, []string{"a"}, nil, "0", indexName)
+		util.Ok(t, err)
+		vals, _, _, err := bd.ReadMapPage("0", indexName, pageSize)
+		util.Ok(t, err)
+		util.Equals(t, map[string]string{"a": value}, vals)
+	}
+
+	_, _, _, err = bd.ReadMapPage("1", indexName, pageSize)
+	util.Assert(t, IsPageNotExist(err), "reading a missing page should return a missing page error, got %v", err)
+
+	stub.put(indexName+"/2"+pageExtension, []byte(expiringMapPageHeader+"\n1:a:soon:x\n"))
+	_, _, _, err = bd.ReadMapPage("2", indexName, pageSize)
+	e, ok := err.(Error)
+	util.Assert(t, ok && e.Code == errCodeBadData, "reading a malformed page should return a bad data error, got %v", err)
+}
+
+// readMapPageViaTempFile reads a map page the way the bucket driver did before pages were downloaded into
+// memory: into a temporary file, which is then decoded
+func readMapPageViaTempFile(d BucketDriver, fileName string, indexName string, pageSize int) (map[string]string, error) {
+	tempFile, err := ioutil.TempFile("", indexName+"-"+fileName+"-*"+pageExtension+".tmp")
+	if err != nil {
+		return nil, err
+	}
+	defer os.Remove(tempFile.Name())
+	defer tempFile.Close()
+
+	_, err = s3manager.NewDownloader(d.session).Download(tempFile, &s3.GetObjectInput{
+		Bucket: aws.String(d.bucketName),
+		Key:    aws.String(path.Join(indexName, fileName+pageExtension)),
+	})
+	if err != nil {
+		return nil, err
+	}
+	_, err = tempFile.Seek(0, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+	vals, _, _, err := decodeMapPage(tempFile, pageSize)
+	return vals, err
+}
+
+// compare downloading map pages into memory with downloading them into temporary files
+func BenchmarkBucketReadMapPage(b *testing.B) {
+	bd, _ := newStubBucketDriver(b)
+	indexName := "bench_map_index"
+	util.Ok(b, bd.CreateMapIndex(indexName, 1000))
+
+	vals := map[string]string{}
+	orderedKeys := []string{}
+	for j := 0; j < 1000; j++ {
+		key := fmt.Sprintf("key-%04d", j)
+		vals[key] = strings.Repeat("value ", 10)
+		orderedKeys = append(orderedKeys, key)
+	}
+	util.Ok(b, bd.WriteMapPage(vals, orderedKeys, nil, "0", indexName))
+
+	b.Run("in memory", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			read, _, _, err := bd.ReadMapPage("0", indexName, 1000)
+			util.Ok(b, err)
+			util.Equals(b, len(vals), len(read))
+		}
+	})
+
+	b.Run("temp file", func(b *testing.B) {
+		b.ReportAllocs()
+		for i := 0; i < b.N; i++ {
+			read, err := readMapPageViaTempFile(bd, "0", indexName, 1000)
+			util.Ok(b, err)
+			util.Equals(b, len(vals), len(read))
+		}
+	})
+}
@@ -0,0 +1,105 @@
+package driver
+
+import (
+	"path"
+	"strings"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+/*
+S3 cannot rename or replace several objects at once, so the bucket driver stores the pages and metadata files of
+an index in generations. The manifest of an index, which stays in the index folder, records the generation
+holding the rest of the index. Generation 0 is stored directly in the index folder, as indexes were before
+generations were introduced, and each later generation in a subfolder of the index folder. Replacing an index
+copies the replacement into the next generation, then switches to it with a single write of the manifest, so
+readers see either the whole original index or the whole replacement. The objects of the previous generation
+are deleted once the manifest is written, and a replace interrupted before then leaves the original index in
+place, along with objects of an unused generation which the next replace deletes.
+
+The driver records the generation of an index when it reads or writes its manifest, which happens when the
+index is opened, and reads the manifest of indexes it has not seen before reading their pages. A request which
+opened an index before it was replaced keeps reading the previous generation, so it may find its pages missing
+*/
+
+// folder returns the folder holding the current generation of an index, reading the manifest of the index when
+// the driver has not seen it. Indexes without a manifest are stored in generation 0
+func (d BucketDriver) folder(indexName string) (string, error) {
+	generation, ok := d.generations.get(indexName)
+	if ok {
+		return generationFolder(indexName, generation), nil
+	}
+
+	_, err := ReadManifest(d, indexName)
+	if err != nil && !IsMetaNotExist(err) {
+		return "", err
+	}
+	if err != nil {
+		d.generations.set(indexName, 0)
+	}
+	generation, _ = d.generations.get(indexName)
+	return generationFolder(indexName, generation), nil
+}
+
+// pageKey returns the key of the object holding a page of an index
+func (d BucketDriver) pageKey(indexName string, fileName string) (string, error) {
+	folder, err := d.folder(indexName)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(folder, addSuffixIfNotExist(fileName, d.pageExtension)), nil
+}
+
+// metaKey returns the key of the object holding a metadata file of an index. The manifest is kept in the index
+// folder, since it records the generation
+func (d BucketDriver) metaKey(indexName string, metaName string) (string, error) {
+	if metaName == manifestMetaName {
+		return path.Join(indexName, metaName+metaExtension), nil
+	}
+	folder, err := d.folder(indexName)
+	if err != nil {
+		return "", err
+	}
+	return path.Join(folder, metaName+metaExtension), nil
+}
+
+// inFolder reports whether an object key is directly inside a folder, and not in one of its subfolders
+func inFolder(key string, folder string) bool {
+	return path.Dir(key) == folder
+}
+
+// isGenerationObject reports whether an object of an index belongs to one of its generations, as opposed to the
+// folder marker, the manifest and lockfiles of the index
+func isGenerationObject(key string, indexName string) bool {
+	itemName := path.Base(key)
+	if inFolder(key, indexName) {
+		return itemName != indexName && itemName != manifestMetaName+metaExtension && !isLockfile(itemName)
+	}
+	return strings.HasPrefix(key, indexName+"/"+generationFolderPrefix)
+}
+
+// deleteObjectKeys deletes objects, a thousand at a time as S3 requires, and records that they are missing
+func (d BucketDriver) deleteObjectKeys(keys []string) error {
+	for start := 0; start < len(keys); start += 1000 {
+		end := start + 1000
+		if end > len(keys) {
+			end = len(keys)
+		}
+		objects := make([]*s3.ObjectIdentifier, 0, end-start)
+		for _, key := range keys[start:end] {
+			objects = append(objects, &s3.ObjectIdentifier{Key: aws.String(key)})
+		}
+		_, err := d.s3Client.DeleteObjects(&s3.DeleteObjectsInput{
+			Bucket: aws.String(d.bucketName),
+			Delete: &s3.Delete{Objects: objects},
+		})
+		if err != nil {
+			return err
+		}
+		for _, key := range keys[start:end] {
+			d.versions.observeMissing(key)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,174 @@
+package driver
+
+import (
+	"crypto/md5"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// s3Stub is a local stand-in for the subset of the S3 API used by the bucket driver, holding the objects of
+// a single bucket in memory. Writes honour the If-Match and If-None-Match conditions
+type s3Stub struct {
+	mutex   sync.Mutex
+	objects map[string][]byte
+}
+
+type stubObject struct {
+	Key  string `xml:"Key"`
+	ETag string `xml:"ETag"`
+	Size int    `xml:"Size"`
+}
+
+type stubListResult struct {
+	XMLName     xml.Name     `xml:"ListBucketResult"`
+	Prefix      string       `xml:"Prefix"`
+	KeyCount    int          `xml:"KeyCount"`
+	IsTruncated bool         `xml:"IsTruncated"`
+	Contents    []stubObject `xml:"Contents"`
+}
+
+type stubDeleteRequest struct {
+	Objects []struct {
+		Key string `xml:"Key"`
+	} `xml:"Object"`
+}
+
+type stubError struct {
+	XMLName xml.Name `xml:"Error"`
+	Code    string   `xml:"Code"`
+	Message string   `xml:"Message"`
+}
+
+func stubETag(data []byte) string {
+	sum := md5.Sum(data)
+	return `"` + hex.EncodeToString(sum[:]) + `"`
+}
+
+// newStubBucketDriver starts an S3 stand-in and returns a bucket driver using it, along with the stand-in
+func newStubBucketDriver(t testing.TB) (BucketDriver, *s3Stub) {
+	stub := &s3Stub{objects: map[string][]byte{}}
+	server := httptest.NewServer(stub)
+	t.Cleanup(server.Close)
+
+	// credentials are read from test.env
+	d, err := NewBucketDriver(pageExtension, "stub-bucket", BucketOptions{
+		Region:         "us-east-1",
+		Endpoint:       server.URL,
+		ForcePathStyle: true,
+	}, testLockDuration)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return d, stub
+}
+
+// put writes an object directly, like another writer would
+func (s *s3Stub) put(key string, data []byte) {
+	s.mutex.Lock()
+	s.objects[key] = data
+	s.mutex.Unlock()
+}
+
+func (s *s3Stub) get(key string) ([]byte, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	data, ok := s.objects[key]
+	return data, ok
+}
+
+func (s *s3Stub) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// path-style requests address /bucket/key
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"), "/", 2)
+	key := ""
+	if len(parts) == 2 {
+		key = parts[1]
+	}
+	query := r.URL.Query()
+
+	switch {
+	case r.Method == http.MethodGet && key == "":
+		s.list(w, query.Get("prefix"))
+	case r.Method == http.MethodPost && query["delete"] != nil:
+		body, _ := ioutil.ReadAll(r.Body)
+		request := stubDeleteRequest{}
+		if err := xml.Unmarshal(body, &request); err != nil {
+			s.fail(w, http.StatusBadRequest, "MalformedXML")
+			return
+		}
+		for _, object := range request.Objects {
+			delete(s.objects, object.Key)
+		}
+		fmt.Fprint(w, "<DeleteResult></DeleteResult>")
+	case r.Method == http.MethodGet || r.Method == http.MethodHead:
+		data, ok := s.objects[key]
+		if !ok {
+			s.fail(w, http.StatusNotFound, "NoSuchKey")
+			return
+		}
+		w.Header().Set("ETag", stubETag(data))
+		w.Header().Set("Content-Length", fmt.Sprint(len(data)))
+		if r.Method == http.MethodGet {
+			w.Write(data)
+		}
+	case r.Method == http.MethodPut:
+		existing, exists := s.objects[key]
+		if match := r.Header.Get("If-Match"); match != "" && (!exists || match != stubETag(existing)) {
+			s.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		if r.Header.Get("If-None-Match") == "*" && exists {
+			s.fail(w, http.StatusPreconditionFailed, "PreconditionFailed")
+			return
+		}
+		data, _ := ioutil.ReadAll(r.Body)
+		if source := r.Header.Get("X-Amz-Copy-Source"); source != "" {
+			// the copy source is URL encoded
+			if unescaped, err := url.PathUnescape(source); err == nil {
+				source = unescaped
+			}
+			sourceParts := strings.SplitN(strings.TrimPrefix(source, "/"), "/", 2)
+			data = s.objects[sourceParts[len(sourceParts)-1]]
+			s.objects[key] = data
+			fmt.Fprintf(w, "<CopyObjectResult><ETag>%s</ETag></CopyObjectResult>", stubETag(data))
+			return
+		}
+		s.objects[key] = data
+		w.Header().Set("ETag", stubETag(data))
+	case r.Method == http.MethodDelete:
+		delete(s.objects, key)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		s.fail(w, http.StatusNotImplemented, "NotImplemented")
+	}
+}
+
+func (s *s3Stub) list(w http.ResponseWriter, prefix string) {
+	result := stubListResult{Prefix: prefix}
+	for key, data := range s.objects {
+		if strings.HasPrefix(key, prefix) {
+			result.Contents = append(result.Contents, stubObject{Key: key, ETag: stubETag(data), Size: len(data)})
+		}
+	}
+	sort.Slice(result.Contents, func(i, j int) bool { return result.Contents[i].Key < result.Contents[j].Key })
+	result.KeyCount = len(result.Contents)
+	out, _ := xml.Marshal(result)
+	w.Write(out)
+}
+
+func (s *s3Stub) fail(w http.ResponseWriter, status int, code string) {
+	w.WriteHeader(status)
+	out, _ := xml.Marshal(stubError{Code: code, Message: code})
+	w.Write(out)
+}
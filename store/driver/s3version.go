@@ -0,0 +1,189 @@
+package driver
+
+import (
+	"io"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/aws/request"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// error codes returned by S3 when the condition of a conditional write fails
+const (
+	s3ErrPreconditionFailed  = "PreconditionFailed"
+	s3ErrConditionalConflict = "ConditionalRequestConflict"
+)
+
+/*
+The bucket driver writes pages and metadata files conditionally, so that a writer never overwrites a change
+it has not read. The ETag of each object read or listed by the driver is recorded, and the object is later
+written only if its ETag still matches (If-Match). Objects which were found missing, or which were absent from
+a complete listing of their index, are written only if they still don't exist (If-None-Match). A failed
+condition is returned as a write conflict error, after which the version of the object is forgotten, and the
+writer retries its read-modify-write
+*/
+
+// objectVersions holds the versions of the objects observed by a bucket driver
+type objectVersions struct {
+	mutex sync.Mutex
+	// ETag of each observed object, or the empty string for objects observed missing
+	etags map[string]string
+	// indexes whose objects were all listed
+	listed map[string]bool
+}
+
+func newObjectVersions() *objectVersions {
+	return &objectVersions{
+		etags:  map[string]string{},
+		listed: map[string]bool{},
+	}
+}
+
+// observe records the ETag of an object read or written by the driver
+func (v *objectVersions) observe(key string, etag *string) {
+	if etag == nil {
+		return
+	}
+	v.mutex.Lock()
+	v.etags[key] = *etag
+	v.mutex.Unlock()
+}
+
+// observeMissing records that an object was found missing
+func (v *objectVersions) observeMissing(key string) {
+	v.mutex.Lock()
+	v.etags[key] = ""
+	v.mutex.Unlock()
+}
+
+// observeListing records the ETags of the objects listed in an index. Objects absent from a complete listing
+// are expected not to exist when they are written
+func (v *objectVersions) observeListing(indexName string, objects []*s3.Object, complete bool) {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	for _, object := range objects {
+		if object.Key != nil && object.ETag != nil {
+			v.etags[*object.Key] = *object.ETag
+		}
+	}
+	v.listed[indexName] = complete
+}
+
+// observeVersion records the version of an object read from a page cache instead of the bucket. Versions
+// identified by modification time cannot be used as write conditions, so they are ignored
+func (v *objectVersions) observeVersion(key string, version string) {
+	if version == "" || strings.HasPrefix(version, modifiedVersionPrefix) {
+		return
+	}
+	v.mutex.Lock()
+	v.etags[key] = version
+	v.mutex.Unlock()
+}
+
+// unchanged reports whether an object still has the version the driver observed
+func (v *objectVersions) unchanged(key string, etag *string) bool {
+	v.mutex.Lock()
+	defer v.mutex.Unlock()
+	observed, ok := v.etags[key]
+	return ok && etag != nil && observed == *etag
+}
+
+// forget discards the version of an object after a write conflict, along with the listing of its index
+func (v *objectVersions) forget(key string) {
+	v.mutex.Lock()
+	delete(v.etags, key)
+	delete(v.listed, path.Dir(key))
+	v.mutex.Unlock()
+}
+
+// condition returns the request option making a write of an object conditional on its observed version
+func (v *objectVersions) condition(key string) request.Option {
+	v.mutex.Lock()
+	etag, observed := v.etags[key]
+	listed := v.listed[path.Dir(key)]
+	v.mutex.Unlock()
+
+	switch {
+	case observed && etag != "":
+		return request.WithSetRequestHeaders(map[string]string{"If-Match": etag})
+	case observed || listed:
+		return request.WithSetRequestHeaders(map[string]string{"If-None-Match": "*"})
+	default:
+		return func(r *request.Request) {}
+	}
+}
+
+// prefix of object versions identified by their modification time
+const modifiedVersionPrefix = "modified:"
+
+// objectVersion identifies the version of an object by its ETag, or by its modification time when the service
+// returns no ETag. The empty string is returned for objects whose version is unknown
+func objectVersion(etag *string, lastModified *time.Time) string {
+	if aws.StringValue(etag) != "" {
+		return *etag
+	}
+	if lastModified != nil {
+		return modifiedVersionPrefix + lastModified.UTC().Format(time.RFC3339Nano)
+	}
+	return ""
+}
+
+// readPageVersion reads an auto index page along with its version, for the page cache
+func (d BucketDriver) readPageVersion(fileName string, indexName string, pageSize int) (autoPageResult, string, error) {
+	page := autoPageResult{vals: map[uint64]string{}, orderedKeys: []uint64{}}
+	version, err := d.downloadPage(fileName, indexName, func(r io.Reader) error {
+		var err error
+		page.vals, page.orderedKeys, err = decodePage(r, pageSize)
+		return err
+	})
+	return page, version, err
+}
+
+// readMapPageVersion reads a map index page along with its version, for the page cache
+func (d BucketDriver) readMapPageVersion(fileName string, indexName string, pageSize int) (mapPageResult, string, error) {
+	page := mapPageResult{vals: map[string]string{}, orderedKeys: []string{}, expiries: map[string]int64{}}
+	version, err := d.downloadPage(fileName, indexName, func(r io.Reader) error {
+		var err error
+		page.vals, page.orderedKeys, page.expiries, err = decodeMapPage(r, pageSize)
+		return err
+	})
+	return page, version, err
+}
+
+// pageVersion returns the current version of a page without downloading it
+func (d BucketDriver) pageVersion(fileName string, indexName string) (string, error) {
+	remotePath, err := d.pageKey(indexName, fileName)
+	if err != nil {
+		return "", err
+	}
+	resp, err := d.s3Client.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(d.bucketName),
+		Key:    aws.String(remotePath),
+	})
+	if err != nil {
+		if isS3NotExistErr(err) {
+			return "", errPageNotExist(indexName, fileName, err)
+		}
+		return "", errInternalDriverFailure("reading the version of s3 file", err)
+	}
+	return objectVersion(resp.ETag, resp.LastModified), nil
+}
+
+// observePageVersion records the version of a page served by the page cache, so that writing the page is
+// conditional on the version which was read
+func (d BucketDriver) observePageVersion(fileName string, indexName string, version string) {
+	if remotePath, err := d.pageKey(indexName, fileName); err == nil {
+		d.versions.observeVersion(remotePath, version)
+	}
+}
+
+// is the error a failed write condition from S3?
+func isS3ConflictErr(in error) bool {
+	err, ok := in.(awserr.Error)
+	return ok && (err.Code() == s3ErrPreconditionFailed || err.Code() == s3ErrConditionalConflict)
+}
@@ -1,10 +1,161 @@
 package driver
 
 import (
+	"bufio"
+	"bytes"
 	"fmt"
+	"io"
 	"strconv"
+	"strings"
 )
 
+// Map pages are written in version 2 or 3 of the page format, which start with a header line. Version 1 map
+// pages have no header and store one 'key:value' line per record, so their keys cannot contain colons or
+// line breaks. Version 2 lines prefix the key with its length, 'length:key:value', and escape backslashes
+// and line breaks in both the key and the value. Version 3 adds the expiry time of each record in
+// milliseconds since the epoch, 'length:key:expiry:value', where the expiry is empty for records which don't
+// expire. Pages without expiring records are written in version 2, so they can be read by older versions of
+// keybite. Auto pages store one 'id:value' line per record
+const (
+	mapPageHeader         = "#keybite-map-page 2"
+	expiringMapPageHeader = "#keybite-map-page 3"
+)
+
+// encodePage serializes the records of an auto page
+func encodePage(vals map[uint64]string, orderedKeys []uint64) []byte {
+	var buf bytes.Buffer
+	for _, key := range orderedKeys {
+		buf.WriteString(strconv.FormatUint(key, 10))
+		buf.WriteByte(':')
+		buf.WriteString(escapeNewlines(vals[key]))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// decodePage reads the records of an auto page
+func decodePage(r io.Reader, pageSize int) (map[uint64]string, []uint64, error) {
+	vals := make(map[uint64]string, pageSize)
+	orderedKeys := make([]uint64, 0, pageSize)
+
+	err := readLines(r, func(line string) error {
+		key, value, err := stringToKeyValue(line)
+		if err != nil {
+			return err
+		}
+		vals[key] = unescapeNewlines(value)
+		orderedKeys = append(orderedKeys, key)
+		return nil
+	})
+
+	return vals, orderedKeys, err
+}
+
+// encodeMapPage serializes the records of a map page in the current page format. Expiry times are in
+// milliseconds since the epoch, and records without an expiry time never expire
+func encodeMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64) []byte {
+	expiring := false
+	for _, key := range orderedKeys {
+		if _, ok := expiries[key]; ok {
+			expiring = true
+			break
+		}
+	}
+
+	var buf bytes.Buffer
+	if expiring {
+		buf.WriteString(expiringMapPageHeader)
+	} else {
+		buf.WriteString(mapPageHeader)
+	}
+	buf.WriteByte('\n')
+	for _, key := range orderedKeys {
+		escapedKey := escapeField(key)
+		buf.WriteString(strconv.Itoa(len(escapedKey)))
+		buf.WriteByte(':')
+		buf.WriteString(escapedKey)
+		buf.WriteByte(':')
+		if expiring {
+			if expiry, ok := expiries[key]; ok {
+				buf.WriteString(strconv.FormatInt(expiry, 10))
+			}
+			buf.WriteByte(':')
+		}
+		buf.WriteString(escapeField(vals[key]))
+		buf.WriteByte('\n')
+	}
+	return buf.Bytes()
+}
+
+// decodeMapPage reads the records of a map page written in any version of the page format. The expiry times
+// of expiring records are returned in milliseconds since the epoch
+func decodeMapPage(r io.Reader, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	vals := make(map[string]string, pageSize)
+	orderedKeys := make([]string, 0, pageSize)
+	expiries := map[string]int64{}
+
+	first := true
+	version := 1
+	err := readLines(r, func(line string) error {
+		if first {
+			first = false
+			switch line {
+			case mapPageHeader:
+				version = 2
+				return nil
+			case expiringMapPageHeader:
+				version = 3
+				return nil
+			}
+		}
+
+		var key, value string
+		var err error
+		switch version {
+		case 3:
+			var expiry int64
+			var expires bool
+			key, value, expiry, expires, err = stringToExpiringMapKeyValue(line)
+			if expires {
+				expiries[key] = expiry
+			}
+		case 2:
+			key, value, err = stringToEscapedMapKeyValue(line)
+		default:
+			key, value, err = stringToMapKeyValue(line)
+			value = unescapeNewlines(value)
+		}
+		if err != nil {
+			return err
+		}
+		vals[key] = value
+		orderedKeys = append(orderedKeys, key)
+		return nil
+	})
+
+	return vals, orderedKeys, expiries, err
+}
+
+// readLines calls handleLine with each line read from r. Lines are not limited in length
+func readLines(r io.Reader, handleLine func(line string) error) error {
+	reader := bufio.NewReader(r)
+	for {
+		line, err := reader.ReadString('\n')
+		if err != nil && err != io.EOF {
+			return err
+		}
+		if len(line) > 0 {
+			line = strings.TrimSuffix(strings.TrimSuffix(line, "\n"), "\r")
+			if lineErr := handleLine(line); lineErr != nil {
+				return lineErr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+	}
+}
+
 // stringToKeyValue converts a line of text to a key-value pair used to read a page file
 func stringToKeyValue(str string) (uint64, string, error) {
 	parts, err := splitOnFirst(str, ':')
@@ -34,6 +185,105 @@ func stringToMapKeyValue(str string) (string, string, error) {
 	return parts[0], parts[1], nil
 }
 
+// stringToEscapedMapKeyValue converts a length-prefixed line of text to a key-value pair used to read a
+// map page file
+func stringToEscapedMapKeyValue(str string) (string, string, error) {
+	parts, err := splitOnFirst(str, ':')
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse archive entry %s into key-value pair: missing key length", str)
+	}
+
+	keyLength, err := strconv.Atoi(parts[0])
+	if err != nil || keyLength < 0 || keyLength >= len(parts[1]) || parts[1][keyLength] != ':' {
+		return "", "", fmt.Errorf("cannot parse archive entry %s into key-value pair: invalid key length %s", str, parts[0])
+	}
+
+	key, err := unescapeField(parts[1][:keyLength])
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse archive entry %s into key-value pair: %w", str, err)
+	}
+	value, err := unescapeField(parts[1][keyLength+1:])
+	if err != nil {
+		return "", "", fmt.Errorf("cannot parse archive entry %s into key-value pair: %w", str, err)
+	}
+
+	return key, value, nil
+}
+
+// stringToExpiringMapKeyValue converts a version 3 line of text to a key-value pair and the expiry time of
+// the record, which is only valid if expires is true
+func stringToExpiringMapKeyValue(str string) (key string, value string, expiry int64, expires bool, err error) {
+	key, rest, err := stringToEscapedMapKeyValue(str)
+	if err != nil {
+		return "", "", 0, false, err
+	}
+
+	parts, err := splitOnFirst(rest, ':')
+	if err != nil {
+		return "", "", 0, false, fmt.Errorf("cannot parse archive entry %s into key-value pair: missing expiry", str)
+	}
+	if parts[0] != "" {
+		expiry, err = strconv.ParseInt(parts[0], 10, 64)
+		if err != nil {
+			return "", "", 0, false, fmt.Errorf("cannot parse archive entry %s into key-value pair: invalid expiry %s", str, parts[0])
+		}
+		expires = true
+	}
+
+	// the value was unescaped with the expiry, but the expiry contains no escapes
+	return key, parts[1], expiry, expires, nil
+}
+
+// escapeField escapes backslashes and line breaks so that any string can be stored within a single line
+func escapeField(in string) string {
+	if !strings.ContainsAny(in, "\\\n\r") {
+		return in
+	}
+	var b strings.Builder
+	for i := 0; i < len(in); i++ {
+		switch in[i] {
+		case '\\':
+			b.WriteString(`\\`)
+		case '\n':
+			b.WriteString(`\n`)
+		case '\r':
+			b.WriteString(`\r`)
+		default:
+			b.WriteByte(in[i])
+		}
+	}
+	return b.String()
+}
+
+// unescapeField reverses escapeField
+func unescapeField(in string) (string, error) {
+	if !strings.Contains(in, `\`) {
+		return in, nil
+	}
+	var b strings.Builder
+	for i := 0; i < len(in); i++ {
+		if in[i] != '\\' {
+			b.WriteByte(in[i])
+			continue
+		}
+		i++
+		if i == len(in) {
+			return "", fmt.Errorf("unterminated escape sequence")
+		}
+		switch in[i] {
+		case '\\':
+			b.WriteByte('\\')
+		case 'n':
+			b.WriteByte('\n')
+		case 'r':
+			b.WriteByte('\r')
+		default:
+			return "", fmt.Errorf("invalid escape sequence '\\%c'", in[i])
+		}
+	}
+	return b.String(), nil
+}
+
 // splitOnFirst splits a string into two substrings after the first appearance of rune 'split'
 func splitOnFirst(str string, split rune) ([]string, error) {
 	for i, char := range str {
@@ -1,7 +1,10 @@
 package driver
 
 import (
+	"bytes"
+	"fmt"
 	"keybite/util"
+	"strings"
 	"testing"
 )
 
@@ -79,3 +82,83 @@ func TestSplitOnFirst(t *testing.T) {
 		util.Equals(t, outs[i][1], actual[1])
 	}
 }
+
+func TestEncodeDecodeMapPage(t *testing.T) {
+	orderedKeys := []string{
+		"",
+		"tenant:42:user",
+		"https://example.com/a b?c=d",
+		"Jane Doe <jane@example.com>",
+		"line\nbreak\r\n",
+		`back\slash\n`,
+		"12:not-a-length",
+		strings.Repeat("long", 100000),
+	}
+	vals := map[string]string{}
+	for i, key := range orderedKeys {
+		vals[key] = fmt.Sprintf("value %d:\n%s", i, key)
+	}
+
+	encoded := encodeMapPage(vals, orderedKeys, nil)
+	util.Assert(t, bytes.HasPrefix(encoded, []byte(mapPageHeader+"\n")), "pages without expiring records should be written in version 2")
+	decodedVals, decodedKeys, decodedExpiries, err := decodeMapPage(bytes.NewReader(encoded), len(orderedKeys))
+	util.Ok(t, err)
+	util.Equals(t, orderedKeys, decodedKeys)
+	util.Equals(t, vals, decodedVals)
+	util.Equals(t, 0, len(decodedExpiries))
+
+	expiries := map[string]int64{orderedKeys[1]: 1600000000000, orderedKeys[4]: 1}
+	encoded = encodeMapPage(vals, orderedKeys, expiries)
+	util.Assert(t, bytes.HasPrefix(encoded, []byte(expiringMapPageHeader+"\n")), "pages with expiring records should be written in version 3")
+	decodedVals, decodedKeys, decodedExpiries, err = decodeMapPage(bytes.NewReader(encoded), len(orderedKeys))
+	util.Ok(t, err)
+	util.Equals(t, orderedKeys, decodedKeys)
+	util.Equals(t, vals, decodedVals)
+	util.Equals(t, expiries, decodedExpiries)
+}
+
+func TestDecodeExpiringMapPage(t *testing.T) {
+	page := expiringMapPageHeader + "\n1:a:1600000000000:x:y\n1:b::z\n"
+	vals, orderedKeys, expiries, err := decodeMapPage(strings.NewReader(page), 2)
+	util.Ok(t, err)
+	util.Equals(t, []string{"a", "b"}, orderedKeys)
+	util.Equals(t, map[string]string{"a": "x:y", "b": "z"}, vals)
+	util.Equals(t, map[string]int64{"a": 1600000000000}, expiries)
+
+	_, _, _, err = decodeMapPage(strings.NewReader(expiringMapPageHeader+"\n1:a:soon:x\n"), 1)
+	util.Assert(t, err != nil, "an invalid expiry should return an error")
+	_, _, _, err = decodeMapPage(strings.NewReader(expiringMapPageHeader+"\n1:a:x\n"), 1)
+	util.Assert(t, err != nil, "a missing expiry field should return an error")
+}
+
+// map pages written before the page format was versioned should still be readable
+func TestDecodeLegacyMapPage(t *testing.T) {
+	legacy := "apple:red\nbanana:yellow:ish\n"
+	vals, orderedKeys, _, err := decodeMapPage(strings.NewReader(legacy), 2)
+	util.Ok(t, err)
+	util.Equals(t, []string{"apple", "banana"}, orderedKeys)
+	util.Equals(t, "yellow:ish", vals["banana"])
+
+	_, _, _, err = decodeMapPage(strings.NewReader(mapPageHeader+"\n20:short:value\n"), 1)
+	util.Assert(t, err != nil, "a key length past the end of the line should return an error")
+}
+
+func TestStringToEscapedMapKeyValue(t *testing.T) {
+	cases := []MapKeyValueAssertion{
+		{"a:b", "c", "3:a:b:c", true},
+		{"", "empty key", "0::empty key", true},
+		{"new\nline", "v", `9:new\nline:v`, true},
+		{"a", "b", "a:b", false},
+		{"a", "b", "5:a:b", false},
+		{"a", "b", `1:a:\q`, false},
+	}
+
+	for _, testCase := range cases {
+		key, val, err := stringToEscapedMapKeyValue(testCase.Line)
+		util.Equals(t, testCase.ShouldSucceed, err == nil)
+		if testCase.ShouldSucceed {
+			util.Equals(t, testCase.Key, key)
+			util.Equals(t, testCase.Value, val)
+		}
+	}
+}
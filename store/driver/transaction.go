@@ -0,0 +1,415 @@
+package driver
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// suffix of the temporary files a transaction commit writes before moving them into place
+const transactionFileExtension = ".txn"
+
+// kinds of staged writes
+const (
+	writeAutoPage = "autoPage"
+	writeMapPage  = "mapPage"
+	writeMeta     = "meta"
+)
+
+// WriteSet holds encoded page and metadata writes which are committed together with CommitWrites. A later
+// write to the same file replaces the earlier one, so each file is written once
+type WriteSet struct {
+	writes    []stagedWrite
+	positions map[string]int
+}
+
+// stagedWrite is the new content of a page or metadata file
+type stagedWrite struct {
+	kind      string
+	indexName string
+	// page name without extension, or metadata name
+	name string
+	data []byte
+}
+
+func stagedWriteKey(kind, indexName, name string) string {
+	return kind + "\x00" + indexName + "\x00" + name
+}
+
+func (s *WriteSet) add(w stagedWrite) {
+	if s.positions == nil {
+		s.positions = map[string]int{}
+	}
+	key := stagedWriteKey(w.kind, w.indexName, w.name)
+	if position, ok := s.positions[key]; ok {
+		s.writes[position] = w
+		return
+	}
+	s.positions[key] = len(s.writes)
+	s.writes = append(s.writes, w)
+}
+
+func (s WriteSet) get(kind, indexName, name string) (stagedWrite, bool) {
+	position, ok := s.positions[stagedWriteKey(kind, indexName, name)]
+	if !ok {
+		return stagedWrite{}, false
+	}
+	return s.writes[position], true
+}
+
+// Len returns the number of files written by the set
+func (s WriteSet) Len() int {
+	return len(s.writes)
+}
+
+// Indexes returns the sorted names of the indexes written by the set
+func (s WriteSet) Indexes() []string {
+	seen := map[string]bool{}
+	indexNames := []string{}
+	for _, w := range s.writes {
+		if !seen[w.indexName] {
+			seen[w.indexName] = true
+			indexNames = append(indexNames, w.indexName)
+		}
+	}
+	sort.Strings(indexNames)
+	return indexNames
+}
+
+// ForIndex returns the writes of the set to an index
+func (s WriteSet) ForIndex(indexName string) WriteSet {
+	indexWrites := WriteSet{}
+	for _, w := range s.writes {
+		if w.indexName == indexName {
+			indexWrites.add(w)
+		}
+	}
+	return indexWrites
+}
+
+// stagedWriteData is the encoded form of a staged write
+type stagedWriteData struct {
+	Kind  string `json:"kind"`
+	Index string `json:"index"`
+	Name  string `json:"name"`
+	Data  []byte `json:"data"`
+}
+
+// MarshalJSON encodes the set, so that it can be persisted before it is committed
+func (s WriteSet) MarshalJSON() ([]byte, error) {
+	encoded := make([]stagedWriteData, len(s.writes))
+	for i, w := range s.writes {
+		encoded[i] = stagedWriteData{Kind: w.kind, Index: w.indexName, Name: w.name, Data: w.data}
+	}
+	return json.Marshal(encoded)
+}
+
+// UnmarshalJSON decodes a set encoded with MarshalJSON
+func (s *WriteSet) UnmarshalJSON(data []byte) error {
+	encoded := []stagedWriteData{}
+	err := json.Unmarshal(data, &encoded)
+	if err != nil {
+		return err
+	}
+
+	*s = WriteSet{}
+	for _, w := range encoded {
+		switch w.Kind {
+		case writeAutoPage, writeMapPage, writeMeta:
+		default:
+			return fmt.Errorf("unknown staged write kind '%s'", w.Kind)
+		}
+		s.add(stagedWrite{kind: w.Kind, indexName: w.Index, name: w.Name, data: w.Data})
+	}
+	return nil
+}
+
+// CommitFunc writes the staged writes of a transaction to the driver wrapped by a staging driver
+type CommitFunc func(d StorageDriver, writes WriteSet) error
+
+// StagingDriver wraps a storage driver for a transaction. Page and metadata writes are held in memory and
+// served to later reads, until Commit writes them all with the commit function of the driver, by default the
+// CommitWrites method of the wrapped driver, or Rollback discards them. The write lock of each index written by the transaction is held until the
+// transaction ends. Creating, dropping and replacing indexes cannot be staged, so those operations fail
+type StagingDriver struct {
+	StorageDriver
+	commit CommitFunc
+	mutex  sync.Mutex
+	staged WriteSet
+	// indexes whose write lock is held by the transaction
+	locked map[string]bool
+}
+
+// NewStagingDriver wraps a storage driver to stage writes for a transaction
+func NewStagingDriver(d StorageDriver) *StagingDriver {
+	return NewStagingDriverWith(d, func(d StorageDriver, writes WriteSet) error {
+		return d.CommitWrites(writes)
+	})
+}
+
+// NewStagingDriverWith wraps a storage driver to stage writes for a transaction, which are committed with the
+// provided function
+func NewStagingDriverWith(d StorageDriver, commit CommitFunc) *StagingDriver {
+	return &StagingDriver{
+		StorageDriver: d,
+		commit:        commit,
+		locked:        map[string]bool{},
+	}
+}
+
+// IsStaged is true, since writes are held until the transaction is committed
+func (s *StagingDriver) IsStaged() bool {
+	return true
+}
+
+// Unstaged returns the driver which writes of a driver staging its writes are committed to, removing the
+// staging driver from the drivers wrapping it. Drivers which don't stage their writes are returned unchanged
+func Unstaged(d StorageDriver) StorageDriver {
+	switch wrapper := d.(type) {
+	case *StagingDriver:
+		return wrapper.StorageDriver
+	case *CoalescingDriver:
+		if wrapper.IsStaged() {
+			return NewCoalescingDriver(Unstaged(wrapper.StorageDriver))
+		}
+	case *CachingDriver:
+		if wrapper.IsStaged() {
+			return NewCachingDriver(Unstaged(wrapper.StorageDriver), wrapper.cache)
+		}
+	}
+	return d
+}
+
+// errNotTransactional indicates an operation cannot be performed as part of a transaction
+func errNotTransactional(operationDescription string) Error {
+	return Error{
+		Message: fmt.Sprintf("Operation %s cannot be performed in a transaction", operationDescription),
+		Code:    errCodeNotTransactional,
+	}
+}
+
+func (s *StagingDriver) stage(w stagedWrite) {
+	s.mutex.Lock()
+	s.staged.add(w)
+	s.mutex.Unlock()
+}
+
+func (s *StagingDriver) stagedWrite(kind, indexName, name string) (stagedWrite, bool) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	return s.staged.get(kind, indexName, name)
+}
+
+// ReadPage reads an auto index page, including staged writes
+func (s *StagingDriver) ReadPage(fileName string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
+	w, ok := s.stagedWrite(writeAutoPage, indexName, fileName)
+	if !ok {
+		return s.StorageDriver.ReadPage(fileName, indexName, pageSize)
+	}
+	return decodePage(bytes.NewReader(w.data), pageSize)
+}
+
+// ReadMapPage reads a map index page, including staged writes
+func (s *StagingDriver) ReadMapPage(fileName string, indexName string, pageSize int) (map[string]string, []string, map[string]int64, error) {
+	w, ok := s.stagedWrite(writeMapPage, indexName, fileName)
+	if !ok {
+		return s.StorageDriver.ReadMapPage(fileName, indexName, pageSize)
+	}
+	return decodeMapPage(bytes.NewReader(w.data), pageSize)
+}
+
+// ReadMeta reads a metadata file, including staged writes
+func (s *StagingDriver) ReadMeta(indexName string, metaName string) ([]byte, error) {
+	w, ok := s.stagedWrite(writeMeta, indexName, metaName)
+	if !ok {
+		return s.StorageDriver.ReadMeta(indexName, metaName)
+	}
+	return append([]byte{}, w.data...), nil
+}
+
+// WritePage stages an auto index page write
+func (s *StagingDriver) WritePage(vals map[uint64]string, orderedKeys []uint64, fileName string, indexName string) error {
+	s.stage(stagedWrite{kind: writeAutoPage, indexName: indexName, name: fileName, data: encodePage(vals, orderedKeys)})
+	return nil
+}
+
+// WriteMapPage stages a map index page write
+func (s *StagingDriver) WriteMapPage(vals map[string]string, orderedKeys []string, expiries map[string]int64, fileName string, indexName string) error {
+	s.stage(stagedWrite{kind: writeMapPage, indexName: indexName, name: fileName, data: encodeMapPage(vals, orderedKeys, expiries)})
+	return nil
+}
+
+// WriteMeta stages a metadata file write
+func (s *StagingDriver) WriteMeta(indexName string, metaName string, data []byte) error {
+	s.stage(stagedWrite{kind: writeMeta, indexName: indexName, name: metaName, data: append([]byte{}, data...)})
+	return nil
+}
+
+// ListPages lists the pages of an index, including pages created by staged writes
+func (s *StagingDriver) ListPages(indexName string, desc bool) ([]string, error) {
+	pageNames, err := s.StorageDriver.ListPages(indexName, desc)
+	if err != nil {
+		return pageNames, err
+	}
+
+	listed := map[string]bool{}
+	for _, name := range pageNames {
+		listed[strings.TrimSuffix(name, filepath.Ext(name))] = true
+	}
+
+	s.mutex.Lock()
+	added := false
+	for _, w := range s.staged.writes {
+		if w.indexName == indexName && w.kind != writeMeta && !listed[w.name] {
+			pageNames = append(pageNames, w.name)
+			listed[w.name] = true
+			added = true
+		}
+	}
+	s.mutex.Unlock()
+
+	if added {
+		sort.SliceStable(pageNames, func(i, j int) bool {
+			iNum, _ := strconv.ParseUint(strings.TrimSuffix(pageNames[i], filepath.Ext(pageNames[i])), 10, 64)
+			jNum, _ := strconv.ParseUint(strings.TrimSuffix(pageNames[j], filepath.Ext(pageNames[j])), 10, 64)
+			if desc {
+				return iNum > jNum
+			}
+			return iNum < jNum
+		})
+	}
+	return pageNames, nil
+}
+
+// IndexIsLocked reports indexes locked by the transaction as unlocked, so its queries can write to them
+func (s *StagingDriver) IndexIsLocked(indexName string) (bool, time.Time, error) {
+	s.mutex.Lock()
+	held := s.locked[indexName]
+	s.mutex.Unlock()
+	if held {
+		return false, time.Time{}, nil
+	}
+	return s.StorageDriver.IndexIsLocked(indexName)
+}
+
+// LockIndex locks an index until the transaction ends
+func (s *StagingDriver) LockIndex(indexName string) error {
+	err := s.StorageDriver.LockIndex(indexName)
+	if err != nil {
+		return err
+	}
+	s.mutex.Lock()
+	s.locked[indexName] = true
+	s.mutex.Unlock()
+	return nil
+}
+
+// UnlockIndex does nothing for indexes locked by the transaction, which stay locked until it ends
+func (s *StagingDriver) UnlockIndex(indexName string) error {
+	s.mutex.Lock()
+	held := s.locked[indexName]
+	s.mutex.Unlock()
+	if held {
+		return nil
+	}
+	return s.StorageDriver.UnlockIndex(indexName)
+}
+
+// CreateAutoIndex cannot be staged
+func (s *StagingDriver) CreateAutoIndex(indexName string, pageSize int) error {
+	return errNotTransactional("create auto index")
+}
+
+// CreateMapIndex cannot be staged
+func (s *StagingDriver) CreateMapIndex(indexName string, pageSize int) error {
+	return errNotTransactional("create map index")
+}
+
+// DropAutoIndex cannot be staged
+func (s *StagingDriver) DropAutoIndex(indexName string) error {
+	return errNotTransactional("drop auto index")
+}
+
+// DropMapIndex cannot be staged
+func (s *StagingDriver) DropMapIndex(indexName string) error {
+	return errNotTransactional("drop map index")
+}
+
+// ReplaceIndex cannot be staged
+func (s *StagingDriver) ReplaceIndex(indexName string, replacementName string) error {
+	return errNotTransactional("replace index")
+}
+
+// CommitWrites cannot be nested in a transaction
+func (s *StagingDriver) CommitWrites(writes WriteSet) error {
+	return errNotTransactional("commit writes")
+}
+
+// Commit writes every staged write to the wrapped driver, then releases the locks held by the transaction
+func (s *StagingDriver) Commit() error {
+	s.mutex.Lock()
+	staged := s.staged
+	s.staged = WriteSet{}
+	s.mutex.Unlock()
+
+	s.mutex.Lock()
+	locked := make([]string, 0, len(s.locked))
+	for indexName := range s.locked {
+		locked = append(locked, indexName)
+	}
+	s.mutex.Unlock()
+
+	// extend the locks held by the transaction, since the transaction may take longer than the lock duration
+	for _, indexName := range locked {
+		err := s.StorageDriver.LockIndex(indexName)
+		if err != nil {
+			s.release()
+			return err
+		}
+	}
+
+	var err error
+	if staged.Len() > 0 {
+		err = s.commit(s.StorageDriver, staged)
+	}
+	releaseErr := s.release()
+	if err != nil {
+		return err
+	}
+	return releaseErr
+}
+
+// Rollback discards every staged write, then releases the locks held by the transaction
+func (s *StagingDriver) Rollback() error {
+	s.mutex.Lock()
+	s.staged = WriteSet{}
+	s.mutex.Unlock()
+	return s.release()
+}
+
+// release unlocks the indexes locked by the transaction
+func (s *StagingDriver) release() error {
+	s.mutex.Lock()
+	locked := s.locked
+	s.locked = map[string]bool{}
+	s.mutex.Unlock()
+
+	var firstErr error
+	for indexName := range locked {
+		err := s.StorageDriver.UnlockIndex(indexName)
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
+
+func isTransactionFile(path string) bool {
+	return filepath.Ext(path) == transactionFileExtension
+}
@@ -0,0 +1,144 @@
+package driver
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"keybite/util"
+	"os"
+	"path"
+	"testing"
+)
+
+func TestStagingDriverStagesWrites(t *testing.T) {
+	m := NewMemoryDriver()
+	indexName := "test_map_index"
+	util.Ok(t, m.CreateMapIndex(indexName, pageSize))
+	util.Ok(t, m.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName))
+
+	s := NewStagingDriver(&m)
+	util.Ok(t, s.LockIndex(indexName))
+	util.Ok(t, s.WriteMapPage(map[string]string{"a": "2"}, []string{"a"}, nil, "0", indexName))
+	util.Ok(t, s.WriteMapPage(map[string]string{"b": "3"}, []string{"b"}, nil, "2", indexName))
+	util.Ok(t, s.WriteMeta(indexName, "directory", []byte("{}")))
+	util.Ok(t, s.UnlockIndex(indexName))
+
+	// staged writes are served to reads through the staging driver only
+	vals, _, _, err := s.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+	vals, _, _, err = m.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "1", vals["a"])
+
+	pageNames, err := s.ListPages(indexName, true)
+	util.Ok(t, err)
+	util.Equals(t, []string{"2", "0"}, pageNames)
+
+	locked, _, err := s.IndexIsLocked(indexName)
+	util.Ok(t, err)
+	util.Assert(t, !locked, "index locked by the transaction should be reported unlocked to it")
+
+	err = s.CreateAutoIndex("other_index", pageSize)
+	util.Assert(t, err != nil, "creating an index in a transaction should fail")
+
+	util.Ok(t, s.Commit())
+	vals, _, _, err = m.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+	vals, _, _, err = m.ReadMapPage("2", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "3", vals["b"])
+	data, err := m.ReadMeta(indexName, "directory")
+	util.Ok(t, err)
+	util.Equals(t, "{}", string(data))
+}
+
+func TestStagingDriverRollback(t *testing.T) {
+	m := NewMemoryDriver()
+	indexName := "test_auto_index"
+	util.Ok(t, m.CreateAutoIndex(indexName, pageSize))
+
+	s := NewStagingDriver(&m)
+	util.Ok(t, s.WritePage(map[uint64]string{1: "a"}, []uint64{1}, "0", indexName))
+	util.Ok(t, s.Rollback())
+
+	_, _, err := m.ReadPage("0", indexName, pageSize)
+	util.Assert(t, IsPageNotExist(err), "rolled back page should not be written")
+	_, _, err = s.ReadPage("0", indexName, pageSize)
+	util.Assert(t, IsPageNotExist(err), "rolled back page should not be served to reads")
+}
+
+func TestMemoryCommitWritesAllOrNothing(t *testing.T) {
+	m := NewMemoryDriver()
+	indexName := "test_map_index"
+	util.Ok(t, m.CreateMapIndex(indexName, pageSize))
+
+	writes := WriteSet{}
+	writes.add(stagedWrite{kind: writeMapPage, indexName: indexName, name: "0", data: encodeMapPage(map[string]string{"a": "1"}, []string{"a"}, nil)})
+	writes.add(stagedWrite{kind: writeMapPage, indexName: "missing_index", name: "0", data: encodeMapPage(map[string]string{"b": "2"}, []string{"b"}, nil)})
+
+	err := m.CommitWrites(writes)
+	util.Assert(t, IsIndexNotExist(err), "committing to a missing index should fail")
+	_, _, _, err = m.ReadMapPage("0", indexName, pageSize)
+	util.Assert(t, IsPageNotExist(err), "no write of a failed commit should be applied")
+}
+
+func TestFSCommitWrites(t *testing.T) {
+	dirName, err := ioutil.TempDir("", "keybite_commit_testing")
+	util.Ok(t, err)
+	defer os.RemoveAll(dirName)
+
+	fsd, err := NewFilesystemDriver(dirName, ".kb", testLockDuration, SyncFull)
+	util.Ok(t, err)
+	indexName := "test_map_index"
+	util.Ok(t, fsd.CreateMapIndex(indexName, pageSize))
+	util.Ok(t, fsd.WriteMapPage(map[string]string{"a": "1"}, []string{"a"}, nil, "0", indexName))
+
+	writes := WriteSet{}
+	writes.add(stagedWrite{kind: writeMapPage, indexName: indexName, name: "0", data: encodeMapPage(map[string]string{"a": "2"}, []string{"a"}, nil)})
+	writes.add(stagedWrite{kind: writeMapPage, indexName: "missing_index", name: "0", data: encodeMapPage(map[string]string{"b": "2"}, []string{"b"}, nil)})
+
+	// a failed write leaves the index unchanged, without transaction files
+	err = fsd.CommitWrites(writes)
+	util.Assert(t, IsIndexNotExist(err), "committing to a missing index should fail")
+	vals, _, _, err := fsd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "1", vals["a"])
+	files, err := ioutil.ReadDir(path.Join(dirName, indexName))
+	util.Ok(t, err)
+	for _, file := range files {
+		util.Assert(t, !isTransactionFile(file.Name()), "transaction file %s left behind", file.Name())
+	}
+
+	writes = WriteSet{}
+	writes.add(stagedWrite{kind: writeMapPage, indexName: indexName, name: "0", data: encodeMapPage(map[string]string{"a": "2"}, []string{"a"}, nil)})
+	writes.add(stagedWrite{kind: writeMeta, indexName: indexName, name: "directory", data: []byte("{}")})
+	util.Ok(t, fsd.CommitWrites(writes))
+
+	vals, _, _, err = fsd.ReadMapPage("0", indexName, pageSize)
+	util.Ok(t, err)
+	util.Equals(t, "2", vals["a"])
+	data, err := fsd.ReadMeta(indexName, "directory")
+	util.Ok(t, err)
+	util.Equals(t, "{}", string(data))
+	pageNames, err := fsd.ListPages(indexName, false)
+	util.Ok(t, err)
+	util.Equals(t, []string{"0.kb"}, pageNames)
+}
+
+func TestWriteSetJSON(t *testing.T) {
+	writes := WriteSet{}
+	writes.add(stagedWrite{kind: writeAutoPage, indexName: "a", name: "0", data: encodePage(map[uint64]string{1: "x"}, []uint64{1})})
+	writes.add(stagedWrite{kind: writeMeta, indexName: "b", name: "directory", data: []byte("{}")})
+
+	data, err := json.Marshal(writes)
+	util.Ok(t, err)
+	decoded := WriteSet{}
+	util.Ok(t, json.Unmarshal(data, &decoded))
+	util.Equals(t, writes, decoded)
+
+	err = json.Unmarshal(data[:len(data)/2], &decoded)
+	util.Assert(t, err != nil, "decoding a truncated write set should fail")
+	err = json.Unmarshal([]byte(`[{"kind":"unknown","index":"a","name":"0"}]`), &decoded)
+	util.Assert(t, err != nil, "decoding an unknown write kind should fail")
+}
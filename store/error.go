@@ -36,11 +36,17 @@ func (e Error) Unwrap() error {
 // most driver errors should be returned as-is, but the driver package is not aware
 // of keys, so missing-key errors should be created at the store package level
 const (
-	errCodeIndexNotExist   = "ERR_INDEX_NOT_EXIST"
-	errCodeKeyNotExist     = "ERR_KEY_NOT_EXIST"
-	errCodeBadData         = "ERR_BAD_INDEX_DATA"
-	errCodeInvalidMapKey   = "ERR_INVALID_MAP_KEY"
-	errCodeKeyAlreadyExist = "ERR_KEY_ALREADY_EXIST"
+	errCodeIndexNotExist       = "ERR_INDEX_NOT_EXIST"
+	errCodeKeyNotExist         = "ERR_KEY_NOT_EXIST"
+	errCodeBadData             = "ERR_BAD_INDEX_DATA"
+	errCodeKeyAlreadyExist     = "ERR_KEY_ALREADY_EXIST"
+	errCodeKindMismatch        = "ERR_INDEX_KIND_MISMATCH"
+	errCodeNotNumeric          = "ERR_NOT_NUMERIC"
+	errCodeValueIndex          = "ERR_VALUE_INDEX"
+	errCodeInvalidCursor       = "ERR_INVALID_CURSOR"
+	errCodeChangeLogNotEnabled = "ERR_CHANGE_LOG_NOT_ENABLED"
+	errCodeHistoryNotEnabled   = "ERR_HISTORY_NOT_ENABLED"
+	errCodeVersionNotExist     = "ERR_VERSION_NOT_EXIST"
 )
 
 // maybeMissingKeyError returns the driver error unless it is a missing-key error
@@ -51,6 +57,12 @@ func maybeMissingKeyError(indexName string, key interface{}, err error) error {
 	return err
 }
 
+// isKeyNotExist reports whether an error is a missing-key error
+func isKeyNotExist(err error) bool {
+	e, ok := err.(Error)
+	return ok && e.Code == errCodeKeyNotExist
+}
+
 // errKeyNotExist indicates
 func errKeyNotExist(indexName string, key interface{}, err error) error {
 	storeErr := Error{
@@ -79,21 +91,114 @@ func errBadData(indexName, fileName string, err error) error {
 	}
 }
 
-func errInvalidMapKey(indexName, key string, err error) error {
+func errKeyAlreadyExist(indexName, key string, err error) error {
 	return Error{
-		message:       fmt.Sprintf("Key '%s' is invalid: %s", key, err.Error()),
-		Code:          errCodeInvalidMapKey,
+		format:        "Key '%s' cannot be inserted into index '%s': already exists",
+		Key:           key,
+		IndexName:     indexName,
 		InternalError: err,
+		Code:          errCodeKeyAlreadyExist,
+	}
+}
+
+func errIndexKindMismatch(indexName, expectedKind, actualKind string) error {
+	return Error{
+		message:   fmt.Sprintf("Index '%s' has kind '%s': cannot perform %s index operations", indexName, actualKind, expectedKind),
+		Code:      errCodeKindMismatch,
+		IndexName: indexName,
+	}
+}
+
+// errNotNumeric indicates a stored value can't be incremented
+func errNotNumeric(indexName string, key interface{}, err error) error {
+	storeErr := Error{
+		format:        "Value at key '%s' in index '%s' cannot be incremented as a 64-bit integer",
 		IndexName:     indexName,
+		InternalError: err,
+		Code:          errCodeNotNumeric,
+	}
+	switch value := key.(type) {
+	case uint64:
+		storeErr.Key = strconv.FormatUint(value, 10)
+	case string:
+		storeErr.Key = value
 	}
+	return storeErr
 }
 
-func errKeyAlreadyExist(indexName, key string, err error) error {
+// errValueIndexSource indicates a value index can't be created from another value index
+func errValueIndexSource(indexName string) error {
 	return Error{
-		format:        "Key '%s' cannot be inserted into index '%s': already exists",
-		Key:           key,
+		format:    "Index '%s' is a value index: value indexes cannot be created from value indexes",
+		IndexName: indexName,
+		Code:      errCodeValueIndex,
+	}
+}
+
+// errValueIndexAlreadyExist indicates a source index already has a value index with the same name
+func errValueIndexAlreadyExist(indexName, valueIndexName string) error {
+	return Error{
+		format:    "Value index '%s' of index '%s' already exists",
+		Key:       valueIndexName,
+		IndexName: indexName,
+		Code:      errCodeValueIndex,
+	}
+}
+
+// errNotValueIndex indicates an index queried by value is not a value index
+func errNotValueIndex(indexName string) error {
+	return Error{
+		format:    "Index '%s' is not a value index: create it with create_value_index",
+		IndexName: indexName,
+		Code:      errCodeValueIndex,
+	}
+}
+
+// errValueIndexWrite indicates a value index was written directly, instead of through writes to its source index
+func errValueIndexWrite(indexName, sourceName string) error {
+	return Error{
+		format:    "Index '%s' is a value index of index '%s': it is only written by writes to its source index",
+		Key:       indexName,
+		IndexName: sourceName,
+		Code:      errCodeValueIndex,
+	}
+}
+
+// errInvalidCursor indicates a list cursor can't be decoded or used
+func errInvalidCursor(cursor string, err error) error {
+	return Error{
+		message:       fmt.Sprintf("Invalid list cursor '%s'", cursor),
+		Code:          errCodeInvalidCursor,
+		InternalError: err,
+	}
+}
+
+// errChangeLogNotEnabled indicates the change log of an index is read before it was enabled
+func errChangeLogNotEnabled(indexName string, err error) error {
+	return Error{
+		format:        "Index '%s' has no change log: enable it with enable_change_log",
 		IndexName:     indexName,
 		InternalError: err,
-		Code:          errCodeKeyAlreadyExist,
+		Code:          errCodeChangeLogNotEnabled,
+	}
+}
+
+// errHistoryNotEnabled indicates the history of an index is read before it was enabled
+func errHistoryNotEnabled(indexName string, err error) error {
+	return Error{
+		format:        "Index '%s' keeps no history: enable it with enable_history",
+		IndexName:     indexName,
+		InternalError: err,
+		Code:          errCodeHistoryNotEnabled,
+	}
+}
+
+// errVersionNotExist indicates the history of a key holds no value at a point in time
+func errVersionNotExist(indexName, key string, at PointInTime) error {
+	return Error{
+		message:   fmt.Sprintf("Key '%s' had no value %s in index '%s'", key, at.String(), indexName),
+		Key:       key,
+		IndexName: indexName,
+		Code:      errCodeVersionNotExist,
 	}
 }
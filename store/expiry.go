@@ -0,0 +1,64 @@
+package store
+
+import (
+	"keybite/store/driver"
+	"strconv"
+)
+
+// VacuumExpired removes expired records from every page of the index, returning the number of records
+// removed. Expired records are already hidden from queries, so vacuuming only reclaims their space. Each
+// page is rewritten under its own write lock, so other writes to the index can run between pages
+func (m MapIndex) VacuumExpired() (Result, error) {
+	pageIDs, err := m.listPageIDs(false)
+	if err != nil {
+		return EmptyResult(), err
+	}
+
+	var removed uint64
+	for _, pageID := range pageIDs {
+		n, err := m.vacuumPage(pageID)
+		if err != nil {
+			return EmptyResult(), err
+		}
+		removed += uint64(n)
+	}
+
+	return SingleResult(strconv.FormatUint(removed, 10)), nil
+}
+
+// vacuumPage removes the expired records of a page while the index is write locked, returning the number of
+// records removed
+func (m MapIndex) vacuumPage(pageID uint64) (int, error) {
+	if m.logsWrite(1) {
+		removed := 0
+		_, err := m.logged(func(m MapIndex) (Result, error) {
+			var err error
+			removed, err = m.vacuumPage(pageID)
+			return EmptyResult(), err
+		})
+		if err != nil {
+			return 0, err
+		}
+		return removed, nil
+	}
+
+	removed := 0
+	err := wrapInWriteLock(m.driver, m.Name, func() error {
+		page, err := m.readPage(pageID)
+		if err != nil {
+			// pages of ordered indexes are not written until they hold a record
+			if m.directory != nil && driver.IsPageNotExist(err) {
+				return nil
+			}
+			return err
+		}
+
+		removed = page.RemoveExpired()
+		if removed == 0 {
+			return nil
+		}
+		// removing records never splits the page
+		return m.persistPage(page)
+	})
+	return removed, err
+}
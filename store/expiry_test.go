@@ -0,0 +1,88 @@
+package store
+
+import (
+	"keybite/util"
+	"testing"
+	"time"
+)
+
+// setNow replaces the clock used for record expiry until the test ends
+func setNow(t *testing.T, current time.Time) {
+	previous := now
+	now = func() time.Time { return current }
+	t.Cleanup(func() { now = previous })
+}
+
+func TestMapPageExpiry(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	setNow(t, start)
+
+	p := EmptyMapPage("test_map_page")
+	_, err := p.Add("session", "a")
+	util.Ok(t, err)
+	p.SetExpiry("session", start.Add(time.Minute))
+
+	val, err := p.Query("session")
+	util.Ok(t, err)
+	util.Equals(t, "a", val)
+
+	setNow(t, start.Add(time.Minute))
+	_, err = p.Query("session")
+	util.Assert(t, err != nil, "expired records should be hidden")
+	err = p.Overwrite("session", "b")
+	util.Assert(t, err != nil, "expired records should not be updated")
+
+	// inserting over an expired record replaces it, and the new record does not expire
+	_, err = p.Add("session", "c")
+	util.Ok(t, err)
+	setNow(t, start.Add(time.Hour))
+	val, err = p.Query("session")
+	util.Ok(t, err)
+	util.Equals(t, "c", val)
+	util.Equals(t, []string{"session"}, p.orderedKeys)
+}
+
+func TestMapIndexTTL(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	setNow(t, start)
+
+	index := newTestingMapIndex(t)
+	for _, key := range []string{"a", "b", "c"} {
+		sel := NewMapSingleSelector(key)
+		_, err := index.InsertWithTTL(&sel, key, time.Minute)
+		util.Ok(t, err)
+	}
+	keep := NewMapSingleSelector("keep")
+	_, err := index.Insert(&keep, "forever")
+	util.Ok(t, err)
+	renewed := NewMapSingleSelector("b")
+	_, err = index.UpsertWithTTL(&renewed, "renewed", time.Hour)
+	util.Ok(t, err)
+
+	setNow(t, start.Add(2*time.Minute))
+
+	sel := NewMapSingleSelector("a")
+	res, err := index.Query(&sel)
+	util.Assert(t, isKeyNotExist(err), "querying an expired record should return a missing key error, got %v", err)
+	util.Assert(t, !res.Valid(), "expired records should not be returned")
+
+	count, err := index.Count()
+	util.Ok(t, err)
+	util.Equals(t, "2", count.String())
+
+	list, err := index.List(0, 0, false)
+	util.Ok(t, err)
+	util.Equals(t, ListResult{MapListItem{Key: "b", Value: "renewed"}, MapListItem{Key: "keep", Value: "forever"}}, list)
+
+	removed, err := index.VacuumExpired()
+	util.Ok(t, err)
+	util.Equals(t, "2", removed.String())
+
+	page, err := index.readPage(index.pageIDForKey("a"))
+	util.Ok(t, err)
+	util.Equals(t, []string{"b", "keep"}, page.orderedKeys)
+
+	removed, err = index.VacuumExpired()
+	util.Ok(t, err)
+	util.Equals(t, "0", removed.String())
+}
@@ -0,0 +1,137 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"strconv"
+	"strings"
+)
+
+// operators comparing the values of records to the operand of a condition
+const (
+	OpEqual          = "="
+	OpNotEqual       = "!="
+	OpLess           = "<"
+	OpLessOrEqual    = "<="
+	OpGreater        = ">"
+	OpGreaterOrEqual = ">="
+	OpPrefix         = "prefix"
+)
+
+// Condition compares the value of a record, or the value at a path in a JSON value, to an operand.
+// Equality compares numbers numerically when both sides are numbers, and as strings otherwise. The ordering
+// operators only match numbers, and prefix compares strings. JSON strings are compared without their quotes
+type Condition struct {
+	// the path of object keys and array indexes to the compared value, nil to compare the whole value
+	path     []string
+	operator string
+	operand  string
+	// the operand as a number, if it is one
+	number   float64
+	isNumber bool
+}
+
+// NewCondition creates a condition comparing the value at a path to an operand. An empty path compares the
+// whole value
+func NewCondition(path []string, operator string, operand string) (Condition, error) {
+	c := Condition{path: path, operator: operator, operand: operand}
+	number, err := strconv.ParseFloat(operand, 64)
+	c.number, c.isNumber = number, err == nil
+
+	switch operator {
+	case OpEqual, OpNotEqual, OpPrefix:
+	case OpLess, OpLessOrEqual, OpGreater, OpGreaterOrEqual:
+		if !c.isNumber {
+			return c, fmt.Errorf("operator %s compares numbers, got '%s'", operator, operand)
+		}
+	default:
+		return c, fmt.Errorf("unknown operator '%s'", operator)
+	}
+	return c, nil
+}
+
+// compared returns the part of a value compared by the condition, or false if the value doesn't hold the path
+func (c Condition) compared(value string) (string, bool) {
+	if len(c.path) == 0 {
+		return value, true
+	}
+	raw, ok := NewPathProjection(c.path).project(value)
+	if !ok {
+		return "", false
+	}
+	var str string
+	if err := json.Unmarshal([]byte(raw), &str); err == nil {
+		return str, true
+	}
+	return raw, true
+}
+
+// Match reports whether a value matches the condition. Values without the compared path never match
+func (c Condition) Match(value string) bool {
+	compared, ok := c.compared(value)
+	if !ok {
+		return false
+	}
+
+	if c.operator == OpPrefix {
+		return strings.HasPrefix(compared, c.operand)
+	}
+
+	number, err := strconv.ParseFloat(compared, 64)
+	isNumber := err == nil
+	switch c.operator {
+	case OpEqual:
+		if isNumber && c.isNumber {
+			return number == c.number
+		}
+		return compared == c.operand
+	case OpNotEqual:
+		if isNumber && c.isNumber {
+			return number != c.number
+		}
+		return compared != c.operand
+	}
+
+	if !isNumber {
+		return false
+	}
+	switch c.operator {
+	case OpLess:
+		return number < c.number
+	case OpLessOrEqual:
+		return number <= c.number
+	case OpGreater:
+		return number > c.number
+	case OpGreaterOrEqual:
+		return number >= c.number
+	}
+	return false
+}
+
+// Filter selects the records of a list or count whose values match every one of its conditions. The zero value
+// matches every record
+type Filter struct {
+	conditions []Condition
+}
+
+// And returns a filter which also requires values to match a condition
+func (f Filter) And(c Condition) Filter {
+	conditions := make([]Condition, len(f.conditions), len(f.conditions)+1)
+	copy(conditions, f.conditions)
+	return Filter{conditions: append(conditions, c)}
+}
+
+// Empty reports whether the filter matches every record
+func (f Filter) Empty() bool {
+	return len(f.conditions) == 0
+}
+
+// Match reports whether a value matches every condition of the filter
+func (f Filter) Match(value string) bool {
+	for _, c := range f.conditions {
+		if !c.Match(value) {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,67 @@
+package store
+
+import (
+	"fmt"
+	"keybite/util"
+	"testing"
+)
+
+func TestConditionMatch(t *testing.T) {
+	value := `{"status": "open", "total": 12.5, "items": [{"sku": "a-1"}], "count": "7"}`
+	matching := []struct {
+		path     []string
+		operator string
+		operand  string
+		match    bool
+	}{
+		{[]string{"status"}, OpEqual, "open", true},
+		{[]string{"status"}, OpNotEqual, "open", false},
+		{[]string{"status"}, OpPrefix, "op", true},
+		{[]string{"total"}, OpEqual, "12.50", true},
+		{[]string{"total"}, OpGreater, "12", true},
+		{[]string{"total"}, OpLessOrEqual, "12", false},
+		{[]string{"count"}, OpGreaterOrEqual, "7", true},
+		{[]string{"status"}, OpLess, "100", false},
+		{[]string{"items", "0", "sku"}, OpPrefix, "a-", true},
+		{[]string{"missing"}, OpNotEqual, "open", false},
+		{nil, OpPrefix, `{"status"`, true},
+		{nil, OpEqual, "open", false},
+	}
+	for _, m := range matching {
+		c, err := NewCondition(m.path, m.operator, m.operand)
+		util.Ok(t, err)
+		util.Assert(t, c.Match(value) == m.match, fmt.Sprintf("%v %s %s should match: %t", m.path, m.operator, m.operand, m.match))
+	}
+
+	_, err := NewCondition(nil, OpLess, "abc")
+	util.Assert(t, err != nil, "ordering operators should require a number")
+	_, err = NewCondition(nil, "~", "abc")
+	util.Assert(t, err != nil, "unknown operators should be rejected")
+}
+
+func TestListWhere(t *testing.T) {
+	index := newTestingIndex(t)
+	for i := 1; i <= 3*testPageSize; i++ {
+		_, err := index.Insert(fmt.Sprintf(`{"n": %d}`, i))
+		util.Ok(t, err)
+	}
+
+	greater, err := NewCondition([]string{"n"}, OpGreater, "10")
+	util.Ok(t, err)
+	filter := Filter{}.And(greater)
+
+	// the limit and offset apply to the matching records
+	results, err := index.ListWhere(5, 3, false, filter)
+	util.Ok(t, err)
+	util.Equals(t, 5, len(results))
+	util.Equals(t, AutoListItem{Key: 14, Value: `{"n": 14}`}, results[0])
+
+	count, err := index.CountWhere(filter)
+	util.Ok(t, err)
+	util.Equals(t, "20", count.String())
+
+	// offsets spanning whole pages skip the same number of records without a filter
+	results, err = index.List(2, testPageSize+5, false)
+	util.Ok(t, err)
+	util.Equals(t, AutoListItem{Key: uint64(testPageSize + 6), Value: fmt.Sprintf(`{"n": %d}`, testPageSize+6)}, results[0])
+}
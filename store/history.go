@@ -0,0 +1,308 @@
+package store
+
+import (
+	"encoding/json"
+	"fmt"
+	"keybite/store/driver"
+	"strconv"
+	"strings"
+	"time"
+)
+
+/*
+The history of a map index keeps the last versions of each of its records, so that overwritten and deleted
+values can be read and restored. It is stored in a map index named after the index with the history suffix,
+where the value at each key is a JSON array of the versions of the record at the key, oldest first. Versions
+are numbered from 1 for each key, and a deleted record is recorded as a version without a value
+*/
+
+// suffix of the map index holding the history of an index
+const historySuffix = ".history"
+
+// RecordVersion is a version of a record kept in the history of an index. Value is nil for versions which
+// record the deletion of the record
+type RecordVersion struct {
+	Version uint64    `json:"version"`
+	Value   *string   `json:"value"`
+	Time    time.Time `json:"time"`
+}
+
+// HistoryResult contains the versions of a record, oldest first
+type HistoryResult []RecordVersion
+
+// String returns a string encoding of the result, with one version per line
+func (r HistoryResult) String() string {
+	var b strings.Builder
+	for _, version := range r {
+		value := ""
+		if version.Value != nil {
+			value = *version.Value
+		}
+		fmt.Fprintf(&b, "%d\t%s\t%s\n", version.Version, version.Time.Format(time.RFC3339Nano), value)
+	}
+	return b.String()
+}
+
+// Valid indicates whether the result was resolved successfully
+func (r HistoryResult) Valid() bool {
+	return len(r) > 0
+}
+
+// PointInTime selects the version of a record read by a point-in-time read, either by version number or as
+// the latest version written at or before a time
+type PointInTime struct {
+	version uint64
+	time    time.Time
+}
+
+// AtVersion selects a version of a record by its version number
+func AtVersion(version uint64) PointInTime {
+	return PointInTime{version: version}
+}
+
+// AtTime selects the version of a record which was current at a time
+func AtTime(t time.Time) PointInTime {
+	return PointInTime{time: t}
+}
+
+// String describes the point in time
+func (p PointInTime) String() string {
+	if p.version > 0 {
+		return "at version " + strconv.FormatUint(p.version, 10)
+	}
+	return "at " + p.time.Format(time.RFC3339Nano)
+}
+
+// selectVersion returns the version of a record selected by the point in time, or false if the versions
+// kept do not include it
+func (p PointInTime) selectVersion(versions []RecordVersion) (RecordVersion, bool) {
+	for j := len(versions) - 1; j >= 0; j-- {
+		if p.version > 0 && versions[j].Version == p.version {
+			return versions[j], true
+		}
+		if p.version == 0 && !versions[j].Time.After(p.time) {
+			return versions[j], true
+		}
+	}
+	return RecordVersion{}, false
+}
+
+// HistoryName returns the name of the map index holding the history of an index
+func HistoryName(indexName string) string {
+	return indexName + historySuffix
+}
+
+func encodeVersions(versions []RecordVersion) (string, error) {
+	data, err := json.Marshal(versions)
+	return string(data), err
+}
+
+func decodeVersions(stored string) ([]RecordVersion, error) {
+	versions := []RecordVersion{}
+	err := json.Unmarshal([]byte(stored), &versions)
+	return versions, err
+}
+
+// updateHistory adds the modified records of an index to its history as new versions, keeping the latest
+// versions of each record
+func updateHistory(d driver.StorageDriver, indexName string, retain int, changes []valueChange) error {
+	at := now().UTC()
+	updated := make(map[string]recordState, len(changes))
+	keys := make([]string, 0, len(changes))
+	for _, change := range changes {
+		unchanged := change.before.present == change.after.present && change.before.value == change.after.value
+		if unchanged {
+			continue
+		}
+		updated[change.key] = change.after
+		keys = append(keys, change.key)
+	}
+	if len(keys) == 0 {
+		return nil
+	}
+
+	history, err := NewMapIndex(HistoryName(indexName), d, 1)
+	if err != nil {
+		return fmt.Errorf("updating the history of index %s failed: %w", indexName, err)
+	}
+	return history.modifyKeys(keys, func(page *MapPage, key string) error {
+		versions := []RecordVersion{}
+		if stored, err := page.Query(key); err == nil {
+			versions, err = decodeVersions(stored)
+			if err != nil {
+				return errBadData(history.Name, page.name, err)
+			}
+		}
+
+		version := RecordVersion{Version: 1, Time: at}
+		if len(versions) > 0 {
+			version.Version = versions[len(versions)-1].Version + 1
+		}
+		if record := updated[key]; record.present {
+			value := record.value
+			version.Value = &value
+		}
+		versions = append(versions, version)
+		if len(versions) > retain {
+			versions = versions[len(versions)-retain:]
+		}
+
+		encoded, err := encodeVersions(versions)
+		if err != nil {
+			return err
+		}
+		page.Upsert(key, encoded)
+		return nil
+	})
+}
+
+// EnableHistory starts keeping the latest versions of the records of a map index, creating its history if
+// needed. The existing records of the index are recorded as their first version when the history is created.
+// Enabling the history of an index which already keeps one changes the number of versions kept, which
+// applies to each record when it is next written. Servers which opened the index before its history was
+// enabled may not record their writes
+func EnableHistory(d driver.StorageDriver, indexName string, versions int, pageSize int) error {
+	if versions < 1 {
+		return fmt.Errorf("the number of versions kept must be a positive integer, got %d", versions)
+	}
+	return updateManifest(d, indexName, "enabling its history", func(manifest *driver.IndexManifest) error {
+		if manifest.Kind != driver.KindMap {
+			return errIndexKindMismatch(indexName, driver.KindMap, manifest.Kind)
+		}
+
+		_, err := driver.ReadManifest(d, HistoryName(indexName))
+		if driver.IsIndexNotExist(err) {
+			err = d.CreateMapIndex(HistoryName(indexName), pageSize)
+			if err != nil {
+				return err
+			}
+			var changes []valueChange
+			changes, err = existingRecords(d, indexName, *manifest)
+			if err != nil {
+				return err
+			}
+			err = updateHistory(d, indexName, versions, changes)
+		}
+		if err != nil {
+			return err
+		}
+		manifest.HistoryVersions = versions
+		return nil
+	})
+}
+
+// DisableHistory stops keeping versions of the records of an index, and drops its history
+func DisableHistory(d driver.StorageDriver, indexName string) error {
+	err := updateManifest(d, indexName, "disabling its history", func(manifest *driver.IndexManifest) error {
+		manifest.HistoryVersions = 0
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	return DropHistory(d, indexName)
+}
+
+// DropHistory drops the history of an index, if it has one
+func DropHistory(d driver.StorageDriver, indexName string) error {
+	err := d.DropMapIndex(HistoryName(indexName))
+	if driver.IsIndexNotExist(err) {
+		return nil
+	}
+	return err
+}
+
+// versions returns the versions of the record at a key kept in the history of the index
+func (m MapIndex) versions(key string) ([]RecordVersion, error) {
+	if m.historyVersions == 0 {
+		return nil, errHistoryNotEnabled(m.Name, nil)
+	}
+	history, err := NewMapIndex(HistoryName(m.Name), m.driver, 1)
+	if err != nil {
+		if driver.IsIndexNotExist(err) {
+			return nil, errHistoryNotEnabled(m.Name, err)
+		}
+		return nil, err
+	}
+
+	selector := NewMapSingleSelector(key)
+	stored, err := history.Query(&selector)
+	if err != nil || !stored.Valid() {
+		if isKeyNotExist(err) {
+			err = nil
+		}
+		return []RecordVersion{}, err
+	}
+	versions, err := decodeVersions(stored.String())
+	if err != nil {
+		return nil, errBadData(history.Name, key, err)
+	}
+	return versions, nil
+}
+
+// History returns the versions of the record at a key kept in the history of the index, oldest first
+func (m MapIndex) History(key string) (HistoryResult, error) {
+	versions, err := m.versions(key)
+	if err != nil {
+		return HistoryResult{}, err
+	}
+	return HistoryResult(versions), nil
+}
+
+// QueryAt returns the value of the record at a key at a point in time
+func (m MapIndex) QueryAt(key string, at PointInTime) (Result, error) {
+	versions, err := m.versions(key)
+	if err != nil {
+		return EmptyResult(), err
+	}
+	version, ok := at.selectVersion(versions)
+	if !ok || version.Value == nil {
+		return EmptyResult(), errVersionNotExist(m.Name, key, at)
+	}
+	return SingleResult(*version.Value), nil
+}
+
+// Revert restores the record at a key to a version kept in its history, which is recorded as a new version.
+// Reverting to a version recording the deletion of the record deletes it. The record is read and written
+// while the index is write locked
+func (m MapIndex) Revert(key string, version uint64) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(1) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.Revert(key, version) })
+	}
+	err := wrapInWriteLock(m.driver, m.Name, func() error {
+		versions, err := m.versions(key)
+		if err != nil {
+			return err
+		}
+		restored, ok := AtVersion(version).selectVersion(versions)
+		if !ok {
+			return errVersionNotExist(m.Name, key, AtVersion(version))
+		}
+
+		err = m.refreshDirectory()
+		if err != nil {
+			return err
+		}
+
+		page, err := m.readOrCreatePage(m.pageIDForKey(key))
+		if err != nil {
+			return err
+		}
+		if restored.Value != nil {
+			page.Upsert(key, *restored.Value)
+		} else if page.has(key) {
+			err = page.Delete(key)
+			if err != nil {
+				return err
+			}
+		}
+		return m.persistPage(page)
+	})
+	if err != nil {
+		return EmptyResult(), err
+	}
+	return SingleResult(key), nil
+}
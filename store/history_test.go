@@ -0,0 +1,131 @@
+package store
+
+import (
+	"keybite/util"
+	"testing"
+	"time"
+)
+
+// historyValues returns the values of record versions, with deleted versions as "-"
+func historyValues(versions HistoryResult) []string {
+	values := make([]string, len(versions))
+	for i, version := range versions {
+		values[i] = "-"
+		if version.Value != nil {
+			values[i] = *version.Value
+		}
+	}
+	return values
+}
+
+func TestPointInTimeSelectVersion(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	one, two := "1", "2"
+	versions := []RecordVersion{
+		{Version: 4, Value: &one, Time: start},
+		{Version: 5, Value: &two, Time: start.Add(time.Minute)},
+		{Version: 6, Time: start.Add(2 * time.Minute)},
+	}
+
+	version, ok := AtVersion(5).selectVersion(versions)
+	util.Assert(t, ok, "kept versions should be selected by number")
+	util.Equals(t, "2", *version.Value)
+	_, ok = AtVersion(3).selectVersion(versions)
+	util.Assert(t, !ok, "versions which are no longer kept should not be selected")
+
+	version, ok = AtTime(start.Add(90 * time.Second)).selectVersion(versions)
+	util.Assert(t, ok, "the version current at a time should be selected")
+	util.Equals(t, uint64(5), version.Version)
+	version, ok = AtTime(start.Add(time.Minute)).selectVersion(versions)
+	util.Assert(t, ok, "versions written at the time should be selected")
+	util.Equals(t, uint64(5), version.Version)
+	_, ok = AtTime(start.Add(-time.Second)).selectVersion(versions)
+	util.Assert(t, !ok, "no version should be selected before the first version kept")
+}
+
+func TestMapIndexHistory(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	setNow(t, start)
+
+	index := newTestingMapIndex(t)
+	alice := NewMapSingleSelector("alice")
+	_, err := index.Insert(&alice, "1")
+	util.Ok(t, err)
+
+	_, err = index.History("alice")
+	util.Assert(t, err != nil, "reading history before it is enabled should fail")
+	err = EnableHistory(index.driver, index.Name, 3, testPageSize)
+	util.Ok(t, err)
+	index, err = NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+
+	for j, value := range []string{"2", "3"} {
+		setNow(t, start.Add(time.Duration(j+1)*time.Minute))
+		_, err = index.Update(&alice, value)
+		util.Ok(t, err)
+	}
+	// writes which leave the value unchanged are not recorded
+	_, err = index.Upsert(&alice, "3")
+	util.Ok(t, err)
+
+	// the existing record is recorded as the first version
+	history, err := index.History("alice")
+	util.Ok(t, err)
+	util.Equals(t, []string{"1", "2", "3"}, historyValues(history))
+	util.Equals(t, uint64(1), history[0].Version)
+
+	value, err := index.QueryAt("alice", AtVersion(2))
+	util.Ok(t, err)
+	util.Equals(t, "2", value.String())
+	value, err = index.QueryAt("alice", AtTime(start.Add(90*time.Second)))
+	util.Ok(t, err)
+	util.Equals(t, "2", value.String())
+
+	// only the latest versions are kept
+	setNow(t, start.Add(3*time.Minute))
+	_, err = index.Delete(&alice)
+	util.Ok(t, err)
+	history, err = index.History("alice")
+	util.Ok(t, err)
+	util.Equals(t, []string{"2", "3", "-"}, historyValues(history))
+	util.Equals(t, uint64(4), history[2].Version)
+	_, err = index.QueryAt("alice", AtVersion(1))
+	util.Assert(t, err != nil, "versions which are no longer kept should not be read")
+	_, err = index.QueryAt("alice", AtVersion(4))
+	util.Assert(t, err != nil, "deleted versions should not be read")
+
+	// reverting restores the value as a new version
+	_, err = index.Revert("alice", 2)
+	util.Ok(t, err)
+	current, err := index.Query(&alice)
+	util.Ok(t, err)
+	util.Equals(t, "2", current.String())
+	history, err = index.History("alice")
+	util.Ok(t, err)
+	util.Equals(t, []string{"3", "-", "2"}, historyValues(history))
+
+	_, err = index.Revert("alice", 4)
+	util.Ok(t, err)
+	current, err = index.Query(&alice)
+	util.Assert(t, isKeyNotExist(err), "querying a reverted deletion should return a missing key error, got %v", err)
+	util.Assert(t, !current.Valid(), "reverting to a deleted version should delete the key")
+	_, err = index.Revert("alice", 1)
+	util.Assert(t, err != nil, "reverting to a version which is no longer kept should fail")
+
+	history, err = index.History("bob")
+	util.Ok(t, err)
+	util.Equals(t, 0, len(history))
+
+	err = DisableHistory(index.driver, index.Name)
+	util.Ok(t, err)
+	index, err = NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	_, err = index.History("alice")
+	util.Assert(t, err != nil, "disabling history should stop keeping versions")
+}
+
+func TestAutoIndexHistory(t *testing.T) {
+	index := newTestingIndex(t)
+	err := EnableHistory(index.driver, index.Name, 3, testPageSize)
+	util.Assert(t, err != nil, "history should only be kept for map indexes")
+}
@@ -0,0 +1,222 @@
+package store
+
+import (
+	"fmt"
+	"keybite/util/log"
+	"math"
+	"strconv"
+)
+
+// addToValue parses a stored value as an int64 and adds delta to it, failing on overflow
+func addToValue(indexName string, key interface{}, value string, delta int64) (string, error) {
+	current, err := strconv.ParseInt(value, 10, 64)
+	if err != nil {
+		return "", errNotNumeric(indexName, key, err)
+	}
+	if (delta > 0 && current > math.MaxInt64-delta) || (delta < 0 && current < math.MinInt64-delta) {
+		return "", errNotNumeric(indexName, key, fmt.Errorf("adding %d to %d overflows a 64-bit integer", delta, current))
+	}
+	return strconv.FormatInt(current+delta, 10), nil
+}
+
+// Increment adds delta to the integer values stored at the selected IDs, returning the new values. All of the
+// values are read and written while the index is write locked, so concurrent increments are never lost
+func (i AutoIndex) Increment(s AutoSelector, delta int64) (Result, error) {
+	if i.logsWrite(s.Length()) {
+		return i.logged(func(i AutoIndex) (Result, error) { return i.Increment(s, delta) })
+	}
+	var result Result = EmptyResult()
+	err := wrapInWriteLock(i.driver, i.Name, func() error {
+		if s.Length() > 1 {
+			var err error
+			result, err = i.incrementMany(s, delta)
+			return err
+		}
+
+		id := s.Select()
+		page, err := i.readPage(autoPageID(id, i.pageSize))
+		if err != nil {
+			return maybeMissingKeyError(i.Name, id, err)
+		}
+		newVal, err := i.incrementInPage(page, id, delta)
+		if err != nil {
+			return err
+		}
+		err = i.persistPage(page)
+		if err != nil {
+			return err
+		}
+		result = SingleResult(newVal)
+		return nil
+	})
+	return result, err
+}
+
+// incrementMany increments a collection of IDs. IDs which can't be incremented have an empty result.
+// The caller must hold the index write lock
+func (i AutoIndex) incrementMany(s AutoSelector, delta int64) (Result, error) {
+	newVals := make(CollectionResult, 0, s.Length())
+	var lastPageID uint64
+	var page Page
+	var loaded bool
+	var err error
+	for s.Next() {
+		id := s.Select()
+		pageID := autoPageID(id, i.pageSize)
+
+		// if the page housing the ID is different than the loaded page, write the changes to the loaded
+		// page and load the needed page
+		if !loaded || pageID != lastPageID {
+			if loaded {
+				err = i.persistPage(page)
+				if err != nil {
+					return newVals, err
+				}
+				loaded = false
+			}
+			page, err = i.readPage(pageID)
+			if err != nil {
+				err = maybeMissingKeyError(i.Name, id, err)
+				log.Info(err.Error())
+				newVals = append(newVals, EmptyResult())
+				continue
+			}
+			loaded = true
+			lastPageID = pageID
+		}
+
+		newVal, err := i.incrementInPage(page, id, delta)
+		if err != nil {
+			log.Info(err.Error())
+			newVals = append(newVals, EmptyResult())
+			continue
+		}
+		newVals = append(newVals, SingleResult(newVal))
+	}
+
+	if loaded {
+		err = i.persistPage(page)
+	}
+	return newVals, err
+}
+
+func (i AutoIndex) incrementInPage(page Page, id uint64, delta int64) (string, error) {
+	current, err := page.Query(id)
+	if err != nil {
+		return "", errKeyNotExist(i.Name, id, err)
+	}
+	newVal, err := addToValue(i.Name, id, current, delta)
+	if err != nil {
+		return "", err
+	}
+	return newVal, page.Overwrite(id, newVal)
+}
+
+// Increment adds delta to the integer values stored at the selected keys, returning the new values. Missing
+// keys are created with the value of delta. All of the values are read and written while the index is write
+// locked, so concurrent increments are never lost
+func (m MapIndex) Increment(s MapSelector, delta int64) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(s.Length()) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.Increment(s, delta) })
+	}
+	var result Result = EmptyResult()
+	err := wrapInWriteLock(m.driver, m.Name, func() error {
+		err := m.refreshDirectory()
+		if err != nil {
+			return err
+		}
+
+		if s.Length() > 1 {
+			var err error
+			result, err = m.incrementMany(s, delta)
+			return err
+		}
+
+		key := s.Select()
+		page, err := m.readOrCreatePage(m.pageIDForKey(key))
+		if err != nil {
+			return err
+		}
+		newVal, err := m.incrementInPage(&page, key, delta)
+		if err != nil {
+			return err
+		}
+		err = m.persistPage(page)
+		if err != nil {
+			return err
+		}
+		result = SingleResult(newVal)
+		return nil
+	})
+	return result, err
+}
+
+// incrementMany increments a collection of keys. Keys which can't be incremented have an empty result.
+// The caller must hold the index write lock
+func (m MapIndex) incrementMany(s MapSelector, delta int64) (Result, error) {
+	newVals := make(CollectionResult, 0, s.Length())
+	var lastPageID uint64
+	var page MapPage
+	var loaded bool
+	var err error
+	for s.Next() {
+		key := s.Select()
+		pageID := m.pageIDForKey(key)
+
+		// if the page housing the key is different than the loaded page, write the changes to the loaded
+		// page and load the needed page. Writing a page may split it, so the page ID is looked up again
+		if !loaded || pageID != lastPageID {
+			if loaded {
+				err = m.persistPage(page)
+				if err != nil {
+					return newVals, err
+				}
+				loaded = false
+				pageID = m.pageIDForKey(key)
+			}
+			page, err = m.readOrCreatePage(pageID)
+			if err != nil {
+				log.Info(err.Error())
+				newVals = append(newVals, EmptyResult())
+				continue
+			}
+			loaded = true
+			lastPageID = pageID
+		}
+
+		newVal, err := m.incrementInPage(&page, key, delta)
+		if err != nil {
+			log.Info(err.Error())
+			newVals = append(newVals, EmptyResult())
+			continue
+		}
+		newVals = append(newVals, SingleResult(newVal))
+	}
+
+	if loaded {
+		err = m.persistPage(page)
+	}
+	return newVals, err
+}
+
+// incrementInPage adds delta to the value at a key of a page. Live records keep their expiry time, so counters
+// inserted with a TTL still expire, while missing and expired records count up from zero and never expire
+func (m MapIndex) incrementInPage(page *MapPage, key string, delta int64) (string, error) {
+	current, err := page.Query(key)
+	live := err == nil
+	if !live {
+		current = "0"
+	}
+	newVal, err := addToValue(m.Name, key, current, delta)
+	if err != nil {
+		return "", err
+	}
+	if live {
+		return newVal, page.Overwrite(key, newVal)
+	}
+	page.Upsert(key, newVal)
+	return newVal, nil
+}
@@ -0,0 +1,112 @@
+package store
+
+import (
+	"keybite/util"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestAutoIndexIncrement(t *testing.T) {
+	index := newTestingIndex(t)
+	for i := 0; i < testPageSize*2; i++ {
+		_, err := index.Insert(strconv.Itoa(i))
+		util.Ok(t, err)
+	}
+
+	sel := NewSingleSelector(1)
+	res, err := index.Increment(&sel, 5)
+	util.Ok(t, err)
+	util.Equals(t, "5", res.String())
+
+	// bulk increments span pages
+	rangeSel := NewRangeSelector(testPageSize-1, testPageSize+1)
+	res, err = index.Increment(&rangeSel, -1)
+	util.Ok(t, err)
+	util.Equals(t, CollectionResult{"7", "8", "9"}, res)
+
+	querySel := NewRangeSelector(testPageSize-1, testPageSize+1)
+	values, err := index.Query(&querySel)
+	util.Ok(t, err)
+	util.Equals(t, CollectionResult{"7", "8", "9"}, values)
+
+	_, err = index.Insert("not a number")
+	util.Ok(t, err)
+	sel = NewSingleSelector(testPageSize*2 + 1)
+	_, err = index.Increment(&sel, 1)
+	util.Assert(t, err != nil, "incrementing a non-numeric value should fail")
+
+	sel = NewSingleSelector(testPageSize * 5)
+	_, err = index.Increment(&sel, 1)
+	util.Assert(t, err != nil, "incrementing a missing ID should fail")
+}
+
+func TestMapIndexIncrement(t *testing.T) {
+	index := newTestingMapIndex(t)
+
+	// missing keys are created
+	sel := NewMapSingleSelector("views")
+	res, err := index.Increment(&sel, 1)
+	util.Ok(t, err)
+	util.Equals(t, "1", res.String())
+
+	sel = NewMapSingleSelector("views")
+	res, err = index.Increment(&sel, 41)
+	util.Ok(t, err)
+	util.Equals(t, "42", res.String())
+
+	// bulk increments split pages holding more keys than the page size
+	keys := make([]string, testPageSize*2)
+	for i := range keys {
+		keys[i] = "key_" + strconv.Itoa(i)
+	}
+	arraySel := NewMapArraySelector(keys)
+	res, err = index.Increment(&arraySel, -2)
+	util.Ok(t, err)
+	for _, val := range res.(CollectionResult) {
+		util.Equals(t, SingleResult("-2"), val)
+	}
+
+	count, err := index.Count()
+	util.Ok(t, err)
+	util.Equals(t, strconv.Itoa(len(keys)+1), count.String())
+
+	textSel := NewMapSingleSelector("text")
+	_, err = index.Insert(&textSel, "not a number")
+	util.Ok(t, err)
+	_, err = index.Increment(&textSel, 1)
+	util.Assert(t, err != nil, "incrementing a non-numeric value should fail")
+
+	maxSel := NewMapSingleSelector("max")
+	_, err = index.Insert(&maxSel, "9223372036854775807")
+	util.Ok(t, err)
+	_, err = index.Increment(&maxSel, 1)
+	util.Assert(t, err != nil, "incrementing past the maximum int64 should fail")
+}
+
+// test that incrementing a record inserted with a TTL keeps its expiry time
+func TestMapIndexIncrementTTL(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	setNow(t, start)
+	index := newTestingMapIndex(t)
+
+	sel := NewMapSingleSelector("requests")
+	_, err := index.InsertWithTTL(&sel, "1", time.Minute)
+	util.Ok(t, err)
+	res, err := index.Increment(&sel, 1)
+	util.Ok(t, err)
+	util.Equals(t, "2", res.String())
+
+	setNow(t, start.Add(2*time.Minute))
+	_, err = index.Query(&sel)
+	util.Assert(t, isKeyNotExist(err), "an incremented record should still expire, got %v", err)
+
+	// expired records count up from zero, without expiring
+	res, err = index.Increment(&sel, 1)
+	util.Ok(t, err)
+	util.Equals(t, "1", res.String())
+	setNow(t, start.Add(time.Hour))
+	res, err = index.Query(&sel)
+	util.Ok(t, err)
+	util.Equals(t, "1", res.String())
+}
@@ -0,0 +1,55 @@
+package store
+
+import "strings"
+
+// KeyRange selects the map keys starting with a prefix, from a key (inclusive) up to another key (exclusive).
+// Empty bounds are unbounded, so the zero value selects every key
+type KeyRange struct {
+	prefix string
+	from   string
+	to     string
+}
+
+// NewKeyRange creates a key range. Empty strings leave the range unbounded
+func NewKeyRange(prefix, from, to string) KeyRange {
+	return KeyRange{prefix: prefix, from: from, to: to}
+}
+
+// unbounded reports whether the range selects every key
+func (r KeyRange) unbounded() bool {
+	return r.prefix == "" && r.from == "" && r.to == ""
+}
+
+// contains reports whether a key is in the range
+func (r KeyRange) contains(key string) bool {
+	return strings.HasPrefix(key, r.prefix) && key >= r.from && (r.to == "" || key < r.to)
+}
+
+// low returns the lowest key in the range
+func (r KeyRange) low() string {
+	if r.prefix > r.from {
+		return r.prefix
+	}
+	return r.from
+}
+
+// high returns the key after the range, or false if the range has no upper bound
+func (r KeyRange) high() (string, bool) {
+	high, bounded := prefixEnd(r.prefix)
+	if r.to != "" && (!bounded || r.to < high) {
+		return r.to, true
+	}
+	return high, bounded
+}
+
+// prefixEnd returns the lowest key after every key starting with a prefix, or false if there is none
+func prefixEnd(prefix string) (string, bool) {
+	end := []byte(prefix)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return string(end[:i+1]), true
+		}
+	}
+	return "", false
+}
@@ -0,0 +1,70 @@
+package store
+
+import (
+	"fmt"
+	"keybite/store/driver"
+	"keybite/util"
+	"testing"
+)
+
+func TestKeyRange(t *testing.T) {
+	r := NewKeyRange("tenant42_", "tenant42_b", "")
+	util.Assert(t, r.contains("tenant42_b"), "the start of a range should be inclusive")
+	util.Assert(t, r.contains("tenant42_zzz"), "keys with the prefix should be in the range")
+	util.Assert(t, !r.contains("tenant42_a"), "keys before the start should not be in the range")
+	util.Assert(t, !r.contains("tenant43_c"), "keys without the prefix should not be in the range")
+	util.Equals(t, "tenant42_b", r.low())
+	high, bounded := r.high()
+	util.Assert(t, bounded, "a prefix bounds the range")
+	util.Equals(t, "tenant42`", high)
+
+	r = NewKeyRange("", "2024-01", "2024-03")
+	util.Assert(t, r.contains("2024-02-15"), "keys between the bounds should be in the range")
+	util.Assert(t, !r.contains("2024-03"), "the end of a range should be exclusive")
+
+	_, bounded = NewKeyRange("\xff\xff", "", "").high()
+	util.Assert(t, !bounded, "a prefix of maximal bytes has no end")
+	high, _ = NewKeyRange("a\xff", "", "").high()
+	util.Equals(t, "b", high)
+}
+
+func TestMapIndexScan(t *testing.T) {
+	memory := driver.NewMemoryDriver()
+	d := &readCountingDriver{MemoryDriver: &memory}
+	err := d.CreateMapIndex("test_map_index", testPageSize)
+	util.Ok(t, err)
+	index, err := NewMapIndex("test_map_index", d, testPageSize)
+	util.Ok(t, err)
+	for tenant := 0; tenant < 10; tenant++ {
+		for i := 0; i < 10; i++ {
+			sel := NewMapSingleSelector(fmt.Sprintf("tenant%d_%02d", tenant, i))
+			_, err = index.Insert(&sel, "value")
+			util.Ok(t, err)
+		}
+	}
+	pages := len(index.directory.Pages)
+	util.Assert(t, pages > 5, "the index should have been split into several pages")
+
+	d.reads = 0
+	results, err := index.Scan(NewKeyRange("tenant4_", "", ""), 0, 0, false, Filter{})
+	util.Ok(t, err)
+	util.Equals(t, 10, len(results))
+	util.Equals(t, MapListItem{Key: "tenant4_00", Value: "value"}, results[0])
+	util.Assert(t, d.reads < pages/2, fmt.Sprintf("scanning a prefix read %d of %d pages", d.reads, pages))
+
+	results, err = index.Scan(NewKeyRange("", "tenant2_05", "tenant3_05"), 3, 0, true, Filter{})
+	util.Ok(t, err)
+	keys := []string{}
+	for _, item := range results {
+		keys = append(keys, item.(MapListItem).Key)
+	}
+	util.Equals(t, []string{"tenant3_04", "tenant3_03", "tenant3_02"}, keys)
+
+	// cursors continue a scan
+	paged, err := index.ScanAfter(NewKeyRange("tenant9", "", ""), Cursor{}, 6, 0, false, Filter{})
+	util.Ok(t, err)
+	paged, err = index.ScanAfter(NewKeyRange("tenant9", "", ""), *paged.Next, 6, 0, false, Filter{})
+	util.Ok(t, err)
+	util.Equals(t, 4, len(paged.Items))
+	util.Equals(t, MapListItem{Key: "tenant9_06", Value: "value"}, paged.Items[0])
+}
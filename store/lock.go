@@ -2,12 +2,30 @@ package store
 
 import (
 	"keybite/store/driver"
+	"math/rand"
 	"time"
 )
 
 const pauseBeforeRetry int64 = 5000
 
+// the number of times a write is attempted before a write conflict is returned, and the longest pause before
+// the first retry, which grows with each attempt
+const (
+	maxWriteAttempts = 5
+	conflictBackoff  = 20 * time.Millisecond
+)
+
+// wrapInWriteLock runs an action holding the index write lock. Drivers which write conditionally detect
+// concurrent writes themselves, so their indexes are not locked
 func wrapInWriteLock(driver driver.StorageDriver, indexName string, action func() error) error {
+	if driver.WritesConditionally() {
+		return action()
+	}
+	return holdWriteLock(driver, indexName, action)
+}
+
+// holdWriteLock runs an action holding the index write lock, whatever the driver
+func holdWriteLock(driver driver.StorageDriver, indexName string, action func() error) error {
 	now := time.Now()
 	locked, exp, err := driver.IndexIsLocked(indexName)
 
@@ -33,3 +51,25 @@ func wrapInWriteLock(driver driver.StorageDriver, indexName string, action func(
 
 	return resErr
 }
+
+// holdWriteLocks runs an action holding the write locks of several indexes, taken in the order provided
+func holdWriteLocks(driver driver.StorageDriver, indexNames []string, action func() error) error {
+	if len(indexNames) == 0 {
+		return action()
+	}
+	return holdWriteLock(driver, indexNames[0], func() error {
+		return holdWriteLocks(driver, indexNames[1:], action)
+	})
+}
+
+// retryOnConflict runs a read-modify-write until it succeeds without a write conflict, pausing for a random
+// time before each retry so that conflicting writers are unlikely to collide again
+func retryOnConflict(write func() (Result, error)) (Result, error) {
+	for attempt := 1; ; attempt++ {
+		result, err := write()
+		if !driver.IsWriteConflict(err) || attempt == maxWriteAttempts {
+			return result, err
+		}
+		time.Sleep(time.Duration(rand.Int63n(int64(attempt) * int64(conflictBackoff))))
+	}
+}
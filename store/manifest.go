@@ -0,0 +1,66 @@
+package store
+
+import (
+	"fmt"
+	"keybite/store/driver"
+)
+
+// openManifest reads the manifest of an index and verifies that the index is of the expected
+// kind. Indexes created before manifests were introduced have no manifest, so one is assumed
+// from the expected kind and the configured default page size (the version is left at 0)
+func openManifest(d driver.StorageDriver, indexName string, kind string, defaultPageSize int) (driver.IndexManifest, error) {
+	manifest, err := driver.ReadManifest(d, indexName)
+	if err != nil {
+		if driver.IsMetaNotExist(err) {
+			return driver.IndexManifest{Kind: kind, PageSize: defaultPageSize}, nil
+		}
+		return manifest, err
+	}
+
+	if manifest.Kind != kind {
+		return manifest, errIndexKindMismatch(indexName, kind, manifest.Kind)
+	}
+
+	return manifest, nil
+}
+
+// updateManifest updates the manifest of an index while the index is write locked. Indexes created before
+// manifests were introduced must be adopted first, and the action is named in the error telling so
+func updateManifest(d driver.StorageDriver, indexName string, action string, update func(manifest *driver.IndexManifest) error) error {
+	_, err := driver.ReadManifest(d, indexName)
+	if err != nil {
+		if driver.IsMetaNotExist(err) {
+			return fmt.Errorf("index %s has no manifest: run create_auto_index or create_map_index to adopt it before %s :: %w", indexName, action, err)
+		}
+		return err
+	}
+
+	return wrapInWriteLock(d, indexName, func() error {
+		manifest, err := driver.ReadManifest(d, indexName)
+		if err != nil {
+			return err
+		}
+		err = update(&manifest)
+		if err != nil {
+			return err
+		}
+		return driver.WriteManifest(d, indexName, manifest)
+	})
+}
+
+// DerivedIndexes returns the names of the indexes which writes to an index may also write: its change log and
+// history, which may be enabled by a later write, and the value indexes listed in its manifest
+func DerivedIndexes(d driver.StorageDriver, indexName string) ([]string, error) {
+	derived := []string{ChangeLogName(indexName), HistoryName(indexName)}
+	manifest, err := driver.ReadManifest(d, indexName)
+	if driver.IsMetaNotExist(err) || driver.IsIndexNotExist(err) {
+		return derived, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, ref := range manifest.ValueIndexes {
+		derived = append(derived, ref.Name)
+	}
+	return derived, nil
+}
@@ -1,9 +1,12 @@
 package store
 
 import (
+	"fmt"
 	"keybite/store/driver"
 	"keybite/util/log"
+	"sort"
 	"strconv"
+	"time"
 )
 
 // MapIndex is an index that acts like a map, mapping unique keys to values
@@ -11,39 +14,292 @@ type MapIndex struct {
 	Name     string
 	pageSize int
 	driver   driver.StorageDriver
+	// the page directory of an index with ordered addressing, nil for hash addressed indexes
+	directory *pageDirectory
+	// the value indexes updated by writes to the index
+	valueIndexes []driver.ValueIndex
+	// whether writes to the index are recorded in its change log
+	changeLog bool
+	// the number of versions of each record kept in the history of the index, 0 when no history is kept
+	historyVersions int
+	// the source index of a value index, empty for other indexes
+	source string
 }
 
-// NewMapIndex returns an index object, validating that index data exists in the data directory
-func NewMapIndex(name string, driver driver.StorageDriver, pageSize int) (MapIndex, error) {
+// NewMapIndex returns an index object, validating that index data exists in the data directory.
+// The page size recorded in the index manifest takes precedence over the provided page size, and writes
+// interrupted before they were complete are recovered from the write-ahead log of the index
+func NewMapIndex(name string, storageDriver driver.StorageDriver, pageSize int) (MapIndex, error) {
+	manifest, err := openManifest(storageDriver, name, driver.KindMap, pageSize)
+	if err != nil {
+		return MapIndex{}, err
+	}
+	err = recoverWriteAheadLog(storageDriver, name, manifest)
+	if err != nil {
+		return MapIndex{}, err
+	}
+
+	var directory *pageDirectory
+	if manifest.OrderedKeys() {
+		directory, err = readPageDirectory(storageDriver, name)
+		if err != nil {
+			return MapIndex{}, err
+		}
+	}
+
 	return MapIndex{
-		Name:     name,
-		pageSize: pageSize,
-		driver:   driver,
+		Name:            name,
+		pageSize:        manifest.PageSize,
+		driver:          storageDriver,
+		directory:       directory,
+		valueIndexes:    manifest.ValueIndexes,
+		changeLog:       manifest.ChangeLog,
+		historyVersions: manifest.HistoryVersions,
+		source:          manifest.Source,
 	}, nil
 }
 
+// checkWritable returns an error for value indexes, which are only written by writes to their source index
+func (m MapIndex) checkWritable() error {
+	if m.source != "" {
+		return errValueIndexWrite(m.Name, m.source)
+	}
+	return nil
+}
+
+// pageIDForKey returns the ID of the page which holds the key. Ordered indexes look the key up in the page
+// directory, while legacy indexes divide the hash of the key by the page size
+func (m MapIndex) pageIDForKey(key string) uint64 {
+	if m.directory == nil {
+		return HashStringToKey(key) / uint64(m.pageSize)
+	}
+	return m.directory.pageFor(key)
+}
+
+// refreshDirectory reads the page directory of an ordered index again, since the index may have been split by
+// another process since the directory was read
+func (m MapIndex) refreshDirectory() error {
+	if m.directory == nil {
+		return nil
+	}
+	dir, err := readPageDirectory(m.driver, m.Name)
+	if err != nil {
+		return err
+	}
+	*m.directory = *dir
+	return nil
+}
+
+// tracksPages indicates whether the pages of the index record their modified records, which pages of ordered
+// indexes always do so that their changes can be moved to the right page if the page was split since it was read
+func (m MapIndex) tracksPages() bool {
+	return m.tracksChanges() || m.directory != nil
+}
+
 // readPage returns page with provided ID belonging to this index
 func (m MapIndex) readPage(pageID uint64) (MapPage, error) {
 	pageIDStr := strconv.FormatUint(pageID, 10)
-	vals, orderedKeys, err := m.driver.ReadMapPage(pageIDStr, m.Name, m.pageSize)
+	vals, orderedKeys, expiries, err := m.driver.ReadMapPage(pageIDStr, m.Name, m.pageSize)
 	if err != nil {
 		return MapPage{}, err
 	}
 
-	return MapPage{
+	page := MapPage{
 		vals:        vals,
 		name:        pageIDStr,
 		orderedKeys: orderedKeys,
-	}, nil
+		expiries:    expiries,
+	}
+	if m.tracksPages() {
+		page.track()
+	}
+	return page, nil
 }
 
 // write a map page to storage using a mutex for concurrency safety
 func (m MapIndex) writePage(p MapPage) error {
 	return wrapInWriteLock(m.driver, m.Name, func() error {
-		return m.driver.WriteMapPage(p.vals, p.orderedKeys, p.name, m.Name)
+		return m.persistPage(p)
 	})
 }
 
+// tracksChanges indicates whether the pages of the index record their modified records
+func (m MapIndex) tracksChanges() bool {
+	return len(m.valueIndexes) > 0 || m.changeLog || m.historyVersions > 0
+}
+
+// logsWrite reports whether a write of a number of records goes through the write-ahead log of the index,
+// because it may write several pages, or because the driver writes conditionally and the write is retried on
+// conflicts. Writes staged for a transaction are committed by the transaction
+func (m MapIndex) logsWrite(records int) bool {
+	return !m.driver.IsStaged() && (records > 1 || m.tracksChanges() || m.driver.WritesConditionally())
+}
+
+// logged runs a write through the write-ahead log of the index
+func (m MapIndex) logged(write func(m MapIndex) (Result, error)) (Result, error) {
+	return withWriteAheadLog(m.driver, m.Name, func(staging driver.StorageDriver) (Result, error) {
+		m.driver = staging
+		return write(m)
+	})
+}
+
+// persistPage writes a map page to storage, then applies its modified records to the value indexes, change
+// log and history of the index. Pages of ordered indexes holding more keys than the page size are split into
+// new pages. The caller must hold the index write lock
+func (m MapIndex) persistPage(p MapPage) error {
+	err := m.writeSplitPage(p)
+	if err != nil || !m.tracksChanges() {
+		return err
+	}
+	changes := p.takeChanges()
+	err = updateValueIndexes(m.driver, m.valueIndexes, changes)
+	if err == nil && m.changeLog {
+		err = appendChanges(m.driver, m.Name, changes)
+	}
+	if err == nil && m.historyVersions > 0 {
+		err = updateHistory(m.driver, m.Name, m.historyVersions, changes)
+	}
+	return err
+}
+
+// writeSplitPage writes a map page to storage, splitting it if it holds more keys than the page size. The
+// directory of ordered indexes is read again first: if another process split the page since it was read, the
+// keys modified in the page which now belong to other pages are written to those pages instead
+func (m MapIndex) writeSplitPage(p MapPage) error {
+	if m.directory == nil {
+		return m.driver.WriteMapPage(p.vals, p.orderedKeys, p.expiries, p.name, m.Name)
+	}
+
+	pageID, err := strconv.ParseUint(p.name, 10, 64)
+	if err != nil {
+		return errBadData(m.Name, p.name, err)
+	}
+
+	err = m.refreshDirectory()
+	if err != nil {
+		return err
+	}
+	dir := *m.directory
+	position, ok := dir.pagePosition(pageID)
+	if !ok {
+		return errBadData(m.Name, p.name, fmt.Errorf("page %d is not in the page directory", pageID))
+	}
+
+	// unmodified keys outside the range of the page were moved by a split, and are left out
+	keys := make([]string, 0, len(p.orderedKeys))
+	moved := []string{}
+	for _, key := range p.orderedKeys {
+		if dir.contains(position, key) {
+			keys = append(keys, key)
+		} else if p.modified(key) {
+			moved = append(moved, key)
+		}
+	}
+	for key := range p.original {
+		if _, present := p.vals[key]; !present && !dir.contains(position, key) {
+			moved = append(moved, key)
+		}
+	}
+
+	if len(keys) <= m.pageSize {
+		err = m.writeRun(p, keys, p.name)
+	} else {
+		err = m.splitPage(p, pageID, keys)
+	}
+	if err != nil || len(moved) == 0 {
+		return err
+	}
+	return m.moveChanges(p, moved)
+}
+
+// splitPage writes the keys of a page holding more keys than the page size to new pages, which are written
+// before the page directory is updated so that a failed split never leaves the directory pointing at missing
+// keys
+func (m MapIndex) splitPage(p MapPage, pageID uint64, keys []string) error {
+	dir := *m.directory
+	runs := splitKeys(keys, m.pageSize)
+	lows := make([]string, 0, len(runs)-1)
+	for _, run := range runs[1:] {
+		lows = append(lows, run[0])
+	}
+	newIDs, err := dir.split(pageID, lows)
+	if err != nil {
+		return errBadData(m.Name, p.name, err)
+	}
+
+	for i, run := range runs[1:] {
+		err = m.writeRun(p, run, strconv.FormatUint(newIDs[i], 10))
+		if err != nil {
+			return err
+		}
+	}
+
+	err = dir.write(m.driver, m.Name)
+	if err != nil {
+		return err
+	}
+	*m.directory = dir
+
+	// the split page is shrunk last, once the directory no longer points to it for the moved keys
+	return m.writeRun(p, runs[0], p.name)
+}
+
+// moveChanges writes the records of keys modified in a page to the pages which now hold the keys, after the
+// page was split by another process since it was read
+func (m MapIndex) moveChanges(from MapPage, keys []string) error {
+	sort.Strings(keys)
+
+	var lastPageID uint64
+	var page MapPage
+	var loaded bool
+	for _, key := range keys {
+		pageID := m.pageIDForKey(key)
+		if !loaded || pageID != lastPageID {
+			if loaded {
+				err := m.writeSplitPage(page)
+				if err != nil {
+					return err
+				}
+				pageID = m.pageIDForKey(key)
+			}
+			var err error
+			page, err = m.readPage(pageID)
+			// pages of ordered indexes are not written until they hold a record
+			if driver.IsPageNotExist(err) {
+				page, err = EmptyMapPage(strconv.FormatUint(pageID, 10)), nil
+				page.track()
+			}
+			if err != nil {
+				return err
+			}
+			loaded = true
+			lastPageID = pageID
+		}
+		page.copyRecord(from, key)
+	}
+
+	if loaded {
+		return m.writeSplitPage(page)
+	}
+	return nil
+}
+
+// writeRun writes a run of keys from a page to the page with the provided name. Runs share the backing
+// array of the page's keys, so the keys are copied before being handed to the driver
+func (m MapIndex) writeRun(p MapPage, run []string, name string) error {
+	vals := make(map[string]string, len(run))
+	orderedKeys := make([]string, len(run))
+	expiries := map[string]int64{}
+	for i, key := range run {
+		vals[key] = p.vals[key]
+		orderedKeys[i] = key
+		if expiry, ok := p.expiries[key]; ok {
+			expiries[key] = expiry
+		}
+	}
+	return m.driver.WriteMapPage(vals, orderedKeys, expiries, name, m.Name)
+}
+
 // readOrCreatePage reads or creates the map page for this page ID
 func (m MapIndex) readOrCreatePage(pageID uint64) (MapPage, error) {
 	p, err := m.readPage(pageID)
@@ -69,16 +325,11 @@ func (m MapIndex) Query(s MapSelector) (Result, error) {
 		var lastPageID uint64
 		var page MapPage
 		var loaded bool
+		var err error
 		for i := 0; s.Next(); i++ {
 			key := s.Select()
-			hashAddr, err := HashStringToKey(key)
-			if err != nil {
-				log.Infof(err.Error())
-				results = append(results, EmptyResult())
-				continue
-			}
+			pageID := m.pageIDForKey(key)
 
-			pageID := hashAddr / uint64(m.pageSize)
 			// if the page housing the queried ID is different than the loaded page, or no page has been loaded
 			// load the needed page
 			if pageID != lastPageID || !loaded {
@@ -107,14 +358,8 @@ func (m MapIndex) Query(s MapSelector) (Result, error) {
 
 	// else return a single result
 	key := s.Select()
-	hashAddr, err := HashStringToKey(key)
-	if err != nil {
-		err = errInvalidMapKey(m.Name, key, err)
-		log.Info(err)
-		return EmptyResult(), err
-	}
+	pageID := m.pageIDForKey(key)
 
-	pageID := hashAddr / uint64(m.pageSize)
 	page, err := m.readPage(pageID)
 	if err != nil {
 		err = maybeMissingKeyError(m.Name, key, err)
@@ -122,28 +367,43 @@ func (m MapIndex) Query(s MapSelector) (Result, error) {
 	}
 
 	resultStr, err := page.Query(key)
+	if err != nil {
+		return EmptyResult(), errKeyNotExist(m.Name, key, err)
+	}
 	return SingleResult(resultStr), nil
 }
 
 // Insert value at key
 func (m MapIndex) Insert(s MapSelector, value string) (Result, error) {
+	return m.InsertWithTTL(s, value, 0)
+}
+
+// InsertWithTTL inserts a value at key which expires once the TTL has passed. Values inserted with a TTL of
+// zero never expire
+func (m MapIndex) InsertWithTTL(s MapSelector, value string, ttl time.Duration) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(s.Length()) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.InsertWithTTL(s, value, ttl) })
+	}
+	// the directory may have been split by another process since the index was opened
+	err := m.refreshDirectory()
+	if err != nil {
+		return EmptyResult(), err
+	}
+	expiresAt := now().Add(ttl)
 	// if there are multiple query selections, update all
 	if s.Length() > 1 {
 		insertedKeys := make(CollectionResult, 0, s.Length())
 		var lastPageID uint64
 		var page MapPage
 		var loaded bool
+		var err error
 		for i := 0; s.Next(); i++ {
 			key := s.Select()
-			hashAddr, err := HashStringToKey(key)
-			if err != nil {
-				err = errInvalidMapKey(m.Name, key, err)
-				log.Info(err.Error())
-				insertedKeys = append(insertedKeys, EmptyResult())
-				continue
-			}
+			pageID := m.pageIDForKey(key)
 
-			pageID := hashAddr / uint64(m.pageSize)
 			// if the page housing the update ID is different than the loaded page, or no page has been loaded yet,
 			// load the needed page
 			if !loaded {
@@ -183,12 +443,15 @@ func (m MapIndex) Insert(s MapSelector, value string) (Result, error) {
 				insertedKeys = append(insertedKeys, EmptyResult())
 				continue
 			}
+			if ttl > 0 {
+				page.SetExpiry(key, expiresAt)
+			}
 
 			insertedKeys = append(insertedKeys, SingleResult(key))
 		}
 
 		// write the updated map to file, conscious of other requests
-		err := m.writePage(page)
+		err = m.writePage(page)
 		if err != nil {
 			log.Info(err.Error())
 		}
@@ -196,14 +459,8 @@ func (m MapIndex) Insert(s MapSelector, value string) (Result, error) {
 	}
 
 	key := s.Select()
-	hashAddr, err := HashStringToKey(key)
-	if err != nil {
-		err = errInvalidMapKey(m.Name, key, err)
-		log.Info(err)
-		return EmptyResult(), err
-	}
+	pageID := m.pageIDForKey(key)
 
-	pageID := hashAddr / uint64(m.pageSize)
 	page, err := m.readOrCreatePage(pageID)
 	if err != nil {
 		return EmptyResult(), err
@@ -213,6 +470,9 @@ func (m MapIndex) Insert(s MapSelector, value string) (Result, error) {
 	if err != nil {
 		return EmptyResult(), errKeyAlreadyExist(m.Name, key, err)
 	}
+	if ttl > 0 {
+		page.SetExpiry(key, expiresAt)
+	}
 
 	err = m.writePage(page)
 
@@ -221,23 +481,28 @@ func (m MapIndex) Insert(s MapSelector, value string) (Result, error) {
 
 // Update existing data
 func (m MapIndex) Update(s MapSelector, newValue string) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(s.Length()) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.Update(s, newValue) })
+	}
+	// the directory may have been split by another process since the index was opened
+	err := m.refreshDirectory()
+	if err != nil {
+		return EmptyResult(), err
+	}
 	// if there are multiple query selections, update all
 	if s.Length() > 1 {
 		updatedKeys := make(CollectionResult, 0, s.Length())
 		var lastPageID uint64
 		var page MapPage
 		var loaded bool
+		var err error
 		for i := 0; s.Next(); i++ {
 			key := s.Select()
-			hashAddr, err := HashStringToKey(key)
-			if err != nil {
-				err = errInvalidMapKey(m.Name, key, err)
-				log.Info(err)
-				updatedKeys = append(updatedKeys, EmptyResult())
-				continue
-			}
+			pageID := m.pageIDForKey(key)
 
-			pageID := hashAddr / uint64(m.pageSize)
 			// if the page housing the update ID is different than the loaded page, or no page has been loaded yet,
 			// load the needed page
 			if !loaded {
@@ -283,7 +548,7 @@ func (m MapIndex) Update(s MapSelector, newValue string) (Result, error) {
 		}
 
 		// write the updated map to file, conscious of other requests
-		err := m.writePage(page)
+		err = m.writePage(page)
 		if err != nil {
 			log.Info(err.Error())
 		}
@@ -291,14 +556,8 @@ func (m MapIndex) Update(s MapSelector, newValue string) (Result, error) {
 	}
 
 	key := s.Select()
-	id, err := HashStringToKey(key)
-	if err != nil {
-		err = errInvalidMapKey(m.Name, key, err)
-		log.Info(err)
-		return EmptyResult(), err
-	}
+	pageID := m.pageIDForKey(key)
 
-	pageID := id / uint64(m.pageSize)
 	page, err := m.readPage(pageID)
 	if err != nil {
 		err = maybeMissingKeyError(m.Name, s.Select(), err)
@@ -318,21 +577,33 @@ func (m MapIndex) Update(s MapSelector, newValue string) (Result, error) {
 
 // Upsert inserts or modifies a value at the given key
 func (m MapIndex) Upsert(s MapSelector, newValue string) (Result, error) {
+	return m.UpsertWithTTL(s, newValue, 0)
+}
+
+// UpsertWithTTL inserts or modifies a value at the given key, which expires once the TTL has passed. Values
+// upserted with a TTL of zero never expire, even if the value they replace did
+func (m MapIndex) UpsertWithTTL(s MapSelector, newValue string, ttl time.Duration) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(s.Length()) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.UpsertWithTTL(s, newValue, ttl) })
+	}
+	// the directory may have been split by another process since the index was opened
+	err := m.refreshDirectory()
+	if err != nil {
+		return EmptyResult(), err
+	}
+	expiresAt := now().Add(ttl)
 	if s.Length() > 1 {
 		upsertedKeys := make(CollectionResult, 0, s.Length())
 		var lastPageID uint64
 		var page MapPage
 		var loaded bool
+		var err error
 		for i := 0; s.Next(); i++ {
 			key := s.Select()
-			hashAddr, err := HashStringToKey(key)
-			if err != nil {
-				err = errInvalidMapKey(m.Name, key, err)
-				log.Info(err)
-				upsertedKeys = append(upsertedKeys, EmptyResult())
-				continue
-			}
-			pageID := hashAddr / uint64(m.pageSize)
+			pageID := m.pageIDForKey(key)
 			// if the page housing the update ID is different than the loaded page, or no page has been loaded yet,
 			// load the needed page
 			if !loaded {
@@ -365,11 +636,14 @@ func (m MapIndex) Upsert(s MapSelector, newValue string) (Result, error) {
 
 			// update or insert value in loaded page
 			page.Upsert(key, newValue)
+			if ttl > 0 {
+				page.SetExpiry(key, expiresAt)
+			}
 			upsertedKeys = append(upsertedKeys, SingleResult(key))
 		}
 
 		// write the updated map to file, conscious of other requests
-		err := m.writePage(page)
+		err = m.writePage(page)
 		if err != nil {
 			log.Info(err.Error())
 		}
@@ -378,19 +652,16 @@ func (m MapIndex) Upsert(s MapSelector, newValue string) (Result, error) {
 	}
 
 	key := s.Select()
-	hashAddr, err := HashStringToKey(key)
-	if err != nil {
-		err = errInvalidMapKey(m.Name, key, err)
-		log.Info(err)
-		return EmptyResult(), err
-	}
-	pageID := hashAddr / uint64(m.pageSize)
+	pageID := m.pageIDForKey(key)
 	page, err := m.readOrCreatePage(pageID)
 	if err != nil {
 		return EmptyResult(), err
 	}
 
 	page.Upsert(key, newValue)
+	if ttl > 0 {
+		page.SetExpiry(key, expiresAt)
+	}
 
 	err = m.writePage(page)
 	if err != nil {
@@ -403,6 +674,17 @@ func (m MapIndex) Upsert(s MapSelector, newValue string) (Result, error) {
 
 // Delete an item from the map index
 func (m MapIndex) Delete(s MapSelector) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(s.Length()) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.Delete(s) })
+	}
+	// the directory may have been split by another process since the index was opened
+	err := m.refreshDirectory()
+	if err != nil {
+		return EmptyResult(), err
+	}
 	if s.Length() > 1 {
 		deletedKeys := make(CollectionResult, 0, s.Length())
 		var lastPageID uint64
@@ -411,14 +693,7 @@ func (m MapIndex) Delete(s MapSelector) (Result, error) {
 		var err error
 		for i := 0; s.Next(); i++ {
 			key := s.Select()
-			hashAddr, err := HashStringToKey(key)
-			if err != nil {
-				err = errInvalidMapKey(m.Name, key, err)
-				log.Info(err.Error())
-				deletedKeys = append(deletedKeys, EmptyResult())
-				continue
-			}
-			pageID := hashAddr / uint64(m.pageSize)
+			pageID := m.pageIDForKey(key)
 			if !loaded {
 				page, err = m.readPage(pageID)
 				if err != nil {
@@ -469,14 +744,8 @@ func (m MapIndex) Delete(s MapSelector) (Result, error) {
 	}
 
 	key := s.Select()
-	hashAddr, err := HashStringToKey(key)
-	if err != nil {
-		err = errInvalidMapKey(m.Name, key, err)
-		log.Info(err)
-		return EmptyResult(), err
-	}
+	pageID := m.pageIDForKey(key)
 
-	pageID := hashAddr / uint64(m.pageSize)
 	page, err := m.readPage(pageID)
 	if err != nil {
 		err = maybeMissingKeyError(m.Name, key, err)
@@ -499,9 +768,83 @@ func (m MapIndex) Delete(s MapSelector) (Result, error) {
 
 // List a subset of results from the map index
 func (m MapIndex) List(limit, offset int, desc bool) (ListResult, error) {
-	pageNames, err := m.driver.ListPages(m.Name, desc)
+	return m.ListWhere(limit, offset, desc, Filter{})
+}
+
+// ListWhere lists a subset of the records matching a filter, in key order. The filter is applied while the
+// pages are read, and the limit and offset apply to the matching records
+func (m MapIndex) ListWhere(limit, offset int, desc bool, f Filter) (ListResult, error) {
+	return m.Scan(KeyRange{}, limit, offset, desc, f)
+}
+
+// ListAfter lists the records matching a filter which follow a cursor, skipping the pages before it without
+// reading them. The result holds the cursor of the next page when the limit was reached
+func (m MapIndex) ListAfter(after Cursor, limit, offset int, desc bool, f Filter) (PagedListResult, error) {
+	return m.ScanAfter(KeyRange{}, after, limit, offset, desc, f)
+}
+
+// Scan lists the records of a key range matching a filter, in key order. Ordered indexes only read the pages
+// holding keys of the range, while legacy indexes read every page
+func (m MapIndex) Scan(r KeyRange, limit, offset int, desc bool, f Filter) (ListResult, error) {
+	results, _, err := m.listFrom(r, Cursor{}, limit, offset, desc, f)
+	return results, err
+}
+
+// ScanAfter lists the records of a key range matching a filter which follow a cursor
+func (m MapIndex) ScanAfter(r KeyRange, after Cursor, limit, offset int, desc bool, f Filter) (PagedListResult, error) {
+	err := after.checkDirection(desc)
+	if err != nil {
+		return PagedListResult{}, err
+	}
+	results, last, err := m.listFrom(r, after, limit, offset, desc, f)
 	if err != nil {
-		return ListResult{}, err
+		return PagedListResult{}, err
+	}
+	paged := PagedListResult{Items: results}
+	if limit > 0 && len(results) == limit {
+		paged.Next = &last
+	}
+	return paged, nil
+}
+
+// listFrom lists the records of a key range following a cursor, returning the cursor of the last record listed.
+// Ordered indexes find the page holding the cursor key in the page directory, since the key may have moved to
+// another page in a split. Legacy indexes list keys in page order, so the cursor page is used
+func (m MapIndex) listFrom(r KeyRange, after Cursor, limit, offset int, desc bool, f Filter) (ListResult, Cursor, error) {
+	last := after
+	var pageIDs []uint64
+	var err error
+	if m.directory != nil {
+		pageIDs = m.directory.pageIDsInRange(r, desc)
+	} else {
+		pageIDs, err = m.listPageIDs(desc)
+		if err != nil {
+			return ListResult{}, last, err
+		}
+	}
+
+	var afterPageID uint64
+	if after.started() {
+		if m.directory != nil {
+			afterPageID = m.directory.pageFor(after.key)
+		} else {
+			afterPageID, err = strconv.ParseUint(after.page, 10, 64)
+			if err != nil {
+				return ListResult{}, last, errInvalidCursor(after.String(), err)
+			}
+		}
+		position := -1
+		for i, pageID := range pageIDs {
+			if pageID == afterPageID {
+				position = i
+				break
+			}
+		}
+		if position < 0 {
+			return ListResult{}, last, errInvalidCursor(after.String(), fmt.Errorf("page %d is not in index %s", afterPageID, m.Name))
+		}
+		// pages before the cursor are never read
+		pageIDs = pageIDs[position:]
 	}
 	// keep track of the number of records read for limit
 	recordsRead := 0
@@ -512,23 +855,17 @@ func (m MapIndex) List(limit, offset int, desc bool) (ListResult, error) {
 	results := make(ListResult, 0, limit)
 
 PageLoop:
-	for _, fileName := range pageNames {
-		pageIDStr := StripExtension(fileName)
-		pageID, err := strconv.ParseUint(pageIDStr, 10, 64)
-		if err != nil {
-			err = errBadData(m.Name, fileName, err)
-			log.Info(err)
-			return ListResult{}, err
-		}
-
-		page, err := m.readPage(pageID)
+	for _, pageID := range pageIDs {
+		page, err := m.readListedPage(pageID)
 		if err != nil {
-			return ListResult{}, err
+			return ListResult{}, last, err
 		}
+		cursorPage := after.started() && pageID == afterPageID
 
-		// if this page is excluded by the offset, move along
-		if (recordsRead + page.Length()) <= offset {
-			recordsRead += page.Length()
+		// if this page is excluded by the offset, move along. The records matching a filter or key range, and the
+		// records of the page holding the cursor, are only known once they are read
+		if f.Empty() && r.unbounded() && !cursorPage && (recordsSkipped+page.Length()) <= offset {
+			recordsSkipped += page.Length()
 			continue PageLoop
 		}
 
@@ -539,7 +876,17 @@ PageLoop:
 
 		// read any relevant records from the page
 	RecordLoop:
-		for _, key := range page.orderedKeys {
+		for _, key := range orderedKeys {
+			if cursorPage && ((!desc && key <= after.key) || (desc && key >= after.key)) {
+				continue RecordLoop
+			}
+			if !r.contains(key) {
+				continue RecordLoop
+			}
+			if !f.Match(page.vals[key]) {
+				continue RecordLoop
+			}
+
 			// skip offset values
 			if recordsSkipped < offset {
 				recordsSkipped++
@@ -551,35 +898,42 @@ PageLoop:
 			}
 
 			results = append(results, MapListItem{Key: key, Value: page.vals[key]})
+			last = Cursor{page: page.name, key: key, desc: desc}
 			recordsRead++
 		}
 	}
 
-	return results, nil
+	return results, last, nil
 }
 
 // Count the number of records present in the index
 func (m MapIndex) Count() (Result, error) {
+	return m.CountWhere(Filter{})
+}
+
+// CountWhere counts the records matching a filter
+func (m MapIndex) CountWhere(f Filter) (Result, error) {
 	var count uint64
-	pageNames, err := m.driver.ListPages(m.Name, false)
+	pageIDs, err := m.listPageIDs(false)
 	if err != nil {
 		return EmptyResult(), err
 	}
 
-	for _, fileName := range pageNames {
-		pageIDStr := StripExtension(fileName)
-		pageID, err := strconv.ParseUint(pageIDStr, 10, 64)
+	for _, pageID := range pageIDs {
+		page, err := m.readListedPage(pageID)
 		if err != nil {
-			err = errBadData(m.Name, fileName, err)
 			return EmptyResult(), err
 		}
 
-		page, err := m.readPage(pageID)
-		if err != nil {
-			return EmptyResult(), err
+		if f.Empty() {
+			count += uint64(page.Length())
+			continue
+		}
+		for _, val := range page.vals {
+			if f.Match(val) {
+				count++
+			}
 		}
-
-		count += uint64(page.Length())
 	}
 
 	countStr := strconv.FormatUint(count, 10)
@@ -587,11 +941,69 @@ func (m MapIndex) Count() (Result, error) {
 	return SingleResult(countStr), nil
 }
 
+// listPageIDs returns the IDs of the pages in the index. Pages of ordered indexes are returned in key order
+func (m MapIndex) listPageIDs(desc bool) ([]uint64, error) {
+	if m.directory != nil {
+		return m.directory.pageIDs(desc), nil
+	}
+
+	pageNames, err := m.driver.ListPages(m.Name, desc)
+	if err != nil {
+		return nil, err
+	}
+
+	pageIDs := make([]uint64, 0, len(pageNames))
+	for _, fileName := range pageNames {
+		pageID, err := strconv.ParseUint(StripExtension(fileName), 10, 64)
+		if err != nil {
+			err = errBadData(m.Name, fileName, err)
+			log.Info(err)
+			return nil, err
+		}
+		pageIDs = append(pageIDs, pageID)
+	}
+	return pageIDs, nil
+}
+
+// readListedPage reads a page returned by listPageIDs, leaving out expired records. Pages of ordered indexes
+// which have not been written yet are empty, and keys left behind in a page by an interrupted split are dropped
+func (m MapIndex) readListedPage(pageID uint64) (MapPage, error) {
+	page, err := m.readPage(pageID)
+	if err != nil {
+		if m.directory != nil && driver.IsPageNotExist(err) {
+			return EmptyMapPage(strconv.FormatUint(pageID, 10)), nil
+		}
+		return page, err
+	}
+
+	position := 0
+	if m.directory != nil {
+		var ok bool
+		position, ok = m.directory.pagePosition(pageID)
+		if !ok {
+			return page, errBadData(m.Name, page.name, fmt.Errorf("page %d is not in the page directory", pageID))
+		}
+	}
+	livePage := EmptyMapPage(page.name)
+	for _, key := range page.orderedKeys {
+		if page.expired(key) || (m.directory != nil && !m.directory.contains(position, key)) {
+			continue
+		}
+		livePage.vals[key] = page.vals[key]
+		livePage.orderedKeys = append(livePage.orderedKeys, key)
+		livePage.copyExpiry(page, key)
+	}
+	return livePage, nil
+}
+
 // WriteEmptyPage creates an empty page file for the specified page ID
 func (m MapIndex) WriteEmptyPage(pageIDStr string) (MapPage, error) {
 	fileName := pageIDStr
 	mapPage := EmptyMapPage(fileName)
-	err := m.driver.WriteMapPage(mapPage.vals, mapPage.orderedKeys, mapPage.name, m.Name)
+	if m.tracksPages() {
+		mapPage.track()
+	}
+	err := m.driver.WriteMapPage(mapPage.vals, mapPage.orderedKeys, mapPage.expiries, mapPage.name, m.Name)
 	return mapPage, err
 }
 
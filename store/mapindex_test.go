@@ -5,14 +5,16 @@ import (
 	"fmt"
 	"keybite/store/driver"
 	"keybite/util"
+	"sort"
 	"strconv"
+	"strings"
 	"testing"
 )
 
 func newTestingMapIndex(t *testing.T) MapIndex {
 	indexName := "test_map_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateMapIndex(indexName)
+	driver.CreateMapIndex(indexName, testPageSize)
 	index, err := NewMapIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 	return index
@@ -41,7 +43,7 @@ func TestMapIndexInsertQueryOne(t *testing.T) {
 func TestMapIndexInsertQueryMany(t *testing.T) {
 	indexName := "test_map_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateMapIndex(indexName)
+	driver.CreateMapIndex(indexName, testPageSize)
 	index, err := NewMapIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -74,7 +76,7 @@ func TestMapIndexInsertQueryMany(t *testing.T) {
 func TestMapIndexInsertManyQueryMany(t *testing.T) {
 	indexName := "test_map_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateMapIndex(indexName)
+	driver.CreateMapIndex(indexName, testPageSize)
 	index, err := NewMapIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -304,7 +306,7 @@ func TestMapIndexDeleteOne(t *testing.T) {
 func TestMapIndexDeleteMany(t *testing.T) {
 	indexName := "test_map_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateMapIndex(indexName)
+	driver.CreateMapIndex(indexName, testPageSize)
 	index, err := NewMapIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -353,7 +355,7 @@ func TestMapIndexDeleteMany(t *testing.T) {
 func TestMapIndexList(t *testing.T) {
 	indexName := "test_map_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateMapIndex(indexName)
+	driver.CreateMapIndex(indexName, testPageSize)
 	index, err := NewMapIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -391,7 +393,7 @@ func TestMapIndexList(t *testing.T) {
 func TestMapIndexCount(t *testing.T) {
 	indexName := "test_map_index"
 	driver := driver.NewMemoryDriver()
-	driver.CreateMapIndex(indexName)
+	driver.CreateMapIndex(indexName, testPageSize)
 	index, err := NewMapIndex(indexName, &driver, testPageSize)
 	util.Ok(t, err)
 
@@ -413,3 +415,142 @@ func TestMapIndexCount(t *testing.T) {
 
 	util.Equals(t, strconv.Itoa(numInserts), result.String())
 }
+
+// ordered map indexes list keys in lexicographic order and keep every page within the page size
+func TestMapIndexOrderedAddressing(t *testing.T) {
+	index := newTestingMapIndex(t)
+	util.Assert(t, index.directory != nil, "new map indexes should use ordered addressing")
+
+	numInserts := testPageSize * 10
+	for i := numInserts - 1; i >= 0; i-- {
+		selector := NewMapSingleSelector(fmt.Sprintf("key_%d", i))
+		_, err := index.Insert(&selector, fmt.Sprintf("value_%d", i))
+		util.Ok(t, err)
+	}
+
+	expectedKeys := make([]string, 0, numInserts)
+	for i := 0; i < numInserts; i++ {
+		expectedKeys = append(expectedKeys, fmt.Sprintf("key_%d", i))
+	}
+	sort.Strings(expectedKeys)
+
+	results, err := index.List(0, 0, false)
+	util.Ok(t, err)
+	util.Equals(t, numInserts, len(results))
+	for i, item := range results {
+		util.Equals(t, expectedKeys[i], item.(MapListItem).Key)
+	}
+
+	descResults, err := index.List(0, 0, true)
+	util.Ok(t, err)
+	util.Equals(t, expectedKeys[numInserts-1], descResults[0].(MapListItem).Key)
+
+	for _, pageID := range index.directory.pageIDs(false) {
+		page, err := index.readPage(pageID)
+		util.Ok(t, err)
+		util.Assert(t, page.Length() <= testPageSize, "pages should not hold more keys than the page size")
+		util.Assert(t, page.Length() >= testPageSize/2, "split pages should be at least half full")
+	}
+
+	// the directory should be read from storage when the index is reopened
+	reopened, err := NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	selector := NewMapArraySelector(expectedKeys)
+	queryRes, err := reopened.Query(&selector)
+	util.Ok(t, err)
+	for i, res := range queryRes.(CollectionResult) {
+		util.Equals(t, "value_"+strings.TrimPrefix(expectedKeys[i], "key_"), res.String())
+	}
+}
+
+// map indexes created before ordered addressing keep using hash addressing until they are repaged
+func TestMapIndexLegacyHashAddressing(t *testing.T) {
+	indexName := "test_map_index"
+	dri := driver.NewMemoryDriver()
+	err := dri.CreateMapIndex(indexName, testPageSize)
+	util.Ok(t, err)
+	err = driver.WriteManifest(&dri, indexName, driver.IndexManifest{Kind: driver.KindMap, PageSize: testPageSize, Version: 1})
+	util.Ok(t, err)
+
+	index, err := NewMapIndex(indexName, &dri, testPageSize)
+	util.Ok(t, err)
+	util.Assert(t, index.directory == nil, "legacy map indexes should use hash addressing")
+
+	numInserts := testPageSize * 3
+	for i := 0; i < numInserts; i++ {
+		selector := NewMapSingleSelector(fmt.Sprintf("key_%d", i))
+		_, err := index.Insert(&selector, fmt.Sprintf("value_%d", i))
+		util.Ok(t, err)
+	}
+
+	page, err := index.readPage(HashStringToKey("key_1") / testPageSize)
+	util.Ok(t, err)
+	_, err = page.Query("key_1")
+	util.Ok(t, err)
+
+	// repaging migrates the index to ordered addressing
+	err = index.Repartition(testPageSize)
+	util.Ok(t, err)
+	migrated, err := NewMapIndex(indexName, &dri, testPageSize)
+	util.Ok(t, err)
+	util.Assert(t, migrated.directory != nil, "repaged map indexes should use ordered addressing")
+
+	count, err := migrated.Count()
+	util.Ok(t, err)
+	util.Equals(t, strconv.Itoa(numInserts), count.String())
+
+	for i := 0; i < numInserts; i++ {
+		selector := NewMapSingleSelector(fmt.Sprintf("key_%d", i))
+		res, err := migrated.Query(&selector)
+		util.Ok(t, err)
+		util.Equals(t, fmt.Sprintf("value_%d", i), res.String())
+	}
+}
+
+// test that writes through a handle opened before another handle split a page land in the right page
+func TestMapIndexStaleDirectory(t *testing.T) {
+	indexName := "test_map_index"
+	dri := driver.NewMemoryDriver()
+	err := dri.CreateMapIndex(indexName, 4)
+	util.Ok(t, err)
+	a, err := NewMapIndex(indexName, &dri, 4)
+	util.Ok(t, err)
+	b, err := NewMapIndex(indexName, &dri, 4)
+	util.Ok(t, err)
+
+	for _, key := range []string{"a", "b", "c", "d"} {
+		selector := NewMapSingleSelector(key)
+		_, err = b.Insert(&selector, "value_"+key)
+		util.Ok(t, err)
+	}
+	// page 0 as read before it is split, which is written after the split
+	stalePage := EmptyMapPage("0")
+	for _, key := range []string{"a", "b", "c", "d"} {
+		stalePage.Upsert(key, "value_"+key)
+	}
+	stalePage.track()
+
+	selector := NewMapSingleSelector("e")
+	_, err = b.Insert(&selector, "value_e")
+	util.Ok(t, err)
+	util.Assert(t, len(b.directory.Pages) > 1, "inserting more keys than the page size should split the page")
+
+	selector = NewMapSingleSelector("z")
+	_, err = a.Insert(&selector, "value_z")
+	util.Ok(t, err)
+	stalePage.Upsert("y", "value_y")
+	err = a.writePage(stalePage)
+	util.Ok(t, err)
+
+	reopened, err := NewMapIndex(indexName, &dri, 4)
+	util.Ok(t, err)
+	for _, key := range []string{"a", "b", "c", "d", "e", "y", "z"} {
+		selector := NewMapSingleSelector(key)
+		res, err := reopened.Query(&selector)
+		util.Ok(t, err)
+		util.Equals(t, "value_"+key, res.String())
+	}
+	count, err := reopened.Count()
+	util.Ok(t, err)
+	util.Equals(t, "7", count.String())
+}
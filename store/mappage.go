@@ -4,13 +4,23 @@ import (
 	"errors"
 	"fmt"
 	"sort"
+	"time"
 )
 
+// now returns the current time, against which record expiry times are checked
+var now = time.Now
+
 // MapPage is an easily transported relevant portion of a MapIndex
 type MapPage struct {
 	vals        map[string]string
 	orderedKeys []string
 	name        string
+	// expiry times of expiring records in milliseconds since the epoch. Expired records are hidden until they
+	// are removed from the page
+	expiries map[string]int64
+	// the records of modified keys before their first modification, recorded for pages of ordered indexes and
+	// of indexes with value indexes, a change log or a history
+	original map[string]recordState
 }
 
 // EmptyMapPage returns an initialized empty map page. Does not create a file for the page.
@@ -22,41 +32,100 @@ func EmptyMapPage(name string) MapPage {
 	}
 }
 
+// expired indicates whether the record at a key has expired
+func (m MapPage) expired(key string) bool {
+	expiry, ok := m.expiries[key]
+	return ok && expiry <= now().UnixNano()/int64(time.Millisecond)
+}
+
+// has indicates whether the page holds a record at a key which has not expired
+func (m MapPage) has(key string) bool {
+	_, ok := m.vals[key]
+	return ok && !m.expired(key)
+}
+
+// track records the original values of the records modified in this page, until they are taken with
+// takeChanges
+func (m *MapPage) track() {
+	if m.original == nil {
+		m.original = map[string]recordState{}
+	}
+}
+
+// remember records the original value of a record before it is modified, if the page is tracked. Expired
+// records are still present, so that they are removed from value indexes once replaced or vacuumed
+func (m MapPage) remember(key string) {
+	if m.original == nil {
+		return
+	}
+	if _, ok := m.original[key]; !ok {
+		val, present := m.vals[key]
+		m.original[key] = recordState{value: val, present: present}
+	}
+}
+
+// modified indicates whether the record at a key may have been modified since the page was read. Every
+// record of an untracked page may have been
+func (m MapPage) modified(key string) bool {
+	if m.original == nil {
+		return true
+	}
+	_, ok := m.original[key]
+	return ok
+}
+
+// takeChanges returns the records modified since the page was read or last had its changes taken, in key order
+func (m MapPage) takeChanges() []valueChange {
+	keys := make([]string, 0, len(m.original))
+	for key := range m.original {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	changes := make([]valueChange, 0, len(keys))
+	for _, key := range keys {
+		val, present := m.vals[key]
+		changes = append(changes, valueChange{
+			key:    key,
+			before: m.original[key],
+			after:  recordState{value: val, present: present},
+		})
+		delete(m.original, key)
+	}
+	return changes
+}
+
 // Query for value
 func (m MapPage) Query(key string) (string, error) {
-	val, ok := m.vals[key]
-	if !ok {
+	if !m.has(key) {
 		return "", fmt.Errorf("key %s not found in this page", key)
 	}
 
-	return val, nil
+	return m.vals[key], nil
 }
 
-// Add a value with a key
+// Add a value with a key. An expired record at the key is replaced
 func (m *MapPage) Add(key string, val string) (string, error) {
-	_, exists := m.vals[key]
-	if exists {
+	if m.has(key) {
 		return "", errors.New("cannot add key to map page: key exists")
 	}
-	m.vals[key] = val
-	m.orderedKeys = append(m.orderedKeys, key)
-	// sort s.t. new key is in proper place
-	sort.Strings(m.orderedKeys)
+	m.Upsert(key, val)
 	return key, nil
 }
 
-// Overwrite an existing value
+// Overwrite an existing value, keeping its expiry time
 func (m MapPage) Overwrite(key string, val string) error {
-	_, exists := m.vals[key]
-	if !exists {
+	if !m.has(key) {
 		return errors.New("cannot update key in map page: key doesn't exist")
 	}
+	m.remember(key)
 	m.vals[key] = val
 	return nil
 }
 
-// Upsert == idempotent insert
+// Upsert == idempotent insert. The record at the key no longer expires
 func (m *MapPage) Upsert(key string, val string) string {
+	m.remember(key)
 	// if this is an insert, add the key to the ordered keys slice & sort
 	_, ok := m.vals[key]
 	if !ok {
@@ -66,21 +135,77 @@ func (m *MapPage) Upsert(key string, val string) string {
 	}
 
 	m.vals[key] = val
+	delete(m.expiries, key)
 	return key
 }
 
+// SetExpiry sets the time at which the record at a key expires
+func (m *MapPage) SetExpiry(key string, expiresAt time.Time) {
+	if m.expiries == nil {
+		m.expiries = map[string]int64{}
+	}
+	m.expiries[key] = expiresAt.UnixNano() / int64(time.Millisecond)
+}
+
+// copyExpiry copies the expiry time of the record at a key from another page
+func (m *MapPage) copyExpiry(from MapPage, key string) {
+	expiry, ok := from.expiries[key]
+	if !ok {
+		return
+	}
+	if m.expiries == nil {
+		m.expiries = map[string]int64{}
+	}
+	m.expiries[key] = expiry
+}
+
+// copyRecord sets the record at a key, including its expiry time, to the record at the key in another page,
+// removing the record if the other page holds none
+func (m *MapPage) copyRecord(from MapPage, key string) {
+	val, ok := from.vals[key]
+	if ok {
+		m.Upsert(key, val)
+		m.copyExpiry(from, key)
+		return
+	}
+	if _, present := m.vals[key]; present {
+		m.remember(key)
+		delete(m.vals, key)
+		delete(m.expiries, key)
+		m.orderedKeys = removeStringFromSlice(m.orderedKeys, key)
+	}
+}
+
+// RemoveExpired removes every expired record from the page, returning the number of records removed
+func (m *MapPage) RemoveExpired() int {
+	liveKeys := make([]string, 0, len(m.orderedKeys))
+	for _, key := range m.orderedKeys {
+		if m.expired(key) {
+			m.remember(key)
+			delete(m.vals, key)
+			delete(m.expiries, key)
+			continue
+		}
+		liveKeys = append(liveKeys, key)
+	}
+	removed := len(m.orderedKeys) - len(liveKeys)
+	m.orderedKeys = liveKeys
+	return removed
+}
+
 // Delete an existing value
 func (m *MapPage) Delete(key string) error {
-	_, exists := m.vals[key]
-	if !exists {
+	if !m.has(key) {
 		return fmt.Errorf("cannot delete key '%s' from map page %s: key doesn't exist", key, m.name)
 	}
+	m.remember(key)
 	delete(m.vals, key)
+	delete(m.expiries, key)
 	m.orderedKeys = removeStringFromSlice(m.orderedKeys, key)
 	return nil
 }
 
-// Length of the underlying map
+// Length of the underlying map, including expired records
 func (m MapPage) Length() int {
 	return len(m.vals)
 }
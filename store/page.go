@@ -2,6 +2,8 @@ package store
 
 import (
 	"fmt"
+	"sort"
+	"strconv"
 )
 
 // Page is an easily transported relevant portion of an index
@@ -10,6 +12,9 @@ type Page struct {
 	name        string
 	minKey      uint64
 	orderedKeys []uint64
+	// the records of modified IDs before their first modification, recorded for pages of indexes with
+	// value indexes or a change log
+	original map[uint64]recordState
 }
 
 // EmptyPage returns an initialized empty page. Does not create a file for the page
@@ -41,10 +46,51 @@ func (p Page) Query(id uint64) (string, error) {
 	return val, nil
 }
 
+// track records the original values of the records modified in this page, until they are taken with
+// takeChanges
+func (p *Page) track() {
+	if p.original == nil {
+		p.original = map[uint64]recordState{}
+	}
+}
+
+// remember records the original value of a record before it is modified, if the page is tracked
+func (p Page) remember(id uint64) {
+	if p.original == nil {
+		return
+	}
+	if _, ok := p.original[id]; !ok {
+		val, present := p.vals[id]
+		p.original[id] = recordState{value: val, present: present}
+	}
+}
+
+// takeChanges returns the records modified since the page was read or last had its changes taken, in ID order
+func (p Page) takeChanges() []valueChange {
+	ids := make([]uint64, 0, len(p.original))
+	for id := range p.original {
+		ids = append(ids, id)
+	}
+	sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+
+	changes := make([]valueChange, 0, len(ids))
+	for _, id := range ids {
+		val, present := p.vals[id]
+		changes = append(changes, valueChange{
+			key:    strconv.FormatUint(id, 10),
+			before: p.original[id],
+			after:  recordState{value: val, present: present},
+		})
+		delete(p.original, id)
+	}
+	return changes
+}
+
 // Append a single value to this page and return the ID
 func (p *Page) Append(val string) uint64 {
 	// the insert ID should either be the greater of the current max key +1, and the minimum key set for this page
 	id := Max((MaxMapKey(p.vals) + 1), p.minKey)
+	p.remember(id)
 	p.vals[id] = val
 	p.orderedKeys = append(p.orderedKeys, id)
 	return id
@@ -56,6 +102,7 @@ func (p *Page) Overwrite(id uint64, newVal string) error {
 	if !ok {
 		return fmt.Errorf("cannot update non-existent record at id %d", id)
 	}
+	p.remember(id)
 
 	p.vals[id] = newVal
 	return nil
@@ -67,6 +114,7 @@ func (p *Page) Delete(id uint64) error {
 	if !exists {
 		return fmt.Errorf("cannot delete id %d from page '%s': key doesn't exist", id, p.name)
 	}
+	p.remember(id)
 	delete(p.vals, id)
 	p.orderedKeys = removeUint64FromSlice(p.orderedKeys, id)
 	return nil
@@ -32,11 +32,7 @@ func TestHashString(t *testing.T) {
 	outcomes := make([]uint64, len(testCases))
 
 	for i, testCase := range testCases {
-		var err error
-		outcomes[i], err = HashStringToKey(testCase)
-		if err != nil {
-			t.FailNow()
-		}
+		outcomes[i] = HashStringToKey(testCase)
 	}
 
 	// test for uniqueness
@@ -51,12 +47,13 @@ func TestHashString(t *testing.T) {
 
 }
 
-func TestHashStringNotAcceptOverMaxLength(t *testing.T) {
-	testString := strings.Repeat("s", 200)
-	_, err := HashStringToKey(testString)
-	if err == nil {
-		t.Fail()
-	}
+// keys of any length and content can be hashed, and hashing is stable for legacy indexes
+func TestHashStringAnyKey(t *testing.T) {
+	longKey := strings.Repeat("s", 200)
+	util.Equals(t, HashStringToKey(longKey), HashStringToKey(longKey))
+	util.Assert(t, HashStringToKey(longKey) != HashStringToKey(longKey+"s"), "keys of different lengths should hash differently")
+	util.Equals(t, HashStringToKey("tenant:42 user"), HashStringToKey("tenant:42 user"))
+	util.Equals(t, uint64(42), HashStringToKey("42"))
 }
 
 func TestPathToIndexPage(t *testing.T) {
@@ -0,0 +1,154 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"strconv"
+)
+
+// Projection selects part of the JSON values of a result, so that only the selected part is returned. The
+// zero value returns results unchanged
+type Projection struct {
+	// the object keys and array indexes leading to the selected value
+	path []string
+	// the top-level fields copied from the value into a new object
+	fields []string
+}
+
+// NewPathProjection selects the value found by following a path of object keys and array indexes
+func NewPathProjection(path []string) Projection {
+	return Projection{path: path}
+}
+
+// NewFieldsProjection selects top-level fields of object values. Fields missing from a value are left out
+func NewFieldsProjection(fields []string) Projection {
+	return Projection{fields: fields}
+}
+
+// project returns the selected part of a value. False is returned when the value is not JSON, or does not
+// contain the selected path
+func (p Projection) project(value string) (string, bool) {
+	if len(p.fields) > 0 {
+		return p.projectFields(value)
+	}
+
+	raw := json.RawMessage(value)
+	for _, segment := range p.path {
+		trimmed := bytes.TrimSpace(raw)
+		if len(trimmed) == 0 {
+			return "", false
+		}
+
+		switch trimmed[0] {
+		case '{':
+			object := map[string]json.RawMessage{}
+			if err := json.Unmarshal(trimmed, &object); err != nil {
+				return "", false
+			}
+			var ok bool
+			raw, ok = object[segment]
+			if !ok {
+				return "", false
+			}
+		case '[':
+			array := []json.RawMessage{}
+			if err := json.Unmarshal(trimmed, &array); err != nil {
+				return "", false
+			}
+			index, err := strconv.Atoi(segment)
+			if err != nil || index < 0 || index >= len(array) {
+				return "", false
+			}
+			raw = array[index]
+		default:
+			return "", false
+		}
+	}
+
+	if !json.Valid(raw) {
+		return "", false
+	}
+	return string(bytes.TrimSpace(raw)), true
+}
+
+// projectFields returns an object holding the selected fields of an object value, in the order they were
+// selected
+func (p Projection) projectFields(value string) (string, bool) {
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(value), &object); err != nil {
+		return "", false
+	}
+
+	projected := bytes.Buffer{}
+	projected.WriteByte('{')
+	written := 0
+	for _, field := range p.fields {
+		raw, ok := object[field]
+		if !ok {
+			continue
+		}
+		if written > 0 {
+			projected.WriteByte(',')
+		}
+		// encoding a string cannot fail
+		key, _ := json.Marshal(field)
+		projected.Write(key)
+		projected.WriteByte(':')
+		projected.Write(bytes.TrimSpace(raw))
+		written++
+	}
+	projected.WriteByte('}')
+	return projected.String(), true
+}
+
+// Apply projects the values of a result. Values without the selected part are replaced by an empty value
+func (p Projection) Apply(r Result) Result {
+	if len(p.path) == 0 && len(p.fields) == 0 {
+		return r
+	}
+
+	switch result := r.(type) {
+	case SingleResult:
+		return p.applySingle(result)
+
+	case CollectionResult:
+		projected := make(CollectionResult, len(result))
+		for i, single := range result {
+			projected[i] = p.applySingle(single)
+		}
+		return projected
+
+	case ListResult:
+		projected := make(ListResult, len(result))
+		for i, item := range result {
+			_, value := item.keyValue()
+			value, _ = p.project(value)
+			switch listItem := item.(type) {
+			case AutoListItem:
+				projected[i] = AutoListItem{Key: listItem.Key, Value: value}
+			case MapListItem:
+				projected[i] = MapListItem{Key: listItem.Key, Value: value}
+			default:
+				projected[i] = item
+			}
+		}
+		return projected
+
+	case PagedListResult:
+		result.Items = p.Apply(result.Items).(ListResult)
+		return result
+	}
+
+	return r
+}
+
+func (p Projection) applySingle(r SingleResult) SingleResult {
+	if !r.Valid() {
+		return r
+	}
+	value, ok := p.project(string(r))
+	if !ok {
+		return EmptyResult()
+	}
+	return SingleResult(value)
+}
@@ -0,0 +1,50 @@
+package store
+
+import (
+	"keybite/util"
+	"testing"
+)
+
+func TestPathProjection(t *testing.T) {
+	value := SingleResult(`{"name": "ada", "profile": {"email": "ada@example.com", "age": 36}, "tags": ["a", {"b": 1.50}]}`)
+
+	projections := map[string][]string{
+		`"ada@example.com"`: {"profile", "email"},
+		`36`:                {"profile", "age"},
+		`{"b": 1.50}`:       {"tags", "1"},
+		`1.50`:              {"tags", "1", "b"},
+	}
+	for expected, path := range projections {
+		util.Equals(t, SingleResult(expected), NewPathProjection(path).Apply(value))
+	}
+
+	missing := [][]string{{"missing"}, {"name", "first"}, {"tags", "2"}, {"tags", "-1"}, {"tags", "x"}}
+	for _, path := range missing {
+		util.Equals(t, EmptyResult(), NewPathProjection(path).Apply(value))
+	}
+	util.Equals(t, EmptyResult(), NewPathProjection([]string{"a"}).Apply(SingleResult("not json")))
+
+	// empty results are left as they are, and the zero projection returns values unchanged
+	util.Equals(t, EmptyResult(), NewPathProjection([]string{"a"}).Apply(EmptyResult()))
+	util.Equals(t, value, Projection{}.Apply(value))
+}
+
+func TestFieldsProjection(t *testing.T) {
+	projection := NewFieldsProjection([]string{"email", "name", "missing"})
+
+	value := SingleResult(`{"name": "ada", "email": "ada@example.com", "bio": "long"}`)
+	util.Equals(t, SingleResult(`{"email":"ada@example.com","name":"ada"}`), projection.Apply(value))
+	util.Equals(t, EmptyResult(), projection.Apply(SingleResult(`["name"]`)))
+
+	collection := CollectionResult{value, EmptyResult(), SingleResult(`{"bio": "only"}`)}
+	util.Equals(t, CollectionResult{`{"email":"ada@example.com","name":"ada"}`, "", "{}"}, projection.Apply(collection))
+
+	list := ListResult{
+		AutoListItem{Key: 1, Value: string(value)},
+		MapListItem{Key: "b", Value: "not json"},
+	}
+	util.Equals(t, ListResult{
+		AutoListItem{Key: 1, Value: `{"email":"ada@example.com","name":"ada"}`},
+		MapListItem{Key: "b", Value: ""},
+	}, projection.Apply(list))
+}
@@ -0,0 +1,260 @@
+package store
+
+import (
+	"fmt"
+	"keybite/store/driver"
+	"keybite/util/log"
+	"sort"
+	"strconv"
+)
+
+// suffix of the index which new pages are written to while an index is being repartitioned
+const repartitionSuffix = ".repage"
+
+// Repartition rewrites every page of the index using the new page size. The new pages are written to a
+// staging index while the index is write locked, then swapped in place of the existing pages. Reads
+// continue to be served from the existing pages until the swap. The lock is held whatever the driver, and
+// drivers which write without it fail the swap with a write conflict if the index was changed meanwhile, in
+// which case the repartition is run again
+func (i *AutoIndex) Repartition(newPageSize int) error {
+	if newPageSize < 1 {
+		return fmt.Errorf("page size must be a positive integer, got %d", newPageSize)
+	}
+	stagingName := i.Name + repartitionSuffix
+
+	_, err := retryOnConflict(func() (Result, error) {
+		err := holdWriteLock(i.driver, i.Name, func() error {
+			err := prepareRepartition(i.driver, i.Name, stagingName, driver.KindAuto, newPageSize)
+			if err != nil {
+				return err
+			}
+
+			pageNames, err := i.driver.ListPages(i.Name, false)
+			if err != nil {
+				return err
+			}
+
+			var newPage Page
+			var newPageID uint64
+			var loaded bool
+			for _, fileName := range pageNames {
+				pageID, err := strconv.ParseUint(StripExtension(fileName), 10, 64)
+				if err != nil {
+					return errBadData(i.Name, fileName, err)
+				}
+
+				page, err := i.readPage(pageID)
+				if err != nil {
+					return err
+				}
+
+				// IDs are read in ascending order, so each new page is complete once an ID belonging to a later page is read
+				for _, id := range page.orderedKeys {
+					pageID := autoPageID(id, newPageSize)
+					if loaded && pageID != newPageID {
+						err = i.driver.WritePage(newPage.vals, newPage.orderedKeys, newPage.name, stagingName)
+						if err != nil {
+							return err
+						}
+						loaded = false
+					}
+					if !loaded {
+						newPage = EmptyPage(strconv.FormatUint(pageID, 10))
+						newPageID = pageID
+						loaded = true
+					}
+					newPage.vals[id] = page.vals[id]
+					newPage.orderedKeys = append(newPage.orderedKeys, id)
+				}
+
+				// extend the write lock after each page, since large indexes may take longer than the lock duration
+				err = i.driver.LockIndex(i.Name)
+				if err != nil {
+					return err
+				}
+			}
+
+			if loaded {
+				err = i.driver.WritePage(newPage.vals, newPage.orderedKeys, newPage.name, stagingName)
+				if err != nil {
+					return err
+				}
+			}
+
+			return i.driver.ReplaceIndex(i.Name, stagingName)
+		})
+		if err != nil {
+			abandonRepartition(i.driver, stagingName, driver.KindAuto)
+		}
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	i.pageSize = newPageSize
+	return nil
+}
+
+// Repartition rewrites every page of the map index using the new page size and ordered addressing, which
+// also migrates indexes using the legacy hash addressing. The new pages are written to a staging index while
+// the index is write locked, then swapped in place of the existing pages. Reads continue to be served from the
+// existing pages until the swap. Ordered indexes are streamed one page at a time in key order, but the keys of
+// a hash addressed index are spread across every page, so its records are held in memory to be sorted. As for
+// auto indexes, the repartition is run again if a driver writing without the lock fails the swap
+func (m *MapIndex) Repartition(newPageSize int) error {
+	if newPageSize < 1 {
+		return fmt.Errorf("page size must be a positive integer, got %d", newPageSize)
+	}
+	stagingName := m.Name + repartitionSuffix
+
+	var staging MapIndex
+	_, err := retryOnConflict(func() (Result, error) {
+		err := holdWriteLock(m.driver, m.Name, func() error {
+			err := prepareRepartition(m.driver, m.Name, stagingName, driver.KindMap, newPageSize)
+			if err != nil {
+				return err
+			}
+
+			staging, err = NewMapIndex(stagingName, m.driver, newPageSize)
+			if err != nil {
+				return err
+			}
+			// repartitioning doesn't change any value, so the value indexes, change log and history are left as they are
+			staging.valueIndexes = nil
+			staging.changeLog = false
+			staging.historyVersions = 0
+
+			err = m.refreshDirectory()
+			if err != nil {
+				return err
+			}
+			// the pages of ordered indexes are found in the directory, but are listed anyway so that drivers
+			// writing conditionally know the version of every page when swapping the index
+			if m.directory != nil {
+				_, err = m.driver.ListPages(m.Name, false)
+				if err != nil {
+					return err
+				}
+			}
+
+			pageIDs, err := m.listPageIDs(false)
+			if err != nil {
+				return err
+			}
+
+			hashedRecords := EmptyMapPage("")
+			for _, pageID := range pageIDs {
+				page, err := m.readListedPage(pageID)
+				if err != nil {
+					return err
+				}
+
+				if m.directory != nil {
+					err = staging.appendSorted(page)
+					if err != nil {
+						return err
+					}
+				} else {
+					for _, key := range page.orderedKeys {
+						hashedRecords.vals[key] = page.vals[key]
+						hashedRecords.orderedKeys = append(hashedRecords.orderedKeys, key)
+						hashedRecords.copyExpiry(page, key)
+					}
+				}
+
+				// extend the write lock after each page, since large indexes may take longer than the lock duration
+				err = m.driver.LockIndex(m.Name)
+				if err != nil {
+					return err
+				}
+			}
+
+			if m.directory == nil {
+				sort.Strings(hashedRecords.orderedKeys)
+				err = staging.appendSorted(hashedRecords)
+				if err != nil {
+					return err
+				}
+			}
+
+			return m.driver.ReplaceIndex(m.Name, stagingName)
+		})
+		if err != nil {
+			abandonRepartition(m.driver, stagingName, driver.KindMap)
+		}
+		return nil, err
+	})
+	if err != nil {
+		return err
+	}
+
+	m.pageSize = newPageSize
+	m.directory = staging.directory
+	return nil
+}
+
+// appendSorted adds the records of a page to an ordered index. The keys of the page must be sorted, and must
+// sort after every key already in the index, so all of the records belong in the last page of the index
+func (m MapIndex) appendSorted(p MapPage) error {
+	if len(p.orderedKeys) == 0 {
+		return nil
+	}
+
+	lastPageID := m.directory.Pages[len(m.directory.Pages)-1].Page
+	lastPage, err := m.readOrCreatePage(lastPageID)
+	if err != nil {
+		return err
+	}
+
+	for _, key := range p.orderedKeys {
+		lastPage.vals[key] = p.vals[key]
+		lastPage.copyExpiry(p, key)
+	}
+	lastPage.orderedKeys = append(lastPage.orderedKeys, p.orderedKeys...)
+
+	return m.persistPage(lastPage)
+}
+
+// prepareRepartition creates the staging index for a repartition, removing any staging index left behind
+// by a previous failed attempt. The manifest of the staging index keeps the creation time of the index
+func prepareRepartition(d driver.StorageDriver, indexName string, stagingName string, kind string, newPageSize int) error {
+	manifest, err := driver.ReadManifest(d, indexName)
+	if err != nil && !driver.IsMetaNotExist(err) {
+		return err
+	}
+	newManifest := driver.NewManifest(kind, newPageSize)
+	if err == nil {
+		newManifest.Created = manifest.Created
+		newManifest.ValueIndexes = manifest.ValueIndexes
+		newManifest.Source = manifest.Source
+		newManifest.ChangeLog = manifest.ChangeLog
+		newManifest.HistoryVersions = manifest.HistoryVersions
+	}
+
+	abandonRepartition(d, stagingName, kind)
+
+	if kind == driver.KindAuto {
+		err = d.CreateAutoIndex(stagingName, newPageSize)
+	} else {
+		err = d.CreateMapIndex(stagingName, newPageSize)
+	}
+	if err != nil {
+		return err
+	}
+
+	return driver.WriteManifest(d, stagingName, newManifest)
+}
+
+// abandonRepartition drops a staging index if it exists
+func abandonRepartition(d driver.StorageDriver, stagingName string, kind string) {
+	var err error
+	if kind == driver.KindAuto {
+		err = d.DropAutoIndex(stagingName)
+	} else {
+		err = d.DropMapIndex(stagingName)
+	}
+	if err != nil && !driver.IsIndexNotExist(err) {
+		log.Warnf("dropping staging index %s failed: %s", stagingName, err.Error())
+	}
+}
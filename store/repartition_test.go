@@ -0,0 +1,89 @@
+package store
+
+import (
+	"fmt"
+	"keybite/store/driver"
+	"keybite/util"
+	"strconv"
+	"testing"
+)
+
+func TestAutoIndexRepartition(t *testing.T) {
+	index := newTestingIndex(t)
+	numRecords := testPageSize*5 + 3
+	for i := 1; i <= numRecords; i++ {
+		_, err := index.Insert(fmt.Sprintf("test_value_%d", i))
+		util.Ok(t, err)
+	}
+	deleteSel := NewSingleSelector(4)
+	_, err := index.Delete(&deleteSel)
+	util.Ok(t, err)
+
+	newPageSize := testPageSize * 3
+	err = index.Repartition(newPageSize)
+	util.Ok(t, err)
+	util.Equals(t, newPageSize, index.pageSize)
+
+	pages, err := index.driver.ListPages(index.Name, false)
+	util.Ok(t, err)
+	util.Equals(t, 2, len(pages))
+
+	manifest, err := driver.ReadManifest(index.driver, index.Name)
+	util.Ok(t, err)
+	util.Equals(t, newPageSize, manifest.PageSize)
+	util.Equals(t, driver.KindAuto, manifest.Kind)
+
+	// reopening the index should use the new page size
+	reopened, err := NewAutoIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, newPageSize, reopened.pageSize)
+
+	for i := 1; i <= numRecords; i++ {
+		sel := NewSingleSelector(uint64(i))
+		res, err := reopened.Query(&sel)
+		if i == 4 {
+			util.Assert(t, err != nil, "deleted record should remain deleted")
+			continue
+		}
+		util.Ok(t, err)
+		util.Equals(t, fmt.Sprintf("test_value_%d", i), res.String())
+	}
+
+	// inserts should continue from the highest ID
+	res, err := reopened.Insert("next_value")
+	util.Ok(t, err)
+	util.Equals(t, strconv.Itoa(numRecords+1), res.String())
+}
+
+func TestMapIndexRepartition(t *testing.T) {
+	index := newTestingMapIndex(t)
+	numRecords := 250
+	for i := 0; i < numRecords; i++ {
+		sel := NewMapSingleSelector(fmt.Sprintf("key_%d", i))
+		_, err := index.Insert(&sel, fmt.Sprintf("value_%d", i))
+		util.Ok(t, err)
+	}
+
+	for _, newPageSize := range []int{testPageSize * 7, 3} {
+		err := index.Repartition(newPageSize)
+		util.Ok(t, err)
+
+		reopened, err := NewMapIndex(index.Name, index.driver, testPageSize)
+		util.Ok(t, err)
+		util.Equals(t, newPageSize, reopened.pageSize)
+
+		count, err := reopened.Count()
+		util.Ok(t, err)
+		util.Equals(t, strconv.Itoa(numRecords), count.String())
+
+		for i := 0; i < numRecords; i++ {
+			sel := NewMapSingleSelector(fmt.Sprintf("key_%d", i))
+			res, err := reopened.Query(&sel)
+			util.Ok(t, err)
+			util.Equals(t, fmt.Sprintf("value_%d", i), res.String())
+		}
+	}
+
+	err := index.Repartition(0)
+	util.Assert(t, err != nil, "repartitioning with a page size of 0 should return an error")
+}
@@ -142,3 +142,8 @@ func IDResult(id uint64) SingleResult {
 	idStr := strconv.FormatUint(id, 10)
 	return SingleResult(idStr)
 }
+
+// BoolResult creates a single result of a boolean
+func BoolResult(b bool) SingleResult {
+	return SingleResult(strconv.FormatBool(b))
+}
@@ -0,0 +1,88 @@
+package store
+
+// CompareAndSwap replaces the value stored at an ID with a new value if the stored value equals the expected
+// value. The comparison and the write happen while the index is write locked, so no other write to the index
+// can happen in between. The result indicates whether the value was swapped
+func (i AutoIndex) CompareAndSwap(id uint64, expected string, newVal string) (Result, error) {
+	if i.logsWrite(1) {
+		return i.logged(func(i AutoIndex) (Result, error) { return i.CompareAndSwap(id, expected, newVal) })
+	}
+	swapped := false
+	err := wrapInWriteLock(i.driver, i.Name, func() error {
+		page, err := i.readPage(autoPageID(id, i.pageSize))
+		if err != nil {
+			return maybeMissingKeyError(i.Name, id, err)
+		}
+
+		current, err := page.Query(id)
+		if err != nil {
+			return errKeyNotExist(i.Name, id, err)
+		}
+		if current != expected {
+			return nil
+		}
+
+		err = page.Overwrite(id, newVal)
+		if err != nil {
+			return errKeyNotExist(i.Name, id, err)
+		}
+		err = i.persistPage(page)
+		if err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		return EmptyResult(), err
+	}
+	return BoolResult(swapped), nil
+}
+
+// CompareAndSwap replaces the value stored at a key with a new value if the stored value equals the expected
+// value. The comparison and the write happen while the index is write locked, so no other write to the index
+// can happen in between. The result indicates whether the value was swapped
+func (m MapIndex) CompareAndSwap(key string, expected string, newValue string) (Result, error) {
+	if err := m.checkWritable(); err != nil {
+		return EmptyResult(), err
+	}
+	if m.logsWrite(1) {
+		return m.logged(func(m MapIndex) (Result, error) { return m.CompareAndSwap(key, expected, newValue) })
+	}
+	swapped := false
+	err := wrapInWriteLock(m.driver, m.Name, func() error {
+		err := m.refreshDirectory()
+		if err != nil {
+			return err
+		}
+
+		page, err := m.readPage(m.pageIDForKey(key))
+		if err != nil {
+			return maybeMissingKeyError(m.Name, key, err)
+		}
+
+		current, err := page.Query(key)
+		if err != nil {
+			return errKeyNotExist(m.Name, key, err)
+		}
+		if current != expected {
+			return nil
+		}
+
+		err = page.Overwrite(key, newValue)
+		if err != nil {
+			return errKeyNotExist(m.Name, key, err)
+		}
+		// the swap never adds a key, so the page is never split
+		err = m.persistPage(page)
+		if err != nil {
+			return err
+		}
+		swapped = true
+		return nil
+	})
+	if err != nil {
+		return EmptyResult(), err
+	}
+	return BoolResult(swapped), nil
+}
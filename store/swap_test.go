@@ -0,0 +1,58 @@
+package store
+
+import (
+	"keybite/util"
+	"testing"
+)
+
+func TestAutoIndexCompareAndSwap(t *testing.T) {
+	index := newTestingIndex(t)
+	_, err := index.Insert("1")
+	util.Ok(t, err)
+
+	res, err := index.CompareAndSwap(1, "1", "2")
+	util.Ok(t, err)
+	util.Equals(t, "true", res.String())
+
+	// the stored value no longer matches the expected value
+	res, err = index.CompareAndSwap(1, "1", "3")
+	util.Ok(t, err)
+	util.Equals(t, "false", res.String())
+
+	sel := NewSingleSelector(1)
+	val, err := index.Query(&sel)
+	util.Ok(t, err)
+	util.Equals(t, "2", val.String())
+
+	_, err = index.CompareAndSwap(2, "1", "2")
+	util.Assert(t, err != nil, "swapping a missing ID should fail")
+	_, err = index.CompareAndSwap(testPageSize*3, "1", "2")
+	util.Assert(t, err != nil, "swapping an ID in a missing page should fail")
+}
+
+func TestMapIndexCompareAndSwap(t *testing.T) {
+	index := newTestingMapIndex(t)
+	sel := NewMapSingleSelector("counter")
+	_, err := index.Insert(&sel, "1")
+	util.Ok(t, err)
+
+	res, err := index.CompareAndSwap("counter", "1", "2")
+	util.Ok(t, err)
+	util.Equals(t, "true", res.String())
+
+	res, err = index.CompareAndSwap("counter", "1", "3")
+	util.Ok(t, err)
+	util.Equals(t, "false", res.String())
+
+	val, err := index.Query(&sel)
+	util.Ok(t, err)
+	util.Equals(t, "2", val.String())
+
+	_, err = index.CompareAndSwap("missing", "1", "2")
+	util.Assert(t, err != nil, "swapping a missing key should fail")
+
+	// the index must not stay locked after a swap
+	locked, _, err := index.driver.IndexIsLocked(index.Name)
+	util.Ok(t, err)
+	util.Assert(t, !locked, "index should be unlocked after a swap")
+}
@@ -2,15 +2,15 @@ package store
 
 import (
 	"errors"
-	"fmt"
 	"path/filepath"
 	"regexp"
 	"strconv"
 	"strings"
 )
 
-// MaxKeyLength is the max length of a string that can be used as a key
-const MaxKeyLength = 150
+// legacyHashWidth is a term of the hash formula used by hash addressed map indexes, which must not change
+// for their keys to keep resolving to the same pages
+const legacyHashWidth = 150
 
 // MaxMapKey returns the max integer key of a map
 func MaxMapKey(m map[uint64]string) uint64 {
@@ -26,30 +26,21 @@ func MaxMapKey(m map[uint64]string) uint64 {
 	return maxNumber
 }
 
-// chars not allowed in map keys
-var forbiddenKeyChar = regexp.MustCompile(`(:|\s+)`)
-
-// HashStringToKey to unique unsigned integer. Strings that can be parses as integers are not hashed.
+// HashStringToKey hashes a string to an unsigned integer, used to address the pages of map indexes created
+// before ordered addressing. Strings that can be parsed as integers are not hashed.
 // https://stackoverflow.com/a/16524816
-func HashStringToKey(s string) (uint64, error) {
+func HashStringToKey(s string) uint64 {
 	if num, err := strconv.ParseUint(s, 10, 64); err == nil {
-		return num, nil
-	}
-
-	if forbiddenKeyChar.MatchString(s) {
-		return 0, fmt.Errorf("cannot hash string containing whitespace or colon into a map key")
+		return num
 	}
 
 	const pow = 27
-	if len(s) > MaxKeyLength {
-		return 0, fmt.Errorf("cannot hash string longer than %d characters", MaxKeyLength)
-	}
 	var result uint64
 	for i, char := range s {
-		result += ((uint64(MaxKeyLength) - uint64(i) - 1) ^ uint64(pow)) * (1 + uint64(char) - uint64('a'))
+		result += ((uint64(legacyHashWidth) - uint64(i) - 1) ^ uint64(pow)) * (1 + uint64(char) - uint64('a'))
 	}
 
-	return result, nil
+	return result
 }
 
 // PathToIndexPage splits a path into an index name and a file name
@@ -0,0 +1,422 @@
+package store
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"keybite/store/driver"
+	"sort"
+	"strconv"
+)
+
+/*
+A value index is a map index derived from the records of a source index. Its keys are the values stored in the
+source index, or a top-level field of those values when they are JSON objects, and its values are JSON arrays of
+the source keys holding each value. Value indexes are listed in the manifest of their source index, and every
+write to the source index updates them once the modified page has been written
+*/
+
+// recordState is the value of a record at some point, or its absence
+type recordState struct {
+	value   string
+	present bool
+}
+
+// valueChange is a modification of the record at a key
+type valueChange struct {
+	key    string
+	before recordState
+	after  recordState
+}
+
+// valueIndexEntry collects the source keys added to and removed from one value of a value index
+type valueIndexEntry struct {
+	added   []string
+	removed []string
+}
+
+// indexedValue returns the value of a record which is indexed by a value index. Records whose value is not
+// a JSON object holding the field are not indexed
+func indexedValue(record recordState, field string) (string, bool) {
+	if !record.present {
+		return "", false
+	}
+	if field == "" {
+		return record.value, true
+	}
+
+	object := map[string]json.RawMessage{}
+	if err := json.Unmarshal([]byte(record.value), &object); err != nil {
+		return "", false
+	}
+	raw, ok := object[field]
+	if !ok || string(raw) == "null" {
+		return "", false
+	}
+
+	var str string
+	if err := json.Unmarshal(raw, &str); err == nil {
+		return str, true
+	}
+	compacted := bytes.Buffer{}
+	if err := json.Compact(&compacted, raw); err != nil {
+		return string(raw), true
+	}
+	return compacted.String(), true
+}
+
+// updateValueIndexes applies modifications of the records of a source index to its value indexes
+func updateValueIndexes(d driver.StorageDriver, valueIndexes []driver.ValueIndex, changes []valueChange) error {
+	for _, ref := range valueIndexes {
+		entries := map[string]*valueIndexEntry{}
+		entry := func(value string) *valueIndexEntry {
+			if _, ok := entries[value]; !ok {
+				entries[value] = &valueIndexEntry{}
+			}
+			return entries[value]
+		}
+
+		for _, change := range changes {
+			before, wasIndexed := indexedValue(change.before, ref.Field)
+			after, isIndexed := indexedValue(change.after, ref.Field)
+			if wasIndexed && isIndexed && before == after {
+				continue
+			}
+			if wasIndexed {
+				entry(before).removed = append(entry(before).removed, change.key)
+			}
+			if isIndexed {
+				entry(after).added = append(entry(after).added, change.key)
+			}
+		}
+		if len(entries) == 0 {
+			continue
+		}
+
+		valueIndex, err := NewMapIndex(ref.Name, d, 1)
+		if err != nil {
+			return fmt.Errorf("updating value index %s failed: %w", ref.Name, err)
+		}
+		err = valueIndex.applyEntries(entries)
+		if err != nil {
+			return fmt.Errorf("updating value index %s failed: %w", ref.Name, err)
+		}
+	}
+	return nil
+}
+
+// applyEntries adds source keys to and removes source keys from the values of a value index. Values left
+// without any source key are deleted
+func (m MapIndex) applyEntries(entries map[string]*valueIndexEntry) error {
+	values := make([]string, 0, len(entries))
+	for value := range entries {
+		values = append(values, value)
+	}
+
+	return m.modifyKeys(values, func(page *MapPage, value string) error {
+		var keys []string
+		if stored, err := page.Query(value); err == nil {
+			keys, err = decodeSourceKeys(stored)
+			if err != nil {
+				return errBadData(m.Name, page.name, err)
+			}
+		}
+		keys = applySourceKeys(keys, entries[value])
+
+		if len(keys) == 0 {
+			if page.has(value) {
+				return page.Delete(value)
+			}
+			return nil
+		}
+		page.Upsert(value, encodeSourceKeys(keys))
+		return nil
+	})
+}
+
+// modifyKeys calls modify with the page holding each key, in key order, while the index is write locked.
+// Pages are read once for consecutive keys, and written once their keys have been modified
+func (m MapIndex) modifyKeys(keys []string, modify func(page *MapPage, key string) error) error {
+	sort.Strings(keys)
+
+	return wrapInWriteLock(m.driver, m.Name, func() error {
+		err := m.refreshDirectory()
+		if err != nil {
+			return err
+		}
+
+		var lastPageID uint64
+		var page MapPage
+		var loaded bool
+		for _, key := range keys {
+			pageID := m.pageIDForKey(key)
+			// writing a page may split it, so the page ID is looked up again after writing
+			if !loaded || pageID != lastPageID {
+				if loaded {
+					err := m.persistPage(page)
+					if err != nil {
+						return err
+					}
+					pageID = m.pageIDForKey(key)
+				}
+				var err error
+				page, err = m.readOrCreatePage(pageID)
+				if err != nil {
+					return err
+				}
+				loaded = true
+				lastPageID = pageID
+			}
+
+			err := modify(&page, key)
+			if err != nil {
+				return err
+			}
+		}
+
+		if loaded {
+			return m.persistPage(page)
+		}
+		return nil
+	})
+}
+
+// applySourceKeys removes and adds source keys to the sorted keys of a value. Both operations are
+// idempotent, so applying the same changes twice leaves the keys unchanged
+func applySourceKeys(keys []string, entry *valueIndexEntry) []string {
+	set := make(map[string]bool, len(keys)+len(entry.added))
+	for _, key := range keys {
+		set[key] = true
+	}
+	for _, key := range entry.removed {
+		delete(set, key)
+	}
+	for _, key := range entry.added {
+		set[key] = true
+	}
+
+	updated := make([]string, 0, len(set))
+	for key := range set {
+		updated = append(updated, key)
+	}
+	sort.Strings(updated)
+	return updated
+}
+
+func encodeSourceKeys(keys []string) string {
+	// encoding a slice of strings cannot fail
+	data, _ := json.Marshal(keys)
+	return string(data)
+}
+
+func decodeSourceKeys(stored string) ([]string, error) {
+	keys := []string{}
+	err := json.Unmarshal([]byte(stored), &keys)
+	return keys, err
+}
+
+// CreateValueIndex creates a value index of a source index, indexing whole values, or a top-level field of
+// values which are JSON objects. The value index is filled with the existing records of the source index
+// while the source index is write locked
+func CreateValueIndex(d driver.StorageDriver, sourceName string, name string, field string, pageSize int) error {
+	sourceManifest, err := driver.ReadManifest(d, sourceName)
+	if err != nil {
+		if driver.IsMetaNotExist(err) {
+			return fmt.Errorf("index %s has no manifest: run create_auto_index or create_map_index to adopt it before creating value indexes :: %w", sourceName, err)
+		}
+		return err
+	}
+	if sourceManifest.Source != "" {
+		return errValueIndexSource(sourceName)
+	}
+	for _, ref := range sourceManifest.ValueIndexes {
+		if ref.Name == name {
+			return errValueIndexAlreadyExist(sourceName, name)
+		}
+	}
+
+	return wrapInWriteLock(d, sourceName, func() error {
+		err := d.CreateMapIndex(name, pageSize)
+		if err != nil {
+			return err
+		}
+		manifest, err := driver.ReadManifest(d, name)
+		if err != nil {
+			return err
+		}
+		manifest.Source = sourceName
+		err = driver.WriteManifest(d, name, manifest)
+		if err != nil {
+			return err
+		}
+
+		// the source manifest is read again while locked, in case another value index was just added
+		sourceManifest, err = driver.ReadManifest(d, sourceName)
+		if err != nil {
+			return err
+		}
+		ref := driver.ValueIndex{Name: name, Field: field}
+		sourceManifest.ValueIndexes = append(sourceManifest.ValueIndexes, ref)
+		err = driver.WriteManifest(d, sourceName, sourceManifest)
+		if err != nil {
+			return err
+		}
+
+		changes, err := existingRecords(d, sourceName, sourceManifest)
+		if err != nil {
+			return err
+		}
+		return updateValueIndexes(d, []driver.ValueIndex{ref}, changes)
+	})
+}
+
+// existingRecords lists every record of an index as a change from an absent record
+func existingRecords(d driver.StorageDriver, indexName string, manifest driver.IndexManifest) ([]valueChange, error) {
+	var records ListResult
+	var err error
+	if manifest.Kind == driver.KindAuto {
+		var index AutoIndex
+		index, err = NewAutoIndex(indexName, d, manifest.PageSize)
+		if err == nil {
+			records, err = index.List(0, 0, false)
+		}
+	} else {
+		var index MapIndex
+		index, err = NewMapIndex(indexName, d, manifest.PageSize)
+		if err == nil {
+			records, err = index.List(0, 0, false)
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	changes := make([]valueChange, len(records))
+	for i, record := range records {
+		key, value := record.keyValue()
+		changes[i] = valueChange{key: key, after: recordState{value: value, present: true}}
+	}
+	return changes, nil
+}
+
+// DropValueIndex removes a value index from the manifest of its source index, then drops it
+func DropValueIndex(d driver.StorageDriver, name string) error {
+	manifest, err := driver.ReadManifest(d, name)
+	if err != nil {
+		return err
+	}
+	if manifest.Source == "" {
+		return errNotValueIndex(name)
+	}
+
+	err = wrapInWriteLock(d, manifest.Source, func() error {
+		sourceManifest, err := driver.ReadManifest(d, manifest.Source)
+		if err != nil {
+			// the source index may have been dropped already
+			if driver.IsIndexNotExist(err) || driver.IsMetaNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		remaining := make([]driver.ValueIndex, 0, len(sourceManifest.ValueIndexes))
+		for _, ref := range sourceManifest.ValueIndexes {
+			if ref.Name != name {
+				remaining = append(remaining, ref)
+			}
+		}
+		sourceManifest.ValueIndexes = remaining
+		return driver.WriteManifest(d, manifest.Source, sourceManifest)
+	})
+	if err != nil {
+		return err
+	}
+
+	return d.DropMapIndex(name)
+}
+
+// QueryByValue returns the records of the source index of a value index which hold a value, in key order.
+// The value of each record is checked again, so records which no longer hold the value, like expired records
+// or records changed by a write whose value index update was interrupted, are left out
+func QueryByValue(d driver.StorageDriver, name string, value string) (ListResult, error) {
+	manifest, err := driver.ReadManifest(d, name)
+	if err != nil {
+		return ListResult{}, err
+	}
+	if manifest.Source == "" {
+		return ListResult{}, errNotValueIndex(name)
+	}
+
+	valueIndex, err := NewMapIndex(name, d, manifest.PageSize)
+	if err != nil {
+		return ListResult{}, err
+	}
+	selector := NewMapSingleSelector(value)
+	stored, err := valueIndex.Query(&selector)
+	if err != nil || !stored.Valid() {
+		if isKeyNotExist(err) {
+			err = nil
+		}
+		return ListResult{}, err
+	}
+	keys, err := decodeSourceKeys(stored.String())
+	if err != nil {
+		return ListResult{}, errBadData(name, value, err)
+	}
+
+	sourceManifest, err := driver.ReadManifest(d, manifest.Source)
+	if err != nil {
+		return ListResult{}, err
+	}
+	field := ""
+	for _, ref := range sourceManifest.ValueIndexes {
+		if ref.Name == name {
+			field = ref.Field
+		}
+	}
+	holdsValue := func(record Result) bool {
+		indexed, ok := indexedValue(recordState{value: record.String(), present: true}, field)
+		return ok && indexed == value
+	}
+
+	results := make(ListResult, 0, len(keys))
+	if sourceManifest.Kind == driver.KindAuto {
+		source, err := NewAutoIndex(manifest.Source, d, sourceManifest.PageSize)
+		if err != nil {
+			return ListResult{}, err
+		}
+		ids := make([]uint64, 0, len(keys))
+		for _, key := range keys {
+			id, err := strconv.ParseUint(key, 10, 64)
+			if err != nil {
+				return ListResult{}, errBadData(name, value, err)
+			}
+			ids = append(ids, id)
+		}
+		sort.Slice(ids, func(i, j int) bool { return ids[i] < ids[j] })
+		for _, id := range ids {
+			sel := NewSingleSelector(id)
+			record, err := source.Query(&sel)
+			if err == nil && record.Valid() && holdsValue(record) {
+				results = append(results, AutoListItem{Key: id, Value: record.String()})
+			} else if err != nil && !isKeyNotExist(err) {
+				return ListResult{}, err
+			}
+		}
+		return results, nil
+	}
+
+	source, err := NewMapIndex(manifest.Source, d, sourceManifest.PageSize)
+	if err != nil {
+		return ListResult{}, err
+	}
+	for _, key := range keys {
+		sel := NewMapSingleSelector(key)
+		record, err := source.Query(&sel)
+		if err == nil && record.Valid() && holdsValue(record) {
+			results = append(results, MapListItem{Key: key, Value: record.String()})
+		} else if err != nil && !isKeyNotExist(err) {
+			return ListResult{}, err
+		}
+	}
+	return results, nil
+}
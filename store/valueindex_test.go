@@ -0,0 +1,176 @@
+package store
+
+import (
+	"keybite/store/driver"
+	"keybite/util"
+	"testing"
+	"time"
+)
+
+func TestIndexedValue(t *testing.T) {
+	value, ok := indexedValue(recordState{value: "admin", present: true}, "")
+	util.Assert(t, ok, "whole values should be indexed")
+	util.Equals(t, "admin", value)
+
+	record := recordState{value: `{"email": "a@example.com", "age": 30, "tags": [1, 2], "none": null}`, present: true}
+	value, ok = indexedValue(record, "email")
+	util.Assert(t, ok, "string fields should be indexed")
+	util.Equals(t, "a@example.com", value)
+	value, ok = indexedValue(record, "age")
+	util.Assert(t, ok, "number fields should be indexed")
+	util.Equals(t, "30", value)
+	value, ok = indexedValue(record, "tags")
+	util.Assert(t, ok, "array fields should be indexed")
+	util.Equals(t, "[1,2]", value)
+
+	for _, field := range []string{"none", "missing"} {
+		_, ok = indexedValue(record, field)
+		util.Assert(t, !ok, "field '"+field+"' should not be indexed")
+	}
+	_, ok = indexedValue(recordState{value: "not json", present: true}, "email")
+	util.Assert(t, !ok, "values which are not JSON objects should not be indexed by field")
+	_, ok = indexedValue(recordState{}, "")
+	util.Assert(t, !ok, "absent records should not be indexed")
+}
+
+// queryByValue returns the keys of the records holding a value
+func queryByValue(t *testing.T, d driver.StorageDriver, name string, value string) []string {
+	res, err := QueryByValue(d, name, value)
+	util.Ok(t, err)
+	keys := []string{}
+	for _, item := range res {
+		key, _ := item.keyValue()
+		keys = append(keys, key)
+	}
+	return keys
+}
+
+func TestMapValueIndex(t *testing.T) {
+	index := newTestingMapIndex(t)
+	for key, value := range map[string]string{"alice": `{"team":"red"}`, "bob": `{"team":"blue"}`} {
+		sel := NewMapSingleSelector(key)
+		_, err := index.Insert(&sel, value)
+		util.Ok(t, err)
+	}
+
+	err := CreateValueIndex(index.driver, index.Name, "by_team", "team", testPageSize)
+	util.Ok(t, err)
+	err = CreateValueIndex(index.driver, index.Name, "by_team", "team", testPageSize)
+	util.Assert(t, err != nil, "creating a value index twice should fail")
+	err = CreateValueIndex(index.driver, "by_team", "by_team_team", "", testPageSize)
+	util.Assert(t, err != nil, "value indexes should not be created from value indexes")
+
+	// existing records are indexed when the value index is created
+	util.Equals(t, []string{"alice"}, queryByValue(t, index.driver, "by_team", "red"))
+
+	// indexes opened after the value index was created update it
+	index, err = NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	carol := NewMapSingleSelector("carol")
+	_, err = index.Insert(&carol, `{"team":"red"}`)
+	util.Ok(t, err)
+	bob := NewMapSingleSelector("bob")
+	_, err = index.Update(&bob, `{"team":"red"}`)
+	util.Ok(t, err)
+	alice := NewMapSingleSelector("alice")
+	_, err = index.Delete(&alice)
+	util.Ok(t, err)
+
+	util.Equals(t, []string{"bob", "carol"}, queryByValue(t, index.driver, "by_team", "red"))
+	util.Equals(t, []string{}, queryByValue(t, index.driver, "by_team", "blue"))
+
+	// entries left without keys are deleted
+	valueIndex, err := NewMapIndex("by_team", index.driver, testPageSize)
+	util.Ok(t, err)
+	count, err := valueIndex.Count()
+	util.Ok(t, err)
+	util.Equals(t, "1", count.String())
+
+	// dropping the value index stops writes from updating it
+	err = DropValueIndex(index.driver, "by_team")
+	util.Ok(t, err)
+	index, err = NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, 0, len(index.valueIndexes))
+	_, err = index.Insert(&alice, `{"team":"red"}`)
+	util.Ok(t, err)
+}
+
+// test that value indexes can't be written directly, and that lookups check the value of each record
+func TestMapValueIndexConsistency(t *testing.T) {
+	index := newTestingMapIndex(t)
+	alice := NewMapSingleSelector("alice")
+	_, err := index.Insert(&alice, `{"team":"red"}`)
+	util.Ok(t, err)
+	err = CreateValueIndex(index.driver, index.Name, "by_team", "team", testPageSize)
+	util.Ok(t, err)
+
+	valueIndex, err := NewMapIndex("by_team", index.driver, testPageSize)
+	util.Ok(t, err)
+	red := NewMapSingleSelector("red")
+	_, err = valueIndex.Upsert(&red, `["bob"]`)
+	util.Assert(t, err != nil, "writing to a value index directly should fail")
+	_, err = valueIndex.Delete(&red)
+	util.Assert(t, err != nil, "deleting from a value index directly should fail")
+	util.Equals(t, []string{"alice"}, queryByValue(t, index.driver, "by_team", "red"))
+
+	// the index was opened before the value index was created, so its write leaves the value index stale
+	_, err = index.Update(&alice, `{"team":"blue"}`)
+	util.Ok(t, err)
+	util.Equals(t, []string{}, queryByValue(t, index.driver, "by_team", "red"))
+}
+
+func TestMapValueIndexExpiry(t *testing.T) {
+	start := time.Unix(1600000000, 0)
+	setNow(t, start)
+
+	index := newTestingMapIndex(t)
+	err := CreateValueIndex(index.driver, index.Name, "by_value", "", testPageSize)
+	util.Ok(t, err)
+	index, err = NewMapIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+
+	session := NewMapSingleSelector("session")
+	_, err = index.InsertWithTTL(&session, "user", time.Minute)
+	util.Ok(t, err)
+	util.Equals(t, []string{"session"}, queryByValue(t, index.driver, "by_value", "user"))
+
+	// expired records are left out of lookups, and removed from the value index when vacuumed
+	setNow(t, start.Add(time.Hour))
+	util.Equals(t, []string{}, queryByValue(t, index.driver, "by_value", "user"))
+	_, err = index.VacuumExpired()
+	util.Ok(t, err)
+	valueIndex, err := NewMapIndex("by_value", index.driver, testPageSize)
+	util.Ok(t, err)
+	count, err := valueIndex.Count()
+	util.Ok(t, err)
+	util.Equals(t, "0", count.String())
+}
+
+func TestAutoValueIndex(t *testing.T) {
+	index := newTestingIndex(t)
+	for _, value := range []string{"a", "b", "a"} {
+		_, err := index.Insert(value)
+		util.Ok(t, err)
+	}
+
+	err := CreateValueIndex(index.driver, index.Name, "by_value", "", testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, []string{"1", "3"}, queryByValue(t, index.driver, "by_value", "a"))
+
+	index, err = NewAutoIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	_, err = index.Insert("a")
+	util.Ok(t, err)
+	sel := NewSingleSelector(1)
+	_, err = index.CompareAndSwap(1, "a", "b")
+	util.Ok(t, err)
+	_, err = index.Delete(&sel)
+	util.Ok(t, err)
+
+	util.Equals(t, []string{"3", "4"}, queryByValue(t, index.driver, "by_value", "a"))
+	util.Equals(t, []string{"2"}, queryByValue(t, index.driver, "by_value", "b"))
+
+	_, err = QueryByValue(index.driver, index.Name, "a")
+	util.Assert(t, err != nil, "querying an index which is not a value index by value should fail")
+}
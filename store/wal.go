@@ -0,0 +1,339 @@
+package store
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"keybite/store/driver"
+	"keybite/util/log"
+	"strings"
+)
+
+/*
+Writes spanning several pages, like updates of several keys or writes which also update the value indexes,
+change log or history of an index, go through the write-ahead log of the index. The pages are staged in memory
+while the write runs, then the staged pages are recorded as an intent in the log metadata of the index before
+any of them is written. The intent is cleared once every page has been written. An index whose log still holds
+an intent when it is opened was interrupted while writing pages: a complete intent is replayed, and an intent
+which could not be decoded was interrupted while being recorded, before any page was written, so it is
+rolled back by clearing it.
+
+The manifest of an index records whether its log may hold an intent: it is marked before an intent is recorded
+and unmarked once the intent is cleared, so opening an index reads the log only when a write is in progress or
+was interrupted. Indexes without a manifest, or whose manifest predates the mark, have their log read whenever
+they are opened. The manifest is marked holding the index write lock, which the staged writes of the index took.
+
+A write of a single page is atomic, so it is not recorded in the log. Drivers which write conditionally don't
+lock indexes for writes, instead each write goes through the log so that the whole read-modify-write is retried
+when a page it read was changed by another writer before the staged pages were written. Intents are still
+recorded and replayed holding the index write lock, so that an intent is never replayed while it is written
+
+Transactions stage the writes of every query of a request, so the writes of their indexes don't go through the
+log one index at a time. Instead, the writes of a transaction to each index are recorded as an intent in the log
+of that index, along with an ID for the transaction and the names of every index it writes, and pages are only
+written once the intents of every index are recorded. Opening an index whose log holds the intent of a
+transaction replays the whole transaction if every index it writes still holds its intent, since it was then
+interrupted while writing pages. Otherwise the transaction was interrupted either while its intents were
+recorded, before any page was written, or while they were cleared, after every page was written, so the intents
+left are cleared without writing anything
+*/
+
+// name of the metadata file holding the write-ahead log of an index
+const walMetaName = "wal"
+
+// walDriver records the writes committed through it in the write-ahead log of an index before writing them
+type walDriver struct {
+	driver.StorageDriver
+	indexName string
+}
+
+// CommitWrites records the writes as an intent, writes them, then clears the intent. The intent is left in
+// place when writing fails, so that the writes are replayed when the index is next opened, unless writing
+// failed with a write conflict, after which the driver has restored the pages it wrote
+func (w walDriver) CommitWrites(writes driver.WriteSet) error {
+	if writes.Len() <= 1 {
+		return w.StorageDriver.CommitWrites(writes)
+	}
+	if w.WritesConditionally() {
+		return holdWriteLock(w.StorageDriver, w.indexName, func() error {
+			return w.commitLogged(writes)
+		})
+	}
+	return w.commitLogged(writes)
+}
+
+func (w walDriver) commitLogged(writes driver.WriteSet) error {
+	intent, err := json.Marshal(writes)
+	if err != nil {
+		return err
+	}
+	err = markWriteAheadLog(w.StorageDriver, w.indexName, true)
+	if err != nil {
+		return err
+	}
+	err = w.StorageDriver.WriteMeta(w.indexName, walMetaName, intent)
+	if err != nil {
+		return err
+	}
+
+	err = w.StorageDriver.CommitWrites(writes)
+	if driver.IsWriteConflict(err) {
+		if clearErr := clearWriteAheadLog(w.StorageDriver, w.indexName); clearErr != nil {
+			log.Errorf("clearing the write-ahead log of index %s after a write conflict failed: %s", w.indexName, clearErr.Error())
+		}
+		return err
+	}
+	if err != nil {
+		log.Errorf("writing %d files of index %s failed, they will be written when the index is next opened: %s", writes.Len(), w.indexName, err.Error())
+		return err
+	}
+	return clearWriteAheadLog(w.StorageDriver, w.indexName)
+}
+
+// transactionIntent is the intent of a transaction recorded in the write-ahead log of one of the indexes it
+// writes. Intents of writes to a single index have no transaction ID or indexes
+type transactionIntent struct {
+	Transaction string          `json:"transaction"`
+	Indexes     []string        `json:"indexes"`
+	Writes      driver.WriteSet `json:"writes"`
+}
+
+// decodeIntent decodes an intent recorded in a write-ahead log, either as the writes to the index or as the
+// intent of a transaction
+func decodeIntent(data []byte) (transactionIntent, error) {
+	intent := transactionIntent{}
+	if bytes.HasPrefix(data, []byte("{")) {
+		err := json.Unmarshal(data, &intent)
+		return intent, err
+	}
+	err := json.Unmarshal(data, &intent.Writes)
+	return intent, err
+}
+
+// NewTransaction wraps a storage driver to stage the writes of a transaction, which are committed through the
+// write-ahead logs of the indexes they write
+func NewTransaction(d driver.StorageDriver) *driver.StagingDriver {
+	return driver.NewStagingDriverWith(d, commitTransaction)
+}
+
+// commitTransaction records the writes of a transaction to each index in the write-ahead log of the index, writes
+// them, then clears the intents. As with writes to a single index, the intents are left in place when writing
+// fails, unless writing failed with a write conflict
+func commitTransaction(d driver.StorageDriver, writes driver.WriteSet) error {
+	if writes.Len() <= 1 {
+		return d.CommitWrites(writes)
+	}
+	indexNames := writes.Indexes()
+	if d.WritesConditionally() {
+		return holdWriteLocks(d, indexNames, func() error {
+			return commitTransactionLogged(d, writes, indexNames)
+		})
+	}
+	return commitTransactionLogged(d, writes, indexNames)
+}
+
+func commitTransactionLogged(d driver.StorageDriver, writes driver.WriteSet, indexNames []string) error {
+	id := make([]byte, 8)
+	_, err := rand.Read(id)
+	if err != nil {
+		return err
+	}
+	transaction := hex.EncodeToString(id)
+
+	for _, indexName := range indexNames {
+		intent, err := json.Marshal(transactionIntent{
+			Transaction: transaction,
+			Indexes:     indexNames,
+			Writes:      writes.ForIndex(indexName),
+		})
+		if err != nil {
+			return err
+		}
+		err = markWriteAheadLog(d, indexName, true)
+		if err != nil {
+			return err
+		}
+		err = d.WriteMeta(indexName, walMetaName, intent)
+		if err != nil {
+			return err
+		}
+	}
+
+	err = d.CommitWrites(writes)
+	if driver.IsWriteConflict(err) {
+		for _, indexName := range indexNames {
+			if clearErr := clearWriteAheadLog(d, indexName); clearErr != nil {
+				log.Errorf("clearing the write-ahead log of index %s after a write conflict failed: %s", indexName, clearErr.Error())
+			}
+		}
+		return err
+	}
+	if err != nil {
+		log.Errorf("writing %d files of transaction %s failed, they will be written when index %s is next opened: %s", writes.Len(), transaction, strings.Join(indexNames, ", "), err.Error())
+		return err
+	}
+	for _, indexName := range indexNames {
+		err = clearWriteAheadLog(d, indexName)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// clearWriteAheadLog removes the intent recorded in the write-ahead log of an index, then unmarks the log in the
+// index manifest
+func clearWriteAheadLog(d driver.StorageDriver, indexName string) error {
+	err := d.WriteMeta(indexName, walMetaName, []byte{})
+	if err != nil {
+		return err
+	}
+	return markWriteAheadLog(d, indexName, false)
+}
+
+// markWriteAheadLog records in the manifest of an index whether its write-ahead log may hold an intent. Nothing is
+// recorded for indexes without a manifest, or whose manifest predates the mark
+func markWriteAheadLog(d driver.StorageDriver, indexName string, pending bool) error {
+	manifest, err := driver.ReadManifest(d, indexName)
+	if driver.IsMetaNotExist(err) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if manifest.Version < driver.WriteAheadLogManifestVersion || manifest.WriteAheadLog == pending {
+		return nil
+	}
+	manifest.WriteAheadLog = pending
+	return driver.WriteManifest(d, indexName, manifest)
+}
+
+// withWriteAheadLog runs a write with a driver staging its writes, then commits them through the write-ahead
+// log of the index. The staged writes are discarded if the write fails. Writes to drivers which write
+// conditionally are run again when committing them fails with a write conflict
+func withWriteAheadLog(d driver.StorageDriver, indexName string, write func(staging driver.StorageDriver) (Result, error)) (Result, error) {
+	if d.WritesConditionally() {
+		return retryOnConflict(func() (Result, error) {
+			return stageAndCommit(d, indexName, write)
+		})
+	}
+	return stageAndCommit(d, indexName, write)
+}
+
+// stageAndCommit runs a write once with a driver staging its writes, then commits them
+func stageAndCommit(d driver.StorageDriver, indexName string, write func(staging driver.StorageDriver) (Result, error)) (Result, error) {
+	staging := driver.NewStagingDriver(walDriver{StorageDriver: d, indexName: indexName})
+	result, err := write(staging)
+	if err != nil {
+		rollbackErr := staging.Rollback()
+		if rollbackErr != nil {
+			log.Warnf("releasing the locks of a failed write to index %s failed: %s", indexName, rollbackErr.Error())
+		}
+		return result, err
+	}
+	err = staging.Commit()
+	if err != nil {
+		return EmptyResult(), err
+	}
+	return result, nil
+}
+
+// recoverWriteAheadLog replays or rolls back an intent left in the write-ahead log of an index by an
+// interrupted write, when the manifest of the index read to open it says the log may hold one. Transactions
+// recover indexes using the driver they wrap, since replaying writes cannot be staged
+func recoverWriteAheadLog(d driver.StorageDriver, indexName string, manifest driver.IndexManifest) error {
+	if !manifest.MayHaveWriteAheadLog() {
+		return nil
+	}
+	d = driver.Unstaged(d)
+	intent, err := d.ReadMeta(indexName, walMetaName)
+	if driver.IsMetaNotExist(err) || (err == nil && len(intent) == 0) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+
+	return holdWriteLock(d, indexName, func() error {
+		// another process may have recovered the index while the lock was awaited
+		intent, err := d.ReadMeta(indexName, walMetaName)
+		if driver.IsMetaNotExist(err) || (err == nil && len(intent) == 0) {
+			return markWriteAheadLog(d, indexName, false)
+		}
+		if err != nil {
+			return err
+		}
+
+		decoded, err := decodeIntent(intent)
+		if err != nil {
+			log.Warnf("rolling back incomplete write-ahead log intent of index %s :: %s", indexName, err.Error())
+			return clearWriteAheadLog(d, indexName)
+		}
+		if decoded.Transaction != "" {
+			return recoverTransaction(d, indexName, decoded)
+		}
+
+		log.Warnf("replaying %d writes from the write-ahead log of index %s", decoded.Writes.Len(), indexName)
+		err = d.CommitWrites(decoded.Writes)
+		if err != nil {
+			return err
+		}
+		return clearWriteAheadLog(d, indexName)
+	})
+}
+
+// recoverTransaction replays a transaction interrupted while writing pages, found in the write-ahead log of one
+// of its indexes, if the logs of every other index it writes hold their intent of the transaction. Otherwise the
+// intents of the transaction left are cleared. The write lock of the index is held by the caller
+func recoverTransaction(d driver.StorageDriver, indexName string, intent transactionIntent) error {
+	others := []string{}
+	for _, other := range intent.Indexes {
+		if other != indexName {
+			others = append(others, other)
+		}
+	}
+
+	return holdWriteLocks(d, others, func() error {
+		writes := map[string]driver.WriteSet{indexName: intent.Writes}
+		for _, other := range others {
+			data, err := d.ReadMeta(other, walMetaName)
+			if driver.IsMetaNotExist(err) || driver.IsIndexNotExist(err) {
+				continue
+			}
+			if err != nil {
+				return err
+			}
+			otherIntent, err := decodeIntent(data)
+			if err == nil && otherIntent.Transaction == intent.Transaction {
+				writes[other] = otherIntent.Writes
+			}
+		}
+
+		if len(writes) < len(intent.Indexes) {
+			log.Warnf("clearing write-ahead log intents of transaction %s, which was interrupted before or after writing pages", intent.Transaction)
+			for other := range writes {
+				err := clearWriteAheadLog(d, other)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		}
+
+		log.Warnf("replaying transaction %s from the write-ahead logs of indexes %s", intent.Transaction, strings.Join(intent.Indexes, ", "))
+		for _, other := range intent.Indexes {
+			err := d.CommitWrites(writes[other])
+			if err != nil {
+				return err
+			}
+		}
+		for _, other := range intent.Indexes {
+			err := clearWriteAheadLog(d, other)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
@@ -0,0 +1,272 @@
+package store
+
+import (
+	"errors"
+	"keybite/store/driver"
+	"keybite/util"
+	"testing"
+)
+
+// interruptedDriver fails every commit, like a process stopped while writing pages
+type interruptedDriver struct {
+	*driver.MemoryDriver
+}
+
+func (d interruptedDriver) CommitWrites(writes driver.WriteSet) error {
+	return errors.New("interrupted")
+}
+
+// walIntent returns the intent recorded in the write-ahead log of an index
+func walIntent(t *testing.T, d driver.StorageDriver, indexName string) string {
+	data, err := d.ReadMeta(indexName, walMetaName)
+	if driver.IsMetaNotExist(err) {
+		return ""
+	}
+	util.Ok(t, err)
+	return string(data)
+}
+
+// insertAcrossPages inserts values into an auto index until its records span two pages
+func insertAcrossPages(t *testing.T, index AutoIndex) {
+	for j := 0; j < testPageSize+1; j++ {
+		_, err := index.Insert("before")
+		util.Ok(t, err)
+	}
+}
+
+func TestWriteAheadLogCommit(t *testing.T) {
+	index := newTestingIndex(t)
+	insertAcrossPages(t, index)
+
+	sel := NewRangeSelector(1, uint64(testPageSize+1))
+	_, err := index.Update(&sel, "after")
+	util.Ok(t, err)
+	util.Equals(t, "", walIntent(t, index.driver, index.Name))
+
+	first := NewSingleSelector(1)
+	val, err := index.Query(&first)
+	util.Ok(t, err)
+	util.Equals(t, "after", val.String())
+}
+
+func TestWriteAheadLogReplay(t *testing.T) {
+	index := newTestingIndex(t)
+	insertAcrossPages(t, index)
+	memory := index.driver.(*driver.MemoryDriver)
+
+	interrupted, err := NewAutoIndex(index.Name, interruptedDriver{memory}, testPageSize)
+	util.Ok(t, err)
+	sel := NewRangeSelector(1, uint64(testPageSize+1))
+	_, err = interrupted.Update(&sel, "after")
+	util.Assert(t, err != nil, "an interrupted write should fail")
+	util.Assert(t, walIntent(t, memory, index.Name) != "", "an interrupted write should leave its intent")
+
+	// opening the index replays the interrupted write on every page
+	index, err = NewAutoIndex(index.Name, memory, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, "", walIntent(t, memory, index.Name))
+	for _, id := range []uint64{1, uint64(testPageSize + 1)} {
+		sel := NewSingleSelector(id)
+		val, err := index.Query(&sel)
+		util.Ok(t, err)
+		util.Equals(t, "after", val.String())
+	}
+}
+
+func TestWriteAheadLogRollback(t *testing.T) {
+	index := newTestingIndex(t)
+	insertAcrossPages(t, index)
+
+	// an intent interrupted while it was recorded is discarded
+	err := markWriteAheadLog(index.driver, index.Name, true)
+	util.Ok(t, err)
+	err = index.driver.WriteMeta(index.Name, walMetaName, []byte(`[{"kind":"autoPage","index":"test_in`))
+	util.Ok(t, err)
+	index, err = NewAutoIndex(index.Name, index.driver, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, "", walIntent(t, index.driver, index.Name))
+
+	first := NewSingleSelector(1)
+	val, err := index.Query(&first)
+	util.Ok(t, err)
+	util.Equals(t, "before", val.String())
+}
+
+// test that the write-ahead log is only read when the manifest says it may hold an intent
+func TestWriteAheadLogManifestMark(t *testing.T) {
+	index := newTestingIndex(t)
+	insertAcrossPages(t, index)
+	memory := index.driver.(*driver.MemoryDriver)
+
+	interrupted, err := NewAutoIndex(index.Name, interruptedDriver{memory}, testPageSize)
+	util.Ok(t, err)
+	sel := NewRangeSelector(1, uint64(testPageSize+1))
+	_, err = interrupted.Update(&sel, "after")
+	util.Assert(t, err != nil, "an interrupted write should fail")
+	manifest, err := driver.ReadManifest(memory, index.Name)
+	util.Ok(t, err)
+	util.Assert(t, manifest.WriteAheadLog, "an interrupted write should leave the write-ahead log marked")
+
+	_, err = NewAutoIndex(index.Name, memory, testPageSize)
+	util.Ok(t, err)
+	manifest, err = driver.ReadManifest(memory, index.Name)
+	util.Ok(t, err)
+	util.Assert(t, !manifest.WriteAheadLog, "recovering an index should unmark its write-ahead log")
+
+	// an unmarked log is not read
+	err = memory.WriteMeta(index.Name, walMetaName, []byte(`not read`))
+	util.Ok(t, err)
+	_, err = NewAutoIndex(index.Name, memory, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, "not read", walIntent(t, memory, index.Name))
+}
+
+func TestWriteAheadLogValueIndex(t *testing.T) {
+	index := newTestingMapIndex(t)
+	err := CreateValueIndex(index.driver, index.Name, "by_value", "", testPageSize)
+	util.Ok(t, err)
+	memory := index.driver.(*driver.MemoryDriver)
+
+	// writes updating value indexes are logged together with the value index pages
+	interrupted, err := NewMapIndex(index.Name, interruptedDriver{memory}, testPageSize)
+	util.Ok(t, err)
+	alice := NewMapSingleSelector("alice")
+	_, err = interrupted.Insert(&alice, "red")
+	util.Assert(t, err != nil, "an interrupted write should fail")
+	util.Equals(t, []string{}, queryByValue(t, memory, "by_value", "red"))
+
+	_, err = NewMapIndex(index.Name, memory, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, []string{"alice"}, queryByValue(t, memory, "by_value", "red"))
+}
+
+// conflictingDriver writes conditionally, and loses its first commits to another writer inserting a value
+type conflictingDriver struct {
+	*driver.MemoryDriver
+	conflicts *int
+}
+
+func (d conflictingDriver) WritesConditionally() bool {
+	return true
+}
+
+// ReadPage copies pages, since the memory driver shares them with its readers
+func (d conflictingDriver) ReadPage(fileName string, indexName string, pageSize int) (map[uint64]string, []uint64, error) {
+	vals, orderedKeys, err := d.MemoryDriver.ReadPage(fileName, indexName, pageSize)
+	copied := make(map[uint64]string, len(vals))
+	for key, val := range vals {
+		copied[key] = val
+	}
+	return copied, append([]uint64{}, orderedKeys...), err
+}
+
+func (d conflictingDriver) CommitWrites(writes driver.WriteSet) error {
+	if *d.conflicts == 0 {
+		return d.MemoryDriver.CommitWrites(writes)
+	}
+	*d.conflicts--
+	other, err := NewAutoIndex("test_index", d.MemoryDriver, testPageSize)
+	if err != nil {
+		return err
+	}
+	if _, err := other.Insert("concurrent"); err != nil {
+		return err
+	}
+	return driver.Error{Message: "changed by another writer", Code: "ERR_WRITE_CONFLICT"}
+}
+
+func TestWriteConflictRetry(t *testing.T) {
+	index := newTestingIndex(t)
+	memory := index.driver.(*driver.MemoryDriver)
+
+	// the insert is retried after each conflict, reading the values inserted by the other writer
+	conflicts := 2
+	conditional, err := NewAutoIndex(index.Name, conflictingDriver{memory, &conflicts}, testPageSize)
+	util.Ok(t, err)
+	id, err := conditional.Insert("retried")
+	util.Ok(t, err)
+	util.Equals(t, "3", id.String())
+	util.Equals(t, 0, conflicts)
+
+	for j, expected := range []string{"concurrent", "concurrent", "retried"} {
+		sel := NewSingleSelector(uint64(j + 1))
+		val, err := index.Query(&sel)
+		util.Ok(t, err)
+		util.Equals(t, expected, val.String())
+	}
+
+	// writers give up after conflicting on every attempt
+	conflicts = maxWriteAttempts
+	_, err = conditional.Insert("lost")
+	util.Assert(t, driver.IsWriteConflict(err), "a write conflicting on every attempt should return a write conflict, got %v", err)
+}
+
+// openTransactionIndexes creates two map indexes, and opens them with a driver staging a transaction
+func openTransactionIndexes(t *testing.T, memory *driver.MemoryDriver, staging driver.StorageDriver) (MapIndex, MapIndex) {
+	indexes := []MapIndex{}
+	for _, indexName := range []string{"test_accounts", "test_ledger"} {
+		err := memory.CreateMapIndex(indexName, testPageSize)
+		util.Ok(t, err)
+		index, err := NewMapIndex(indexName, staging, testPageSize)
+		util.Ok(t, err)
+		indexes = append(indexes, index)
+	}
+	return indexes[0], indexes[1]
+}
+
+// test that a transaction interrupted while writing pages is replayed when any index it wrote is next opened
+func TestWriteAheadLogTransactionReplay(t *testing.T) {
+	m := driver.NewMemoryDriver()
+	memory := &m
+	transaction := NewTransaction(interruptedDriver{memory})
+	accounts, ledger := openTransactionIndexes(t, memory, transaction)
+
+	sel := NewMapSingleSelector("alice")
+	_, err := accounts.Upsert(&sel, "10")
+	util.Ok(t, err)
+	_, err = ledger.Upsert(&sel, "credit 10")
+	util.Ok(t, err)
+	err = transaction.Commit()
+	util.Assert(t, err != nil, "an interrupted commit should fail")
+	util.Assert(t, walIntent(t, memory, accounts.Name) != "", "an interrupted transaction should leave its intent")
+	util.Assert(t, walIntent(t, memory, ledger.Name) != "", "an interrupted transaction should leave its intent")
+
+	// opening either index replays the writes to both
+	accounts, err = NewMapIndex(accounts.Name, memory, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, "", walIntent(t, memory, accounts.Name))
+	util.Equals(t, "", walIntent(t, memory, ledger.Name))
+	val, err := accounts.Query(&sel)
+	util.Ok(t, err)
+	util.Equals(t, "10", val.String())
+	ledger, err = NewMapIndex(ledger.Name, memory, testPageSize)
+	util.Ok(t, err)
+	val, err = ledger.Query(&sel)
+	util.Ok(t, err)
+	util.Equals(t, "credit 10", val.String())
+}
+
+// test that the intents of a transaction interrupted while they were recorded are cleared without writing pages
+func TestWriteAheadLogTransactionRollback(t *testing.T) {
+	m := driver.NewMemoryDriver()
+	memory := &m
+	transaction := NewTransaction(interruptedDriver{memory})
+	accounts, ledger := openTransactionIndexes(t, memory, transaction)
+
+	sel := NewMapSingleSelector("alice")
+	_, err := accounts.Upsert(&sel, "10")
+	util.Ok(t, err)
+	_, err = ledger.Upsert(&sel, "credit 10")
+	util.Ok(t, err)
+	err = transaction.Commit()
+	util.Assert(t, err != nil, "an interrupted commit should fail")
+	// the intent of the ledger was never recorded
+	err = memory.WriteMeta(ledger.Name, walMetaName, []byte(`{"transaction":"`))
+	util.Ok(t, err)
+
+	accounts, err = NewMapIndex(accounts.Name, memory, testPageSize)
+	util.Ok(t, err)
+	util.Equals(t, "", walIntent(t, memory, accounts.Name))
+	_, err = accounts.Query(&sel)
+	util.Assert(t, err != nil, "the writes of an incomplete transaction should not be replayed")
+}